@@ -0,0 +1,242 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+)
+
+// apiVersion identifies the request/response schema defined in this file. It is reported in
+// every response body and in the API-Version response header.
+const apiVersion = "v1"
+
+// Response is the body of every API response. Result is set on success, Error on failure.
+type Response struct {
+	Version string          `json:"version"`
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Result  any             `json:"result"`
+	Error   *ChaincodeError `json:"error,omitempty"`
+}
+
+// Amounts are limited to the range accepted by the chaincode float32 fields; rates are fractions.
+// Credit scores are on a 0-100 scale, as assumed by the chaincode thresholds.
+//
+// Requests never carry the acting user: it is the user authenticated by the bearer token.
+//
+// Currencies are addressed by their registered code, such as "USD"; a request without a currency
+// uses the default currency. See chaincode-go/chaincode/currencies.go.
+
+// ContractQueryByIDRequest queries a single loan or insurance contract of the authenticated user.
+type ContractQueryByIDRequest struct {
+	BusinessID   string `json:"business_id" form:"business_id" binding:"required,max=128"`
+	BusinessType string `json:"business_type" form:"business_type" binding:"required,oneof=loan insurance Loan Insurance"`
+}
+
+// CreateContractRequest creates a loan or insurance contract in the Applied state.
+type CreateContractRequest struct {
+	CurrentTime  json.Number `json:"current_time"`
+	BusinessType string      `json:"business_type" binding:"required,oneof=Loan Insurance"`
+	Amount       float32     `json:"amount" binding:"required,gt=0,lte=100000000"`
+	Rate         float32     `json:"rate" binding:"gte=0,lte=1"`
+	Issuer       string      `json:"issuer" binding:"required,max=64"`
+	Period       int         `json:"period" binding:"required_if=BusinessType Loan,gte=0,lte=3650"`
+	BusinessID   string      `json:"business_id" binding:"required,max=128"`
+	Currency     string      `json:"currency" binding:"omitempty,alphanum,uppercase,min=3,max=10"`
+}
+
+// Conditions are the applicant conditions evaluated by the chaincode when starting or checking a contract.
+type Conditions struct {
+	Credit          float32 `json:"credit" binding:"gte=0,lte=100"`
+	Income          float32 `json:"income" binding:"gte=0"`
+	IsSudden        bool    `json:"is_sudden"`
+	ContingencyInfo string  `json:"contingency_info" binding:"max=1024"`
+}
+
+// ContractActionRequest starts or checks a contract: loan start, loan check, insurance start and insurance check.
+type ContractActionRequest struct {
+	BusinessID  string      `json:"business_id" binding:"required,max=128"`
+	Conditions  Conditions  `json:"conditions" binding:"required"`
+	CurrentTime json.Number `json:"current_time"`
+}
+
+// PayTransferRequest transfers currency from the authenticated user to another user.
+type PayTransferRequest struct {
+	Amount       float32     `json:"amount" binding:"required,gt=0,lte=100000000"`
+	TargetUserID string      `json:"target_user_id" binding:"required,max=64"`
+	CurrentTime  json.Number `json:"current_time"`
+}
+
+// DepositRequest deposits currency to the authenticated user.
+type DepositRequest struct {
+	Amount      float32     `json:"amount" binding:"required,gt=0,lte=100000000"`
+	CurrentTime json.Number `json:"current_time"`
+}
+
+// ContractFilter selects contracts by business type and state in list queries.
+type ContractFilter struct {
+	Type  string `form:"type" binding:"omitempty,oneof=loan insurance"`
+	State string `form:"state" binding:"omitempty,oneof=Applied Approved Rejected Expired Claimed"`
+}
+
+// ContractTransitionRequest starts or checks the contract addressed by /v1/contracts/{type}/{id}.
+// If Currency is set, the contract must settle in that currency. SettlementCurrency repays a loan
+// in another currency at the current exchange rate; it is only accepted when checking a loan.
+type ContractTransitionRequest struct {
+	Conditions         Conditions  `json:"conditions" binding:"required"`
+	CurrentTime        json.Number `json:"current_time"`
+	Currency           string      `json:"currency" binding:"omitempty,alphanum,uppercase,min=3,max=10"`
+	SettlementCurrency string      `json:"settlement_currency" binding:"omitempty,alphanum,uppercase,min=3,max=10"`
+}
+
+// TransferRequest transfers currency from the user addressed by /v1/users/{id}/transfers.
+// CoinSelection chooses the coins spent by the transfer; see chaincode-go/chaincode/coinselection.go.
+// Only coins of the currency of the transfer are spent.
+type TransferRequest struct {
+	TargetUserID  string      `json:"target_user_id" binding:"required,max=64"`
+	Amount        float32     `json:"amount" binding:"required,gt=0,lte=100000000"`
+	Currency      string      `json:"currency" binding:"omitempty,alphanum,uppercase,min=3,max=10"`
+	CoinSelection string      `json:"coin_selection" binding:"omitempty,oneof=oldest largest-first smallest-sufficient random branch-and-bound"`
+	CurrentTime   json.Number `json:"current_time"`
+}
+
+// ConsolidateRequest merges the coins of a currency of the user addressed by
+// /v1/users/{id}/coins/consolidate worth at most MaxAmount, or all of them if it is zero, up to
+// MaxInputs coins.
+type ConsolidateRequest struct {
+	MaxAmount float32 `json:"max_amount" binding:"gte=0,lte=100000000"`
+	MaxInputs int     `json:"max_inputs" binding:"gte=0,lte=100"`
+	Currency  string  `json:"currency" binding:"omitempty,alphanum,uppercase,min=3,max=10"`
+}
+
+// CreateDepositRequest deposits currency to the user addressed by /v1/users/{id}/deposits. A
+// currency with an issuing authority can only be deposited by its issuer.
+type CreateDepositRequest struct {
+	Amount      float32     `json:"amount" binding:"required,gt=0,lte=100000000"`
+	Currency    string      `json:"currency" binding:"omitempty,alphanum,uppercase,min=3,max=10"`
+	CurrentTime json.Number `json:"current_time"`
+}
+
+// CurrencyQuery selects the currency of an account query.
+type CurrencyQuery struct {
+	Currency string `form:"currency" binding:"omitempty,alphanum,uppercase,min=3,max=10"`
+}
+
+// RegisterCurrencyRequest registers a currency. Decimals is the number of decimals of its
+// amounts, at most 2; Issuer, if set, is the only user who may deposit it.
+type RegisterCurrencyRequest struct {
+	Code     string `json:"code" binding:"required,alphanum,uppercase,min=3,max=10"`
+	Name     string `json:"name" binding:"required,max=64"`
+	Decimals *int   `json:"decimals" binding:"required,gte=0,lte=2"`
+	Issuer   string `json:"issuer" binding:"max=64"`
+}
+
+// PostExchangeRateRequest posts the rate of Base in Quote: one unit of Base is worth Rate units of
+// Quote, less the Spread kept on conversion. ValidFrom and ValidUntil are Unix seconds; a rate
+// without ValidFrom is valid from the time it is posted.
+type PostExchangeRateRequest struct {
+	Base       string      `json:"base" binding:"required,alphanum,uppercase,min=3,max=10"`
+	Quote      string      `json:"quote" binding:"required,alphanum,uppercase,min=3,max=10,nefield=Base"`
+	Rate       float64     `json:"rate" binding:"required,gt=0"`
+	Spread     float64     `json:"spread" binding:"gte=0,lt=1"`
+	ValidFrom  json.Number `json:"valid_from"`
+	ValidUntil json.Number `json:"valid_until" binding:"required"`
+}
+
+// ConvertRequest converts Amount of the From currency, or the default currency, of the user
+// addressed by /v1/users/{id}/conversions into the To currency at the current exchange rate.
+type ConvertRequest struct {
+	Amount float32 `json:"amount" binding:"required,gt=0,lte=100000000"`
+	From   string  `json:"from" binding:"omitempty,alphanum,uppercase,min=3,max=10"`
+	To     string  `json:"to" binding:"required,alphanum,uppercase,min=3,max=10"`
+}
+
+// FeeScheduleRequest replaces the fee schedule: the fee charged to the sender of a transfer for
+// each transfer reason, paid into FeeAccount. Transfers with a reason without a rule are free.
+// See chaincode-go/chaincode/fees.go.
+type FeeScheduleRequest struct {
+	FeeAccount string             `json:"fee_account" binding:"required_with=Rules,max=64"`
+	Rules      map[string]FeeRule `json:"rules" binding:"omitempty,dive,keys,oneof=Transfer Loan Insurance,endkeys,required"`
+}
+
+// FeeRule is the fee of a transfer reason: a flat Amount, a percentage Rate of the amount
+// transferred, or the Amount and Rate of the first tier the amount transferred is within.
+type FeeRule struct {
+	Type   string    `json:"type" binding:"required,oneof=flat percentage tiered"`
+	Amount float32   `json:"amount" binding:"gte=0,lte=100000000"`
+	Rate   float64   `json:"rate" binding:"gte=0,lt=1"`
+	Tiers  []FeeTier `json:"tiers" binding:"required_if=Type tiered,omitempty,max=20,dive"`
+}
+
+// FeeTier is a tier of a tiered fee for amounts up to UpTo; the last tier may have no UpTo.
+type FeeTier struct {
+	UpTo   float32 `json:"up_to" binding:"gte=0,lte=100000000"`
+	Amount float32 `json:"amount" binding:"gte=0,lte=100000000"`
+	Rate   float64 `json:"rate" binding:"gte=0,lt=1"`
+}
+
+// FeeQuery quotes the fee of a transfer.
+type FeeQuery struct {
+	Reason   string  `form:"reason" binding:"required,oneof=Transfer Loan Insurance"`
+	Amount   float32 `form:"amount" binding:"required,gt=0,lte=100000000"`
+	Currency string  `form:"currency" binding:"omitempty,alphanum,uppercase,min=3,max=10"`
+}
+
+// ImportIdentityRequest imports the enrolled Fabric identity of a user into the wallet. Both
+// values are PEM encoded; the private key must belong to the certificate.
+type ImportIdentityRequest struct {
+	Certificate string `json:"certificate" binding:"required,max=8192"`
+	PrivateKey  string `json:"private_key" binding:"required,max=8192"`
+}
+
+// RevokeIdentityRequest revokes the Fabric identity of a user. The reason is one of the CRL
+// reason codes accepted by Fabric CA.
+type RevokeIdentityRequest struct {
+	Reason string `form:"reason" binding:"omitempty,oneof=unspecified keycompromise affiliationchanged superseded cessationofoperation"`
+}
+
+// IdentityInfo describes the Fabric identity of a user without its private key.
+type IdentityInfo struct {
+	UserID      string    `json:"user_id"`
+	MSPID       string    `json:"msp_id"`
+	Role        string    `json:"role,omitempty"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotAfter    time.Time `json:"not_after"`
+	Certificate string    `json:"certificate"`
+}
+
+func newIdentityInfo(userID string, id *walletIdentity) (*IdentityInfo, error) {
+	certificate, err := identity.CertificateFromPEM([]byte(id.Credentials.Certificate))
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := certificateAttributes(certificate)
+	if err != nil {
+		return nil, err
+	}
+	return &IdentityInfo{
+		UserID:      userID,
+		MSPID:       id.MSPID,
+		Role:        attributes[roleAttribute],
+		Subject:     certificate.Subject.String(),
+		Issuer:      certificate.Issuer.String(),
+		NotAfter:    certificate.NotAfter,
+		Certificate: id.Credentials.Certificate,
+	}, nil
+}
+
+// timestampOrNow returns the client supplied Unix timestamp, or the current time when it is not set.
+// The chaincode compares this value with contract creation times, which are Unix seconds.
+func timestampOrNow(currentTime json.Number) string {
+	if currentTime != "" {
+		return currentTime.String()
+	}
+	return strconv.FormatInt(time.Now().Unix(), 10)
+}
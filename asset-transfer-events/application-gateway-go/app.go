@@ -10,20 +10,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/gin-gonic/gin"
 	"log"
 	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 )
 
-const (
-	channelName   = "mychannel"
-	chaincodeName = "events"
-)
-
 //var now = time.Now()
 
 //var assetID = fmt.Sprintf("asset%d", now.Unix()*1e3+int64(now.Nanosecond())/1e6)
@@ -36,8 +34,13 @@ type Currency struct {
 	CreatedVia string  `json:"CreatedVia"` //"Loan","Insurance","Transfer","Deposit","System"
 	UpdatedAt  string  `json:"UpdatedAt"`
 	UpdatedVia string  `json:"UpdatedVia"` //"Loan","Insurance","Transfer"
+	//币种代码，为空时为默认币种CNY
+	CurrencyCode string `json:"CurrencyCode,omitempty"`
 }
 
+// defaultCurrencyCode is the currency of coins and contracts without a currency code.
+const defaultCurrencyCode = "CNY"
+
 type Asset struct {
 	ID             string `json:"ID"`
 	Color          string `json:"Color"`
@@ -46,477 +49,237 @@ type Asset struct {
 	AppraisedValue string `json:"AppraisedValue"`
 }
 
-type QueryAssetRequest struct {
-	user_id  string `json:"user_id"`
-	password string `json:"password"`
-}
-
-type ContractQueryRequest struct {
-	user_id  string `json:"user_id"`
-	password string `json:"password"`
-}
-type ContractQueryByIdRequest struct {
-	user_id       string `json:"user_id"`
-	business_id   string `json:"business_id"`
-	business_type string `json:"business_type"`
-}
-type CreateContractRequest struct {
-	user_id        string  `json:"user_id"`
-	password       string  `json:"password"`
-	current_time   string  `json:"current_time"`
-	bussiness_type string  `json:"bussiness_type"`
-	amount         float32 `json:"amount"`
-	rate           float32 `json:"rate"`
-	issuer         string  `json:"issuer"`
-	period         int     `json:"period"`
-	business_id    string  `json:"business_id"`
-}
-type Conditions struct {
-	credit           float32 `json:"credit"`
-	income           float32 `json:"income"`
-	is_sudden        bool    `json:"is_sudden"`
-	contingency_info string  `json:"contingency_info"`
-}
-
-type LoanStartRequest struct {
-	user_id      string     `json:"user_id"`
-	bussiness_id string     `json:"bussiness_id"`
-	conditions   Conditions `json:"conditions"`
-	current_time string     `json:"current_time"`
-}
-type LoanCheckRequest struct {
-	user_id      string     `json:"user_id"`
-	bussiness_id string     `json:"bussiness_id"`
-	conditions   Conditions `json:"conditions"`
-	current_time string     `json:"current_time"`
-}
-type InsuranceStartRequest struct {
-	user_id      string     `json:"user_id"`
-	bussiness_id string     `json:"bussiness_id"`
-	conditions   Conditions `json:"conditions"`
-	current_time string     `json:"current_time"`
-}
-type InsuranceCheckRequest struct {
-	user_id      string     `json:"user_id"`
-	bussiness_id string     `json:"bussiness_id"`
-	conditions   Conditions `json:"conditions"`
-	current_time string     `json:"current_time"`
-}
-type PayTranserRequest struct {
-	user_id        string  `json:"user_id"`
-	password       string  `json:"password"`
-	amount         float32 `json:"amount"`
-	target_user_id string  `json:"target_user_id"`
-	current_time   string  `json:"current_time"`
-}
-type DepositTranserRequest struct {
-	user_id      string  `json:"user_id"`
-	password     string  `json:"password"`
-	amount       float32 `json:"amount"`
-	current_time string  `json:"current_time"`
-}
-
 func main() {
-	clientConnection := newGrpcConnection()
-	defer clientConnection.Close()
-
-	id := newIdentity()
-	sign := newSign()
-
-	gateway, err := client.Connect(
-		id,
-		client.WithSign(sign),
-		client.WithClientConnection(clientConnection),
-		client.WithEvaluateTimeout(5*time.Second),
-		client.WithEndorseTimeout(15*time.Second),
-		client.WithSubmitTimeout(5*time.Second),
-		client.WithCommitStatusTimeout(1*time.Minute),
-	)
+	config, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	defer gateway.Close()
-
-	network := gateway.GetNetwork(channelName)
-	contract := network.GetContract(chaincodeName)
 
-	// Context used for event listening
-	ctx, cancel := context.WithCancel(context.Background())
+	// Context used for health checks, event listening and shutdown, cancelled on SIGINT/SIGTERM
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	// Listen for events emitted by subsequent transactions
-	startChaincodeEventListening(ctx, network)
-
-	//调用链码进行资产初始化
+	peers, err := newPeerPool(config)
+	if err != nil {
+		log.Fatalf("Failed to connect to peers: %v", err)
+	}
+	defer peers.Close()
 
-	router := gin.Default()
+	// Check every peer before serving, so that the first requests go to a peer that is up
+	peers.CheckAll(ctx)
+	go peers.Run(ctx)
 
-	router.GET("/ecosys/asset", func(c *gin.Context) {
+	// The gateway's own identity is only used to listen for events. Transactions are signed by
+	// the identity of the requesting user, loaded from the wallet.
+	gatewayIdentity, err := loadGatewayIdentity(config.MSPID, config.Identity)
+	if err != nil {
+		log.Fatalf("Failed to load gateway identity: %v", err)
+	}
 
-		var queryAssetRequest QueryAssetRequest
-		if err := c.ShouldBindJSON(&queryAssetRequest); err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-		fmt.Println("\n--> Evaluate Transaction: GetAllAssets, function returns all the current assets on the ledger")
+	userWallet, err := newWallet(config.Wallet)
+	if err != nil {
+		log.Fatalf("Failed to open wallet: %v", err)
+	}
+	gateways := newGatewayPool(peers, userWallet, config, gatewayIdentity)
+	defer gateways.Close()
 
-		evaluateResult, err := contract.EvaluateTransaction("ReadTotalCurrencyByOwner", queryAssetRequest.user_id, queryAssetRequest.password)
-		if err != nil {
-			panic(fmt.Errorf("failed to evaluate transaction: %w", err))
-		}
-		result := formatJSON(evaluateResult)
-
-		fmt.Printf("*** Result:%s\n", result)
-
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"code":    "500",
-				"message": "GetAllAssets Failed",
-				"result":  "",
-			})
-			log.Fatalf("Failed to evaluate transaction: %s\n", err)
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"code":    "200",
-			"message": "GetAllAssets Success",
-			"result":  result,
-		})
-	})
+	ca, err := newCertificateAuthority(config.CA)
+	if err != nil {
+		log.Fatalf("Failed to set up certificate authority: %v", err)
+	}
+	identities := newIdentityManager(ca, userWallet, config.MSPID)
 
-	router.GET("/ecosys/contract", func(c *gin.Context) {
-		var contractQueryRequest ContractQueryRequest
-		if err := c.ShouldBindJSON(&contractQueryRequest); err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-		fmt.Println("\n--> Evaluate Transaction: GetAllContracts, function returns all the current Contracts on the ledger")
+	// Consume chaincode events, resuming from the last checkpoint
+	gatewayMetrics := newMetrics()
+	checkpointer, err := client.NewFileCheckpointer(config.Events.CheckpointPath)
+	if err != nil {
+		log.Fatalf("Failed to open event checkpoint: %v", err)
+	}
+	defer checkpointer.Close()
 
-		insuranceResult, err1 := contract.EvaluateTransaction("ReadInsuranceListByOwner", contractQueryRequest.user_id)
-		if err1 != nil {
-			panic(fmt.Errorf("failed to evaluate transaction: %w", err1))
-		}
+	network := func() (eventNetwork, error) {
+		return gateways.Network()
+	}
+	// Events are printed, pushed to the event streams of the users they concern and delivered to
+	// matching webhooks
+	hub := newEventHub(streamBufferSize)
+	webhookStore, err := openWebhookStore(config.Webhooks.Path)
+	if err != nil {
+		log.Fatalf("Failed to open webhooks: %v", err)
+	}
+	defer webhookStore.Close()
+	webhooks := newWebhookDispatcher(webhookStore, config.Webhooks)
+	events := newEventConsumer("events", network, config.Chaincode, checkpointer, config.Events.StartBlock, gatewayMetrics)
+	for _, eventName := range []string{
+		eventCreateCurrency,
+		eventTransferCurrency,
+		eventConsolidateCurrency,
+		eventConvertCurrency,
+		eventPostExchangeRate,
+		eventSetFeeSchedule,
+		eventCreateLoan,
+		eventStartLoan,
+		eventLoanContractCheck,
+		eventCreateInsurance,
+		eventStartInsurance,
+		eventInsuranceContractCheck,
+	} {
+		events.Handle(eventName, printEvent)
+		events.Handle(eventName, hub.publish)
+		events.Handle(eventName, webhooks.enqueue)
+	}
+	eventsDone := make(chan struct{})
+	go func() {
+		defer close(eventsDone)
+		events.Run(ctx)
+	}()
+	webhooksDone := make(chan struct{})
+	go func() {
+		defer close(webhooksDone)
+		webhooks.Run(ctx)
+	}()
 
-		loanResult, err2 := contract.EvaluateTransaction("ReadLoanListByOwner")
-		if err2 != nil {
-			panic(fmt.Errorf("failed to evaluate transaction: %w", err2))
+	// Project every chaincode event since block 0 into the local read model. The projection
+	// store is its own checkpoint, so that both are updated together.
+	projectionStore, err := openProjectionStore(config.Projection.Path)
+	if err != nil {
+		log.Fatalf("Failed to open projection: %v", err)
+	}
+	defer projectionStore.Close()
+	if config.Projection.Rebuild {
+		fmt.Println("*** Rebuilding the projection from block 0")
+		if err := projectionStore.Reset(); err != nil {
+			log.Fatalf("Failed to reset projection: %v", err)
 		}
-		// 把insuranceResult 和 loanResult 合并
-		evaluateResult := bytes.Join([][]byte{insuranceResult, loanResult}, []byte("\n"))
+	}
+	var genesis uint64
+	projector := newProjection(projectionStore, gatewayMetrics)
+	projectionEvents := newEventConsumer("projection", network, config.Chaincode, projectionStore, &genesis, gatewayMetrics)
+	projector.register(projectionEvents)
+	projectionDone := make(chan struct{})
+	go func() {
+		defer close(projectionDone)
+		projectionEvents.Run(ctx)
+	}()
 
-		result := formatJSON(evaluateResult)
+	// Submitted transactions are tracked until their commit status is known. Their status is
+	// pushed to the event stream of the submitting user and to the webhooks subscribing to it.
+	transactionStore, err := openTransactionStore(config.Transactions.Path)
+	if err != nil {
+		log.Fatalf("Failed to open transactions: %v", err)
+	}
+	defer transactionStore.Close()
+	transactions := newTransactionTracker(transactionStore, gateways, config.Transactions)
+	transactions.Notify(hub.publish)
+	transactions.Notify(webhooks.enqueue)
+	transactionsDone := make(chan struct{})
+	go func() {
+		defer close(transactionsDone)
+		transactions.Run(ctx)
+	}()
 
-		fmt.Printf("*** Result:%s\n", result)
+	auth, err := newAuth(config.Auth)
+	if err != nil {
+		log.Fatalf("Failed to set up authentication: %v", err)
+	}
+	if err := bootstrapAdmin(ctx, config.Auth, auth, identities); err != nil {
+		log.Fatalf("Failed to create admin account: %v", err)
+	}
 
-		if err1 != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"code":    "500",
-				"message": "GetAllContracts Failed",
-				"result":  "",
-			})
-			log.Fatalf("Failed to evaluate transaction: %s\n", err1)
-			return
-		}
-		if err2 != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"code":    "500",
-				"message": "GetAllContracts Failed",
-				"result":  "",
-			})
-			log.Fatalf("Failed to evaluate transaction: %s\n", err2)
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"code":    "200",
-			"message": "GetAllContracts Success",
-			"result":  result,
-		})
-	})
-	router.GET("/ecosys/query_contract", func(c *gin.Context) {
-		var contractQueryByIdRequest ContractQueryByIdRequest
-		if err := c.ShouldBindJSON(&contractQueryByIdRequest); err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-		fmt.Println("\n--> Evaluate Transaction: GetAllContracts, function returns all the current Contracts on the ledger")
-
-		if contractQueryByIdRequest.business_type == "loan" {
-			evaluateResult, err := contract.EvaluateTransaction("ReadLoan", contractQueryByIdRequest.user_id, contractQueryByIdRequest.business_id)
-			result := formatJSON(evaluateResult)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"code":    "500",
-					"message": "GetAllContracts Failed",
-					"result":  "",
-				})
-				log.Fatalf("Failed to evaluate transaction: %s\n", err)
-				return
-			}
-			c.JSON(http.StatusOK, gin.H{
-				"code":    "200",
-				"message": "GetAllContracts Success",
-				"result":  result,
-			})
-		} else {
-			evaluateResult, err := contract.EvaluateTransaction("ReadInsurance", contractQueryByIdRequest.user_id, contractQueryByIdRequest.business_id)
-			result := formatJSON(evaluateResult)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"code":    "500",
-					"message": "GetAllContracts Failed",
-					"result":  "",
-				})
-				log.Fatalf("Failed to evaluate transaction: %s\n", err)
-				return
-			}
-			c.JSON(http.StatusOK, gin.H{
-				"code":    "200",
-				"message": "GetAllContracts Success",
-				"result":  result,
-			})
-		}
+	retry := newRetryPolicy(config.Retry, gatewayMetrics)
+	service := newEcosysService(gateways, gatewayMetrics, serviceOptions{
+		transactions:         transactions,
+		idempotencyRetention: config.Idempotency.Retention,
+		retry:                retry,
 	})
+	server := &http.Server{
+		Addr: config.Listen,
+		Handler: newRouter(service, auth, identities, routerOptions{
+			health:     gateways,
+			projection: projector,
+			events:     hub,
+			webhooks:   webhooks,
+		}),
+	}
+	// Event streams never end by themselves; end them so that shutdown does not wait for them
+	server.RegisterOnShutdown(hub.Close)
 
-	router.POST("/ecosys/new_contract", func(c *gin.Context) {
-		var createContractRequest CreateContractRequest
-		if err := c.ShouldBindJSON(&createContractRequest); err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-		fmt.Println("\n--> Evaluate Transaction: Create a new contract, function returns all the current Contracts on the ledger")
-		evaluateResult, err := contract.SubmitTransaction("CreateContract", createContractRequest.user_id, createContractRequest.business_id, fmt.Sprintf("%f", createContractRequest.amount), createContractRequest.issuer, fmt.Sprintf("%f", createContractRequest.rate), createContractRequest.bussiness_type, fmt.Sprintf("%d", createContractRequest.period))
-		result := formatJSON(evaluateResult)
-
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"code":    "500",
-				"message": "Create Failed",
-				"result":  string(result),
-			})
-			log.Fatalf("Failed to evaluate transaction: %s\n", err)
-			return
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to serve: %v", err)
 		}
-		c.JSON(http.StatusOK, gin.H{
-			"code":    "200",
-			"message": "Create Success",
-			"result":  string(result),
-		})
-	})
+	}()
 
-	//firstBlockNumber := createAsset(contract)
-
-	router.POST("/ecosys/loan/start", func(c *gin.Context) {
-		var loanStartRequest LoanStartRequest
-		err := c.BindJSON(&loanStartRequest)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"code":    "400",
-				"message": "Bad Request",
-				"result":  "",
-			})
-			return
-		}
-		result, err := contract.SubmitTransaction("StartLoan", loanStartRequest.user_id, loanStartRequest.bussiness_id, fmt.Sprintf("%f", loanStartRequest.conditions.credit), fmt.Sprintf("%f", loanStartRequest.conditions.income))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"code":    "500",
-				"message": "Update Failed",
-				"result":  string(result),
-			})
-			log.Fatalf("Failed to evaluate transaction: %s\n", err)
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"code":    "200",
-			"message": "Update Success",
-			"result":  string(result),
-		})
-	})
+	<-ctx.Done()
+	fmt.Println("\n*** Shutting down, waiting for in-flight requests")
 
-	router.POST("/ecosys/loan/check_contract", func(c *gin.Context) {
-		var loanCheckRequest LoanCheckRequest
-		err := c.BindJSON(&loanCheckRequest)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"code":    "400",
-				"message": "Bad Request",
-				"result":  "",
-			})
-			return
-		}
-		result, err := contract.SubmitTransaction("LoanContractCheck", loanCheckRequest.user_id, loanCheckRequest.bussiness_id, fmt.Sprintf("%f", loanCheckRequest.conditions.credit), fmt.Sprintf("%f", loanCheckRequest.conditions.income))
-
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"code":    "500",
-				"message": "Loan Check Failed",
-				"result":  result,
-			})
-			log.Fatalf("Failed to evaluate transaction: %s\n", err)
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"code":    "200",
-			"message": "Loan Check Success",
-			"result":  result,
-		})
-	})
+	// In-flight requests are allowed to finish, including transactions waiting for commit status
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), config.Timeouts.Shutdown)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down gracefully: %v", err)
+	}
 
-	router.POST("/ecosys/insurance/start", func(c *gin.Context) {
-		var insuranceStartRequest InsuranceStartRequest
-		err := c.BindJSON(&insuranceStartRequest)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"code":    "400",
-				"message": "Bad Request",
-				"result":  "",
-			})
-			return
-		}
-		result, err := contract.SubmitTransaction("StartInsurance", insuranceStartRequest.user_id, insuranceStartRequest.bussiness_id, fmt.Sprintf("%f", insuranceStartRequest.conditions.credit), fmt.Sprintf("%f", insuranceStartRequest.conditions.income))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"code":    "500",
-				"message": "Insurance Start Failed",
-				"result":  string(result),
-			})
-			log.Fatalf("Failed to evaluate transaction: %s\n", err)
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"code":    "200",
-			"message": "Insurance Start Success",
-			"result":  string(result),
-		})
-	})
-	router.POST("/ecosys/insurance/check_contract", func(c *gin.Context) {
-		var insuranceCheckRequest InsuranceCheckRequest
-		err := c.BindJSON(&insuranceCheckRequest)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"code":    "400",
-				"message": "Bad Request",
-				"result":  "",
-			})
-			return
-		}
-		result, err := contract.SubmitTransaction("InsuranceContractCheck", insuranceCheckRequest.user_id, insuranceCheckRequest.bussiness_id, fmt.Sprintf("%f", insuranceCheckRequest.conditions.credit), fmt.Sprintf("%f", insuranceCheckRequest.conditions.income), fmt.Sprintf("%t", insuranceCheckRequest.conditions.is_sudden), insuranceCheckRequest.conditions.contingency_info)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"code":    "500",
-				"message": "Insurance Check Failed",
-				"result":  result,
-			})
-			log.Fatalf("Failed to evaluate transaction: %s\n", err)
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"code":    "200",
-			"message": "Insurance Check Success",
-			"result":  result,
-		})
-	})
-	router.POST("/ecosys/pay/transfer", func(c *gin.Context) {
-		var payTransferRequest PayTranserRequest
-		err := c.BindJSON(&payTransferRequest)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"code":    "400",
-				"message": "Bad Request",
-				"result":  "",
-			})
-			return
-		}
-		result, err := contract.SubmitTransaction("TransferCurrency", payTransferRequest.user_id, payTransferRequest.target_user_id, fmt.Sprintf("%f", payTransferRequest.amount), "Transfer")
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"code":    "500",
-				"message": "Pay Transfer Failed",
-				"result":  result,
-			})
-			log.Fatalf("Failed to evaluate transaction: %s\n", err)
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"code":    "200",
-			"message": "Pay Transfer Success",
-			"result":  result,
-		})
-	})
-	router.POST("/ecosys/pay/deposit", func(c *gin.Context) {
-		var depositTransferRequest DepositTranserRequest
-		err := c.BindJSON(&depositTransferRequest)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"code":    "400",
-				"message": "Bad Request",
-				"result":  "",
-			})
-			return
-		}
-		var currency = Currency{
-			CurrencyID: "Currency" + depositTransferRequest.current_time,
-			Amount:     depositTransferRequest.amount,
-			Owner:      depositTransferRequest.user_id,
-			CreatedAt:  depositTransferRequest.current_time,
-			CreatedVia: "Deposit",
-			UpdatedAt:  depositTransferRequest.current_time,
-			UpdatedVia: "Deposit",
-		}
-		currencyJson, err := json.Marshal(currency)
-		currencyJsonStr := string(currencyJson)
-		result, err := contract.SubmitTransaction("CreateCurrency", currencyJsonStr) // TODO
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"code":    "500",
-				"message": "Deposite Failed",
-				"result":  result,
-			})
-			log.Fatalf("Failed to evaluate transaction: %s\n", err)
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"code":    "200",
-			"message": "Deposite Success",
-			"result":  result,
-		})
-	})
+	// Commit statuses still awaited are resolved from the ledger after a restart
+	transactions.Close()
 
-	err = router.Run(":8000")
+	// The checkpoints are closed once the event consumers have stopped writing to them
+	<-transactionsDone
+	<-eventsDone
+	<-projectionDone
+	<-webhooksDone
+}
+
+// newAuth creates the authentication service. Tokens are signed with the configured secret, or
+// with a random key if it is not set.
+func newAuth(config AuthConfig) (*authService, error) {
+	users, err := newUserStore(config.UserStorePath)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	// Replay events from the block containing the first transaction
-	//replayChaincodeEvents(ctx, network, firstBlockNumber)
+	secret := []byte(config.TokenSecret)
+	if len(secret) == 0 {
+		fmt.Println("*** ECOSYS_AUTH_SECRET is not set, access tokens will not survive a restart")
+		if secret, err = newTokenSecret(); err != nil {
+			return nil, err
+		}
+	}
+	return newAuthService(users, secret, config.TokenTTL), nil
 }
 
-func startChaincodeEventListening(ctx context.Context, network *client.Network) {
-	fmt.Println("\n*** Start chaincode event listening")
-
-	events, err := network.ChaincodeEvents(ctx, chaincodeName)
-	if err != nil {
-		panic(fmt.Errorf("failed to start chaincode event listening: %w", err))
+// newWallet opens the wallet of user identities. It is encrypted if a passphrase is configured,
+// or stored as plain files otherwise.
+func newWallet(config WalletConfig) (wallet, error) {
+	if config.Passphrase != "" {
+		return newEncryptedFileWallet(config.Path, config.Passphrase)
 	}
+	fmt.Println("*** ECOSYS_WALLET_PASSPHRASE is not set, private keys in the wallet are not encrypted")
+	return newFileSystemWallet(config.Path)
+}
 
-	go func() {
-		for event := range events {
-			asset := formatJSON(event.Payload)
-			fmt.Printf("\n<-- Chaincode event received: %s - %s\n", event.EventName, asset)
-		}
-	}()
+// newCertificateAuthority returns the configured Fabric CA, or a local CA for development if
+// no CA URL is configured.
+func newCertificateAuthority(config CAConfig) (certificateAuthority, error) {
+	if config.URL == "" {
+		fmt.Println("*** ECOSYS_CA_URL is not set, enrolling users with a local development CA")
+		return newLocalCA()
+	}
+	return newFabricCA(config.URL, config.Name, config.TLSCertPath, config.RegistrarID, config.RegistrarSecret)
 }
 
-func formatJSON(data []byte) string {
+func formatJSON(data []byte) (string, error) {
 	var result bytes.Buffer
 	if err := json.Indent(&result, data, "", "  "); err != nil {
-		panic(fmt.Errorf("failed to parse JSON: %w", err))
+		return "", fmt.Errorf("failed to parse JSON: %w", err)
 	}
-	return result.String()
+	return result.String(), nil
 }
 
 func createAsset(contract *client.Contract, asset Asset) ([]byte, error) {
-	var err error
 	fmt.Printf("\n--> Submit transaction: CreateAsset, %s owned by %s with appraised value %s\n", asset.ID, asset.Owner, asset.AppraisedValue)
 
 	result, commit, err := contract.SubmitAsync("CreateAsset", client.WithArguments(
@@ -527,39 +290,32 @@ func createAsset(contract *client.Contract, asset Asset) ([]byte, error) {
 		asset.AppraisedValue,
 	))
 	if err != nil {
-		panic(fmt.Errorf("failed to submit transaction: %w", err))
+		return nil, fmt.Errorf("failed to submit transaction: %w", err)
 	}
 
 	status, err := commit.Status()
 	if err != nil {
-		panic(fmt.Errorf("failed to get transaction commit status: %w", err))
+		return nil, fmt.Errorf("failed to get transaction commit status: %w", err)
 	}
 
 	if !status.Successful {
-		panic(fmt.Errorf("failed to commit transaction with status code %v", status.Code))
+		return nil, fmt.Errorf("failed to commit transaction with status code %v", status.Code)
 	}
 	fmt.Println("\n*** CreateAsset committed successfully")
 
-	if err != nil {
-		return result, err
-	}
 	return result, nil
 }
 
 func updateAsset(contract *client.Contract, asset Asset) ([]byte, error) {
-	var err error
 	fmt.Printf("\n--> Submit transaction: UpdateAsset, %s update appraised value to 200\n", asset.ID)
 
 	result, err := contract.SubmitTransaction("UpdateAsset", asset.ID, asset.Color, asset.Size, asset.Owner, asset.AppraisedValue)
 	if err != nil {
-		panic(fmt.Errorf("failed to submit transaction: %w", err))
+		return nil, fmt.Errorf("failed to submit transaction: %w", err)
 	}
 
 	fmt.Println("\n*** UpdateAsset committed successfully")
 
-	if err != nil {
-		return result, err
-	}
 	return result, nil
 }
 
@@ -568,13 +324,10 @@ func transferAsset(contract *client.Contract, assetID string, newOwner string) e
 
 	_, err := contract.SubmitTransaction("TransferAsset", assetID, newOwner)
 	if err != nil {
-		panic(fmt.Errorf("failed to submit transaction: %w", err))
+		return fmt.Errorf("failed to submit transaction: %w", err)
 	}
 
 	fmt.Println("\n*** TransferAsset committed successfully")
-	if err != nil {
-		return err
-	}
 	return nil
 }
 
@@ -583,12 +336,9 @@ func deleteAsset(contract *client.Contract, assetID string) error {
 
 	_, err := contract.SubmitTransaction("DeleteAsset", assetID)
 	if err != nil {
-		panic(fmt.Errorf("failed to submit transaction: %w", err))
+		return fmt.Errorf("failed to submit transaction: %w", err)
 	}
 
 	fmt.Println("\n*** DeleteAsset committed successfully")
-	if err != nil {
-		return err
-	}
 	return nil
 }
@@ -0,0 +1,449 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Error code for requests without a valid access token. Requests with a valid token that act on
+// another user's resources are rejected with errCodeForbidden.
+const errCodeUnauthenticated = "UNAUTHENTICATED"
+
+// authUserKey is the gin context key holding the authenticated user ID.
+const authUserKey = "auth.user"
+
+var (
+	errUserExists         = errors.New("user already exists")
+	errInvalidCredentials = errors.New("invalid user ID or password")
+	errInvalidToken       = errors.New("invalid or expired access token")
+)
+
+// userAccount is a registered gateway user. Only the bcrypt hash of the password is stored.
+type userAccount struct {
+	UserID       string    `json:"user_id"`
+	PasswordHash []byte    `json:"password_hash"`
+	Role         string    `json:"role"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// userStore keeps user accounts in memory and, when a path is set, persists them as a JSON file
+// so that accounts survive a restart of the gateway.
+type userStore struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]*userAccount
+}
+
+// newUserStore loads the accounts stored at path. An empty path keeps accounts in memory only.
+func newUserStore(path string) (*userStore, error) {
+	store := &userStore{path: path, users: map[string]*userAccount{}}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user store: %w", err)
+	}
+	if err := json.Unmarshal(data, &store.users); err != nil {
+		return nil, fmt.Errorf("failed to parse user store %s: %w", path, err)
+	}
+	return store, nil
+}
+
+func (s *userStore) get(userID string) (*userAccount, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	account, ok := s.users[userID]
+	return account, ok
+}
+
+func (s *userStore) add(account *userAccount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[account.UserID]; ok {
+		return errUserExists
+	}
+	s.users[account.UserID] = account
+	if err := s.save(); err != nil {
+		delete(s.users, account.UserID)
+		return err
+	}
+	return nil
+}
+
+func (s *userStore) remove(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.users[userID]
+	if !ok {
+		return nil
+	}
+	delete(s.users, userID)
+	if err := s.save(); err != nil {
+		s.users[userID] = account
+		return err
+	}
+	return nil
+}
+
+// save writes the accounts to a temporary file and renames it, so a crash never leaves a partial file.
+func (s *userStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write user store: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// authClaims are the claims of a gateway access token. The subject is the user ID.
+type authClaims struct {
+	Role string `json:"role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// authService registers users, verifies passwords and issues HS256 signed access tokens. Tokens
+// are revoked on logout until they expire.
+type authService struct {
+	users    *userStore
+	secret   []byte
+	tokenTTL time.Duration
+
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+func newAuthService(users *userStore, secret []byte, tokenTTL time.Duration) *authService {
+	return &authService{
+		users:    users,
+		secret:   secret,
+		tokenTTL: tokenTTL,
+		revoked:  map[string]time.Time{},
+	}
+}
+
+// newTokenSecret returns a random signing key, used when no key is configured. Tokens signed
+// with it are invalidated by a restart of the gateway.
+func newTokenSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Register creates a user account.
+func (a *authService) Register(userID string, password string, role string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return a.users.add(&userAccount{UserID: userID, PasswordHash: hash, Role: role, CreatedAt: time.Now().UTC()})
+}
+
+// Unregister removes a user account, when provisioning the rest of the user failed.
+func (a *authService) Unregister(userID string) error {
+	return a.users.remove(userID)
+}
+
+// Login verifies the password of a user and returns a new access token and its expiry time.
+func (a *authService) Login(userID string, password string) (string, time.Time, error) {
+	account, ok := a.users.get(userID)
+	if !ok {
+		// Compare against a dummy hash so that unknown users take as long as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return "", time.Time{}, errInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(password)); err != nil {
+		return "", time.Time{}, errInvalidCredentials
+	}
+	return a.issueToken(userID, account.Role)
+}
+
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func (a *authService) issueToken(userID string, role string) (string, time.Time, error) {
+	tokenID := make([]byte, 16)
+	if _, err := rand.Read(tokenID); err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(a.tokenTTL)
+	claims := authClaims{Role: role, RegisteredClaims: jwt.RegisteredClaims{
+		ID:        hex.EncodeToString(tokenID),
+		Subject:   userID,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// Verify checks the signature, expiry and revocation of an access token and returns its claims.
+func (a *authService) Verify(token string) (*authClaims, error) {
+	var claims authClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return a.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.revoked[claims.ID]; ok {
+		return nil, errInvalidToken
+	}
+	return &claims, nil
+}
+
+// Logout revokes an access token. Revocations are dropped once the token has expired anyway.
+func (a *authService) Logout(claims *authClaims) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for id, expiresAt := range a.revoked {
+		if now.After(expiresAt) {
+			delete(a.revoked, id)
+		}
+	}
+	a.revoked[claims.ID] = claims.ExpiresAt.Time
+}
+
+// RegisterRequest creates a gateway user account and enrolls its Fabric identity. The role is
+// embedded in the enrollment certificate and defaults to applicant. Users cannot give themselves
+// a privileged role; see CreateUserRequest.
+type RegisterRequest struct {
+	UserID   string `json:"user_id" binding:"required,max=64,excludesall=/\\"`
+	Password string `json:"password" binding:"required,min=8,max=72"`
+	Role     string `json:"role" binding:"omitempty,oneof=applicant issuer adjuster"`
+}
+
+// CreateUserRequest creates a user account with any role, including the privileged roles checked
+// by the chaincode. Only admins may create accounts this way.
+type CreateUserRequest struct {
+	UserID   string `json:"user_id" binding:"required,max=64,excludesall=/\\"`
+	Password string `json:"password" binding:"required,min=8,max=72"`
+	Role     string `json:"role" binding:"required,oneof=applicant issuer adjuster treasury oracle admin"`
+}
+
+// LoginRequest exchanges a user ID and password for an access token.
+type LoginRequest struct {
+	UserID   string `json:"user_id" binding:"required,max=64"`
+	Password string `json:"password" binding:"required,max=72"`
+}
+
+// LoginResult is the access token returned by a successful login. It is sent by clients in the
+// Authorization header as "Bearer <token>".
+type LoginResult struct {
+	UserID    string    `json:"user_id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// registerAuthRoutes registers sign-up, login and logout, and the creation of accounts by admins.
+// Sign-up and login are the only routes that do not require an access token.
+func (s *apiServer) registerAuthRoutes(router gin.IRouter) {
+	auth := router.Group("/" + apiVersion + "/auth")
+	auth.POST("/register", s.register)
+	auth.POST("/login", s.login)
+	auth.POST("/logout", s.requireAuth, s.logout)
+
+	admin := router.Group("/"+apiVersion+"/admin", s.requireAuth, s.requireRole(roleAdmin))
+	admin.POST("/users", s.createUser)
+}
+
+func (s *apiServer) register(c *gin.Context) {
+	var request RegisterRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	if request.Role == "" {
+		request.Role = roleApplicant
+	}
+	s.createAccount(c, "Register", request.UserID, request.Password, request.Role)
+}
+
+// createUser creates an account with the role chosen by an admin.
+func (s *apiServer) createUser(c *gin.Context) {
+	var request CreateUserRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	s.createAccount(c, "CreateUser", request.UserID, request.Password, request.Role)
+}
+
+// createAccount creates a user account and enrolls its Fabric identity with role, removing the
+// account again if the enrollment fails.
+func (s *apiServer) createAccount(c *gin.Context, operation string, userID string, password string, role string) {
+	err := s.auth.Register(userID, password, role)
+	if errors.Is(err, errUserExists) {
+		writeError(c, http.StatusConflict, operation+" Failed", &ChaincodeError{
+			Code:    errCodeAlreadyExists,
+			Message: err.Error(),
+			Details: map[string]string{"user_id": userID},
+		})
+		return
+	}
+	if err != nil {
+		respondError(c, operation+" Failed", err)
+		return
+	}
+
+	id, err := s.identities.Enroll(c.Request.Context(), userID, role)
+	if err != nil {
+		if unregisterErr := s.auth.Unregister(userID); unregisterErr != nil {
+			log.Printf("Failed to remove account %s after failed enrollment: %v", userID, unregisterErr)
+		}
+		respondError(c, operation+" Failed", err)
+		return
+	}
+	result, err := newIdentityInfo(userID, id)
+	if err != nil {
+		respondError(c, operation+" Failed", err)
+		return
+	}
+	respondCreated(c, operation+" Success", result)
+}
+
+// bootstrapAdmin creates the configured admin account and enrolls its identity, so that the first
+// admin can grant the privileged roles. An existing account is left as it is.
+func bootstrapAdmin(ctx context.Context, config AuthConfig, auth *authService, identities *identityManager) error {
+	if config.AdminUserID == "" {
+		return nil
+	}
+	if _, ok := auth.users.get(config.AdminUserID); ok {
+		return nil
+	}
+	if config.AdminPassword == "" {
+		return fmt.Errorf("no password is set for the admin account %s", config.AdminUserID)
+	}
+	if err := auth.Register(config.AdminUserID, config.AdminPassword, roleAdmin); err != nil {
+		return err
+	}
+	if _, err := identities.Enroll(ctx, config.AdminUserID, roleAdmin); err != nil {
+		if unregisterErr := auth.Unregister(config.AdminUserID); unregisterErr != nil {
+			log.Printf("Failed to remove account %s after failed enrollment: %v", config.AdminUserID, unregisterErr)
+		}
+		return err
+	}
+	log.Printf("Created admin account %s", config.AdminUserID)
+	return nil
+}
+
+func (s *apiServer) login(c *gin.Context) {
+	var request LoginRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	token, expiresAt, err := s.auth.Login(request.UserID, request.Password)
+	if errors.Is(err, errInvalidCredentials) {
+		writeError(c, http.StatusUnauthorized, "Login Failed", &ChaincodeError{Code: errCodeUnauthenticated, Message: err.Error()})
+		return
+	}
+	if err != nil {
+		respondError(c, "Login Failed", err)
+		return
+	}
+	respondOK(c, "Login Success", LoginResult{UserID: request.UserID, Token: token, ExpiresAt: expiresAt})
+}
+
+func (s *apiServer) logout(c *gin.Context) {
+	claims := c.MustGet(authUserKey).(*authClaims)
+	s.auth.Logout(claims)
+	respondOK(c, "Logout Success", nil)
+}
+
+// requireAuth rejects requests without a valid bearer token and stores the claims of the token
+// in the gin context for the handlers.
+func (s *apiServer) requireAuth(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		c.Header("WWW-Authenticate", "Bearer")
+		writeError(c, http.StatusUnauthorized, "Unauthorized", &ChaincodeError{Code: errCodeUnauthenticated, Message: "missing bearer token"})
+		return
+	}
+	claims, err := s.auth.Verify(token)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeError(c, http.StatusUnauthorized, "Unauthorized", &ChaincodeError{Code: errCodeUnauthenticated, Message: err.Error()})
+		return
+	}
+	c.Set(authUserKey, claims)
+	c.Next()
+}
+
+// requireSelf rejects requests to a /users/{id} or /issuers/{id} resource of another user.
+func (s *apiServer) requireSelf(c *gin.Context) {
+	if userID := authenticatedUser(c); c.Param("id") != userID {
+		writeError(c, http.StatusForbidden, "Forbidden", &ChaincodeError{
+			Code:    errCodeForbidden,
+			Message: "access to the resources of another user is not allowed",
+			Details: map[string]string{"user_id": userID, "resource": c.Param("id")},
+		})
+		return
+	}
+	c.Next()
+}
+
+// requireRole rejects requests of users without one of the given roles.
+func (s *apiServer) requireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if role := authenticatedRole(c); !slices.Contains(roles, role) {
+			writeError(c, http.StatusForbidden, "Forbidden", &ChaincodeError{
+				Code:    errCodeForbidden,
+				Message: fmt.Sprintf("the %s role is not allowed to access this resource", role),
+				Details: map[string]string{"role": role, "required": strings.Join(roles, ",")},
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// authenticatedUser returns the ID of the user authenticated by requireAuth.
+func authenticatedUser(c *gin.Context) string {
+	return c.MustGet(authUserKey).(*authClaims).Subject
+}
+
+// authenticatedRole returns the role of the user authenticated by requireAuth.
+func authenticatedRole(c *gin.Context) string {
+	return c.MustGet(authUserKey).(*authClaims).Role
+}
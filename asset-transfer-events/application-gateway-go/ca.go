@@ -0,0 +1,569 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles of platform users, embedded in their enrollment certificate as the "role" attribute.
+// Treasury, oracle and admin are privileged: the chaincode trusts them to manage currencies, fees,
+// exchange rates and migrations, so they are only granted by an admin (POST /v1/admin/users) and
+// never at sign-up.
+const (
+	roleApplicant = "applicant"
+	roleIssuer    = "issuer"
+	roleAdjuster  = "adjuster"
+	roleTreasury  = "treasury"
+	roleOracle    = "oracle"
+	roleAdmin     = "admin"
+)
+
+// roleAttribute is the name of the certificate attribute holding the role of a user.
+const roleAttribute = "role"
+
+// attributeExtensionOID is the X.509 extension in which Fabric CA embeds certificate attributes,
+// read in chaincode with the client identity library (cid.GetAttributeValue).
+var attributeExtensionOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+var errIdentityRevoked = errors.New("identity has been revoked")
+
+// caRegistration registers a platform user as a client identity of the CA.
+type caRegistration struct {
+	EnrollmentID string
+	Role         string
+}
+
+// certificateAuthority registers and enrolls the Fabric identities of platform users. Key pairs
+// are generated by the gateway; only certificate signing requests are sent to the CA.
+type certificateAuthority interface {
+	// Register creates an identity and returns its one-time enrollment secret.
+	Register(ctx context.Context, registration caRegistration) (string, error)
+	// Enroll issues the first certificate of a registered identity.
+	Enroll(ctx context.Context, enrollmentID string, secret string, csrPEM []byte) ([]byte, error)
+	// Reenroll issues a new certificate to an identity, authenticated by its current certificate.
+	Reenroll(ctx context.Context, current *walletIdentity, csrPEM []byte) ([]byte, error)
+	// Revoke revokes an identity and all of its certificates.
+	Revoke(ctx context.Context, enrollmentID string, reason string) error
+}
+
+// identityManager provisions the Fabric identities of platform users in the wallet.
+type identityManager struct {
+	ca     certificateAuthority
+	wallet wallet
+	mspID  string
+}
+
+func newIdentityManager(ca certificateAuthority, wallet wallet, mspID string) *identityManager {
+	return &identityManager{ca: ca, wallet: wallet, mspID: mspID}
+}
+
+// Enroll registers a new user with the CA, enrolls it and stores the identity in the wallet.
+func (m *identityManager) Enroll(ctx context.Context, userID string, role string) (*walletIdentity, error) {
+	secret, err := m.ca.Register(ctx, caRegistration{EnrollmentID: userID, Role: role})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register %s with the CA: %w", userID, err)
+	}
+	privateKeyPEM, csrPEM, err := newKeyAndCSR(userID)
+	if err != nil {
+		return nil, err
+	}
+	certificatePEM, err := m.ca.Enroll(ctx, userID, secret, csrPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll %s: %w", userID, err)
+	}
+	return m.store(userID, certificatePEM, privateKeyPEM)
+}
+
+// Reenroll replaces the identity of a user with a new key pair and certificate, for example
+// before the current certificate expires.
+func (m *identityManager) Reenroll(ctx context.Context, userID string) (*walletIdentity, error) {
+	current, err := m.wallet.Get(userID)
+	if err != nil {
+		return nil, err
+	}
+	privateKeyPEM, csrPEM, err := newKeyAndCSR(userID)
+	if err != nil {
+		return nil, err
+	}
+	certificatePEM, err := m.ca.Reenroll(ctx, current, csrPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reenroll %s: %w", userID, err)
+	}
+	return m.store(userID, certificatePEM, privateKeyPEM)
+}
+
+// Revoke revokes the identity of a user at the CA and removes it from the wallet. The user can
+// no longer transact until a new identity is imported.
+func (m *identityManager) Revoke(ctx context.Context, userID string, reason string) error {
+	if _, err := m.wallet.Get(userID); err != nil {
+		return err
+	}
+	if err := m.ca.Revoke(ctx, userID, reason); err != nil {
+		return fmt.Errorf("failed to revoke %s: %w", userID, err)
+	}
+	return m.wallet.Remove(userID)
+}
+
+func (m *identityManager) store(userID string, certificatePEM []byte, privateKeyPEM []byte) (*walletIdentity, error) {
+	id, err := newWalletIdentity(m.mspID, certificatePEM, privateKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("CA returned an unusable certificate: %w", err)
+	}
+	if err := m.wallet.Put(userID, id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// newKeyAndCSR generates a P-256 key pair and a certificate signing request for it.
+func newKeyAndCSR(commonName string) ([]byte, []byte, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	privateKeyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), nil
+}
+
+// certificateAttributes returns the attributes embedded in a certificate by the CA.
+func certificateAttributes(certificate *x509.Certificate) (map[string]string, error) {
+	for _, extension := range certificate.Extensions {
+		if extension.Id.Equal(attributeExtensionOID) {
+			var attributes struct {
+				Attrs map[string]string `json:"attrs"`
+			}
+			if err := json.Unmarshal(extension.Value, &attributes); err != nil {
+				return nil, fmt.Errorf("invalid attribute extension: %w", err)
+			}
+			return attributes.Attrs, nil
+		}
+	}
+	return map[string]string{}, nil
+}
+
+// fabricCA is a client of the Fabric CA server REST API. Registration and revocation are
+// authorized by a registrar identity, enrolled with the bootstrap credentials on first use.
+type fabricCA struct {
+	url        string
+	caName     string
+	httpClient *http.Client
+
+	registrarID     string
+	registrarSecret string
+
+	mu        sync.Mutex
+	registrar *walletIdentity
+}
+
+// newFabricCA creates a client of the Fabric CA server at url, trusting the TLS certificate in tlsCertPath.
+func newFabricCA(url string, caName string, tlsCertPath string, registrarID string, registrarSecret string) (*fabricCA, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if tlsCertPath != "" {
+		certificate, err := loadCertificate(tlsCertPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AddCert(certificate)
+	}
+	return &fabricCA{
+		url:             strings.TrimSuffix(url, "/"),
+		caName:          caName,
+		httpClient:      &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		registrarID:     registrarID,
+		registrarSecret: registrarSecret,
+	}, nil
+}
+
+type fabricCAAttribute struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	ECert bool   `json:"ecert"`
+}
+
+type fabricCAAttributeRequest struct {
+	Name     string `json:"name"`
+	Optional bool   `json:"optional"`
+}
+
+type fabricCAResponse struct {
+	Success bool            `json:"success"`
+	Result  json.RawMessage `json:"result"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (f *fabricCA) Register(ctx context.Context, registration caRegistration) (string, error) {
+	registrar, err := f.registrarIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+	request := map[string]any{
+		"id":              registration.EnrollmentID,
+		"type":            "client",
+		"max_enrollments": -1,
+		"attrs":           []fabricCAAttribute{{Name: roleAttribute, Value: registration.Role, ECert: true}},
+		"caname":          f.caName,
+	}
+	var result struct {
+		Secret string `json:"secret"`
+	}
+	if err := f.send(ctx, "/api/v1/register", request, tokenAuth(registrar), &result); err != nil {
+		return "", err
+	}
+	return result.Secret, nil
+}
+
+func (f *fabricCA) Enroll(ctx context.Context, enrollmentID string, secret string, csrPEM []byte) ([]byte, error) {
+	return f.enroll(ctx, "/api/v1/enroll", csrPEM, basicAuth(enrollmentID, secret))
+}
+
+func (f *fabricCA) Reenroll(ctx context.Context, current *walletIdentity, csrPEM []byte) ([]byte, error) {
+	return f.enroll(ctx, "/api/v1/reenroll", csrPEM, tokenAuth(current))
+}
+
+func (f *fabricCA) enroll(ctx context.Context, path string, csrPEM []byte, authorize caAuthorizer) ([]byte, error) {
+	request := map[string]any{
+		"certificate_request": string(csrPEM),
+		"attr_reqs":           []fabricCAAttributeRequest{{Name: roleAttribute, Optional: true}},
+		"caname":              f.caName,
+	}
+	var result struct {
+		Cert string `json:"Cert"`
+	}
+	if err := f.send(ctx, path, request, authorize, &result); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(result.Cert)
+}
+
+func (f *fabricCA) Revoke(ctx context.Context, enrollmentID string, reason string) error {
+	registrar, err := f.registrarIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	request := map[string]any{
+		"id":     enrollmentID,
+		"reason": reason,
+		"caname": f.caName,
+	}
+	return f.send(ctx, "/api/v1/revoke", request, tokenAuth(registrar), nil)
+}
+
+// registrarIdentity enrolls the registrar with its bootstrap secret. The identity is kept in memory
+// only, and enrolled again after a restart of the gateway.
+func (f *fabricCA) registrarIdentity(ctx context.Context) (*walletIdentity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.registrar != nil {
+		return f.registrar, nil
+	}
+
+	privateKeyPEM, csrPEM, err := newKeyAndCSR(f.registrarID)
+	if err != nil {
+		return nil, err
+	}
+	certificatePEM, err := f.Enroll(ctx, f.registrarID, f.registrarSecret, csrPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll CA registrar %s: %w", f.registrarID, err)
+	}
+	registrar, err := newWalletIdentity("", certificatePEM, privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	f.registrar = registrar
+	return registrar, nil
+}
+
+// caAuthorizer sets the Authorization header of a request to the Fabric CA server.
+type caAuthorizer func(request *http.Request, body []byte) error
+
+func basicAuth(enrollmentID string, secret string) caAuthorizer {
+	return func(request *http.Request, _ []byte) error {
+		request.SetBasicAuth(enrollmentID, secret)
+		return nil
+	}
+}
+
+// tokenAuth authorizes a request with a Fabric CA token: the base64 certificate of the caller and
+// its signature over the method, URI, body and certificate of the request.
+func tokenAuth(id *walletIdentity) caAuthorizer {
+	return func(request *http.Request, body []byte) error {
+		b64Cert := base64.StdEncoding.EncodeToString([]byte(id.Credentials.Certificate))
+		payload := request.Method + "." +
+			base64.StdEncoding.EncodeToString([]byte(request.URL.RequestURI())) + "." +
+			base64.StdEncoding.EncodeToString(body) + "." +
+			b64Cert
+
+		sign, err := id.sign()
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256([]byte(payload))
+		signature, err := sign(digest[:])
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", b64Cert+"."+base64.StdEncoding.EncodeToString(signature))
+		return nil
+	}
+}
+
+func (f *fabricCA) send(ctx context.Context, path string, request any, authorize caAuthorizer, result any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if err := authorize(httpRequest, body); err != nil {
+		return err
+	}
+
+	httpResponse, err := f.httpClient.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("failed to call CA: %w", err)
+	}
+	defer httpResponse.Body.Close()
+	responseBody, err := io.ReadAll(io.LimitReader(httpResponse.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	var response fabricCAResponse
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		return fmt.Errorf("CA returned status %d: %s", httpResponse.StatusCode, responseBody)
+	}
+	if !response.Success {
+		messages := make([]string, 0, len(response.Errors))
+		for _, caError := range response.Errors {
+			messages = append(messages, fmt.Sprintf("%d: %s", caError.Code, caError.Message))
+		}
+		return fmt.Errorf("CA request %s failed: %s", path, strings.Join(messages, "; "))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// localCA is an in-process stand-in for a Fabric CA, used for tests and development. It issues
+// certificates from a self-signed root created at startup, with attributes embedded the same way
+// as Fabric CA. Peers do not trust its root, so it cannot be used against a real network.
+type localCA struct {
+	mu          sync.Mutex
+	key         *ecdsa.PrivateKey
+	certificate *x509.Certificate
+	serial      int64
+	identities  map[string]*localCAIdentity
+}
+
+type localCAIdentity struct {
+	secret   string
+	role     string
+	enrolled bool
+	revoked  bool
+}
+
+func newLocalCA() (*localCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "local-ca", Organization: []string{"ecosys"}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(certificateDER)
+	if err != nil {
+		return nil, err
+	}
+	return &localCA{key: key, certificate: certificate, serial: 1, identities: map[string]*localCAIdentity{}}, nil
+}
+
+func (l *localCA) Register(_ context.Context, registration caRegistration) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.identities[registration.EnrollmentID]; ok {
+		return "", fmt.Errorf("identity %s is already registered", registration.EnrollmentID)
+	}
+
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	l.identities[registration.EnrollmentID] = &localCAIdentity{
+		secret: base64.RawURLEncoding.EncodeToString(secret),
+		role:   registration.Role,
+	}
+	return l.identities[registration.EnrollmentID].secret, nil
+}
+
+func (l *localCA) Enroll(_ context.Context, enrollmentID string, secret string, csrPEM []byte) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	registered, ok := l.identities[enrollmentID]
+	if !ok || registered.secret != secret || registered.enrolled {
+		return nil, errors.New("authentication failure")
+	}
+	if registered.revoked {
+		return nil, errIdentityRevoked
+	}
+	certificatePEM, err := l.issue(enrollmentID, registered, csrPEM)
+	if err != nil {
+		return nil, err
+	}
+	registered.enrolled = true
+	return certificatePEM, nil
+}
+
+func (l *localCA) Reenroll(_ context.Context, current *walletIdentity, csrPEM []byte) ([]byte, error) {
+	certificate, err := l.verify(current)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	registered, ok := l.identities[certificate.Subject.CommonName]
+	if !ok || !registered.enrolled {
+		return nil, errors.New("authentication failure")
+	}
+	if registered.revoked {
+		return nil, errIdentityRevoked
+	}
+	return l.issue(certificate.Subject.CommonName, registered, csrPEM)
+}
+
+func (l *localCA) Revoke(_ context.Context, enrollmentID string, _ string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	registered, ok := l.identities[enrollmentID]
+	if !ok {
+		return fmt.Errorf("identity %s is not registered", enrollmentID)
+	}
+	registered.revoked = true
+	return nil
+}
+
+// verify checks that an identity was issued by this CA and proves possession of its private key.
+func (l *localCA) verify(id *walletIdentity) (*x509.Certificate, error) {
+	certificate, err := parseCertificatePEM([]byte(id.Credentials.Certificate))
+	if err != nil {
+		return nil, err
+	}
+	if err := certificate.CheckSignatureFrom(l.certificate); err != nil {
+		return nil, fmt.Errorf("certificate was not issued by this CA: %w", err)
+	}
+
+	// Sign a challenge with the private key of the identity, as token authentication does
+	sign, err := id.sign()
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte("reenroll " + certificate.SerialNumber.String()))
+	signature, err := sign(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := certificate.PublicKey.(*ecdsa.PublicKey)
+	if !ok || !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+		return nil, errors.New("authentication failure")
+	}
+	return certificate, nil
+}
+
+func (l *localCA) issue(enrollmentID string, registered *localCAIdentity, csrPEM []byte) ([]byte, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		return nil, errors.New("invalid certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %w", err)
+	}
+
+	attributes, err := json.Marshal(map[string]map[string]string{"attrs": {
+		"hf.EnrollmentID": enrollmentID,
+		"hf.Type":         "client",
+		"hf.Affiliation":  "",
+		roleAttribute:     registered.role,
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	l.serial++
+	serial := big.NewInt(l.serial)
+	template := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: enrollmentID, OrganizationalUnit: []string{"client"}},
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().AddDate(1, 0, 0),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: attributeExtensionOID, Value: attributes}},
+	}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, l.certificate, csr.PublicKey, l.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER}), nil
+}
+
+func parseCertificatePEM(certificatePEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil {
+		return nil, errors.New("invalid certificate PEM")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
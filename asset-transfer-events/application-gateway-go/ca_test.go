@@ -0,0 +1,263 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLocalCALifecycle(t *testing.T) {
+	identities := newTestIdentities(t)
+	ctx := context.Background()
+
+	enrolled, err := identities.Enroll(ctx, "bank", roleIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := newIdentityInfo("bank", enrolled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Role != roleIssuer || info.Subject != "CN=bank,OU=client" {
+		t.Errorf("identity = %+v", info)
+	}
+
+	if _, err := identities.Enroll(ctx, "bank", roleIssuer); err == nil {
+		t.Errorf("identity was registered twice")
+	}
+
+	reenrolled, err := identities.Reenroll(ctx, "bank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reenrolled.Credentials.Certificate == enrolled.Credentials.Certificate || reenrolled.Credentials.PrivateKey == enrolled.Credentials.PrivateKey {
+		t.Errorf("reenrollment did not replace the key pair and certificate")
+	}
+	if stored, _ := identities.wallet.Get("bank"); stored.Credentials.Certificate != reenrolled.Credentials.Certificate {
+		t.Errorf("wallet holds the old certificate")
+	}
+
+	if err := identities.Revoke(ctx, "bank", "keycompromise"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := identities.wallet.Get("bank"); !errors.Is(err, errIdentityNotFound) {
+		t.Errorf("revoked identity is still in the wallet: %v", err)
+	}
+	if _, err := identities.ca.Reenroll(ctx, reenrolled, nil); !errors.Is(err, errIdentityRevoked) {
+		t.Errorf("revoked identity was reenrolled: %v", err)
+	}
+}
+
+func TestRegisterEnrollsIdentity(t *testing.T) {
+	identities := newTestIdentities(t)
+	auth := newTestAuth(t)
+	router := newRouter(newEcosysService(&fakeContract{}, newMetrics(), serviceOptions{}), auth, identities, routerOptions{})
+	register := func(body string) (*httptest.ResponseRecorder, Response) {
+		request := httptest.NewRequest(http.MethodPost, "/v1/auth/register", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		return record(t, router, request)
+	}
+
+	recorder, response := register(`{"user_id": "adjuster1", "password": "correct horse", "role": "adjuster"}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	if result, _ := response.Result.(map[string]any); result["role"] != roleAdjuster {
+		t.Errorf("result = %v", result)
+	}
+	if _, err := identities.wallet.Get("adjuster1"); err != nil {
+		t.Errorf("identity was not stored in the wallet: %v", err)
+	}
+
+	// The CA already knows alice, so enrollment fails and the account is rolled back
+	if _, err := identities.ca.Register(context.Background(), caRegistration{EnrollmentID: "alice", Role: roleApplicant}); err != nil {
+		t.Fatal(err)
+	}
+	if recorder, _ := register(`{"user_id": "alice", "password": "correct horse"}`); recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	if _, ok := auth.users.get("alice"); ok {
+		t.Errorf("account was kept after enrollment failed")
+	}
+}
+
+func TestPrivilegedRolesAreGrantedByAdmins(t *testing.T) {
+	identities := newTestIdentities(t)
+	auth := newTestAuth(t)
+	router := newRouter(newEcosysService(&fakeContract{}, newMetrics(), serviceOptions{}), auth, identities, routerOptions{})
+	send := func(role string, target string, body string) (*httptest.ResponseRecorder, Response) {
+		request := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		if role != "" {
+			token, _, err := auth.issueToken("root", role)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		return record(t, router, request)
+	}
+
+	for _, role := range []string{roleTreasury, roleOracle, roleAdmin} {
+		body := `{"user_id": "mallory", "password": "correct horse", "role": "` + role + `"}`
+		if recorder, _ := send("", "/v1/auth/register", body); recorder.Code != http.StatusBadRequest {
+			t.Errorf("sign-up as %s status = %d", role, recorder.Code)
+		}
+	}
+	if _, ok := auth.users.get("mallory"); ok {
+		t.Errorf("account was created with a privileged role")
+	}
+
+	body := `{"user_id": "treasurer", "password": "correct horse", "role": "treasury"}`
+	if recorder, _ := send(roleTreasury, "/v1/admin/users", body); recorder.Code != http.StatusForbidden {
+		t.Errorf("account created by a treasurer status = %d", recorder.Code)
+	}
+	recorder, response := send(roleAdmin, "/v1/admin/users", body)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	if result, _ := response.Result.(map[string]any); result["role"] != roleTreasury {
+		t.Errorf("result = %v", result)
+	}
+	if account, ok := auth.users.get("treasurer"); !ok || account.Role != roleTreasury {
+		t.Errorf("account = %+v", account)
+	}
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	identities := newTestIdentities(t)
+	auth := newTestAuth(t)
+	config := AuthConfig{AdminUserID: "root", AdminPassword: "correct horse"}
+	for i := 0; i < 2; i++ {
+		if err := bootstrapAdmin(context.Background(), config, auth, identities); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if account, ok := auth.users.get("root"); !ok || account.Role != roleAdmin {
+		t.Errorf("account = %+v", account)
+	}
+	if _, err := identities.wallet.Get("root"); err != nil {
+		t.Errorf("identity was not stored in the wallet: %v", err)
+	}
+	if err := bootstrapAdmin(context.Background(), AuthConfig{AdminUserID: "other"}, auth, identities); err == nil {
+		t.Errorf("admin account created without a password")
+	}
+}
+
+// TestFabricCAClient runs register and enroll against a fake Fabric CA server, issuing certificates
+// from a local CA, and checks the authorization of each request.
+func TestFabricCAClient(t *testing.T) {
+	issuer, err := newLocalCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issuer.Register(context.Background(), caRegistration{EnrollmentID: "admin", Role: roleTreasury}); err != nil {
+		t.Fatal(err)
+	}
+	adminSecret := issuer.identities["admin"].secret
+
+	var registered []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var request struct {
+			ID                 string              `json:"id"`
+			Attrs              []fabricCAAttribute `json:"attrs"`
+			CertificateRequest string              `json:"certificate_request"`
+			CAName             string              `json:"caname"`
+		}
+		if err := json.Unmarshal(body, &request); err != nil || request.CAName != "ca-test" {
+			t.Errorf("bad request body %s", body)
+		}
+
+		var result any
+		switch r.URL.Path {
+		case "/api/v1/enroll":
+			user, secret, ok := r.BasicAuth()
+			if !ok {
+				t.Errorf("enroll without basic auth")
+			}
+			certificatePEM, err := issuer.Enroll(r.Context(), user, secret, []byte(request.CertificateRequest))
+			if err != nil {
+				w.Write([]byte(`{"success": false, "errors": [{"code": 20, "message": "Authentication failure"}]}`))
+				return
+			}
+			result = map[string]string{"Cert": base64.StdEncoding.EncodeToString(certificatePEM)}
+		case "/api/v1/register":
+			verifyToken(t, r, body)
+			registered = append(registered, request.ID+"="+request.Attrs[0].Value)
+			secret, err := issuer.Register(r.Context(), caRegistration{EnrollmentID: request.ID, Role: request.Attrs[0].Value})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = map[string]string{"secret": secret}
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "result": result})
+	}))
+	defer server.Close()
+
+	ca, err := newFabricCA(server.URL, "ca-test", "", "admin", adminSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities := newIdentityManager(ca, newTestWallet(t), testMSPID)
+	id, err := identities.Enroll(context.Background(), "bank", roleIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := newIdentityInfo("bank", id); info.Role != roleIssuer {
+		t.Errorf("identity = %+v", info)
+	}
+	if len(registered) != 1 || registered[0] != "bank=issuer" {
+		t.Errorf("registered = %v", registered)
+	}
+
+	wrongSecret, err := newFabricCA(server.URL, "ca-test", "", "admin", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrongSecret.Register(context.Background(), caRegistration{EnrollmentID: "other", Role: roleApplicant}); err == nil || !strings.Contains(err.Error(), "Authentication failure") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+// verifyToken checks a Fabric CA authorization token against the request it was created for.
+func verifyToken(t *testing.T, r *http.Request, body []byte) {
+	t.Helper()
+	b64Cert, b64Signature, ok := strings.Cut(r.Header.Get("Authorization"), ".")
+	if !ok {
+		t.Fatalf("malformed token %q", r.Header.Get("Authorization"))
+	}
+	certificatePEM, _ := base64.StdEncoding.DecodeString(b64Cert)
+	signature, _ := base64.StdEncoding.DecodeString(b64Signature)
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil {
+		t.Fatalf("token does not contain a certificate")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := r.Method + "." + base64.StdEncoding.EncodeToString([]byte(r.URL.RequestURI())) + "." +
+		base64.StdEncoding.EncodeToString(body) + "." + b64Cert
+	digest := sha256.Sum256([]byte(payload))
+	if !ecdsa.VerifyASN1(certificate.PublicKey.(*ecdsa.PublicKey), digest[:], signature) {
+		t.Errorf("token signature does not verify")
+	}
+}
@@ -0,0 +1,541 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the gateway. It is read from a YAML file (JSON files are valid
+// YAML too), then overridden by ECOSYS_* environment variables and finally by command line flags.
+// See config.example.yaml for a complete file.
+type Config struct {
+	Listen    string `yaml:"listen"`
+	Channel   string `yaml:"channel"`
+	Chaincode string `yaml:"chaincode"`
+	MSPID     string `yaml:"msp_id"`
+
+	// Identity is the gateway's own identity, used to listen for chaincode events.
+	Identity IdentityConfig `yaml:"identity"`
+	// Peers are the Gateway peers, of this or other organizations, in order of preference.
+	Peers []PeerConfig `yaml:"peers"`
+	// PeerSelection is how peers are chosen for Gateway connections: "priority" or "round_robin".
+	PeerSelection string             `yaml:"peer_selection"`
+	HealthCheck   HealthCheckConfig  `yaml:"health_check"`
+	Timeouts      TimeoutConfig      `yaml:"timeouts"`
+	Auth          AuthConfig         `yaml:"auth"`
+	Wallet        WalletConfig       `yaml:"wallet"`
+	CA            CAConfig           `yaml:"ca"`
+	Events        EventsConfig       `yaml:"events"`
+	Projection    ProjectionConfig   `yaml:"projection"`
+	Webhooks      WebhooksConfig     `yaml:"webhooks"`
+	Transactions  TransactionsConfig `yaml:"transactions"`
+	Idempotency   IdempotencyConfig  `yaml:"idempotency"`
+	Retry         RetryConfig        `yaml:"retry"`
+}
+
+// IdentityConfig locates an MSP signing certificate and private key. Each directory holds one file.
+type IdentityConfig struct {
+	CertDir string `yaml:"cert_dir"`
+	KeyDir  string `yaml:"key_dir"`
+}
+
+// PeerConfig is a Gateway peer endpoint. HostOverride is the TLS server name of the peer, if it
+// differs from the host name of the endpoint. Org only labels the peer in health reports.
+type PeerConfig struct {
+	Endpoint     string `yaml:"endpoint"`
+	HostOverride string `yaml:"host_override"`
+	TLSCertPath  string `yaml:"tls_cert_path"`
+	Org          string `yaml:"org"`
+}
+
+// HealthCheckConfig sets how often the connection to each peer is checked, and how long a peer
+// may take to connect before it is considered down.
+type HealthCheckConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// TimeoutConfig holds the client.With*Timeout values and the graceful shutdown timeout.
+type TimeoutConfig struct {
+	Evaluate     time.Duration `yaml:"evaluate"`
+	Endorse      time.Duration `yaml:"endorse"`
+	Submit       time.Duration `yaml:"submit"`
+	CommitStatus time.Duration `yaml:"commit_status"`
+	Shutdown     time.Duration `yaml:"shutdown"`
+}
+
+// AuthConfig configures user accounts and access tokens. The token secret should be set with
+// ECOSYS_AUTH_SECRET rather than in a file; a random secret is used if it is empty. If AdminUserID
+// is set, the admin account is created on start if it does not exist yet, with the password set
+// preferably with ECOSYS_AUTH_ADMIN_PASSWORD.
+type AuthConfig struct {
+	UserStorePath string        `yaml:"user_store_path"`
+	TokenTTL      time.Duration `yaml:"token_ttl"`
+	TokenSecret   string        `yaml:"token_secret"`
+	AdminUserID   string        `yaml:"admin_user_id"`
+	AdminPassword string        `yaml:"admin_password"`
+}
+
+// WalletConfig configures the wallet of user identities. The wallet is encrypted if a passphrase
+// is set, preferably with ECOSYS_WALLET_PASSPHRASE.
+type WalletConfig struct {
+	Path       string `yaml:"path"`
+	Passphrase string `yaml:"passphrase"`
+}
+
+// CAConfig configures the Fabric CA used to enroll users. A local development CA is used if URL is empty.
+type CAConfig struct {
+	URL             string `yaml:"url"`
+	Name            string `yaml:"name"`
+	TLSCertPath     string `yaml:"tls_cert_path"`
+	RegistrarID     string `yaml:"registrar_id"`
+	RegistrarSecret string `yaml:"registrar_secret"`
+}
+
+// EventsConfig configures the chaincode event consumer. Progress is checkpointed to CheckpointPath;
+// StartBlock is where listening starts while the checkpoint is empty, or the next committed block
+// if it is not set.
+type EventsConfig struct {
+	CheckpointPath string  `yaml:"checkpoint_path"`
+	StartBlock     *uint64 `yaml:"start_block"`
+}
+
+// ProjectionConfig configures the local read model projected from chaincode events. With Rebuild,
+// the projection is deleted at startup and projected again from block 0.
+type ProjectionConfig struct {
+	Path    string `yaml:"path"`
+	Rebuild bool   `yaml:"rebuild"`
+}
+
+// WebhooksConfig configures webhook deliveries. A failed delivery is retried after RetryDelay,
+// doubled on every attempt up to MaxRetryDelay, and moved to the dead letters after MaxAttempts.
+type WebhooksConfig struct {
+	Path          string        `yaml:"path"`
+	Timeout       time.Duration `yaml:"timeout"`
+	MaxAttempts   int           `yaml:"max_attempts"`
+	RetryDelay    time.Duration `yaml:"retry_delay"`
+	MaxRetryDelay time.Duration `yaml:"max_retry_delay"`
+}
+
+// TransactionsConfig configures the tracking of submitted transactions. A transaction whose commit
+// status is still not found on the ledger after Expiry is given up on as unknown.
+type TransactionsConfig struct {
+	Path   string        `yaml:"path"`
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+// IdempotencyConfig configures idempotent submissions. The chaincode keeps the idempotency key of
+// a transaction, and returns its outcome to retries with the same key, for Retention.
+type IdempotencyConfig struct {
+	Retention time.Duration `yaml:"retention"`
+}
+
+// RetryConfig configures the retries of submissions failing with a read conflict or an aborted
+// endorsement. A submission is endorsed again after Delay, doubled on every attempt up to MaxDelay
+// and randomized, up to MaxAttempts in total. Budget is the fraction of submissions that may be
+// retried over time, beyond a burst of a few retries.
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"max_attempts"`
+	Delay       time.Duration `yaml:"delay"`
+	MaxDelay    time.Duration `yaml:"max_delay"`
+	Budget      float64       `yaml:"budget"`
+}
+
+// defaultConfig connects to the Org1 peer of the Fabric test network.
+func defaultConfig() *Config {
+	const cryptoPath = "../../test-network/organizations/peerOrganizations/org1.example.com"
+	return &Config{
+		Listen:    ":8000",
+		Channel:   "mychannel",
+		Chaincode: "events",
+		MSPID:     "Org1MSP",
+		Identity: IdentityConfig{
+			CertDir: cryptoPath + "/users/User1@org1.example.com/msp/signcerts",
+			KeyDir:  cryptoPath + "/users/User1@org1.example.com/msp/keystore",
+		},
+		Peers: []PeerConfig{{
+			Endpoint:     "dns:///localhost:7051",
+			HostOverride: "peer0.org1.example.com",
+			TLSCertPath:  cryptoPath + "/peers/peer0.org1.example.com/tls/ca.crt",
+			Org:          "Org1MSP",
+		}},
+		PeerSelection: selectPriority,
+		HealthCheck: HealthCheckConfig{
+			Interval: 10 * time.Second,
+			Timeout:  3 * time.Second,
+		},
+		Timeouts: TimeoutConfig{
+			Evaluate:     5 * time.Second,
+			Endorse:      15 * time.Second,
+			Submit:       5 * time.Second,
+			CommitStatus: 1 * time.Minute,
+			Shutdown:     1*time.Minute + 10*time.Second,
+		},
+		Auth: AuthConfig{
+			UserStorePath: "users.json",
+			TokenTTL:      12 * time.Hour,
+		},
+		Wallet: WalletConfig{
+			Path: "wallet",
+		},
+		CA: CAConfig{
+			Name:        "ca-org1",
+			TLSCertPath: "../../test-network/organizations/fabric-ca/org1/tls-cert.pem",
+			RegistrarID: "admin",
+		},
+		Events: EventsConfig{
+			CheckpointPath: "events-checkpoint.json",
+		},
+		Projection: ProjectionConfig{
+			Path: "projection.db",
+		},
+		Webhooks: WebhooksConfig{
+			Path:          "webhooks.db",
+			Timeout:       10 * time.Second,
+			MaxAttempts:   8,
+			RetryDelay:    10 * time.Second,
+			MaxRetryDelay: 1 * time.Hour,
+		},
+		Transactions: TransactionsConfig{
+			Path:   "transactions.db",
+			Expiry: 10 * time.Minute,
+		},
+		Idempotency: IdempotencyConfig{
+			Retention: 24 * time.Hour,
+		},
+		Retry: RetryConfig{
+			MaxAttempts: 3,
+			Delay:       100 * time.Millisecond,
+			MaxDelay:    2 * time.Second,
+			Budget:      0.2,
+		},
+	}
+}
+
+// loadConfig builds the configuration from the defaults, the file named by -config or
+// ECOSYS_CONFIG, the environment and the command line flags, then validates it.
+func loadConfig(args []string, getenv func(string) string) (*Config, error) {
+	flags := flag.NewFlagSet("assetTransfer", flag.ContinueOnError)
+	configPath := flags.String("config", getenv("ECOSYS_CONFIG"), "configuration file (YAML or JSON)")
+	listen := flags.String("listen", "", "HTTP listen address")
+	channel := flags.String("channel", "", "channel name")
+	chaincode := flags.String("chaincode", "", "chaincode name")
+	mspID := flags.String("msp-id", "", "MSP ID of the organization")
+	rebuildProjection := flags.Bool("rebuild-projection", false, "rebuild the projection from block 0")
+	var peers stringList
+	flags.Var(&peers, "peer", "peer endpoint as endpoint[,host_override[,tls_cert_path[,org]]]; repeat for several peers")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	config := defaultConfig()
+	if *configPath != "" {
+		if err := config.readFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.applyEnv(getenv); err != nil {
+		return nil, err
+	}
+
+	setIfNotEmpty(&config.Listen, *listen)
+	setIfNotEmpty(&config.Channel, *channel)
+	setIfNotEmpty(&config.Chaincode, *chaincode)
+	setIfNotEmpty(&config.MSPID, *mspID)
+	if len(peers) > 0 {
+		config.Peers = parsePeers(peers)
+	}
+	if *rebuildProjection {
+		config.Projection.Rebuild = true
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// readFile reads a configuration file over the defaults. Unknown keys are rejected, so that a
+// misspelt setting is not silently ignored.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv applies the ECOSYS_* environment variables. ECOSYS_PEERS is a semicolon separated list
+// of peers in the format of the -peer flag.
+func (c *Config) applyEnv(getenv func(string) string) error {
+	values := map[string]*string{
+		"ECOSYS_LISTEN":              &c.Listen,
+		"ECOSYS_CHANNEL":             &c.Channel,
+		"ECOSYS_CHAINCODE":           &c.Chaincode,
+		"ECOSYS_MSP_ID":              &c.MSPID,
+		"ECOSYS_PEER_SELECTION":      &c.PeerSelection,
+		"ECOSYS_IDENTITY_CERT_DIR":   &c.Identity.CertDir,
+		"ECOSYS_IDENTITY_KEY_DIR":    &c.Identity.KeyDir,
+		"ECOSYS_USER_STORE_PATH":     &c.Auth.UserStorePath,
+		"ECOSYS_AUTH_SECRET":         &c.Auth.TokenSecret,
+		"ECOSYS_AUTH_ADMIN_USER":     &c.Auth.AdminUserID,
+		"ECOSYS_AUTH_ADMIN_PASSWORD": &c.Auth.AdminPassword,
+		"ECOSYS_WALLET_PATH":         &c.Wallet.Path,
+		"ECOSYS_WALLET_PASSPHRASE":   &c.Wallet.Passphrase,
+		"ECOSYS_CA_URL":              &c.CA.URL,
+		"ECOSYS_CA_NAME":             &c.CA.Name,
+		"ECOSYS_CA_TLS_CERT":         &c.CA.TLSCertPath,
+		"ECOSYS_CA_REGISTRAR_ID":     &c.CA.RegistrarID,
+		"ECOSYS_CA_REGISTRAR_SECRET": &c.CA.RegistrarSecret,
+		"ECOSYS_EVENTS_CHECKPOINT":   &c.Events.CheckpointPath,
+		"ECOSYS_PROJECTION_PATH":     &c.Projection.Path,
+		"ECOSYS_WEBHOOKS_PATH":       &c.Webhooks.Path,
+		"ECOSYS_TRANSACTIONS_PATH":   &c.Transactions.Path,
+	}
+	for name, field := range values {
+		setIfNotEmpty(field, getenv(name))
+	}
+
+	durations := map[string]*time.Duration{
+		"ECOSYS_TIMEOUT_EVALUATE":      &c.Timeouts.Evaluate,
+		"ECOSYS_TIMEOUT_ENDORSE":       &c.Timeouts.Endorse,
+		"ECOSYS_TIMEOUT_SUBMIT":        &c.Timeouts.Submit,
+		"ECOSYS_TIMEOUT_COMMIT_STATUS": &c.Timeouts.CommitStatus,
+		"ECOSYS_TIMEOUT_SHUTDOWN":      &c.Timeouts.Shutdown,
+		"ECOSYS_TOKEN_TTL":             &c.Auth.TokenTTL,
+		"ECOSYS_HEALTH_CHECK_INTERVAL": &c.HealthCheck.Interval,
+		"ECOSYS_HEALTH_CHECK_TIMEOUT":  &c.HealthCheck.Timeout,
+		"ECOSYS_WEBHOOKS_TIMEOUT":      &c.Webhooks.Timeout,
+		"ECOSYS_IDEMPOTENCY_RETENTION": &c.Idempotency.Retention,
+	}
+	for name, field := range durations {
+		value := getenv(name)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		*field = duration
+	}
+
+	if value := getenv("ECOSYS_EVENTS_START_BLOCK"); value != "" {
+		startBlock, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid ECOSYS_EVENTS_START_BLOCK: %w", err)
+		}
+		c.Events.StartBlock = &startBlock
+	}
+	if value := getenv("ECOSYS_RETRY_MAX_ATTEMPTS"); value != "" {
+		maxAttempts, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid ECOSYS_RETRY_MAX_ATTEMPTS: %w", err)
+		}
+		c.Retry.MaxAttempts = maxAttempts
+	}
+
+	if value := getenv("ECOSYS_PROJECTION_REBUILD"); value != "" {
+		rebuild, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid ECOSYS_PROJECTION_REBUILD: %w", err)
+		}
+		c.Projection.Rebuild = rebuild
+	}
+
+	if value := getenv("ECOSYS_PEERS"); value != "" {
+		c.Peers = parsePeers(splitNonEmpty(value, ";"))
+	}
+	return nil
+}
+
+// validate reports every invalid setting at once, naming the setting and the problem.
+func (c *Config) validate() error {
+	var problems []string
+	problem := func(setting string, format string, args ...any) {
+		problems = append(problems, setting+": "+fmt.Sprintf(format, args...))
+	}
+
+	if _, port, err := net.SplitHostPort(c.Listen); err != nil {
+		problem("listen", "%v", err)
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		problem("listen", "invalid port %q", port)
+	}
+	for setting, value := range map[string]string{"channel": c.Channel, "chaincode": c.Chaincode, "msp_id": c.MSPID} {
+		if value == "" {
+			problem(setting, "must be set")
+		}
+	}
+
+	checkDir(problem, "identity.cert_dir", c.Identity.CertDir)
+	checkDir(problem, "identity.key_dir", c.Identity.KeyDir)
+
+	if len(c.Peers) == 0 {
+		problem("peers", "at least one peer must be configured")
+	}
+	for i, peer := range c.Peers {
+		setting := fmt.Sprintf("peers[%d]", i)
+		if peer.Endpoint == "" {
+			problem(setting+".endpoint", "must be set")
+		}
+		if peer.TLSCertPath == "" {
+			problem(setting+".tls_cert_path", "must be set")
+		} else if _, err := loadCertificate(peer.TLSCertPath); err != nil {
+			problem(setting+".tls_cert_path", "%v", err)
+		}
+	}
+	if c.PeerSelection != selectPriority && c.PeerSelection != selectRoundRobin {
+		problem("peer_selection", "must be %q or %q", selectPriority, selectRoundRobin)
+	}
+
+	for setting, timeout := range map[string]time.Duration{
+		"timeouts.evaluate":        c.Timeouts.Evaluate,
+		"timeouts.endorse":         c.Timeouts.Endorse,
+		"timeouts.submit":          c.Timeouts.Submit,
+		"timeouts.commit_status":   c.Timeouts.CommitStatus,
+		"timeouts.shutdown":        c.Timeouts.Shutdown,
+		"auth.token_ttl":           c.Auth.TokenTTL,
+		"health_check.interval":    c.HealthCheck.Interval,
+		"health_check.timeout":     c.HealthCheck.Timeout,
+		"webhooks.timeout":         c.Webhooks.Timeout,
+		"webhooks.retry_delay":     c.Webhooks.RetryDelay,
+		"webhooks.max_retry_delay": c.Webhooks.MaxRetryDelay,
+		"transactions.expiry":      c.Transactions.Expiry,
+		"idempotency.retention":    c.Idempotency.Retention,
+		"retry.delay":              c.Retry.Delay,
+		"retry.max_delay":          c.Retry.MaxDelay,
+	} {
+		if timeout <= 0 {
+			problem(setting, "must be a positive duration, such as 5s")
+		}
+	}
+	if c.Timeouts.Shutdown > 0 && c.Timeouts.Shutdown < c.Timeouts.CommitStatus {
+		problem("timeouts.shutdown", "must not be shorter than timeouts.commit_status, or in-flight transactions are cut off")
+	}
+
+	if c.Auth.UserStorePath == "" {
+		problem("auth.user_store_path", "must be set")
+	}
+	if c.Wallet.Path == "" {
+		problem("wallet.path", "must be set")
+	}
+	if c.Events.CheckpointPath == "" {
+		problem("events.checkpoint_path", "must be set")
+	}
+	if c.Projection.Path == "" {
+		problem("projection.path", "must be set")
+	}
+	if c.Webhooks.Path == "" {
+		problem("webhooks.path", "must be set")
+	}
+	if c.Webhooks.MaxAttempts <= 0 {
+		problem("webhooks.max_attempts", "must be positive")
+	}
+	if c.Retry.MaxAttempts <= 0 {
+		problem("retry.max_attempts", "must be positive; 1 disables retries")
+	}
+	if c.Retry.Budget < 0 || c.Retry.Budget > 1 {
+		problem("retry.budget", "must be between 0 and 1")
+	}
+	if c.Transactions.Path == "" {
+		problem("transactions.path", "must be set")
+	}
+	if c.CA.URL != "" {
+		if !strings.HasPrefix(c.CA.URL, "https://") && !strings.HasPrefix(c.CA.URL, "http://") {
+			problem("ca.url", "must be an http:// or https:// URL")
+		}
+		if c.CA.RegistrarID == "" || c.CA.RegistrarSecret == "" {
+			problem("ca.registrar_id", "registrar ID and secret must be set to register users")
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+}
+
+func checkDir(problem func(string, string, ...any), setting string, dir string) {
+	if dir == "" {
+		problem(setting, "must be set")
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		problem(setting, "%v", err)
+		return
+	}
+	if len(entries) == 0 {
+		problem(setting, "directory %s is empty", filepath.Clean(dir))
+	}
+}
+
+// stringList is a flag that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parsePeers parses peers in the format endpoint[,host_override[,tls_cert_path[,org]]].
+func parsePeers(values []string) []PeerConfig {
+	peers := make([]PeerConfig, 0, len(values))
+	for _, value := range values {
+		fields := strings.Split(value, ",")
+		peer := PeerConfig{Endpoint: strings.TrimSpace(fields[0])}
+		if len(fields) > 1 {
+			peer.HostOverride = strings.TrimSpace(fields[1])
+		}
+		if len(fields) > 2 {
+			peer.TLSCertPath = strings.TrimSpace(fields[2])
+		}
+		if len(fields) > 3 {
+			peer.Org = strings.TrimSpace(fields[3])
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func splitNonEmpty(value string, separator string) []string {
+	var parts []string
+	for _, part := range strings.Split(value, separator) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func setIfNotEmpty(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
@@ -0,0 +1,174 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCrypto writes a gateway identity and a peer TLS certificate, returning their paths.
+func writeTestCrypto(t *testing.T) (string, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	certificatePEM, privateKeyPEM := newTestCredentials(t, "User1")
+	certDir := filepath.Join(dir, "signcerts")
+	keyDir := filepath.Join(dir, "keystore")
+	tlsCertPath := filepath.Join(dir, "ca.crt")
+	for path, data := range map[string][]byte{
+		filepath.Join(certDir, "cert.pem"): certificatePEM,
+		filepath.Join(keyDir, "key_sk"):    privateKeyPEM,
+		tlsCertPath:                        certificatePEM,
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certDir, keyDir, tlsCertPath
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	certDir, keyDir, tlsCertPath := writeTestCrypto(t)
+	configPath := writeFile(t, "gateway.yaml", `
+listen: ":9000"
+channel: staging-channel
+chaincode: ecosys
+identity:
+  cert_dir: `+certDir+`
+  key_dir: `+keyDir+`
+peers:
+  - endpoint: dns:///peer0.staging:7051
+    host_override: peer0.staging
+    tls_cert_path: `+tlsCertPath+`
+  - endpoint: dns:///peer1.staging:7051
+    tls_cert_path: `+tlsCertPath+`
+timeouts:
+  endorse: 30s
+`)
+
+	config, err := loadConfig([]string{"-config", configPath, "-listen", ":9100"}, env(map[string]string{
+		"ECOSYS_CHANNEL":          "prod-channel",
+		"ECOSYS_LISTEN":           ":9050",
+		"ECOSYS_TIMEOUT_EVALUATE": "2s",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Listen != ":9100" {
+		t.Errorf("listen = %q, flags should override the environment", config.Listen)
+	}
+	if config.Channel != "prod-channel" {
+		t.Errorf("channel = %q, the environment should override the file", config.Channel)
+	}
+	if config.Chaincode != "ecosys" || config.MSPID != "Org1MSP" {
+		t.Errorf("chaincode = %q, msp_id = %q", config.Chaincode, config.MSPID)
+	}
+	if config.Timeouts.Endorse != 30*time.Second || config.Timeouts.Evaluate != 2*time.Second || config.Timeouts.Submit != 5*time.Second {
+		t.Errorf("timeouts = %+v", config.Timeouts)
+	}
+	if len(config.Peers) != 2 || config.Peers[0].HostOverride != "peer0.staging" || config.Peers[1].Endpoint != "dns:///peer1.staging:7051" {
+		t.Errorf("peers = %+v", config.Peers)
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	certDir, keyDir, tlsCertPath := writeTestCrypto(t)
+	configPath := writeFile(t, "gateway.json", `{
+		"chaincode": "ecosys",
+		"identity": {"cert_dir": "`+certDir+`", "key_dir": "`+keyDir+`"},
+		"peers": [{"endpoint": "dns:///localhost:7051", "tls_cert_path": "`+tlsCertPath+`"}],
+		"timeouts": {"commit_status": "2m", "shutdown": "3m"}
+	}`)
+
+	config, err := loadConfig([]string{"-config", configPath}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Chaincode != "ecosys" || config.Timeouts.CommitStatus != 2*time.Minute {
+		t.Errorf("config = %+v", config)
+	}
+}
+
+func TestLoadConfigPeersFromEnvironment(t *testing.T) {
+	certDir, keyDir, tlsCertPath := writeTestCrypto(t)
+	config, err := loadConfig(nil, env(map[string]string{
+		"ECOSYS_IDENTITY_CERT_DIR": certDir,
+		"ECOSYS_IDENTITY_KEY_DIR":  keyDir,
+		"ECOSYS_PEERS":             "dns:///a:7051,a," + tlsCertPath + "; dns:///b:7051,b," + tlsCertPath,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PeerConfig{
+		{Endpoint: "dns:///a:7051", HostOverride: "a", TLSCertPath: tlsCertPath},
+		{Endpoint: "dns:///b:7051", HostOverride: "b", TLSCertPath: tlsCertPath},
+	}
+	if len(config.Peers) != 2 || config.Peers[0] != want[0] || config.Peers[1] != want[1] {
+		t.Errorf("peers = %+v, want %+v", config.Peers, want)
+	}
+}
+
+func TestLoadConfigRejectsUnknownSettings(t *testing.T) {
+	configPath := writeFile(t, "gateway.yaml", "chaincode: ecosys\ntimeout:\n  endorse: 30s\n")
+	_, err := loadConfig([]string{"-config", configPath}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestLoadConfigReportsAllProblems(t *testing.T) {
+	configPath := writeFile(t, "gateway.yaml", `
+listen: "8000"
+channel: ""
+identity:
+  cert_dir: /nonexistent/signcerts
+peers:
+  - endpoint: dns:///localhost:7051
+peer_selection: random
+timeouts:
+  submit: 0s
+ca:
+  url: localhost:7054
+`)
+	_, err := loadConfig([]string{"-config", configPath}, env(nil))
+	if err == nil {
+		t.Fatal("invalid configuration was accepted")
+	}
+	for _, setting := range []string{
+		"listen:",
+		"channel: must be set",
+		"identity.cert_dir:",
+		"peers[0].tls_cert_path: must be set",
+		"peer_selection: must be",
+		"timeouts.submit: must be a positive duration",
+		"ca.url: must be an http:// or https:// URL",
+	} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("error does not report %q:\n%v", setting, err)
+		}
+	}
+}
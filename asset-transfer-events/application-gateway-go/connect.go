@@ -7,108 +7,305 @@ SPDX-License-Identifier: Apache-2.0
 package main
 
 import (
+	"context"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path"
+	"sync"
 
+	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"github.com/hyperledger/fabric-protos-go-apiv2/common"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
-)
-
-const (
-	mspID        = "Org1MSP"
-	cryptoPath   = "../../test-network/organizations/peerOrganizations/org1.example.com"
-	certPath     = cryptoPath + "/users/User1@org1.example.com/msp/signcerts"
-	keyPath      = cryptoPath + "/users/User1@org1.example.com/msp/keystore"
-	tlsCertPath  = cryptoPath + "/peers/peer0.org1.example.com/tls/ca.crt"
-	peerEndpoint = "dns:///localhost:7051"
-	gatewayPeer  = "peer0.org1.example.com"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 // newGrpcConnection creates a gRPC connection to the Gateway server.
-func newGrpcConnection() *grpc.ClientConn {
-	certificatePEM, err := os.ReadFile(tlsCertPath)
+func newGrpcConnection(peer PeerConfig) (*grpc.ClientConn, error) {
+	certificate, err := loadCertificate(peer.TLSCertPath)
 	if err != nil {
-		panic(fmt.Errorf("failed to read TLS certifcate file: %w", err))
+		return nil, err
 	}
 
-	certificate, err := identity.CertificateFromPEM(certificatePEM)
+	certPool := x509.NewCertPool()
+	certPool.AddCert(certificate)
+	transportCredentials := credentials.NewClientTLSFromCert(certPool, peer.HostOverride)
+
+	connection, err := grpc.NewClient(peer.Endpoint, grpc.WithTransportCredentials(transportCredentials))
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to create gRPC connection to %s: %w", peer.Endpoint, err)
 	}
 
-	certPool := x509.NewCertPool()
-	certPool.AddCert(certificate)
-	transportCredentials := credentials.NewClientTLSFromCert(certPool, gatewayPeer)
+	return connection, nil
+}
 
-	connection, err := grpc.NewClient(peerEndpoint, grpc.WithTransportCredentials(transportCredentials))
+// loadGatewayIdentity loads the gateway's own identity from the MSP directories in its configuration.
+func loadGatewayIdentity(mspID string, config IdentityConfig) (*walletIdentity, error) {
+	certificatePEM, err := readFirstFile(config.CertDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate file: %w", err)
+	}
+	privateKeyPEM, err := readFirstFile(config.KeyDir)
 	if err != nil {
-		panic(fmt.Errorf("failed to create gRPC connection: %w", err))
+		return nil, fmt.Errorf("failed to read private key file: %w", err)
 	}
+	return newWalletIdentity(mspID, certificatePEM, privateKeyPEM)
+}
 
-	return connection
+func loadCertificate(filename string) (*x509.Certificate, error) {
+	certificatePEM, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate file: %w", err)
+	}
+	return identity.CertificateFromPEM(certificatePEM)
 }
 
-// newIdentity creates a client identity for this Gateway connection using an X.509 certificate.
-func newIdentity() *identity.X509Identity {
-	certificatePEM, err := readFirstFile(certPath)
+func readFirstFile(dirPath string) ([]byte, error) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	fileNames, err := dir.Readdirnames(1)
 	if err != nil {
-		panic(fmt.Errorf("failed to read certificate file: %w", err))
+		return nil, err
+	}
+
+	return os.ReadFile(path.Join(dirPath, fileNames[0]))
+}
+
+// gatewayOptions returns the options used for every Gateway connection through a peer connection.
+func gatewayOptions(sign identity.Sign, clientConnection *grpc.ClientConn, timeouts TimeoutConfig) []client.ConnectOption {
+	return []client.ConnectOption{
+		client.WithSign(sign),
+		client.WithClientConnection(clientConnection),
+		client.WithEvaluateTimeout(timeouts.Evaluate),
+		client.WithEndorseTimeout(timeouts.Endorse),
+		client.WithSubmitTimeout(timeouts.Submit),
+		client.WithCommitStatusTimeout(timeouts.CommitStatus),
 	}
+}
+
+// gatewayPool connects a Gateway for each user identity in the wallet, so that transactions are
+// signed by the user on whose behalf they are submitted. Gateways share the peer connections of
+// the peer pool, and are moved to another peer when the peer they use is no longer selected.
+type gatewayPool struct {
+	peers           *peerPool
+	wallet          wallet
+	config          *Config
+	gatewayIdentity *walletIdentity
 
-	certificate, err := identity.CertificateFromPEM(certificatePEM)
+	mu       sync.Mutex
+	gateways map[string]*pooledGateway
+	own      *pooledGateway
+}
+
+type pooledGateway struct {
+	certificate string
+	peer        *peerConnection
+	gateway     *client.Gateway
+}
+
+func newGatewayPool(peers *peerPool, wallet wallet, config *Config, gatewayIdentity *walletIdentity) *gatewayPool {
+	return &gatewayPool{
+		peers:           peers,
+		wallet:          wallet,
+		config:          config,
+		gatewayIdentity: gatewayIdentity,
+		gateways:        map[string]*pooledGateway{},
+	}
+}
+
+// Contract returns the chaincode contract signing as userID. The Gateway is reconnected when the
+// identity of the user has been replaced in the wallet since it was connected, or when its peer
+// is no longer selected.
+func (p *gatewayPool) Contract(userID string) (chaincodeContract, error) {
+	return p.contract(userID)
+}
+
+func (p *gatewayPool) contract(userID string) (*pooledContract, error) {
+	id, err := p.wallet.Get(userID)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	id, err := identity.NewX509Identity(mspID, certificate)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pooled, err := p.reconnect(userID, p.gateways[userID], id)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to connect gateway for %s: %w", userID, err)
 	}
+	p.gateways[userID] = pooled
 
-	return id
+	return &pooledContract{
+		pool:     p,
+		userID:   userID,
+		peer:     pooled.peer,
+		contract: &fabricContract{contract: pooled.gateway.GetNetwork(p.config.Channel).GetContract(p.config.Chaincode)},
+	}, nil
 }
 
-func loadCertificate(filename string) (*x509.Certificate, error) {
-	certificatePEM, err := os.ReadFile(filename)
+// Network returns the channel through the gateway's own identity, used to listen for events.
+func (p *gatewayPool) Network() (*client.Network, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pooled, err := p.reconnect("the gateway", p.own, p.gatewayIdentity)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read certificate file: %w", err)
+		return nil, fmt.Errorf("failed to connect gateway: %w", err)
 	}
-	return identity.CertificateFromPEM(certificatePEM)
+	p.own = pooled
+	return pooled.gateway.GetNetwork(p.config.Channel), nil
+}
+
+// Status returns the connectivity of every peer.
+func (p *gatewayPool) Status() []PeerStatus {
+	return p.peers.Status()
 }
 
-// newSign creates a function that generates a digital signature from a message digest using a private key.
-func newSign() identity.Sign {
-	privateKeyPEM, err := readFirstFile(keyPath)
+// Ready checks that a peer is reachable and that the channel can be queried through it, using the
+// cheap GetChainInfo query of the qscc system chaincode. It returns the height of the ledger.
+func (p *gatewayPool) Ready(ctx context.Context) (uint64, error) {
+	if !p.peers.healthy() {
+		return 0, errors.New("no peer is reachable")
+	}
+	network, err := p.Network()
 	if err != nil {
-		panic(fmt.Errorf("failed to read private key file: %w", err))
+		return 0, err
 	}
 
-	privateKey, err := identity.PrivateKeyFromPEM(privateKeyPEM)
+	result, err := network.GetContract("qscc").EvaluateWithContext(ctx, "GetChainInfo", client.WithArguments(p.config.Channel))
 	if err != nil {
-		panic(err)
+		return 0, fmt.Errorf("failed to query channel %s: %w", p.config.Channel, err)
+	}
+	var info common.BlockchainInfo
+	if err := proto.Unmarshal(result, &info); err != nil {
+		return 0, fmt.Errorf("failed to parse chain info: %w", err)
 	}
+	return info.GetHeight(), nil
+}
 
-	sign, err := identity.NewPrivateKeySign(privateKey)
+// TransactionStatus looks up the commit status of a transaction on the ledger, with the
+// GetTransactionByID and GetBlockByTxID queries of the qscc system chaincode. It fails while the
+// transaction is not committed.
+func (p *gatewayPool) TransactionStatus(ctx context.Context, transactionID string) (*client.Status, error) {
+	network, err := p.Network()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	qscc := network.GetContract("qscc")
 
-	return sign
+	result, err := qscc.EvaluateWithContext(ctx, "GetTransactionByID", client.WithArguments(p.config.Channel, transactionID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query transaction %s: %w", transactionID, err)
+	}
+	var processed peer.ProcessedTransaction
+	if err := proto.Unmarshal(result, &processed); err != nil {
+		return nil, fmt.Errorf("failed to parse transaction %s: %w", transactionID, err)
+	}
+
+	result, err = qscc.EvaluateWithContext(ctx, "GetBlockByTxID", client.WithArguments(p.config.Channel, transactionID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query block of transaction %s: %w", transactionID, err)
+	}
+	var block common.Block
+	if err := proto.Unmarshal(result, &block); err != nil {
+		return nil, fmt.Errorf("failed to parse block of transaction %s: %w", transactionID, err)
+	}
+
+	code := peer.TxValidationCode(processed.GetValidationCode())
+	return &client.Status{
+		Code:          code,
+		Successful:    code == peer.TxValidationCode_VALID,
+		TransactionID: transactionID,
+		BlockNumber:   block.GetHeader().GetNumber(),
+	}, nil
 }
 
-func readFirstFile(dirPath string) ([]byte, error) {
-	dir, err := os.Open(dirPath)
+// reconnect returns pooled if it can still be used for id, or otherwise connects a new Gateway
+// through the selected peer and closes pooled. The caller must hold the lock.
+func (p *gatewayPool) reconnect(label string, pooled *pooledGateway, id *walletIdentity) (*pooledGateway, error) {
+	if pooled != nil && pooled.certificate == id.Credentials.Certificate && p.peers.keep(pooled.peer) {
+		return pooled, nil
+	}
+
+	peer := p.peers.pick()
+	gateway, err := connectIdentity(id, peer.connection, p.config.Timeouts)
 	if err != nil {
 		return nil, err
 	}
+	if pooled != nil {
+		pooled.gateway.Close()
+		if pooled.peer != peer {
+			log.Printf("Moved Gateway of %s from peer %s to %s", label, pooled.peer.name(), peer.name())
+		}
+	}
+	return &pooledGateway{certificate: id.Credentials.Certificate, peer: peer, gateway: gateway}, nil
+}
+
+// Close closes every Gateway. The peer connections are closed by the peer pool.
+func (p *gatewayPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for userID, pooled := range p.gateways {
+		pooled.gateway.Close()
+		delete(p.gateways, userID)
+	}
+	if p.own != nil {
+		p.own.gateway.Close()
+		p.own = nil
+	}
+}
+
+// pooledContract is the contract of a pooled Gateway. A peer that cannot be reached is reported
+// to the peer pool. Evaluations have no side effects, so they are retried once through another
+// peer; submissions are not, since the transaction may already have been endorsed.
+type pooledContract struct {
+	pool     *gatewayPool
+	userID   string
+	peer     *peerConnection
+	contract *fabricContract
+}
+
+func (c *pooledContract) Evaluate(ctx context.Context, function string, args ...string) ([]byte, error) {
+	result, err := c.contract.Evaluate(ctx, function, args...)
+	if status.Code(err) != codes.Unavailable {
+		return result, err
+	}
+
+	c.pool.peers.reportFailure(c.peer, err)
+	retry, retryErr := c.pool.contract(c.userID)
+	if retryErr != nil || retry.peer == c.peer {
+		return nil, err
+	}
+	return retry.contract.Evaluate(ctx, function, args...)
+}
 
-	fileNames, err := dir.Readdirnames(1)
+func (c *pooledContract) SubmitAsync(ctx context.Context, function string, transient map[string][]byte, args ...string) ([]byte, submittedTransaction, error) {
+	result, submitted, err := c.contract.SubmitAsync(ctx, function, transient, args...)
 	if err != nil {
-		return nil, err
+		c.pool.peers.reportFailure(c.peer, err)
 	}
+	return result, submitted, err
+}
 
-	return os.ReadFile(path.Join(dirPath, fileNames[0]))
+func connectIdentity(id *walletIdentity, clientConnection *grpc.ClientConn, timeouts TimeoutConfig) (*client.Gateway, error) {
+	x509Identity, err := id.x509Identity()
+	if err != nil {
+		return nil, err
+	}
+	sign, err := id.sign()
+	if err != nil {
+		return nil, err
+	}
+	return client.Connect(x509Identity, gatewayOptions(sign, clientConnection, timeouts)...)
 }
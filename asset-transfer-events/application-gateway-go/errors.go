@@ -0,0 +1,270 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error codes returned by the chaincode. See chaincode-go/chaincode/errors.go.
+const (
+	errCodeNotFound          = "NOT_FOUND"
+	errCodeAlreadyExists     = "ALREADY_EXISTS"
+	errCodeInvalidArgument   = "INVALID_ARGUMENT"
+	errCodeInvalidState      = "INVALID_STATE"
+	errCodeInsufficientFunds = "INSUFFICIENT_FUNDS"
+	errCodeConditionNotMet   = "CONDITION_NOT_MET"
+	errCodeForbidden         = "FORBIDDEN"
+	errCodeInternal          = "INTERNAL"
+	errCodeIdempotentReplay  = "IDEMPOTENT_REPLAY"
+)
+
+// Error codes raised by the gateway itself when a transaction fails outside the chaincode.
+const (
+	errCodeBadRequest         = "BAD_REQUEST"
+	errCodeEndorsementFailed  = "ENDORSEMENT_FAILED"
+	errCodeSubmitFailed       = "SUBMIT_FAILED"
+	errCodeCommitFailed       = "COMMIT_FAILED"
+	errCodeCommitStatusFailed = "COMMIT_STATUS_UNKNOWN"
+	errCodeTimeout            = "TIMEOUT"
+	errCodeUnavailable        = "UNAVAILABLE"
+	errCodeBadPayload         = "BAD_CHAINCODE_RESPONSE"
+	errCodeNotEnrolled        = "IDENTITY_NOT_ENROLLED"
+	errCodeCurrencyMismatch   = "CURRENCY_MISMATCH"
+)
+
+// ChaincodeError is the structured error returned by chaincode functions.
+type ChaincodeError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func (e *ChaincodeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// httpStatus maps an error code to the HTTP status reported to API clients.
+func (e *ChaincodeError) httpStatus() int {
+	switch e.Code {
+	case errCodeBadRequest:
+		return http.StatusBadRequest
+	case errCodeUnauthenticated:
+		return http.StatusUnauthorized
+	case errCodeEndorsementFailed, errCodeSubmitFailed, errCodeBadPayload:
+		return http.StatusBadGateway
+	case errCodeCommitFailed:
+		return http.StatusConflict
+	case errCodeCommitStatusFailed, errCodeTimeout:
+		return http.StatusGatewayTimeout
+	case errCodeUnavailable:
+		return http.StatusServiceUnavailable
+	case errCodeNotFound:
+		return http.StatusNotFound
+	case errCodeAlreadyExists, errCodeInvalidState, errCodeCurrencyMismatch:
+		return http.StatusConflict
+	case errCodeInvalidArgument:
+		return http.StatusBadRequest
+	case errCodeInsufficientFunds, errCodeConditionNotMet:
+		return http.StatusUnprocessableEntity
+	case errCodeForbidden, errCodeNotEnrolled:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// parseChaincodeError extracts the structured chaincode error from a SubmitTransaction or
+// EvaluateTransaction error. The peer reports the chaincode error message in the gRPC status
+// details, for example "chaincode response 500, {"code":"NOT_FOUND",...}".
+func parseChaincodeError(err error) (*ChaincodeError, bool) {
+	var chaincodeError *ChaincodeError
+	if errors.As(err, &chaincodeError) {
+		return chaincodeError, true
+	}
+
+	statusErr, ok := status.FromError(err)
+	if !ok {
+		return nil, false
+	}
+
+	messages := []string{statusErr.Message()}
+	for _, detail := range statusErr.Details() {
+		if errorDetail, ok := detail.(*gateway.ErrorDetail); ok {
+			messages = append(messages, errorDetail.GetMessage())
+		}
+	}
+
+	for _, message := range messages {
+		if chaincodeError, ok := decodeChaincodeError(message); ok {
+			return chaincodeError, true
+		}
+	}
+	return nil, false
+}
+
+func decodeChaincodeError(message string) (*ChaincodeError, bool) {
+	start := strings.Index(message, "{")
+	end := strings.LastIndex(message, "}")
+	if start < 0 || end < start {
+		return nil, false
+	}
+
+	var chaincodeError ChaincodeError
+	if err := json.Unmarshal([]byte(message[start:end+1]), &chaincodeError); err != nil || chaincodeError.Code == "" {
+		return nil, false
+	}
+	return &chaincodeError, true
+}
+
+// idempotentReplay returns the error of a submission whose idempotency key was already used, which
+// holds the ID and result of the original transaction.
+func idempotentReplay(err error) (*ChaincodeError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	chaincodeError, ok := parseChaincodeError(err)
+	if !ok || chaincodeError.Code != errCodeIdempotentReplay {
+		return nil, false
+	}
+	return chaincodeError, true
+}
+
+// badPayloadError reports a chaincode result that could not be passed on to the client as JSON.
+type badPayloadError struct {
+	function string
+	payload  []byte
+}
+
+func (e *badPayloadError) Error() string {
+	return fmt.Sprintf("%s returned a result that is not valid JSON: %q", e.function, e.payload)
+}
+
+// commitFailedError reports a transaction that was committed in a block but failed validation,
+// for example because of a read conflict with a concurrent transaction.
+type commitFailedError struct {
+	transactionID  string
+	validationCode string
+}
+
+func (e *commitFailedError) Error() string {
+	return fmt.Sprintf("transaction %s failed to commit with status code %s", e.transactionID, e.validationCode)
+}
+
+// toAPIError classifies any error returned by the service layer. Errors raised by the chaincode
+// keep their own code; failures at each step of the transaction flow are reported with a gateway code.
+func toAPIError(err error) *ChaincodeError {
+	var exhausted *retriesExhaustedError
+	if errors.As(err, &exhausted) {
+		apiError := *toAPIError(exhausted.err)
+		details := map[string]string{"attempts": strconv.Itoa(exhausted.attempts)}
+		for key, value := range apiError.Details {
+			details[key] = value
+		}
+		apiError.Message, apiError.Details = err.Error(), details
+		return &apiError
+	}
+	if chaincodeError, ok := parseChaincodeError(err); ok {
+		return chaincodeError
+	}
+
+	var badPayload *badPayloadError
+	var commitFailed *commitFailedError
+	var commitStatusErr *client.CommitStatusError
+	var submitErr *client.SubmitError
+	var endorseErr *client.EndorseError
+	switch {
+	case errors.Is(err, errIdentityNotFound):
+		return &ChaincodeError{Code: errCodeNotEnrolled, Message: err.Error()}
+	case errors.As(err, &badPayload):
+		return &ChaincodeError{Code: errCodeBadPayload, Message: err.Error()}
+	case errors.As(err, &commitFailed):
+		return &ChaincodeError{Code: errCodeCommitFailed, Message: err.Error(), Details: map[string]string{
+			"transactionId":  commitFailed.transactionID,
+			"validationCode": commitFailed.validationCode,
+		}}
+	case errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded:
+		return &ChaincodeError{Code: errCodeTimeout, Message: err.Error()}
+	case status.Code(err) == codes.Unavailable:
+		return &ChaincodeError{Code: errCodeUnavailable, Message: err.Error()}
+	case errors.As(err, &commitStatusErr):
+		return &ChaincodeError{Code: errCodeCommitStatusFailed, Message: err.Error(), Details: map[string]string{
+			"transactionId": commitStatusErr.TransactionID,
+		}}
+	case errors.As(err, &submitErr):
+		return &ChaincodeError{Code: errCodeSubmitFailed, Message: err.Error(), Details: map[string]string{
+			"transactionId": submitErr.TransactionID,
+		}}
+	case errors.As(err, &endorseErr):
+		return &ChaincodeError{Code: errCodeEndorsementFailed, Message: err.Error(), Details: map[string]string{
+			"transactionId": endorseErr.TransactionID,
+		}}
+	default:
+		return &ChaincodeError{Code: errCodeInternal, Message: err.Error()}
+	}
+}
+
+// respondError writes the consistent JSON error body used by every endpoint:
+//
+//	{"version": "v1", "code": "404", "message": "...", "result": "", "error": {"code": "NOT_FOUND", "message": "...", "details": {...}}}
+func respondError(c *gin.Context, message string, err error) {
+	apiError := toAPIError(err)
+	httpStatus := apiError.httpStatus()
+	if httpStatus >= http.StatusInternalServerError {
+		log.Printf("%s: %v\n", message, err)
+	}
+
+	writeError(c, httpStatus, message, apiError)
+}
+
+func writeError(c *gin.Context, httpStatus int, message string, apiError *ChaincodeError) {
+	c.Header("API-Version", apiVersion)
+	c.AbortWithStatusJSON(httpStatus, Response{
+		Version: apiVersion,
+		Code:    fmt.Sprintf("%d", httpStatus),
+		Message: message,
+		Result:  "",
+		Error:   apiError,
+	})
+}
+
+// respondBadRequest reports a request body or parameter that failed to bind.
+func respondBadRequest(c *gin.Context, err error) {
+	writeError(c, http.StatusBadRequest, "Bad Request", &ChaincodeError{Code: errCodeBadRequest, Message: err.Error()})
+}
+
+// requireCounterparty rejects a request naming the authenticated user as its own counterparty,
+// such as a transfer to oneself or a contract issued to oneself.
+func requireCounterparty(c *gin.Context, field string, counterparty string) bool {
+	if counterparty == authenticatedUser(c) {
+		writeError(c, http.StatusBadRequest, "Bad Request", &ChaincodeError{
+			Code:    errCodeBadRequest,
+			Message: field + " must differ from the authenticated user",
+			Details: map[string]string{field: counterparty},
+		})
+		return false
+	}
+	return true
+}
+
+// recoverPanic is the gin recovery handler. A panic in one handler is reported as a 500 response
+// for that request only; the server keeps serving every other request.
+func recoverPanic(c *gin.Context, recovered any) {
+	log.Printf("Recovered from panic serving %s %s: %v\n", c.Request.Method, c.Request.URL.Path, recovered)
+	writeError(c, http.StatusInternalServerError, "Internal Server Error", &ChaincodeError{Code: errCodeInternal, Message: fmt.Sprintf("%v", recovered)})
+}
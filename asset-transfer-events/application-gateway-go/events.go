@@ -0,0 +1,197 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// Chaincode event names. Each event carries the JSON of the state written by the transaction.
+const (
+	eventCreateCurrency         = "CreateCurrency"
+	eventTransferCurrency       = "TransferCurrency"
+	eventConsolidateCurrency    = "ConsolidateCurrency"
+	eventConvertCurrency        = "ConvertCurrency"
+	eventPostExchangeRate       = "PostExchangeRate"
+	eventSetFeeSchedule         = "SetFeeSchedule"
+	eventCreateLoan             = "CreateLoan"
+	eventStartLoan              = "StartLoan"
+	eventLoanContractCheck      = "LoanContractCheck"
+	eventCreateInsurance        = "CreateInsurance"
+	eventStartInsurance         = "StartInsurance"
+	eventInsuranceContractCheck = "InsuranceContractCheck"
+)
+
+// eventHandler processes one chaincode event. An event is only checkpointed once every handler
+// registered for it has succeeded, so handlers may see an event again after a failure or a restart
+// and must be idempotent.
+type eventHandler func(ctx context.Context, event *client.ChaincodeEvent) error
+
+// eventNetwork is the part of a client.Network used to receive chaincode events.
+type eventNetwork interface {
+	ChaincodeEvents(ctx context.Context, chaincodeName string, options ...client.ChaincodeEventsOption) (<-chan *client.ChaincodeEvent, error)
+}
+
+// eventCheckpointer records the position of the last processed event. It is implemented by
+// client.FileCheckpointer and projectionStore.
+type eventCheckpointer interface {
+	client.Checkpoint
+	CheckpointChaincodeEvent(event *client.ChaincodeEvent) error
+	Sync() error
+}
+
+// eventConsumer delivers chaincode events to the handlers registered for their event name, with
+// at-least-once semantics. Progress is checkpointed after each event, and listening resumes from
+// the checkpoint after a dropped connection or a restart.
+type eventConsumer struct {
+	name         string
+	network      func() (eventNetwork, error)
+	chaincode    string
+	checkpointer eventCheckpointer
+	startBlock   *uint64
+	metrics      *metrics
+	handlers     map[string][]eventHandler
+
+	// retryDelay is the first delay before a failed handler or event stream is retried. It doubles
+	// on every consecutive failure, up to maxRetryDelay.
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+}
+
+// newEventConsumer creates a consumer for the events of a chaincode. If the checkpoint is empty,
+// listening starts at startBlock, or at the next committed block if startBlock is nil. The name
+// identifies the consumer in logs and metrics.
+func newEventConsumer(name string, network func() (eventNetwork, error), chaincode string, checkpointer eventCheckpointer, startBlock *uint64, metrics *metrics) *eventConsumer {
+	return &eventConsumer{
+		name:          name,
+		network:       network,
+		chaincode:     chaincode,
+		checkpointer:  checkpointer,
+		startBlock:    startBlock,
+		metrics:       metrics,
+		handlers:      map[string][]eventHandler{},
+		retryDelay:    time.Second,
+		maxRetryDelay: 30 * time.Second,
+	}
+}
+
+// Handle registers a handler for the events with the given name. Handlers must be registered
+// before Run is called.
+func (c *eventConsumer) Handle(eventName string, handler eventHandler) {
+	c.handlers[eventName] = append(c.handlers[eventName], handler)
+}
+
+// Run receives and dispatches events until the context is cancelled. The event stream ends when
+// the connection to its peer drops; it is then reopened from the checkpoint, through another peer
+// if the peer pool has failed over.
+func (c *eventConsumer) Run(ctx context.Context) {
+	fmt.Printf("\n*** Start chaincode event listening for %s from block %d\n", c.name, c.checkpointer.BlockNumber())
+
+	delay := c.retryDelay
+	for ctx.Err() == nil {
+		received, err := c.receive(ctx)
+		if err != nil {
+			log.Printf("Chaincode event listening for %s failed, retrying in %s: %v", c.name, delay, err)
+		}
+		if received {
+			delay = c.retryDelay
+		}
+		if !c.sleep(ctx, delay) {
+			return
+		}
+		delay = min(2*delay, c.maxRetryDelay)
+	}
+}
+
+// receive dispatches the events of one event stream until it ends, reporting whether any event
+// was processed.
+func (c *eventConsumer) receive(ctx context.Context) (bool, error) {
+	network, err := c.network()
+	if err != nil {
+		return false, err
+	}
+
+	var options []client.ChaincodeEventsOption
+	if c.startBlock != nil {
+		options = append(options, client.WithStartBlock(*c.startBlock))
+	}
+	// The checkpoint takes precedence over the start block once an event has been processed
+	options = append(options, client.WithCheckpoint(c.checkpointer))
+
+	events, err := network.ChaincodeEvents(ctx, c.chaincode, options...)
+	if err != nil {
+		return false, err
+	}
+
+	received := false
+	for event := range events {
+		if !c.dispatch(ctx, event) {
+			// Cancelled before the event was processed; it is delivered again on the next run
+			return received, nil
+		}
+		if err := c.checkpoint(event); err != nil {
+			return received, err
+		}
+		received = true
+	}
+	return received, nil
+}
+
+// dispatch calls the handlers of an event, retrying until they all succeed. It returns false if
+// the context is cancelled first.
+func (c *eventConsumer) dispatch(ctx context.Context, event *client.ChaincodeEvent) bool {
+	fmt.Printf("\n<-- Chaincode event received by %s: %s in block %d, transaction %s\n", c.name, event.EventName, event.BlockNumber, event.TransactionID)
+	c.metrics.eventReceivedIn(c.name, event.BlockNumber)
+
+	for _, handler := range c.handlers[event.EventName] {
+		delay := c.retryDelay
+		for {
+			err := handler(ctx, event)
+			if err == nil {
+				break
+			}
+			log.Printf("Failed to handle %s event of transaction %s in %s, retrying in %s: %v", event.EventName, event.TransactionID, c.name, delay, err)
+			if !c.sleep(ctx, delay) {
+				return false
+			}
+			delay = min(2*delay, c.maxRetryDelay)
+		}
+	}
+	return true
+}
+
+// checkpoint records an event as processed and commits the checkpoint to stable storage.
+func (c *eventConsumer) checkpoint(event *client.ChaincodeEvent) error {
+	if err := c.checkpointer.CheckpointChaincodeEvent(event); err != nil {
+		return fmt.Errorf("failed to checkpoint event of transaction %s: %w", event.TransactionID, err)
+	}
+	return c.checkpointer.Sync()
+}
+
+func (c *eventConsumer) sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// printEvent is an event handler printing the event payload, formatted if it is JSON.
+func printEvent(_ context.Context, event *client.ChaincodeEvent) error {
+	payload, err := formatJSON(event.Payload)
+	if err != nil {
+		payload = string(event.Payload)
+	}
+	fmt.Printf("%s: %s\n", event.EventName, payload)
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// fakeEventNetwork delivers its events on the first stream, resuming after the checkpoint like a
+// peer would, and cancels the test once the consumer reconnects.
+type fakeEventNetwork struct {
+	events       []*client.ChaincodeEvent
+	checkpointer eventCheckpointer
+	cancel       context.CancelFunc
+	streams      int
+}
+
+func (f *fakeEventNetwork) ChaincodeEvents(ctx context.Context, _ string, _ ...client.ChaincodeEventsOption) (<-chan *client.ChaincodeEvent, error) {
+	f.streams++
+	if f.streams > 1 {
+		f.cancel()
+		return nil, errors.New("cancelled")
+	}
+
+	events := make(chan *client.ChaincodeEvent, len(f.events))
+	skipping := f.checkpointer.TransactionID() != ""
+	for _, event := range f.events {
+		if event.BlockNumber < f.checkpointer.BlockNumber() {
+			continue
+		}
+		if skipping && event.BlockNumber == f.checkpointer.BlockNumber() {
+			skipping = event.TransactionID != f.checkpointer.TransactionID()
+			continue
+		}
+		events <- event
+	}
+	close(events)
+	return events, nil
+}
+
+func newTestCheckpointer(t *testing.T, path string) *client.FileCheckpointer {
+	t.Helper()
+	checkpointer, err := client.NewFileCheckpointer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { checkpointer.Close() })
+	return checkpointer
+}
+
+// consume runs an event consumer over events until it has processed the stream once, returning
+// the transactions handled by name.
+func consume(t *testing.T, checkpointer eventCheckpointer, events []*client.ChaincodeEvent, failures map[string]int) map[string][]string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	network := &fakeEventNetwork{events: events, checkpointer: checkpointer, cancel: cancel}
+	consumer := newEventConsumer("test", func() (eventNetwork, error) { return network, nil }, "events", checkpointer, nil, newMetrics())
+	consumer.retryDelay = time.Millisecond
+
+	handled := map[string][]string{}
+	handler := func(_ context.Context, event *client.ChaincodeEvent) error {
+		handled[event.EventName] = append(handled[event.EventName], event.TransactionID)
+		if failures[event.TransactionID] > 0 {
+			failures[event.TransactionID]--
+			return errors.New("projection unavailable")
+		}
+		return nil
+	}
+	consumer.Handle(eventCreateLoan, handler)
+	consumer.Handle(eventStartLoan, handler)
+	consumer.Run(ctx)
+	return handled
+}
+
+func TestEventConsumerResumesFromCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	events := []*client.ChaincodeEvent{
+		{BlockNumber: 5, TransactionID: "tx1", EventName: eventCreateLoan},
+		{BlockNumber: 5, TransactionID: "tx2", EventName: eventStartLoan},
+		{BlockNumber: 6, TransactionID: "tx3", EventName: eventCreateCurrency},
+	}
+
+	handled := consume(t, newTestCheckpointer(t, path), events[:2], map[string]int{"tx2": 2})
+	if len(handled[eventCreateLoan]) != 1 || len(handled[eventStartLoan]) != 3 {
+		t.Errorf("handled = %v, a failed handler should be retried until it succeeds", handled)
+	}
+
+	// After a restart, only the events after the checkpoint are delivered
+	checkpointer := newTestCheckpointer(t, path)
+	if checkpointer.BlockNumber() != 5 || checkpointer.TransactionID() != "tx2" {
+		t.Fatalf("checkpoint = block %d, transaction %q", checkpointer.BlockNumber(), checkpointer.TransactionID())
+	}
+	handled = consume(t, checkpointer, events, nil)
+	if len(handled) != 0 {
+		t.Errorf("handled = %v, events before the checkpoint were delivered again", handled)
+	}
+	if checkpointer.BlockNumber() != 6 || checkpointer.TransactionID() != "tx3" {
+		t.Errorf("events without a handler were not checkpointed: block %d, transaction %q", checkpointer.BlockNumber(), checkpointer.TransactionID())
+	}
+}
+
+func TestEventConsumerDoesNotCheckpointUnhandledEvents(t *testing.T) {
+	checkpointer := newTestCheckpointer(t, filepath.Join(t.TempDir(), "checkpoint.json"))
+	ctx, cancel := context.WithCancel(context.Background())
+
+	network := &fakeEventNetwork{
+		events:       []*client.ChaincodeEvent{{BlockNumber: 7, TransactionID: "tx1", EventName: eventStartInsurance}},
+		checkpointer: checkpointer,
+		cancel:       cancel,
+	}
+	consumer := newEventConsumer("test", func() (eventNetwork, error) { return network, nil }, "events", checkpointer, nil, newMetrics())
+	consumer.retryDelay = time.Millisecond
+	consumer.Handle(eventStartInsurance, func(context.Context, *client.ChaincodeEvent) error {
+		// Shut down while the handler keeps failing
+		cancel()
+		return errors.New("projection unavailable")
+	})
+	consumer.Run(ctx)
+
+	if checkpointer.BlockNumber() != 0 || checkpointer.TransactionID() != "" {
+		t.Errorf("event was checkpointed without being handled: block %d, transaction %q", checkpointer.BlockNumber(), checkpointer.TransactionID())
+	}
+}
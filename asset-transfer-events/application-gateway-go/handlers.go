@@ -0,0 +1,652 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiServer holds the HTTP handlers of the gateway. Handlers only bind requests and write
+// responses; every chaincode call goes through the service layer, which returns errors.
+type apiServer struct {
+	service    *ecosysService
+	auth       *authService
+	identities *identityManager
+	routerOptions
+}
+
+// routerOptions are the optional parts of the API; the routes of a part that is not set are not
+// registered.
+type routerOptions struct {
+	health     gatewayHealth
+	projection *projection
+	events     *eventHub
+	webhooks   *webhookDispatcher
+}
+
+// newRouter creates the gin engine with logging, request metrics and panic recovery, and registers all routes.
+func newRouter(service *ecosysService, auth *authService, identities *identityManager, options routerOptions) *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Logger(), service.metrics.observeRequests, gin.CustomRecovery(recoverPanic))
+
+	server := &apiServer{service: service, auth: auth, identities: identities, routerOptions: options}
+	server.registerHealthRoutes(router)
+	server.registerAuthRoutes(router)
+	server.registerRoutes(router)
+	if options.projection != nil {
+		server.registerProjectionRoutes(router)
+	}
+	if options.events != nil {
+		server.registerStreamRoutes(router)
+	}
+	if options.webhooks != nil {
+		server.registerWebhookRoutes(router)
+	}
+	if service.transactions != nil {
+		server.registerTransactionRoutes(router)
+	}
+	server.registerLegacyRoutes(router)
+	return router
+}
+
+// registerRoutes registers the resource-oriented v1 API. Reads are GET requests addressed by
+// path and query parameters only. Contract start and check move currency and are not idempotent,
+// so they are POST actions on the contract resource.
+//
+// Every route requires an access token. Users and issuers may only address their own resources,
+// and contracts are always those applied for by the authenticated user.
+func (s *apiServer) registerRoutes(router gin.IRouter) {
+	v1 := router.Group("/"+apiVersion, s.requireAuth)
+
+	users := v1.Group("/users/:id", s.requireSelf)
+	users.GET("/identity", s.getIdentity)
+	users.PUT("/identity", s.putIdentity)
+	users.DELETE("/identity", s.revokeIdentity)
+	users.POST("/identity/reenroll", s.reenrollIdentity)
+	users.GET("/balance", s.getBalance)
+	users.GET("/balances", s.getBalances)
+	users.GET("/history", s.getHistory)
+	users.GET("/statements", s.getStatement)
+	users.GET("/contracts", s.listUserContracts)
+	users.POST("/transfers", s.createTransfer)
+	users.POST("/deposits", s.createDeposit)
+	users.GET("/coins", s.listCoins)
+	users.POST("/coins/consolidate", s.consolidateCoins)
+	users.POST("/conversions", s.createConversion)
+	users.GET("/account", s.getAccount)
+	users.POST("/account/migrate", s.migrateAccount)
+	users.POST("/account/aggregate", s.aggregateAccount)
+
+	currencies := v1.Group("/currencies")
+	currencies.GET("", s.listCurrencies)
+	currencies.GET("/:code", s.getCurrency)
+	currencies.POST("", s.requireRole(roleTreasury), s.registerCurrency)
+
+	fees := v1.Group("/fees")
+	fees.GET("", s.getFeeSchedule)
+	fees.PUT("", s.requireRole(roleTreasury), s.putFeeSchedule)
+	fees.GET("/quote", s.quoteFee)
+
+	rates := v1.Group("/fx/rates")
+	rates.GET("", s.listExchangeRates)
+	rates.GET("/:base/:quote", s.getExchangeRate)
+	rates.POST("", s.requireRole(roleOracle), s.postExchangeRate)
+
+	contracts := v1.Group("/contracts")
+	contracts.POST("", s.createContract)
+	contracts.GET("/:type/:id", s.getContract)
+	contracts.POST("/:type/:id/start", s.startContract)
+	contracts.POST("/:type/:id/check", s.checkContract)
+
+	issuers := v1.Group("/issuers/:id", s.requireSelf)
+	issuers.GET("/contracts", s.listIssuerContracts)
+	issuers.GET("/portfolio", s.getIssuerPortfolio)
+}
+
+// respondOK writes the success body used by every endpoint.
+func respondOK(c *gin.Context, message string, result any) {
+	respondWithStatus(c, http.StatusOK, message, result)
+}
+
+// respondCreated writes the success body of a request that created a resource.
+func respondCreated(c *gin.Context, message string, result any) {
+	respondWithStatus(c, http.StatusCreated, message, result)
+}
+
+func respondWithStatus(c *gin.Context, httpStatus int, message string, result any) {
+	c.Header("API-Version", apiVersion)
+	c.JSON(httpStatus, Response{
+		Version: apiVersion,
+		Code:    fmt.Sprintf("%d", httpStatus),
+		Message: message,
+		Result:  result,
+	})
+}
+
+// idempotencyKeyHeader is the request header making a submission idempotent: a request retried
+// with the same key returns the outcome of the first one instead of being executed again.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// submitContext returns the context in which a request submits its transaction, with the options
+// of its headers. The transaction is not waited for if the client prefers an asynchronous
+// response and transactions are tracked. The idempotency key is validated by the chaincode, whose
+// INVALID_ARGUMENT error is reported as a bad request.
+func (s *apiServer) submitContext(c *gin.Context) (context.Context, *submission) {
+	submission := &submission{
+		async:          s.service.transactions != nil && asyncRequested(c),
+		idempotencyKey: c.GetHeader(idempotencyKeyHeader),
+	}
+	return withSubmission(c.Request.Context(), submission), submission
+}
+
+// respondSubmitted writes the result of a committed transaction, or accepts an asynchronously
+// submitted one, pointing to its status. A result replayed for an idempotency key is marked with
+// the Idempotent-Replayed header. The Transaction-Attempts header counts the times the transaction
+// was endorsed, more than once if it was retried.
+func respondSubmitted(c *gin.Context, submission *submission, httpStatus int, operation string, result any) {
+	if submission.attempts > 0 {
+		c.Header("Transaction-Attempts", strconv.Itoa(submission.attempts))
+	}
+	if submission.replayedTransactionID != "" {
+		c.Header("Idempotent-Replayed", "true")
+	}
+	if submission.transaction != nil {
+		c.Header("Preference-Applied", "respond-async")
+		c.Header("Location", "/"+apiVersion+"/transactions/"+submission.transaction.TransactionID)
+		respondWithStatus(c, http.StatusAccepted, operation+" Accepted", submission.transaction)
+		return
+	}
+	respondWithStatus(c, httpStatus, operation+" Success", result)
+}
+
+// contractType reads the {type} path parameter, which is "loan" or "insurance".
+func contractType(c *gin.Context) (string, bool) {
+	businessType := c.Param("type")
+	if businessType != "loan" && businessType != "insurance" {
+		writeError(c, http.StatusNotFound, "Not Found", &ChaincodeError{
+			Code:    errCodeNotFound,
+			Message: "unknown contract type " + businessType,
+			Details: map[string]string{"type": businessType},
+		})
+		return "", false
+	}
+	return businessType, true
+}
+
+func (s *apiServer) getIdentity(c *gin.Context) {
+	id, err := s.identities.wallet.Get(c.Param("id"))
+	if err != nil {
+		respondError(c, "GetIdentity Failed", err)
+		return
+	}
+	result, err := newIdentityInfo(c.Param("id"), id)
+	if err != nil {
+		respondError(c, "GetIdentity Failed", err)
+		return
+	}
+	respondOK(c, "GetIdentity Success", result)
+}
+
+// putIdentity stores the enrolled Fabric identity of a user in the wallet. Later transactions of
+// the user are signed with it.
+func (s *apiServer) putIdentity(c *gin.Context) {
+	var request ImportIdentityRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	id, err := newWalletIdentity(s.identities.mspID, []byte(request.Certificate), []byte(request.PrivateKey))
+	if err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	if err := s.identities.wallet.Put(c.Param("id"), id); err != nil {
+		respondError(c, "PutIdentity Failed", err)
+		return
+	}
+	result, err := newIdentityInfo(c.Param("id"), id)
+	if err != nil {
+		respondError(c, "PutIdentity Failed", err)
+		return
+	}
+	respondOK(c, "PutIdentity Success", result)
+}
+
+// reenrollIdentity replaces the identity of a user with a new key pair and certificate from the CA.
+func (s *apiServer) reenrollIdentity(c *gin.Context) {
+	id, err := s.identities.Reenroll(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, "ReenrollIdentity Failed", err)
+		return
+	}
+	result, err := newIdentityInfo(c.Param("id"), id)
+	if err != nil {
+		respondError(c, "ReenrollIdentity Failed", err)
+		return
+	}
+	respondOK(c, "ReenrollIdentity Success", result)
+}
+
+// revokeIdentity revokes the identity of a user at the CA, for example after its key was compromised.
+func (s *apiServer) revokeIdentity(c *gin.Context) {
+	var request RevokeIdentityRequest
+	if err := c.ShouldBindQuery(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	if err := s.identities.Revoke(c.Request.Context(), c.Param("id"), request.Reason); err != nil {
+		respondError(c, "RevokeIdentity Failed", err)
+		return
+	}
+	respondOK(c, "RevokeIdentity Success", nil)
+}
+
+func (s *apiServer) getBalance(c *gin.Context) {
+	result, err := s.service.Balance(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, "GetBalance Failed", err)
+		return
+	}
+	respondOK(c, "GetBalance Success", result)
+}
+
+func (s *apiServer) getBalances(c *gin.Context) {
+	result, err := s.service.Balances(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, "GetBalances Failed", err)
+		return
+	}
+	respondOK(c, "GetBalances Success", result)
+}
+
+func (s *apiServer) listUserContracts(c *gin.Context) {
+	var filter ContractFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	contracts, err := s.service.Contracts(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, "ListContracts Failed", err)
+		return
+	}
+	result, err := contracts.Filter(filter)
+	if err != nil {
+		respondError(c, "ListContracts Failed", &badPayloadError{function: "ReadLoanListByOwner", payload: contracts.Loans})
+		return
+	}
+	respondOK(c, "ListContracts Success", result)
+}
+
+func (s *apiServer) createTransfer(c *gin.Context) {
+	var request TransferRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	if !requireCounterparty(c, "target_user_id", request.TargetUserID) {
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.Transfer(ctx, c.Param("id"), request.TargetUserID, request.Amount, request.Currency, request.CoinSelection)
+	if err != nil {
+		respondError(c, "Transfer Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusCreated, "Transfer", result)
+}
+
+func (s *apiServer) createDeposit(c *gin.Context) {
+	var request CreateDepositRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.Deposit(ctx, c.Param("id"), request.Amount, request.Currency, timestampOrNow(request.CurrentTime))
+	if err != nil {
+		respondError(c, "Deposit Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusCreated, "Deposit", result)
+}
+
+func (s *apiServer) listCoins(c *gin.Context) {
+	result, err := s.service.Coins(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, "ListCoins Failed", err)
+		return
+	}
+	respondOK(c, "ListCoins Success", result)
+}
+
+func (s *apiServer) consolidateCoins(c *gin.Context) {
+	var request ConsolidateRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.Consolidate(ctx, c.Param("id"), request.MaxAmount, request.MaxInputs, request.Currency)
+	if err != nil {
+		respondError(c, "ConsolidateCoins Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "ConsolidateCoins", result)
+}
+
+// createConversion converts currency of the user at the current exchange rate, less its spread.
+func (s *apiServer) createConversion(c *gin.Context) {
+	var request ConvertRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.Convert(ctx, c.Param("id"), request.Amount, request.From, request.To)
+	if err != nil {
+		respondError(c, "ConvertCurrency Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusCreated, "ConvertCurrency", result)
+}
+
+func (s *apiServer) getAccount(c *gin.Context) {
+	var query CurrencyQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	result, err := s.service.Account(c.Request.Context(), c.Param("id"), query.Currency)
+	if err != nil {
+		respondError(c, "GetAccount Failed", err)
+		return
+	}
+	respondOK(c, "GetAccount Success", result)
+}
+
+func (s *apiServer) migrateAccount(c *gin.Context) {
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.MigrateToAccount(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, "MigrateAccount Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "MigrateAccount", result)
+}
+
+func (s *apiServer) aggregateAccount(c *gin.Context) {
+	var query CurrencyQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.AggregateAccount(ctx, c.Param("id"), query.Currency)
+	if err != nil {
+		respondError(c, "AggregateAccount Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "AggregateAccount", result)
+}
+
+func (s *apiServer) createContract(c *gin.Context) {
+	var request CreateContractRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	if !requireCounterparty(c, "issuer", request.Issuer) {
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.CreateContract(ctx, authenticatedUser(c), request.BusinessID, request.Amount, request.Issuer, request.Rate, request.BusinessType, request.Period, request.Currency)
+	if err != nil {
+		respondError(c, "CreateContract Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusCreated, "CreateContract", result)
+}
+
+func (s *apiServer) getContract(c *gin.Context) {
+	businessType, ok := contractType(c)
+	if !ok {
+		return
+	}
+	result, err := s.service.Contract(c.Request.Context(), authenticatedUser(c), businessType, c.Param("id"))
+	if err != nil {
+		respondError(c, "GetContract Failed", err)
+		return
+	}
+	respondOK(c, "GetContract Success", result)
+}
+
+func (s *apiServer) startContract(c *gin.Context) {
+	businessType, ok := contractType(c)
+	if !ok {
+		return
+	}
+	var request ContractTransitionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	if !settlementCurrencyAllowed(c, request.SettlementCurrency, false) {
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	if request.Currency != "" {
+		if err := s.service.CheckContractCurrency(ctx, authenticatedUser(c), businessType, c.Param("id"), request.Currency); err != nil {
+			respondError(c, "StartContract Failed", err)
+			return
+		}
+	}
+	var result any
+	var err error
+	if businessType == "loan" {
+		result, err = s.service.StartLoan(ctx, authenticatedUser(c), c.Param("id"), request.Conditions.Credit, request.Conditions.Income)
+	} else {
+		result, err = s.service.StartInsurance(ctx, authenticatedUser(c), c.Param("id"), request.Conditions.Credit, request.Conditions.Income)
+	}
+	if err != nil {
+		respondError(c, "StartContract Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "StartContract", result)
+}
+
+func (s *apiServer) checkContract(c *gin.Context) {
+	businessType, ok := contractType(c)
+	if !ok {
+		return
+	}
+	var request ContractTransitionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	if !settlementCurrencyAllowed(c, request.SettlementCurrency, businessType == "loan") {
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	if request.Currency != "" {
+		if err := s.service.CheckContractCurrency(ctx, authenticatedUser(c), businessType, c.Param("id"), request.Currency); err != nil {
+			respondError(c, "CheckContract Failed", err)
+			return
+		}
+	}
+	conditions := request.Conditions
+	var result any
+	var err error
+	if businessType == "loan" {
+		result, err = s.service.CheckLoan(ctx, authenticatedUser(c), c.Param("id"), conditions.Credit, conditions.Income, timestampOrNow(request.CurrentTime), request.SettlementCurrency)
+	} else {
+		result, err = s.service.CheckInsurance(ctx, authenticatedUser(c), c.Param("id"), conditions.Credit, conditions.Income, conditions.IsSudden, conditions.ContingencyInfo)
+	}
+	if err != nil {
+		respondError(c, "CheckContract Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "CheckContract", result)
+}
+
+// settlementCurrencyAllowed rejects a settlement currency unless the transition settles in it,
+// which only a loan check does.
+func settlementCurrencyAllowed(c *gin.Context, settlementCurrency string, allowed bool) bool {
+	if settlementCurrency != "" && !allowed {
+		writeError(c, http.StatusBadRequest, "Bad Request", &ChaincodeError{
+			Code:    errCodeBadRequest,
+			Message: "settlement_currency is only accepted when checking a loan",
+			Details: map[string]string{"settlement_currency": settlementCurrency},
+		})
+		return false
+	}
+	return true
+}
+
+func (s *apiServer) listCurrencies(c *gin.Context) {
+	result, err := s.service.Currencies(c.Request.Context(), authenticatedUser(c))
+	if err != nil {
+		respondError(c, "ListCurrencies Failed", err)
+		return
+	}
+	respondOK(c, "ListCurrencies Success", result)
+}
+
+func (s *apiServer) getCurrency(c *gin.Context) {
+	result, err := s.service.Currency(c.Request.Context(), authenticatedUser(c), c.Param("code"))
+	if err != nil {
+		respondError(c, "GetCurrency Failed", err)
+		return
+	}
+	respondOK(c, "GetCurrency Success", result)
+}
+
+// registerCurrency registers a currency. Only the treasury may register currencies.
+func (s *apiServer) registerCurrency(c *gin.Context) {
+	var request RegisterCurrencyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.RegisterCurrency(ctx, authenticatedUser(c), request.Code, request.Name, *request.Decimals, request.Issuer)
+	if err != nil {
+		respondError(c, "RegisterCurrency Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusCreated, "RegisterCurrency", result)
+}
+
+func (s *apiServer) getFeeSchedule(c *gin.Context) {
+	result, err := s.service.FeeSchedule(c.Request.Context(), authenticatedUser(c))
+	if err != nil {
+		respondError(c, "GetFeeSchedule Failed", err)
+		return
+	}
+	respondOK(c, "GetFeeSchedule Success", result)
+}
+
+// putFeeSchedule replaces the fee schedule. Only the treasury may set fees.
+func (s *apiServer) putFeeSchedule(c *gin.Context) {
+	var request FeeScheduleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.SetFeeSchedule(ctx, authenticatedUser(c), request)
+	if err != nil {
+		respondError(c, "SetFeeSchedule Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "SetFeeSchedule", result)
+}
+
+// quoteFee returns the fee the sender of a transfer would pay on top of the amount.
+func (s *apiServer) quoteFee(c *gin.Context) {
+	var query FeeQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	result, err := s.service.QuoteFee(c.Request.Context(), authenticatedUser(c), query.Reason, query.Amount, query.Currency)
+	if err != nil {
+		respondError(c, "QuoteFee Failed", err)
+		return
+	}
+	respondOK(c, "QuoteFee Success", result)
+}
+
+func (s *apiServer) listExchangeRates(c *gin.Context) {
+	result, err := s.service.ExchangeRates(c.Request.Context(), authenticatedUser(c))
+	if err != nil {
+		respondError(c, "ListExchangeRates Failed", err)
+		return
+	}
+	respondOK(c, "ListExchangeRates Success", result)
+}
+
+// getExchangeRate quotes the conversion of base into quote, from the rate posted for the pair or
+// the inverse of the rate posted for the reverse pair.
+func (s *apiServer) getExchangeRate(c *gin.Context) {
+	result, err := s.service.ExchangeRate(c.Request.Context(), authenticatedUser(c), c.Param("base"), c.Param("quote"))
+	if err != nil {
+		respondError(c, "GetExchangeRate Failed", err)
+		return
+	}
+	respondOK(c, "GetExchangeRate Success", result)
+}
+
+// postExchangeRate posts the rate of a currency pair, replacing the previous one. Only the rate
+// oracle may post rates.
+func (s *apiServer) postExchangeRate(c *gin.Context) {
+	var request PostExchangeRateRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.PostExchangeRate(ctx, authenticatedUser(c), request.Base, request.Quote, request.Rate, request.Spread,
+		request.ValidFrom.String(), request.ValidUntil.String())
+	if err != nil {
+		respondError(c, "PostExchangeRate Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusCreated, "PostExchangeRate", result)
+}
+
+func (s *apiServer) listIssuerContracts(c *gin.Context) {
+	var filter ContractFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	contracts, err := s.service.IssuerContracts(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, "ListIssuerContracts Failed", err)
+		return
+	}
+	result, err := contracts.Filter(filter)
+	if err != nil {
+		respondError(c, "ListIssuerContracts Failed", &badPayloadError{function: "ReadLoanListByIssuer", payload: contracts.Loans})
+		return
+	}
+	respondOK(c, "ListIssuerContracts Success", result)
+}
+
+func (s *apiServer) getIssuerPortfolio(c *gin.Context) {
+	result, err := s.service.IssuerPortfolio(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, "GetIssuerPortfolio Failed", err)
+		return
+	}
+	respondOK(c, "GetIssuerPortfolio Success", result)
+}
@@ -0,0 +1,933 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testMSPID = "Org1MSP"
+
+type chaincodeCall struct {
+	submit    bool
+	function  string
+	transient map[string][]byte
+	args      []string
+}
+
+// fakeContract records every chaincode call and returns a canned result or error. It provides
+// itself as the contract of every user, recording the signing user of each call. Submitted
+// transactions are committed with status, or as valid in block 1 if it is nil; if release is
+// set, their commit status is only returned once it is closed. The first conflicts submissions
+// fail with an MVCC read conflict.
+type fakeContract struct {
+	calls   []chaincodeCall
+	signers []string
+	result  []byte
+	// results are the results of evaluating specific functions, instead of result
+	results   map[string][]byte
+	err       error
+	status    *client.Status
+	release   chan struct{}
+	conflicts int
+}
+
+func (f *fakeContract) Contract(userID string) (chaincodeContract, error) {
+	f.signers = append(f.signers, userID)
+	return f, nil
+}
+
+func (f *fakeContract) Evaluate(_ context.Context, function string, args ...string) ([]byte, error) {
+	f.calls = append(f.calls, chaincodeCall{function: function, args: args})
+	if result, found := f.results[function]; found {
+		return result, f.err
+	}
+	return f.result, f.err
+}
+
+func (f *fakeContract) SubmitAsync(_ context.Context, function string, transient map[string][]byte, args ...string) ([]byte, submittedTransaction, error) {
+	f.calls = append(f.calls, chaincodeCall{submit: true, function: function, transient: transient, args: args})
+	if f.err != nil {
+		return nil, nil, f.err
+	}
+	status := f.status
+	if status == nil {
+		status = &client.Status{Code: peer.TxValidationCode_VALID, Successful: true, BlockNumber: 1}
+	}
+	if f.conflicts > 0 {
+		f.conflicts--
+		status = &client.Status{Code: peer.TxValidationCode_MVCC_READ_CONFLICT, BlockNumber: 1}
+	}
+	commit := &fakeCommit{status: *status, release: f.release}
+	commit.status.TransactionID = fmt.Sprintf("tx%d", len(f.calls))
+	return f.result, commit, nil
+}
+
+type fakeCommit struct {
+	status  client.Status
+	release chan struct{}
+}
+
+func (f *fakeCommit) TransactionID() string {
+	return f.status.TransactionID
+}
+
+func (f *fakeCommit) Status(ctx context.Context) (*client.Status, error) {
+	if f.release != nil {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-f.release:
+		}
+	}
+	return &f.status, nil
+}
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func newTestAuth(t *testing.T) *authService {
+	t.Helper()
+	users, err := newUserStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newAuthService(users, []byte("test secret"), time.Hour)
+}
+
+func newTestWallet(t *testing.T) wallet {
+	t.Helper()
+	userWallet, err := newFileSystemWallet(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userWallet
+}
+
+func newTestIdentities(t *testing.T) *identityManager {
+	t.Helper()
+	ca, err := newLocalCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newIdentityManager(ca, newTestWallet(t), testMSPID)
+}
+
+// serve sends a request authenticated as alice.
+func serve(t *testing.T, contract *fakeContract, method string, target string, body string) (*httptest.ResponseRecorder, Response) {
+	t.Helper()
+	return serveAs(t, contract, "alice", method, target, body)
+}
+
+// serveAs sends a request authenticated as user, or without a token if user is empty.
+func serveAs(t *testing.T, contract *fakeContract, user string, method string, target string, body string) (*httptest.ResponseRecorder, Response) {
+	t.Helper()
+	auth := newTestAuth(t)
+	router := newRouter(newEcosysService(contract, newMetrics(), serviceOptions{}), auth, newTestIdentities(t), routerOptions{})
+
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	if user != "" {
+		token, _, err := auth.issueToken(user, roleApplicant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return record(t, router, request)
+}
+
+func record(t *testing.T, router http.Handler, request *http.Request) (*httptest.ResponseRecorder, Response) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	var response Response
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response is not JSON: %s", recorder.Body.String())
+	}
+	return recorder, response
+}
+
+func TestEndpointsForwardArguments(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   string
+		method string
+		target string
+		body   string
+		calls  []chaincodeCall
+	}{
+		{
+			name:   "balance",
+			method: http.MethodGet,
+			target: "/ecosys/asset",
+			body:   `{"user_id": "alice", "password": "secret"}`,
+			calls:  []chaincodeCall{{function: "ReadTotalCurrencyByOwner", args: []string{"alice"}}},
+		},
+		{
+			name:   "contracts",
+			method: http.MethodGet,
+			target: "/ecosys/contract",
+			body:   `{"user_id": "alice"}`,
+			calls: []chaincodeCall{
+				{function: "ReadInsuranceListByOwner", args: []string{"alice"}},
+				{function: "ReadLoanListByOwner", args: []string{"alice"}},
+			},
+		},
+		{
+			name:   "loan contract",
+			method: http.MethodGet,
+			target: "/ecosys/query_contract",
+			body:   `{"user_id": "alice", "business_id": "Loan1", "business_type": "loan"}`,
+			calls:  []chaincodeCall{{function: "ReadLoan", args: []string{"alice", "Loan1"}}},
+		},
+		{
+			name:   "insurance contract",
+			method: http.MethodGet,
+			target: "/ecosys/query_contract",
+			body:   `{"user_id": "alice", "business_id": "Insurance1", "business_type": "Insurance"}`,
+			calls:  []chaincodeCall{{function: "ReadInsurance", args: []string{"alice", "Insurance1"}}},
+		},
+		{
+			name:   "contracts by query",
+			method: http.MethodGet,
+			target: "/ecosys/contract?user_id=alice",
+			calls: []chaincodeCall{
+				{function: "ReadInsuranceListByOwner", args: []string{"alice"}},
+				{function: "ReadLoanListByOwner", args: []string{"alice"}},
+			},
+		},
+		{
+			name:   "contract by query",
+			method: http.MethodGet,
+			target: "/ecosys/query_contract?user_id=alice&business_id=Loan1&type=loan",
+			calls:  []chaincodeCall{{function: "ReadLoan", args: []string{"alice", "Loan1"}}},
+		},
+		{
+			name:   "issuer contracts",
+			user:   "bank",
+			method: http.MethodGet,
+			target: "/ecosys/issuer/contract?issuer_id=bank",
+			calls: []chaincodeCall{
+				{function: "ReadLoanListByIssuer", args: []string{"bank"}},
+				{function: "ReadInsuranceListByIssuer", args: []string{"bank"}},
+			},
+		},
+		{
+			name:   "issuer portfolio",
+			user:   "bank",
+			method: http.MethodGet,
+			target: "/ecosys/issuer/portfolio?issuer_id=bank",
+			calls:  []chaincodeCall{{function: "ReadIssuerPortfolio", args: []string{"bank"}}},
+		},
+		{
+			name:   "create contract",
+			method: http.MethodPost,
+			target: "/ecosys/new_contract",
+			body:   `{"user_id": "alice", "business_id": "Loan1", "business_type": "Loan", "amount": 1000, "rate": 0.05, "issuer": "bank", "period": 30}`,
+			calls: []chaincodeCall{{submit: true, function: "CreateContract",
+				args: []string{"alice", "Loan1", "1000.000000", "bank", "0.050000", "Loan", "30"}}},
+		},
+		{
+			name:   "start loan",
+			method: http.MethodPost,
+			target: "/ecosys/loan/start",
+			body:   `{"user_id": "alice", "business_id": "Loan1", "conditions": {"credit": 80, "income": 6000}}`,
+			calls:  []chaincodeCall{{submit: true, function: "StartLoan", args: []string{"alice", "Loan1", "80.000000", "6000.000000"}}},
+		},
+		{
+			name:   "check loan",
+			method: http.MethodPost,
+			target: "/ecosys/loan/check_contract",
+			body:   `{"user_id": "alice", "business_id": "Loan1", "conditions": {"credit": 50, "income": 4000}, "current_time": 1724674565}`,
+			calls: []chaincodeCall{{submit: true, function: "LoanContractCheck",
+				args: []string{"alice", "Loan1", "50.000000", "4000.000000", "1724674565"}}},
+		},
+		{
+			name:   "start insurance",
+			method: http.MethodPost,
+			target: "/ecosys/insurance/start",
+			body:   `{"user_id": "alice", "business_id": "Insurance1", "conditions": {"credit": 70, "income": 8000}}`,
+			calls:  []chaincodeCall{{submit: true, function: "StartInsurance", args: []string{"alice", "Insurance1", "70.000000", "8000.000000"}}},
+		},
+		{
+			name:   "check insurance",
+			method: http.MethodPost,
+			target: "/ecosys/insurance/check_contract",
+			body:   `{"user_id": "alice", "business_id": "Insurance1", "conditions": {"credit": 70, "income": 8000, "is_sudden": true, "contingency_info": "flood"}}`,
+			calls: []chaincodeCall{{submit: true, function: "InsuranceContractCheck",
+				args: []string{"alice", "Insurance1", "70.000000", "8000.000000", "true", "flood"}}},
+		},
+		{
+			name:   "transfer",
+			method: http.MethodPost,
+			target: "/ecosys/pay/transfer",
+			body:   `{"user_id": "alice", "target_user_id": "bob", "amount": 12.5}`,
+			calls:  []chaincodeCall{{submit: true, function: "TransferCurrency", args: []string{"alice", "bob", "12.500000", "Transfer"}}},
+		},
+		{
+			name:   "deposit",
+			method: http.MethodPost,
+			target: "/ecosys/pay/deposit",
+			body:   `{"user_id": "alice", "amount": 100, "current_time": "1724674565"}`,
+			calls: []chaincodeCall{{submit: true, function: "CreateCurrency",
+				args: []string{`{"CurrencyID":"Currency1724674565","Amount":100,"Owner":"alice","CreatedAt":"1724674565","CreatedVia":"Deposit","UpdatedAt":"1724674565","UpdatedVia":"Deposit"}`}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := test.user
+			if user == "" {
+				user = "alice"
+			}
+			contract := &fakeContract{result: []byte("true")}
+			recorder, response := serveAs(t, contract, user, test.method, test.target, test.body)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+			}
+			if response.Version != apiVersion {
+				t.Errorf("version = %q, want %q", response.Version, apiVersion)
+			}
+			if !reflect.DeepEqual(contract.calls, test.calls) {
+				t.Errorf("chaincode calls = %+v, want %+v", contract.calls, test.calls)
+			}
+		})
+	}
+}
+
+func TestRESTEndpointsForwardArguments(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		user   string
+		body   string
+		status int
+		calls  []chaincodeCall
+	}{
+		{
+			name:   "balance",
+			method: http.MethodGet,
+			target: "/v1/users/alice/balance",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "ReadTotalCurrencyByOwner", args: []string{"alice"}}},
+		},
+		{
+			name:   "balances",
+			method: http.MethodGet,
+			target: "/v1/users/alice/balances",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "ReadBalancesByOwner", args: []string{"alice"}}},
+		},
+		{
+			name:   "user contracts",
+			method: http.MethodGet,
+			target: "/v1/users/alice/contracts?type=loan&state=Approved",
+			status: http.StatusOK,
+			calls: []chaincodeCall{
+				{function: "ReadInsuranceListByOwner", args: []string{"alice"}},
+				{function: "ReadLoanListByOwner", args: []string{"alice"}},
+			},
+		},
+		{
+			name:   "contract",
+			method: http.MethodGet,
+			target: "/v1/contracts/insurance/Insurance1",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "ReadInsurance", args: []string{"alice", "Insurance1"}}},
+		},
+		{
+			name:   "create contract",
+			method: http.MethodPost,
+			target: "/v1/contracts",
+			body:   `{"business_id": "Insurance1", "business_type": "Insurance", "amount": 500, "rate": 0.1, "issuer": "insurer"}`,
+			status: http.StatusCreated,
+			calls: []chaincodeCall{{submit: true, function: "CreateContract",
+				args: []string{"alice", "Insurance1", "500.000000", "insurer", "0.100000", "Insurance", "0"}}},
+		},
+		{
+			name:   "create contract in currency",
+			method: http.MethodPost,
+			target: "/v1/contracts",
+			body:   `{"business_id": "Loan1", "business_type": "Loan", "amount": 500, "rate": 0.1, "issuer": "bank", "period": 30, "currency": "USD"}`,
+			status: http.StatusCreated,
+			calls: []chaincodeCall{{submit: true, function: "CreateContractInCurrency",
+				args: []string{"alice", "Loan1", "500.000000", "bank", "0.100000", "Loan", "30", "USD"}}},
+		},
+		{
+			name:   "start loan",
+			method: http.MethodPost,
+			target: "/v1/contracts/loan/Loan1/start",
+			body:   `{"conditions": {"credit": 80, "income": 6000}}`,
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{submit: true, function: "StartLoan", args: []string{"alice", "Loan1", "80.000000", "6000.000000"}}},
+		},
+		{
+			name:   "check loan",
+			method: http.MethodPost,
+			target: "/v1/contracts/loan/Loan1/check",
+			body:   `{"conditions": {"credit": 50, "income": 4000}, "current_time": 1724674565}`,
+			status: http.StatusOK,
+			calls: []chaincodeCall{{submit: true, function: "LoanContractCheck",
+				args: []string{"alice", "Loan1", "50.000000", "4000.000000", "1724674565"}}},
+		},
+		{
+			name:   "check loan in another currency",
+			method: http.MethodPost,
+			target: "/v1/contracts/loan/Loan1/check",
+			body:   `{"conditions": {"credit": 50, "income": 4000}, "current_time": 1724674565, "settlement_currency": "USD"}`,
+			status: http.StatusOK,
+			calls: []chaincodeCall{{submit: true, function: "LoanContractCheckInCurrency",
+				args: []string{"alice", "Loan1", "50.000000", "4000.000000", "1724674565", "USD"}}},
+		},
+		{
+			name:   "check insurance",
+			method: http.MethodPost,
+			target: "/v1/contracts/insurance/Insurance1/check",
+			body:   `{"conditions": {"credit": 70, "income": 8000, "is_sudden": true, "contingency_info": "flood"}}`,
+			status: http.StatusOK,
+			calls: []chaincodeCall{{submit: true, function: "InsuranceContractCheck",
+				args: []string{"alice", "Insurance1", "70.000000", "8000.000000", "true", "flood"}}},
+		},
+		{
+			name:   "transfer",
+			method: http.MethodPost,
+			target: "/v1/users/alice/transfers",
+			body:   `{"target_user_id": "bob", "amount": 12.5}`,
+			status: http.StatusCreated,
+			calls:  []chaincodeCall{{submit: true, function: "TransferCurrency", args: []string{"alice", "bob", "12.500000", "Transfer"}}},
+		},
+		{
+			name:   "transfer with coin selection",
+			method: http.MethodPost,
+			target: "/v1/users/alice/transfers",
+			body:   `{"target_user_id": "bob", "amount": 12.5, "coin_selection": "largest-first"}`,
+			status: http.StatusCreated,
+			calls: []chaincodeCall{{submit: true, function: "TransferCurrencyWithCoinSelection",
+				args: []string{"alice", "bob", "12.500000", "Transfer", "largest-first"}}},
+		},
+		{
+			name:   "transfer in currency",
+			method: http.MethodPost,
+			target: "/v1/users/alice/transfers",
+			body:   `{"target_user_id": "bob", "amount": 12.5, "currency": "USD"}`,
+			status: http.StatusCreated,
+			calls: []chaincodeCall{{submit: true, function: "TransferCurrencyInCurrency",
+				args: []string{"alice", "bob", "12.500000", "USD", "Transfer", ""}}},
+		},
+		{
+			name:   "deposit in currency",
+			method: http.MethodPost,
+			target: "/v1/users/alice/deposits",
+			body:   `{"amount": 100, "currency": "POINTS", "current_time": 1724674565}`,
+			status: http.StatusCreated,
+			calls: []chaincodeCall{{submit: true, function: "CreateCurrency",
+				args: []string{`{"CurrencyID":"Currency1724674565","Amount":100,"Owner":"alice","CreatedAt":"1724674565","CreatedVia":"Deposit","UpdatedAt":"1724674565","UpdatedVia":"Deposit","CurrencyCode":"POINTS"}`}}},
+		},
+		{
+			name:   "coins",
+			method: http.MethodGet,
+			target: "/v1/users/alice/coins",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "ReadCurrencyListByOwner", args: []string{"alice"}}},
+		},
+		{
+			name:   "consolidate coins",
+			method: http.MethodPost,
+			target: "/v1/users/alice/coins/consolidate",
+			body:   `{"max_amount": 5, "max_inputs": 20}`,
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{submit: true, function: "ConsolidateCurrency", args: []string{"alice", "5.000000", "20", ""}}},
+		},
+		{
+			name:   "consolidate coins in currency",
+			method: http.MethodPost,
+			target: "/v1/users/alice/coins/consolidate",
+			body:   `{"currency": "USD"}`,
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{submit: true, function: "ConsolidateCurrency", args: []string{"alice", "0.000000", "0", "USD"}}},
+		},
+		{
+			name:   "account",
+			method: http.MethodGet,
+			target: "/v1/users/alice/account",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "ReadAccount", args: []string{"alice", ""}}},
+		},
+		{
+			name:   "account in currency",
+			method: http.MethodGet,
+			target: "/v1/users/alice/account?currency=USD",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "ReadAccount", args: []string{"alice", "USD"}}},
+		},
+		{
+			name:   "migrate to account",
+			method: http.MethodPost,
+			target: "/v1/users/alice/account/migrate",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{submit: true, function: "MigrateCurrencyToAccount", args: []string{"alice"}}},
+		},
+		{
+			name:   "aggregate account",
+			method: http.MethodPost,
+			target: "/v1/users/alice/account/aggregate",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{submit: true, function: "AggregateAccount", args: []string{"alice", ""}}},
+		},
+		{
+			name:   "currencies",
+			method: http.MethodGet,
+			target: "/v1/currencies",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "ListCurrencies"}},
+		},
+		{
+			name:   "currency",
+			method: http.MethodGet,
+			target: "/v1/currencies/USD",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "ReadCurrencyDefinition", args: []string{"USD"}}},
+		},
+		{
+			name:   "fee schedule",
+			method: http.MethodGet,
+			target: "/v1/fees",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "ReadFeeSchedule"}},
+		},
+		{
+			name:   "fee quote",
+			method: http.MethodGet,
+			target: "/v1/fees/quote?reason=Transfer&amount=250&currency=USD",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "QuoteFee", args: []string{"Transfer", "250.000000", "USD"}}},
+		},
+		{
+			name:   "exchange rates",
+			method: http.MethodGet,
+			target: "/v1/fx/rates",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "ListExchangeRates"}},
+		},
+		{
+			name:   "exchange rate",
+			method: http.MethodGet,
+			target: "/v1/fx/rates/USD/CNY",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "QuoteExchangeRate", args: []string{"USD", "CNY"}}},
+		},
+		{
+			name:   "convert",
+			method: http.MethodPost,
+			target: "/v1/users/alice/conversions",
+			body:   `{"amount": 10, "from": "USD", "to": "CNY"}`,
+			status: http.StatusCreated,
+			calls:  []chaincodeCall{{submit: true, function: "ConvertCurrency", args: []string{"alice", "10.000000", "USD", "CNY"}}},
+		},
+		{
+			name:   "issuer portfolio",
+			user:   "bank",
+			method: http.MethodGet,
+			target: "/v1/issuers/bank/portfolio",
+			status: http.StatusOK,
+			calls:  []chaincodeCall{{function: "ReadIssuerPortfolio", args: []string{"bank"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := test.user
+			if user == "" {
+				user = "alice"
+			}
+			contract := &fakeContract{result: []byte("[]")}
+			recorder, _ := serveAs(t, contract, user, test.method, test.target, test.body)
+
+			if recorder.Code != test.status {
+				t.Fatalf("status = %d, want %d, body = %s", recorder.Code, test.status, recorder.Body.String())
+			}
+			if !reflect.DeepEqual(contract.calls, test.calls) {
+				t.Errorf("chaincode calls = %+v, want %+v", contract.calls, test.calls)
+			}
+		})
+	}
+}
+
+func TestContractListFilter(t *testing.T) {
+	contract := &fakeContract{result: []byte(`[{"BusinessID":"Loan1","State":"Approved"},{"BusinessID":"Loan2","State":"Applied"}]`)}
+	recorder, response := serve(t, contract, http.MethodGet, "/v1/users/alice/contracts?type=loan&state=Approved", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+
+	result, _ := json.Marshal(response.Result)
+	want := `{"insurances":[],"loans":[{"BusinessID":"Loan1","State":"Approved"}]}`
+	if string(result) != want {
+		t.Errorf("result = %s, want %s", result, want)
+	}
+}
+
+func TestInvalidRequestsAreRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		body   string
+	}{
+		{name: "missing target", target: "/ecosys/pay/transfer", body: `{"amount": 10}`},
+		{name: "negative amount", target: "/ecosys/pay/transfer", body: `{"user_id": "alice", "target_user_id": "bob", "amount": -10}`},
+		{name: "transfer to self", target: "/ecosys/pay/transfer", body: `{"target_user_id": "alice", "amount": 10}`},
+		{name: "contract issued to self", target: "/v1/contracts",
+			body: `{"business_id": "Loan1", "business_type": "Loan", "amount": 10, "rate": 0.1, "issuer": "alice", "period": 30}`},
+		{name: "zero deposit", target: "/ecosys/pay/deposit", body: `{"user_id": "alice", "amount": 0}`},
+		{name: "unknown business type", target: "/ecosys/new_contract",
+			body: `{"user_id": "alice", "business_id": "X1", "business_type": "Lease", "amount": 10, "issuer": "bank"}`},
+		{name: "rate out of range", target: "/ecosys/new_contract",
+			body: `{"user_id": "alice", "business_id": "Loan1", "business_type": "Loan", "amount": 10, "rate": 5, "issuer": "bank", "period": 30}`},
+		{name: "loan without period", target: "/ecosys/new_contract",
+			body: `{"user_id": "alice", "business_id": "Loan1", "business_type": "Loan", "amount": 10, "rate": 0.1, "issuer": "bank"}`},
+		{name: "credit out of range", target: "/ecosys/loan/start",
+			body: `{"user_id": "alice", "business_id": "Loan1", "conditions": {"credit": 200, "income": 6000}}`},
+		{name: "malformed JSON", target: "/ecosys/loan/start", body: `{"user_id": `},
+		{name: "unknown coin selection", target: "/v1/users/alice/transfers",
+			body: `{"target_user_id": "bob", "amount": 10, "coin_selection": "cheapest"}`},
+		{name: "too many coins to consolidate", target: "/v1/users/alice/coins/consolidate", body: `{"max_inputs": 1000}`},
+		{name: "lower case currency", target: "/v1/users/alice/transfers", body: `{"target_user_id": "bob", "amount": 10, "currency": "usd"}`},
+		{name: "conversion without target currency", target: "/v1/users/alice/conversions", body: `{"amount": 10, "from": "USD"}`},
+		{name: "insurance settled in another currency", target: "/v1/contracts/insurance/Insurance1/check",
+			body: `{"conditions": {"credit": 70, "income": 8000}, "settlement_currency": "USD"}`},
+		{name: "start settled in another currency", target: "/v1/contracts/loan/Loan1/start",
+			body: `{"conditions": {"credit": 80, "income": 6000}, "settlement_currency": "USD"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			contract := &fakeContract{}
+			recorder, response := serve(t, contract, http.MethodPost, test.target, test.body)
+
+			if recorder.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+			}
+			if response.Error == nil || response.Error.Code != errCodeBadRequest {
+				t.Errorf("error = %+v, want code %s", response.Error, errCodeBadRequest)
+			}
+			if len(contract.calls) != 0 {
+				t.Errorf("chaincode was called for an invalid request: %+v", contract.calls)
+			}
+		})
+	}
+}
+
+func TestChaincodeErrorsMapToHTTPStatus(t *testing.T) {
+	tests := []struct {
+		code   string
+		status int
+	}{
+		{code: errCodeNotFound, status: http.StatusNotFound},
+		{code: errCodeInvalidState, status: http.StatusConflict},
+		{code: errCodeInsufficientFunds, status: http.StatusUnprocessableEntity},
+		{code: errCodeForbidden, status: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			contract := &fakeContract{
+				err: status.Error(codes.Unknown, `chaincode response 500, {"code":"`+test.code+`","message":"failed","details":{"id":"Loan1"}}`),
+			}
+			recorder, response := serve(t, contract, http.MethodPost, "/ecosys/pay/transfer",
+				`{"user_id": "alice", "target_user_id": "bob", "amount": 10}`)
+
+			if recorder.Code != test.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, test.status)
+			}
+			if response.Error == nil || response.Error.Code != test.code || response.Error.Details["id"] != "Loan1" {
+				t.Errorf("error = %+v", response.Error)
+			}
+		})
+	}
+}
+
+func TestRequestsRequireAuthentication(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{name: "no token", method: http.MethodGet, target: "/v1/users/alice/balance", status: http.StatusUnauthorized},
+		{name: "no token legacy", method: http.MethodGet, target: "/ecosys/asset?user_id=alice", status: http.StatusUnauthorized},
+		{name: "other user balance", user: "mallory", method: http.MethodGet, target: "/v1/users/alice/balance", status: http.StatusForbidden},
+		{name: "other user transfer", user: "mallory", method: http.MethodPost, target: "/v1/users/alice/transfers",
+			body: `{"target_user_id": "mallory", "amount": 10}`, status: http.StatusForbidden},
+		{name: "other issuer portfolio", user: "mallory", method: http.MethodGet, target: "/v1/issuers/bank/portfolio", status: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			contract := &fakeContract{}
+			recorder, response := serveAs(t, contract, test.user, test.method, test.target, test.body)
+
+			if recorder.Code != test.status {
+				t.Fatalf("status = %d, want %d, body = %s", recorder.Code, test.status, recorder.Body.String())
+			}
+			if response.Error == nil {
+				t.Errorf("error is not set")
+			}
+			if len(contract.calls) != 0 {
+				t.Errorf("chaincode was called for an unauthorized request: %+v", contract.calls)
+			}
+		})
+	}
+}
+
+func TestLegacyRequestsActAsAuthenticatedUser(t *testing.T) {
+	contract := &fakeContract{result: []byte("true")}
+	recorder, _ := serveAs(t, contract, "mallory", http.MethodPost, "/ecosys/pay/transfer",
+		`{"user_id": "alice", "password": "secret", "target_user_id": "mallory", "amount": 10}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder, _ = serveAs(t, contract, "mallory", http.MethodPost, "/ecosys/pay/transfer",
+		`{"user_id": "alice", "password": "secret", "target_user_id": "bob", "amount": 10}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	want := []chaincodeCall{{submit: true, function: "TransferCurrency", args: []string{"mallory", "bob", "10.000000", "Transfer"}}}
+	if !reflect.DeepEqual(contract.calls, want) {
+		t.Errorf("chaincode calls = %+v, want %+v", contract.calls, want)
+	}
+	if !reflect.DeepEqual(contract.signers, []string{"mallory"}) {
+		t.Errorf("signers = %v, want [mallory]", contract.signers)
+	}
+}
+
+func TestRegisterLoginLogout(t *testing.T) {
+	contract := &fakeContract{result: []byte("100")}
+	router := newRouter(newEcosysService(contract, newMetrics(), serviceOptions{}), newTestAuth(t), newTestIdentities(t), routerOptions{})
+	send := func(method string, target string, token string, body string) (*httptest.ResponseRecorder, Response) {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		return record(t, router, request)
+	}
+
+	credentials := `{"user_id": "alice", "password": "correct horse"}`
+	if recorder, _ := send(http.MethodPost, "/v1/auth/register", "", credentials); recorder.Code != http.StatusCreated {
+		t.Fatalf("register status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder, _ := send(http.MethodPost, "/v1/auth/register", "", credentials); recorder.Code != http.StatusConflict {
+		t.Fatalf("duplicate register status = %d", recorder.Code)
+	}
+	if recorder, _ := send(http.MethodPost, "/v1/auth/login", "", `{"user_id": "alice", "password": "wrong password"}`); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("login with wrong password status = %d", recorder.Code)
+	}
+
+	recorder, response := send(http.MethodPost, "/v1/auth/login", "", credentials)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("login status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	token, _ := response.Result.(map[string]any)["token"].(string)
+
+	if recorder, _ := send(http.MethodGet, "/v1/users/alice/balance", token, ""); recorder.Code != http.StatusOK {
+		t.Fatalf("balance status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder, _ := send(http.MethodPost, "/v1/auth/logout", token, ""); recorder.Code != http.StatusOK {
+		t.Fatalf("logout status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder, _ := send(http.MethodGet, "/v1/users/alice/balance", token, ""); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("balance after logout status = %d", recorder.Code)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	contract := &fakeContract{}
+	auth := newTestAuth(t)
+	router := newRouter(newEcosysService(contract, newMetrics(), serviceOptions{idempotencyRetention: time.Hour}), auth, newTestIdentities(t), routerOptions{})
+	token, _, err := auth.issueToken("alice", roleApplicant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := func(key string) (*httptest.ResponseRecorder, Response) {
+		request := httptest.NewRequest(http.MethodPost, "/ecosys/pay/transfer", strings.NewReader(`{"target_user_id": "bob", "amount": 10}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer "+token)
+		request.Header.Set(idempotencyKeyHeader, key)
+		return record(t, router, request)
+	}
+
+	if recorder, _ := transfer("payment-1"); recorder.Code != http.StatusOK || recorder.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	want := map[string][]byte{transientIdempotencyKey: []byte("payment-1"), transientIdempotencyRetention: []byte("3600")}
+	if transient := contract.calls[0].transient; !reflect.DeepEqual(transient, want) {
+		t.Errorf("transient = %q, want %q", transient, want)
+	}
+
+	// The chaincode rejects a retry with the outcome of the original transaction
+	contract.err = &ChaincodeError{Code: errCodeIdempotentReplay, Details: map[string]string{"transactionId": "tx1", "result": "null"}}
+	recorder, response := transfer("payment-1")
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Idempotent-Replayed") != "true" || response.Error != nil {
+		t.Errorf("replayed status = %d, header = %q, error = %+v", recorder.Code, recorder.Header().Get("Idempotent-Replayed"), response.Error)
+	}
+
+	// The chaincode alone validates the idempotency key
+	contract.err = &ChaincodeError{Code: errCodeInvalidArgument, Message: "idempotency key must be at most 255 printable characters"}
+	recorder, response = transfer(strings.Repeat("k", 256))
+	if recorder.Code != http.StatusBadRequest || response.Error == nil || response.Error.Code != errCodeInvalidArgument {
+		t.Errorf("long idempotency key status = %d, error = %+v", recorder.Code, response.Error)
+	}
+	if key := string(contract.calls[2].transient[transientIdempotencyKey]); key != strings.Repeat("k", 256) {
+		t.Errorf("submitted idempotency key = %q", key)
+	}
+}
+
+func TestFeeSchedule(t *testing.T) {
+	contract := &fakeContract{}
+	auth := newTestAuth(t)
+	router := newRouter(newEcosysService(contract, newMetrics(), serviceOptions{}), auth, newTestIdentities(t), routerOptions{})
+	put := func(role string, body string) *httptest.ResponseRecorder {
+		token, _, err := auth.issueToken("carol", role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := httptest.NewRequest(http.MethodPut, "/v1/fees", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder, _ := record(t, router, request)
+		return recorder
+	}
+
+	schedule := `{"fee_account": "platform", "rules": {
+		"Transfer": {"type": "tiered", "tiers": [{"up_to": 100, "amount": 1}, {"amount": 0.5, "rate": 0.01}]},
+		"Loan": {"type": "percentage", "rate": 0.003}}}`
+	if recorder := put(roleApplicant, schedule); recorder.Code != http.StatusForbidden {
+		t.Errorf("set fees as applicant status = %d", recorder.Code)
+	}
+	for name, body := range map[string]string{
+		"unknown reason":      `{"fee_account": "platform", "rules": {"Deposit": {"type": "flat", "amount": 1}}}`,
+		"unknown type":        `{"fee_account": "platform", "rules": {"Transfer": {"type": "progressive"}}}`,
+		"tiered without tier": `{"fee_account": "platform", "rules": {"Transfer": {"type": "tiered"}}}`,
+		"rate of 100%":        `{"fee_account": "platform", "rules": {"Transfer": {"type": "percentage", "rate": 1}}}`,
+		"no fee account":      `{"rules": {"Transfer": {"type": "flat", "amount": 1}}}`,
+	} {
+		if recorder := put(roleTreasury, body); recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s status = %d", name, recorder.Code)
+		}
+	}
+	if contract.calls != nil {
+		t.Fatalf("invalid schedules reached the chaincode: %+v", contract.calls)
+	}
+
+	if recorder := put(roleTreasury, schedule); recorder.Code != http.StatusOK {
+		t.Fatalf("set fees status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	if len(contract.calls) != 1 || contract.calls[0].function != "SetFeeSchedule" {
+		t.Fatalf("chaincode calls = %+v", contract.calls)
+	}
+	var got, want any
+	if err := json.Unmarshal([]byte(contract.calls[0].args[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal([]byte(`{"FeeAccount": "platform", "Rules": {
+		"Transfer": {"Type": "tiered", "Amount": 0, "Rate": 0, "Tiers": [{"UpTo": 100, "Amount": 1, "Rate": 0}, {"UpTo": 0, "Amount": 0.5, "Rate": 0.01}]},
+		"Loan": {"Type": "percentage", "Amount": 0, "Rate": 0.003, "Tiers": []}}}`), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("fee schedule = %v, want %v", got, want)
+	}
+}
+
+func TestCurrencies(t *testing.T) {
+	contract := &fakeContract{}
+	auth := newTestAuth(t)
+	router := newRouter(newEcosysService(contract, newMetrics(), serviceOptions{}), auth, newTestIdentities(t), routerOptions{})
+	send := func(user string, role string, method string, target string, body string) (*httptest.ResponseRecorder, Response) {
+		token, _, err := auth.issueToken(user, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer "+token)
+		return record(t, router, request)
+	}
+
+	register := `{"code": "POINTS", "name": "Loyalty points", "decimals": 0, "issuer": "bank"}`
+	if recorder, _ := send("alice", roleApplicant, http.MethodPost, "/v1/currencies", register); recorder.Code != http.StatusForbidden {
+		t.Errorf("register as applicant status = %d", recorder.Code)
+	}
+	if recorder, _ := send("carol", roleTreasury, http.MethodPost, "/v1/currencies", `{"code": "BTC", "name": "Bitcoin", "decimals": 8}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("register with 8 decimals status = %d", recorder.Code)
+	}
+	if recorder, _ := send("carol", roleTreasury, http.MethodPost, "/v1/currencies", register); recorder.Code != http.StatusCreated {
+		t.Fatalf("register status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	want := []chaincodeCall{{submit: true, function: "RegisterCurrency", args: []string{"POINTS", "Loyalty points", "0", "bank"}}}
+	if !reflect.DeepEqual(contract.calls, want) {
+		t.Errorf("chaincode calls = %+v, want %+v", contract.calls, want)
+	}
+
+	// A contract is only started if it settles in the currency of the request
+	contract.calls = nil
+	contract.result = []byte(`{"BusinessID":"Loan1","State":"Applied","CurrencyCode":"USD"}`)
+	recorder, response := send("alice", roleApplicant, http.MethodPost, "/v1/contracts/loan/Loan1/start", `{"conditions": {"credit": 80, "income": 6000}, "currency": "CNY"}`)
+	if recorder.Code != http.StatusConflict || response.Error == nil || response.Error.Code != errCodeCurrencyMismatch || response.Error.Details["currency"] != "USD" {
+		t.Errorf("start in another currency status = %d, error = %+v", recorder.Code, response.Error)
+	}
+	if recorder, _ := send("alice", roleApplicant, http.MethodPost, "/v1/contracts/loan/Loan1/start", `{"conditions": {"credit": 80, "income": 6000}, "currency": "USD"}`); recorder.Code != http.StatusOK {
+		t.Errorf("start in the contract currency status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	want = []chaincodeCall{
+		{function: "ReadLoan", args: []string{"alice", "Loan1"}},
+		{function: "ReadLoan", args: []string{"alice", "Loan1"}},
+		{submit: true, function: "StartLoan", args: []string{"alice", "Loan1", "80.000000", "6000.000000"}},
+	}
+	if !reflect.DeepEqual(contract.calls, want) {
+		t.Errorf("chaincode calls = %+v, want %+v", contract.calls, want)
+	}
+
+	// Only the rate oracle posts exchange rates
+	contract.calls = nil
+	contract.result = nil
+	rate := `{"base": "USD", "quote": "CNY", "rate": 7.2, "spread": 0.005, "valid_until": 1724760965}`
+	if recorder, _ := send("carol", roleTreasury, http.MethodPost, "/v1/fx/rates", rate); recorder.Code != http.StatusForbidden {
+		t.Errorf("post rate as treasury status = %d", recorder.Code)
+	}
+	if recorder, _ := send("fx", roleOracle, http.MethodPost, "/v1/fx/rates", `{"base": "USD", "quote": "USD", "rate": 1, "valid_until": 1724760965}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("post rate of a currency in itself status = %d", recorder.Code)
+	}
+	if recorder, _ := send("fx", roleOracle, http.MethodPost, "/v1/fx/rates", `{"base": "USD", "quote": "CNY", "rate": 7.2, "spread": 1, "valid_until": 1724760965}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("post rate with full spread status = %d", recorder.Code)
+	}
+	if recorder, _ := send("fx", roleOracle, http.MethodPost, "/v1/fx/rates", rate); recorder.Code != http.StatusCreated {
+		t.Fatalf("post rate status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	want = []chaincodeCall{{submit: true, function: "PostExchangeRate", args: []string{"USD", "CNY", "7.2", "0.005", "", "1724760965"}}}
+	if !reflect.DeepEqual(contract.calls, want) {
+		t.Errorf("chaincode calls = %+v, want %+v", contract.calls, want)
+	}
+}
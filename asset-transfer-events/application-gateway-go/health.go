@@ -0,0 +1,82 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readinessTimeout bounds the chaincode query made by a readiness check.
+const readinessTimeout = 5 * time.Second
+
+// gatewayHealth reports the connectivity of the Gateway peers and whether the channel can be
+// queried. It is implemented by gatewayPool.
+type gatewayHealth interface {
+	Status() []PeerStatus
+	Ready(ctx context.Context) (uint64, error)
+}
+
+// PeerHealth is the result of the peer health endpoint. Healthy is true if at least one peer can
+// be reached, since requests then fail over to it.
+type PeerHealth struct {
+	Healthy bool         `json:"healthy"`
+	Peers   []PeerStatus `json:"peers"`
+}
+
+// Readiness is the result of the readiness endpoint.
+type Readiness struct {
+	Ready        bool   `json:"ready"`
+	LedgerHeight uint64 `json:"ledger_height,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// registerHealthRoutes registers the health, readiness and metrics endpoints. They do not require
+// an access token, so that load balancers, orchestrators and Prometheus can reach them. The
+// readiness and peer health endpoints are only registered with a gateway health to report.
+func (s *apiServer) registerHealthRoutes(router gin.IRouter) {
+	router.GET("/healthz", s.getLiveness)
+	router.GET("/metrics", s.service.metrics.handler())
+	if s.health != nil {
+		router.GET("/readyz", s.getReadiness)
+		router.GET("/health/peers", s.getPeerHealth)
+	}
+}
+
+// getLiveness reports that the process is up and serving requests.
+func (s *apiServer) getLiveness(c *gin.Context) {
+	respondOK(c, "Liveness Success", gin.H{"status": "up"})
+}
+
+// getReadiness reports whether requests can be served: a peer must be reachable and a query of
+// the channel through it must succeed.
+func (s *apiServer) getReadiness(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	height, err := s.health.Ready(ctx)
+	if err != nil {
+		respondWithStatus(c, http.StatusServiceUnavailable, "Not ready", Readiness{Error: err.Error()})
+		return
+	}
+	s.service.metrics.setLedgerHeight(height)
+	respondOK(c, "Readiness Success", Readiness{Ready: true, LedgerHeight: height})
+}
+
+func (s *apiServer) getPeerHealth(c *gin.Context) {
+	health := PeerHealth{Peers: s.health.Status()}
+	for _, peer := range health.Peers {
+		health.Healthy = health.Healthy || peer.Healthy
+	}
+
+	if !health.Healthy {
+		respondWithStatus(c, http.StatusServiceUnavailable, "No peer is reachable", health)
+		return
+	}
+	respondOK(c, "GetPeerHealth Success", health)
+}
@@ -0,0 +1,98 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeHealth struct {
+	peers  []PeerStatus
+	height uint64
+	err    error
+}
+
+func (f *fakeHealth) Status() []PeerStatus {
+	return f.peers
+}
+
+func (f *fakeHealth) Ready(context.Context) (uint64, error) {
+	return f.height, f.err
+}
+
+func newHealthRouter(t *testing.T, contract *fakeContract, health *fakeHealth) (http.Handler, *authService, *metrics) {
+	t.Helper()
+	auth := newTestAuth(t)
+	service := newEcosysService(contract, newMetrics(), serviceOptions{})
+	return newRouter(service, auth, newTestIdentities(t), routerOptions{health: health}), auth, service.metrics
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	for _, test := range []struct {
+		target string
+		health *fakeHealth
+		want   int
+	}{
+		{"/healthz", &fakeHealth{err: errors.New("no peer is reachable")}, http.StatusOK},
+		{"/readyz", &fakeHealth{height: 42}, http.StatusOK},
+		{"/readyz", &fakeHealth{err: errors.New("no peer is reachable")}, http.StatusServiceUnavailable},
+		{"/health/peers", &fakeHealth{peers: []PeerStatus{{Name: "peer0"}, {Name: "peer1", Healthy: true}}}, http.StatusOK},
+		{"/health/peers", &fakeHealth{peers: []PeerStatus{{Name: "peer0"}}}, http.StatusServiceUnavailable},
+	} {
+		router, _, _ := newHealthRouter(t, &fakeContract{}, test.health)
+		recorder, _ := record(t, router, httptest.NewRequest(http.MethodGet, test.target, nil))
+		if recorder.Code != test.want {
+			t.Errorf("%s status = %d, want %d, body = %s", test.target, recorder.Code, test.want, recorder.Body.String())
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	contract := &fakeContract{result: []byte("100")}
+	router, auth, gatewayMetrics := newHealthRouter(t, contract, &fakeHealth{height: 12})
+	token, _, err := auth.issueToken("alice", roleApplicant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(method string, target string, body string) {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	request(http.MethodGet, "/v1/users/alice/balance", "")
+	contract.result = []byte(`{"Strategy":"random","Inputs":["Currency1"],"Amount":10,"Change":2.5,"Coins":3}`)
+	request(http.MethodPost, "/v1/users/alice/transfers", `{"target_user_id": "bob", "amount": 10, "coin_selection": "random"}`)
+	contract.err = status.Error(codes.DeadlineExceeded, "timed out")
+	request(http.MethodPost, "/v1/users/alice/transfers", `{"target_user_id": "bob", "amount": 10}`)
+	request(http.MethodGet, "/readyz", "")
+	gatewayMetrics.eventReceivedIn("events", 9)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	for _, want := range []string{
+		`ecosys_http_request_duration_seconds_count{method="GET",route="/v1/users/:id/balance",status="200"} 1`,
+		`ecosys_chaincode_duration_seconds_count{function="ReadTotalCurrencyByOwner",operation="evaluate"} 1`,
+		`ecosys_chaincode_errors_total{code="TIMEOUT",function="TransferCurrency",operation="submit"} 1`,
+		`ecosys_currency_coins{owner="alice"} 3`,
+		`ecosys_ledger_height 12`,
+		`ecosys_chaincode_event_lag_blocks{consumer="events"} 2`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+}
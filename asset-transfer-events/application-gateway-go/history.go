@@ -0,0 +1,260 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultHistoryLimit is the number of entries of a history page without a limit.
+const defaultHistoryLimit = 20
+
+// kindFee is the kind of the entry of a fee account collecting the fee of a transfer.
+const kindFee = "fee"
+
+// transferRecord is a movement of currency recorded by the chaincode for one of its parties, in
+// one currency. Delta is the change of the balance of Owner in OwnerCurrency. See
+// chaincode-go/chaincode/history.go.
+type transferRecord struct {
+	TxID          string  `json:"TxID"`
+	From          string  `json:"From"`
+	To            string  `json:"To"`
+	Amount        float32 `json:"Amount"`
+	CurrencyCode  string  `json:"CurrencyCode"`
+	PaidCurrency  string  `json:"PaidCurrency"`
+	PaidAmount    float32 `json:"PaidAmount"`
+	Rate          float64 `json:"Rate"`
+	Fee           float32 `json:"Fee"`
+	FeeAccount    string  `json:"FeeAccount"`
+	Reason        string  `json:"Reason"`
+	ContractID    string  `json:"ContractID"`
+	Timestamp     string  `json:"Timestamp"`
+	Owner         string  `json:"Owner"`
+	OwnerCurrency string  `json:"OwnerCurrency"`
+	Delta         float32 `json:"Delta"`
+}
+
+// transferHistory is a page of the transfer records of a user, newest first.
+type transferHistory struct {
+	Records  []*transferRecord `json:"Records"`
+	Bookmark string            `json:"Bookmark"`
+}
+
+// HistoryQuery selects a page of the history of a user in a currency. Cursor is the next_cursor
+// of the previous page.
+type HistoryQuery struct {
+	Currency string `form:"currency" binding:"omitempty,alphanum,uppercase,min=3,max=10"`
+	Limit    int    `form:"limit" binding:"omitempty,min=1,max=100"`
+	Cursor   string `form:"cursor" binding:"max=1024"`
+}
+
+// StatementEntry is a movement of currency in the history of a user, as on a bank statement.
+// Amount is the change of the balance of the user, including the fee it paid, and Balance the
+// balance after the movement. Kind is one of the projection kinds, or fee.
+type StatementEntry struct {
+	TransactionID string  `json:"transaction_id"`
+	Timestamp     string  `json:"timestamp"`
+	Kind          string  `json:"kind"`
+	Reason        string  `json:"reason"`
+	ContractID    string  `json:"contract_id,omitempty"`
+	Counterparty  string  `json:"counterparty,omitempty"`
+	Amount        float64 `json:"amount"`
+	Fee           float64 `json:"fee,omitempty"`
+	// Rate is set if the movement exchanged currencies.
+	Rate    float64 `json:"rate,omitempty"`
+	Balance float64 `json:"balance"`
+}
+
+// HistoryPage is a page of the history of a user in a currency, newest first. OpeningBalance is
+// the balance before the oldest entry of the page and ClosingBalance after the newest one.
+type HistoryPage struct {
+	UserID         string            `json:"user_id"`
+	Currency       string            `json:"currency"`
+	OpeningBalance float64           `json:"opening_balance"`
+	ClosingBalance float64           `json:"closing_balance"`
+	Entries        []*StatementEntry `json:"entries"`
+	NextCursor     string            `json:"next_cursor,omitempty"`
+}
+
+// historyCursor continues a history after a page: the chaincode bookmark of the next page and the
+// balance before the oldest entry returned so far, which closes the next page.
+type historyCursor struct {
+	Bookmark     string `json:"b"`
+	BalanceCents int64  `json:"c"`
+}
+
+var errInvalidCursor = errors.New("cursor is not a cursor returned by a previous page")
+
+func encodeHistoryCursor(cursor historyCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeHistoryCursor(encoded string) (*historyCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var cursor historyCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Bookmark == "" {
+		return nil, errInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// TransactionHistory returns a page of the transfer records of a user in a currency, newest first.
+func (s *ecosysService) TransactionHistory(ctx context.Context, userID string, currency string, limit int, bookmark string) (*transferHistory, error) {
+	result, err := s.evaluate(ctx, userID, "ReadTransactionHistory", userID, currency, fmt.Sprintf("%d", limit), bookmark)
+	if err != nil {
+		return nil, err
+	}
+	var history transferHistory
+	if err := json.Unmarshal(result, &history); err != nil {
+		return nil, &badPayloadError{function: "ReadTransactionHistory", payload: result}
+	}
+	return &history, nil
+}
+
+// CurrencyBalance returns the balance of a user in a currency, in cents.
+func (s *ecosysService) CurrencyBalance(ctx context.Context, userID string, currency string) (int64, error) {
+	result, err := s.evaluate(ctx, userID, "ReadTotalCurrencyByOwnerInCurrency", userID, currency)
+	if err != nil {
+		return 0, err
+	}
+	var balance float32
+	if err := json.Unmarshal(result, &balance); err != nil {
+		return 0, &badPayloadError{function: "ReadTotalCurrencyByOwnerInCurrency", payload: result}
+	}
+	return toCents(balance), nil
+}
+
+// History returns a page of the history of a user with running balances. The first page closes
+// at the current balance, and each entry before it is worked back from the entry after it.
+//
+// The balance and the first page are read separately, so a movement committed in between makes
+// the running balances of that page off by its amount.
+func (s *ecosysService) History(ctx context.Context, userID string, currency string, limit int, cursor *historyCursor) (*HistoryPage, error) {
+	if currency == "" {
+		currency = defaultCurrencyCode
+	}
+	var bookmark string
+	var balanceCents int64
+	if cursor != nil {
+		bookmark, balanceCents = cursor.Bookmark, cursor.BalanceCents
+	} else {
+		var err error
+		if balanceCents, err = s.CurrencyBalance(ctx, userID, currency); err != nil {
+			return nil, err
+		}
+	}
+	history, err := s.TransactionHistory(ctx, userID, currency, limit, bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &HistoryPage{
+		UserID:         userID,
+		Currency:       currency,
+		ClosingBalance: fromCents(balanceCents),
+		Entries:        []*StatementEntry{},
+	}
+	for _, record := range history.Records {
+		page.Entries = append(page.Entries, statementEntry(userID, record, balanceCents))
+		balanceCents -= toCents(record.Delta)
+	}
+	page.OpeningBalance = fromCents(balanceCents)
+	if history.Bookmark != "" {
+		page.NextCursor = encodeHistoryCursor(historyCursor{Bookmark: history.Bookmark, BalanceCents: balanceCents})
+	}
+	return page, nil
+}
+
+// statementEntry returns the entry of a transfer record in the history of a user, with the
+// balance after it.
+func statementEntry(userID string, record *transferRecord, balanceCents int64) *StatementEntry {
+	entry := &StatementEntry{
+		TransactionID: record.TxID,
+		Timestamp:     record.Timestamp,
+		Kind:          recordKind(userID, record),
+		Reason:        record.Reason,
+		ContractID:    record.ContractID,
+		Amount:        fromCents(toCents(record.Delta)),
+		Balance:       fromCents(balanceCents),
+	}
+	switch userID {
+	case record.From:
+		entry.Counterparty = record.To
+		if currencyOrDefault(record.OwnerCurrency) == currencyOrDefault(record.CurrencyCode) {
+			entry.Fee = fromCents(toCents(record.Fee))
+		}
+	case record.To:
+		entry.Counterparty = record.From
+	default:
+		// The fee account collecting the fee of a transfer
+		entry.Counterparty = record.From
+	}
+	if entry.Counterparty == userID {
+		entry.Counterparty = ""
+	}
+	if record.PaidCurrency != "" && record.PaidCurrency != record.CurrencyCode {
+		entry.Rate = record.Rate
+	}
+	return entry
+}
+
+// recordKind returns the kind of a transfer record in the history of a user. The records of
+// loan and insurance contracts do not tell a disbursement from a repayment, nor a premium from a
+// payout, so they are of kind contract; the contract events of the projection tell them apart.
+func recordKind(userID string, record *transferRecord) string {
+	switch {
+	case record.From == "" && record.Reason == "Deposit":
+		return kindDeposit
+	case record.From == "" && record.Reason == "Fee":
+		// The spread of a conversion paid to the fee account
+		return kindFee
+	case record.From == "":
+		return kindIssuance
+	case userID != record.From && userID != record.To:
+		return kindFee
+	case record.Reason == "Convert":
+		return kindConversion
+	case record.Reason == "Loan" || record.Reason == "Insurance":
+		return kindContract
+	default:
+		return kindTransfer
+	}
+}
+
+// getHistory returns the history of a user in a currency as a statement with running balances.
+func (s *apiServer) getHistory(c *gin.Context) {
+	var query HistoryQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	var cursor *historyCursor
+	if query.Cursor != "" {
+		var err error
+		if cursor, err = decodeHistoryCursor(query.Cursor); err != nil {
+			respondBadRequest(c, err)
+			return
+		}
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultHistoryLimit
+	}
+	result, err := s.service.History(c.Request.Context(), c.Param("id"), query.Currency, query.Limit, cursor)
+	if err != nil {
+		respondError(c, "GetHistory Failed", err)
+		return
+	}
+	respondOK(c, "GetHistory Success", result)
+}
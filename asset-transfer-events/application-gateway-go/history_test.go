@@ -0,0 +1,99 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// historyPage decodes the history page of a response.
+func historyPage(t *testing.T, response Response) *HistoryPage {
+	t.Helper()
+	data, err := json.Marshal(response.Result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page HistoryPage
+	if err := json.Unmarshal(data, &page); err != nil {
+		t.Fatal(err)
+	}
+	return &page
+}
+
+func TestHistoryRunsBalancesBackFromTheCurrentBalance(t *testing.T) {
+	contract := &fakeContract{results: map[string][]byte{
+		"ReadTotalCurrencyByOwnerInCurrency": []byte(`949`),
+		"ReadTransactionHistory": []byte(`{"Records": [
+			{"TxID": "tx3", "From": "alice", "To": "bob", "Amount": 50, "CurrencyCode": "CNY", "PaidCurrency": "CNY", "PaidAmount": 50,
+			 "Fee": 1, "FeeAccount": "platform", "Reason": "Transfer", "Timestamp": "1003", "Owner": "alice", "OwnerCurrency": "CNY", "Delta": -51},
+			{"TxID": "tx2", "From": "bank", "To": "alice", "Amount": 100, "CurrencyCode": "CNY", "PaidCurrency": "CNY", "PaidAmount": 100,
+			 "Reason": "Loan", "ContractID": "Loan1", "Timestamp": "1002", "Owner": "alice", "OwnerCurrency": "CNY", "Delta": 100}],
+			"Bookmark": "next"}`),
+	}}
+	recorder, response := serve(t, contract, http.MethodGet, "/v1/users/alice/history?limit=2", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	want := []chaincodeCall{
+		{function: "ReadTotalCurrencyByOwnerInCurrency", args: []string{"alice", "CNY"}},
+		{function: "ReadTransactionHistory", args: []string{"alice", "CNY", "2", ""}},
+	}
+	if !reflect.DeepEqual(contract.calls, want) {
+		t.Errorf("chaincode calls = %+v, want %+v", contract.calls, want)
+	}
+
+	page := historyPage(t, response)
+	wantEntries := []*StatementEntry{
+		{TransactionID: "tx3", Timestamp: "1003", Kind: kindTransfer, Reason: "Transfer", Counterparty: "bob", Amount: -51, Fee: 1, Balance: 949},
+		{TransactionID: "tx2", Timestamp: "1002", Kind: kindContract, Reason: "Loan", ContractID: "Loan1", Counterparty: "bank", Amount: 100, Balance: 1000},
+	}
+	if page.ClosingBalance != 949 || page.OpeningBalance != 900 || !reflect.DeepEqual(page.Entries, wantEntries) {
+		t.Errorf("page = %+v, entries = %+v", page, page.Entries)
+	}
+	if page.NextCursor == "" {
+		t.Fatal("no cursor to the next page")
+	}
+
+	// The next page closes at the opening balance of the previous one
+	contract.calls = nil
+	contract.results["ReadTransactionHistory"] = []byte(`{"Records": [
+		{"TxID": "tx1", "To": "alice", "Amount": 900, "CurrencyCode": "CNY", "Reason": "Deposit", "Timestamp": "1001", "Owner": "alice", "OwnerCurrency": "CNY", "Delta": 900}],
+		"Bookmark": ""}`)
+	_, response = serve(t, contract, http.MethodGet, "/v1/users/alice/history?limit=2&cursor="+page.NextCursor, "")
+	want = []chaincodeCall{{function: "ReadTransactionHistory", args: []string{"alice", "CNY", "2", "next"}}}
+	if !reflect.DeepEqual(contract.calls, want) {
+		t.Errorf("chaincode calls = %+v, want %+v", contract.calls, want)
+	}
+	page = historyPage(t, response)
+	if page.ClosingBalance != 900 || page.OpeningBalance != 0 || len(page.Entries) != 1 || page.Entries[0].Balance != 900 || page.NextCursor != "" {
+		t.Errorf("page = %+v", page)
+	}
+
+	if recorder, _ := serve(t, contract, http.MethodGet, "/v1/users/alice/history?cursor=bogus", ""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("invalid cursor status = %d", recorder.Code)
+	}
+}
+
+func TestHistoryShowsTheRateOfConversions(t *testing.T) {
+	record := &transferRecord{TxID: "tx1", From: "alice", To: "alice", Amount: 71.28, CurrencyCode: "CNY", PaidCurrency: "USD", PaidAmount: 10,
+		Rate: 7.128, Reason: "Convert", Owner: "alice", OwnerCurrency: "USD", Delta: -10}
+	entry := statementEntry("alice", record, 4000)
+	want := &StatementEntry{TransactionID: "tx1", Kind: kindConversion, Reason: "Convert", Amount: -10, Rate: 7.128, Balance: 40}
+	if !reflect.DeepEqual(entry, want) {
+		t.Errorf("entry = %+v, want %+v", entry, want)
+	}
+}
+
+func TestHistoryShowsTheConversionSpreadAsAFee(t *testing.T) {
+	record := &transferRecord{TxID: "tx1", To: "platform", Amount: 0.02, CurrencyCode: "USD", Reason: "Fee", Owner: "platform", OwnerCurrency: "USD", Delta: 0.02}
+	entry := statementEntry("platform", record, 2)
+	want := &StatementEntry{TransactionID: "tx1", Kind: kindFee, Reason: "Fee", Amount: 0.02, Balance: 0.02}
+	if !reflect.DeepEqual(entry, want) {
+		t.Errorf("entry = %+v, want %+v", entry, want)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registerLegacyRoutes keeps the original /ecosys routes working for the current frontend. They
+// call the same service layer as the /v1 routes. New clients should use the /v1 routes instead.
+//
+// Like the /v1 routes they require an access token, and act as the authenticated user. The user_id,
+// password and issuer_id fields still sent by older clients are ignored.
+// Submissions accept the Idempotency-Key and Prefer headers of the /v1 routes.
+func (s *apiServer) registerLegacyRoutes(router gin.IRouter) {
+	legacy := router.Group("/ecosys", s.requireAuth)
+	legacy.GET("/asset", s.legacyQueryAsset)
+	legacy.GET("/contract", s.legacyQueryContracts)
+	legacy.GET("/query_contract", s.legacyQueryContract)
+	legacy.GET("/issuer/contract", s.legacyQueryIssuerContracts)
+	legacy.GET("/issuer/portfolio", s.legacyQueryIssuerPortfolio)
+
+	legacy.POST("/new_contract", s.legacyCreateContract)
+	legacy.POST("/loan/start", s.legacyStartLoan)
+	legacy.POST("/loan/check_contract", s.legacyCheckLoan)
+	legacy.POST("/insurance/start", s.legacyStartInsurance)
+	legacy.POST("/insurance/check_contract", s.legacyCheckInsurance)
+	legacy.POST("/pay/transfer", s.legacyTransfer)
+	legacy.POST("/pay/deposit", s.legacyDeposit)
+}
+
+// bindLegacyQuery binds a legacy GET request. The frontend sends query parameters, while older
+// clients send a JSON body; the body is only read when there is one. The frontend names the
+// business type "type", which is accepted as an alias of "business_type".
+func bindLegacyQuery(c *gin.Context, request any) error {
+	if c.Request.ContentLength > 0 {
+		return c.ShouldBindJSON(request)
+	}
+	query := c.Request.URL.Query()
+	if query.Get("business_type") == "" && query.Get("type") != "" {
+		query.Set("business_type", query.Get("type"))
+		c.Request.URL.RawQuery = query.Encode()
+	}
+	return c.ShouldBindQuery(request)
+}
+
+func (s *apiServer) legacyQueryAsset(c *gin.Context) {
+	result, err := s.service.Balance(c.Request.Context(), authenticatedUser(c))
+	if err != nil {
+		respondError(c, "GetAllAssets Failed", err)
+		return
+	}
+	respondOK(c, "GetAllAssets Success", result)
+}
+
+func (s *apiServer) legacyQueryContracts(c *gin.Context) {
+	result, err := s.service.Contracts(c.Request.Context(), authenticatedUser(c))
+	if err != nil {
+		respondError(c, "GetAllContracts Failed", err)
+		return
+	}
+	respondOK(c, "GetAllContracts Success", result)
+}
+
+func (s *apiServer) legacyQueryContract(c *gin.Context) {
+	var request ContractQueryByIDRequest
+	if err := bindLegacyQuery(c, &request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	result, err := s.service.Contract(c.Request.Context(), authenticatedUser(c), request.BusinessType, request.BusinessID)
+	if err != nil {
+		respondError(c, "GetContract Failed", err)
+		return
+	}
+	respondOK(c, "GetContract Success", result)
+}
+
+func (s *apiServer) legacyQueryIssuerContracts(c *gin.Context) {
+	result, err := s.service.IssuerContracts(c.Request.Context(), authenticatedUser(c))
+	if err != nil {
+		respondError(c, "GetIssuerContracts Failed", err)
+		return
+	}
+	respondOK(c, "GetIssuerContracts Success", result)
+}
+
+func (s *apiServer) legacyQueryIssuerPortfolio(c *gin.Context) {
+	result, err := s.service.IssuerPortfolio(c.Request.Context(), authenticatedUser(c))
+	if err != nil {
+		respondError(c, "GetIssuerPortfolio Failed", err)
+		return
+	}
+	respondOK(c, "GetIssuerPortfolio Success", result)
+}
+
+func (s *apiServer) legacyCreateContract(c *gin.Context) {
+	var request CreateContractRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	if !requireCounterparty(c, "issuer", request.Issuer) {
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.CreateContract(ctx, authenticatedUser(c), request.BusinessID, request.Amount, request.Issuer, request.Rate, request.BusinessType, request.Period, "")
+	if err != nil {
+		respondError(c, "Create Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "Create", result)
+}
+
+func (s *apiServer) legacyStartLoan(c *gin.Context) {
+	var request ContractActionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.StartLoan(ctx, authenticatedUser(c), request.BusinessID, request.Conditions.Credit, request.Conditions.Income)
+	if err != nil {
+		respondError(c, "Loan Start Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "Loan Start", result)
+}
+
+func (s *apiServer) legacyCheckLoan(c *gin.Context) {
+	var request ContractActionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.CheckLoan(ctx, authenticatedUser(c), request.BusinessID, request.Conditions.Credit, request.Conditions.Income, timestampOrNow(request.CurrentTime), "")
+	if err != nil {
+		respondError(c, "Loan Check Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "Loan Check", result)
+}
+
+func (s *apiServer) legacyStartInsurance(c *gin.Context) {
+	var request ContractActionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.StartInsurance(ctx, authenticatedUser(c), request.BusinessID, request.Conditions.Credit, request.Conditions.Income)
+	if err != nil {
+		respondError(c, "Insurance Start Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "Insurance Start", result)
+}
+
+func (s *apiServer) legacyCheckInsurance(c *gin.Context) {
+	var request ContractActionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	conditions := request.Conditions
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.CheckInsurance(ctx, authenticatedUser(c), request.BusinessID, conditions.Credit, conditions.Income, conditions.IsSudden, conditions.ContingencyInfo)
+	if err != nil {
+		respondError(c, "Insurance Check Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "Insurance Check", result)
+}
+
+func (s *apiServer) legacyTransfer(c *gin.Context) {
+	var request PayTransferRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	if !requireCounterparty(c, "target_user_id", request.TargetUserID) {
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.Transfer(ctx, authenticatedUser(c), request.TargetUserID, request.Amount, "", "")
+	if err != nil {
+		respondError(c, "Pay Transfer Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "Pay Transfer", result)
+}
+
+func (s *apiServer) legacyDeposit(c *gin.Context) {
+	var request DepositRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	ctx, submission := s.submitContext(c)
+	result, err := s.service.Deposit(ctx, authenticatedUser(c), request.Amount, "", timestampOrNow(request.CurrentTime))
+	if err != nil {
+		respondError(c, "Deposit Failed", err)
+		return
+	}
+	respondSubmitted(c, submission, http.StatusOK, "Deposit", result)
+}
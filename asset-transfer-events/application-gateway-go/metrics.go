@@ -0,0 +1,190 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Chaincode operations, used as the operation label of the chaincode metrics.
+const (
+	operationEvaluate = "evaluate"
+	operationSubmit   = "submit"
+)
+
+// metrics holds the Prometheus metrics of the gateway, in a registry of its own so that tests
+// can create as many as they need.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requestDuration      *prometheus.HistogramVec
+	chaincodeDuration    *prometheus.HistogramVec
+	chaincodeErrors      *prometheus.CounterVec
+	commitStatusTimeouts *prometheus.CounterVec
+	chaincodeRetries     *prometheus.CounterVec
+	coinCount            *prometheus.GaugeVec
+	ledgerHeight         prometheus.Gauge
+	eventBlock           *prometheus.GaugeVec
+	eventLag             *prometheus.GaugeVec
+
+	mu         sync.Mutex
+	height     uint64
+	lastEvents map[string]uint64
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry:   prometheus.NewRegistry(),
+		lastEvents: map[string]uint64{},
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "ecosys_http_request_duration_seconds",
+			Help: "Latency of HTTP requests by route and status code.",
+		}, []string{"method", "route", "status"}),
+		chaincodeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ecosys_chaincode_duration_seconds",
+			Help:    "Latency of chaincode evaluations and submissions, including commit for submissions.",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"operation", "function"}),
+		chaincodeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ecosys_chaincode_errors_total",
+			Help: "Failed chaincode evaluations and submissions by error code.",
+		}, []string{"operation", "function", "code"}),
+		commitStatusTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ecosys_commit_status_timeouts_total",
+			Help: "Submitted transactions whose commit status was not received in time.",
+		}, []string{"function"}),
+		chaincodeRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ecosys_chaincode_retries_total",
+			Help: "Submissions endorsed again after a read conflict or an aborted endorsement, by reason.",
+		}, []string{"function", "reason"}),
+		coinCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ecosys_currency_coins",
+			Help: "Unspent currency coins (UTXOs) of each owner, as of the last listing, coin-selected transfer or consolidation.",
+		}, []string{"owner"}),
+		ledgerHeight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ecosys_ledger_height",
+			Help: "Height of the channel ledger, as of the last readiness check.",
+		}),
+		eventBlock: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ecosys_chaincode_event_block",
+			Help: "Block number of the last chaincode event received by each event consumer.",
+		}, []string{"consumer"}),
+		eventLag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ecosys_chaincode_event_lag_blocks",
+			Help: "Blocks committed since the block of the last chaincode event received by each event consumer. Blocks without events of this chaincode also count.",
+		}, []string{"consumer"}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.requestDuration,
+		m.chaincodeDuration,
+		m.chaincodeErrors,
+		m.commitStatusTimeouts,
+		m.chaincodeRetries,
+		m.coinCount,
+		m.ledgerHeight,
+		m.eventBlock,
+		m.eventLag,
+	)
+	return m
+}
+
+// handler serves the metrics in the Prometheus text format.
+func (m *metrics) handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// observeRequests is middleware recording the latency of every request by route template, so
+// that /v1/users/alice/balance and /v1/users/bob/balance are counted together.
+func (m *metrics) observeRequests(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	m.requestDuration.WithLabelValues(c.Request.Method, route, fmt.Sprintf("%d", c.Writer.Status())).Observe(time.Since(start).Seconds())
+}
+
+// observeChaincode records the latency and outcome of a chaincode evaluation or submission.
+func (m *metrics) observeChaincode(operation string, function string, start time.Time, err error) {
+	m.chaincodeDuration.WithLabelValues(operation, function).Observe(time.Since(start).Seconds())
+	if err == nil {
+		return
+	}
+
+	m.chaincodeErrors.WithLabelValues(operation, function, toAPIError(err).Code).Inc()
+	var commitStatusErr *client.CommitStatusError
+	if errors.As(err, &commitStatusErr) && (status.Code(err) == codes.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded)) {
+		m.commitStatusTimeouts.WithLabelValues(function).Inc()
+	}
+}
+
+// observeRetry records a submission retried for reason, a validation code or gateway error code.
+func (m *metrics) observeRetry(function string, reason string) {
+	m.chaincodeRetries.WithLabelValues(function, reason).Inc()
+}
+
+// setCoinCount records the number of unspent coins of an owner.
+func (m *metrics) setCoinCount(owner string, coins int) {
+	m.coinCount.WithLabelValues(owner).Set(float64(coins))
+}
+
+// setLedgerHeight records the ledger height found by a readiness check.
+func (m *metrics) setLedgerHeight(height uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.height = height
+	m.ledgerHeight.Set(float64(height))
+	m.updateEventLag()
+}
+
+// knownLedgerHeight returns the ledger height found by the last readiness check or implied by
+// the last event received, or zero if it is not known yet.
+func (m *metrics) knownLedgerHeight() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.height
+}
+
+// eventReceivedIn records the block of a chaincode event received by an event consumer.
+func (m *metrics) eventReceivedIn(consumer string, blockNumber uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastEvents[consumer] = blockNumber
+	m.eventBlock.WithLabelValues(consumer).Set(float64(blockNumber))
+	if blockNumber >= m.height {
+		m.height = blockNumber + 1
+	}
+	m.updateEventLag()
+}
+
+// updateEventLag sets the event lag of every consumer that has received an event, once the
+// ledger height is known. The caller must hold the lock.
+func (m *metrics) updateEventLag() {
+	if m.height == 0 {
+		return
+	}
+	for consumer, lastEvent := range m.lastEvents {
+		var lag uint64
+		if m.height > lastEvent+1 {
+			lag = m.height - 1 - lastEvent
+		}
+		m.eventLag.WithLabelValues(consumer).Set(float64(lag))
+	}
+}
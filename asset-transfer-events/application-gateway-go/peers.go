@@ -0,0 +1,263 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// Peer selection policies.
+const (
+	// selectPriority sends all traffic to the first healthy peer in configuration order, and
+	// moves back to a preferred peer once it has recovered.
+	selectPriority = "priority"
+	// selectRoundRobin spreads users over the healthy peers. A user stays on its peer while the
+	// peer is healthy, since each user has its own Gateway connection.
+	selectRoundRobin = "round_robin"
+)
+
+var errNoPeers = errors.New("no peer is configured")
+
+// peerConnection is the gRPC connection to one Gateway peer and its last known health.
+type peerConnection struct {
+	config     PeerConfig
+	connection *grpc.ClientConn
+
+	mu                  sync.Mutex
+	healthy             bool
+	state               connectivity.State
+	lastChecked         time.Time
+	lastError           string
+	consecutiveFailures int
+}
+
+func (c *peerConnection) isHealthy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.healthy
+}
+
+func (c *peerConnection) name() string {
+	if c.config.HostOverride != "" {
+		return c.config.HostOverride
+	}
+	return c.config.Endpoint
+}
+
+func (c *peerConnection) record(state connectivity.State, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+	c.lastChecked = time.Now()
+	c.healthy = err == nil
+	if err != nil {
+		c.lastError = err.Error()
+		c.consecutiveFailures++
+	} else {
+		c.lastError = ""
+		c.consecutiveFailures = 0
+	}
+}
+
+// PeerStatus is the connectivity of one peer, as reported by the peer health endpoint.
+type PeerStatus struct {
+	Name                string    `json:"name"`
+	Endpoint            string    `json:"endpoint"`
+	Org                 string    `json:"org,omitempty"`
+	State               string    `json:"state"`
+	Healthy             bool      `json:"healthy"`
+	Preferred           bool      `json:"preferred"`
+	LastChecked         time.Time `json:"last_checked"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+// peerPool holds a connection to every configured peer, checks their health in the background
+// and selects the peer for new Gateway connections.
+type peerPool struct {
+	peers     []*peerConnection
+	selection string
+	interval  time.Duration
+	timeout   time.Duration
+
+	mu   sync.Mutex
+	next int
+}
+
+// newPeerPool creates the gRPC connections to the peers. No connection is dialled until the
+// first health check or request.
+func newPeerPool(config *Config) (*peerPool, error) {
+	pool := &peerPool{
+		selection: config.PeerSelection,
+		interval:  config.HealthCheck.Interval,
+		timeout:   config.HealthCheck.Timeout,
+	}
+	for _, peer := range config.Peers {
+		connection, err := newGrpcConnection(peer)
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		// Peers are assumed healthy until checked, so that requests are not refused at startup
+		pool.peers = append(pool.peers, &peerConnection{config: peer, connection: connection, healthy: true, state: connectivity.Idle})
+	}
+	if len(pool.peers) == 0 {
+		return nil, errNoPeers
+	}
+	return pool, nil
+}
+
+// Close closes the connections to all peers.
+func (p *peerPool) Close() {
+	for _, peer := range p.peers {
+		if peer.connection != nil {
+			peer.connection.Close()
+		}
+	}
+}
+
+// pick selects the peer for a new Gateway connection. If no peer is healthy, the preferred peer
+// is returned anyway; requests then fail until a peer recovers.
+func (p *peerPool) pick() *peerConnection {
+	if p.selection == selectRoundRobin {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for i := range p.peers {
+			peer := p.peers[(p.next+i)%len(p.peers)]
+			if peer.isHealthy() {
+				p.next = (p.next + i + 1) % len(p.peers)
+				return peer
+			}
+		}
+		return p.peers[0]
+	}
+	return p.preferred()
+}
+
+// preferred returns the first healthy peer in configuration order.
+func (p *peerPool) preferred() *peerConnection {
+	for _, peer := range p.peers {
+		if peer.isHealthy() {
+			return peer
+		}
+	}
+	return p.peers[0]
+}
+
+// healthy reports whether any peer is healthy.
+func (p *peerPool) healthy() bool {
+	for _, peer := range p.peers {
+		if peer.isHealthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// keep reports whether a Gateway connected through peer should stay on it.
+func (p *peerPool) keep(peer *peerConnection) bool {
+	if p.selection == selectRoundRobin {
+		return peer.isHealthy()
+	}
+	return peer == p.preferred()
+}
+
+// reportFailure marks a peer unhealthy after a request to it failed because it was unreachable,
+// so that the next request fails over without waiting for the health check.
+func (p *peerPool) reportFailure(peer *peerConnection, err error) {
+	if status.Code(err) != codes.Unavailable {
+		return
+	}
+	log.Printf("Peer %s is unavailable: %v", peer.name(), err)
+	peer.record(peer.connection.GetState(), err)
+}
+
+// Run checks the health of all peers every interval until the context is cancelled.
+func (p *peerPool) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.CheckAll(ctx)
+		}
+	}
+}
+
+// CheckAll checks the health of all peers concurrently.
+func (p *peerPool) CheckAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, peer := range p.peers {
+		wg.Add(1)
+		go func(peer *peerConnection) {
+			defer wg.Done()
+			p.check(ctx, peer)
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// check waits up to the health check timeout for the connection to a peer to become ready,
+// reconnecting it if it is idle or failed.
+func (p *peerPool) check(ctx context.Context, peer *peerConnection) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	wasHealthy := peer.isHealthy()
+	state := peer.connection.GetState()
+	if state == connectivity.Idle || state == connectivity.TransientFailure {
+		peer.connection.Connect()
+	}
+	for state != connectivity.Ready {
+		if !peer.connection.WaitForStateChange(ctx, state) {
+			break
+		}
+		state = peer.connection.GetState()
+	}
+
+	var err error
+	if state != connectivity.Ready {
+		err = fmt.Errorf("connection is %s after %s", state, p.timeout)
+	}
+	peer.record(state, err)
+
+	if healthy := err == nil; healthy != wasHealthy {
+		log.Printf("Peer %s is now %s", peer.name(), map[bool]string{true: "healthy", false: "unhealthy"}[healthy])
+	}
+}
+
+// Status returns the connectivity of every peer.
+func (p *peerPool) Status() []PeerStatus {
+	preferred := p.preferred()
+	statuses := make([]PeerStatus, 0, len(p.peers))
+	for _, peer := range p.peers {
+		peer.mu.Lock()
+		statuses = append(statuses, PeerStatus{
+			Name:                peer.name(),
+			Endpoint:            peer.config.Endpoint,
+			Org:                 peer.config.Org,
+			State:               peer.state.String(),
+			Healthy:             peer.healthy,
+			Preferred:           peer == preferred,
+			LastChecked:         peer.lastChecked,
+			LastError:           peer.lastError,
+			ConsecutiveFailures: peer.consecutiveFailures,
+		})
+		peer.mu.Unlock()
+	}
+	return statuses
+}
@@ -0,0 +1,130 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// newTestPeerPool creates a peer pool with plaintext connections to the given addresses.
+func newTestPeerPool(t *testing.T, selection string, addresses ...string) *peerPool {
+	t.Helper()
+	pool := &peerPool{selection: selection, interval: time.Hour, timeout: time.Second}
+	for _, address := range addresses {
+		connection, err := grpc.NewClient("passthrough:///"+address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.peers = append(pool.peers, &peerConnection{config: PeerConfig{Endpoint: address}, connection: connection, healthy: true})
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+var errUnavailable = status.Error(codes.Unavailable, "connection refused")
+
+func TestPeerSelection(t *testing.T) {
+	pool := newTestPeerPool(t, selectPriority, "peer0:7051", "peer1:7051", "peer2:7051")
+	peer0, peer1, peer2 := pool.peers[0], pool.peers[1], pool.peers[2]
+
+	if pool.pick() != peer0 {
+		t.Errorf("priority selection did not pick the first peer")
+	}
+	pool.reportFailure(peer0, errors.New("chaincode error"))
+	if !peer0.isHealthy() {
+		t.Errorf("peer was marked down by an error that is not about connectivity")
+	}
+	pool.reportFailure(peer0, errUnavailable)
+	if pool.pick() != peer1 || pool.keep(peer0) {
+		t.Errorf("priority selection did not fail over to the second peer")
+	}
+	peer0.record(0, nil)
+	if !pool.keep(peer0) || pool.keep(peer1) {
+		t.Errorf("priority selection did not move back to the recovered peer")
+	}
+
+	pool.selection = selectRoundRobin
+	pool.reportFailure(peer1, errUnavailable)
+	var picked []*peerConnection
+	for i := 0; i < 4; i++ {
+		picked = append(picked, pool.pick())
+	}
+	if picked[0] != peer0 || picked[1] != peer2 || picked[2] != peer0 || picked[3] != peer2 {
+		t.Errorf("round robin selection did not skip the unhealthy peer")
+	}
+	if !pool.keep(peer2) || pool.keep(peer1) {
+		t.Errorf("round robin selection moved a user off a healthy peer")
+	}
+}
+
+func TestPeerHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	go server.Serve(listener)
+	defer server.Stop()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	pool := newTestPeerPool(t, selectPriority, closed.Addr().String(), listener.Addr().String())
+	pool.CheckAll(context.Background())
+
+	statuses := pool.Status()
+	if statuses[0].Healthy || statuses[0].LastError == "" || statuses[0].ConsecutiveFailures != 1 {
+		t.Errorf("unreachable peer = %+v", statuses[0])
+	}
+	if !statuses[1].Healthy || statuses[1].State != "READY" || !statuses[1].Preferred {
+		t.Errorf("reachable peer = %+v", statuses[1])
+	}
+}
+
+func TestGatewayFailsOverBetweenPeers(t *testing.T) {
+	userWallet := newTestWallet(t)
+	certificatePEM, privateKeyPEM := newTestCredentials(t, "alice")
+	id, err := newWalletIdentity(testMSPID, certificatePEM, privateKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userWallet.Put("alice", id); err != nil {
+		t.Fatal(err)
+	}
+
+	peers := newTestPeerPool(t, selectPriority, "peer0:7051", "peer1:7051")
+	pool := newGatewayPool(peers, userWallet, defaultConfig(), nil)
+	defer pool.Close()
+
+	contract, err := pool.contract("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contract.peer != peers.peers[0] {
+		t.Fatalf("gateway connected through %s", contract.peer.name())
+	}
+
+	peers.reportFailure(peers.peers[0], errUnavailable)
+	if contract, _ = pool.contract("alice"); contract.peer != peers.peers[1] {
+		t.Errorf("gateway was not reconnected through the second peer")
+	}
+
+	peers.peers[0].record(0, nil)
+	if contract, _ = pool.contract("alice"); contract.peer != peers.peers[0] {
+		t.Errorf("gateway was not moved back to the recovered peer")
+	}
+}
@@ -0,0 +1,540 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// Kinds of projected transactions.
+const (
+	kindDeposit          = "deposit"
+	kindIssuance         = "issuance"
+	kindTransfer         = "transfer"
+	kindConversion       = "conversion"
+	kindContract         = "contract"
+	kindLoanDisbursement = "loan_disbursement"
+	kindLoanRepayment    = "loan_repayment"
+	kindInsurancePremium = "insurance_premium"
+	kindInsurancePayout  = "insurance_payout"
+)
+
+// defaultProjectionLimit is the number of results of a projection query without a limit.
+const defaultProjectionLimit = 20
+
+// contractEvent is the payload of the loan and insurance events: the contract after the
+// transaction. Period is only set for loans.
+type contractEvent struct {
+	BusinessID string  `json:"BusinessID"`
+	Amount     float32 `json:"Amount"`
+	Issuer     string  `json:"Issuer"`
+	State      string  `json:"State"`
+	Period     int     `json:"Period"`
+	Rate       float32 `json:"Rate"`
+	Applicant  string  `json:"Applicant"`
+	CreatedAt  string  `json:"CreatedAt"`
+	UpdatedAt  string  `json:"UpdatedAt"`
+	// CurrencyCode is empty for contracts created before currencies were introduced.
+	CurrencyCode string `json:"CurrencyCode"`
+	// RepaymentCurrency is set if a loan was repaid in another currency, RepaymentAmount in that
+	// currency at RepaymentRate.
+	RepaymentCurrency string  `json:"RepaymentCurrency"`
+	RepaymentAmount   float32 `json:"RepaymentAmount"`
+	RepaymentRate     float64 `json:"RepaymentRate"`
+	// Fee was paid to FeeAccount by the sender of the currency moved by the transaction.
+	Fee        float32 `json:"Fee"`
+	FeeAccount string  `json:"FeeAccount"`
+}
+
+// transferEvent is the payload of the TransferCurrency event.
+type transferEvent struct {
+	From      string  `json:"From"`
+	To        string  `json:"To"`
+	Amount    float32 `json:"Amount"`
+	Reason    string  `json:"Reason"`
+	Timestamp string  `json:"Timestamp"`
+	// CurrencyCode is empty in events of chaincode that predates currencies.
+	CurrencyCode string `json:"CurrencyCode"`
+	// Fee is paid by From to FeeAccount on top of Amount.
+	Fee        float32 `json:"Fee"`
+	FeeAccount string  `json:"FeeAccount"`
+}
+
+// conversionEvent is the payload of the ConvertCurrency event.
+type conversionEvent struct {
+	Owner         string  `json:"Owner"`
+	FromCurrency  string  `json:"FromCurrency"`
+	FromAmount    float32 `json:"FromAmount"`
+	ToCurrency    string  `json:"ToCurrency"`
+	ToAmount      float32 `json:"ToAmount"`
+	EffectiveRate float64 `json:"EffectiveRate"`
+	Timestamp     string  `json:"Timestamp"`
+	// SpreadAmount in ToCurrency was paid to FeeAccount out of the converted amount.
+	SpreadAmount float32 `json:"SpreadAmount"`
+	FeeAccount   string  `json:"FeeAccount"`
+}
+
+// projection maintains a local read model of balances, contracts and transaction history from
+// chaincode events, so that reads do not need to evaluate transactions on a peer.
+//
+// Amounts are kept per currency; events without a currency code are in the default currency.
+//
+// A transaction only emits its last chaincode event. Currency moved by a loan or insurance
+// contract is therefore inferred from the state the contract moved to, the same way the
+// chaincode computes it.
+type projection struct {
+	store   *projectionStore
+	metrics *metrics
+}
+
+func newProjection(store *projectionStore, metrics *metrics) *projection {
+	return &projection{store: store, metrics: metrics}
+}
+
+// register registers the projection handlers with an event consumer. The consumer must use the
+// projection store as its checkpointer and start at block 0, so that the projection sees every
+// transaction.
+func (p *projection) register(consumer *eventConsumer) {
+	for _, eventName := range []string{
+		eventCreateCurrency,
+		eventTransferCurrency,
+		eventConvertCurrency,
+		eventCreateLoan,
+		eventStartLoan,
+		eventLoanContractCheck,
+		eventCreateInsurance,
+		eventStartInsurance,
+		eventInsuranceContractCheck,
+	} {
+		consumer.Handle(eventName, p.handle)
+	}
+}
+
+// handle projects one chaincode event. Events whose payload cannot be decoded are logged and
+// skipped rather than retried, since they would never decode.
+func (p *projection) handle(_ context.Context, event *client.ChaincodeEvent) error {
+	update, err := projectEvent(event)
+	if err != nil {
+		log.Printf("Skipping %s event of transaction %s in projection: %v", event.EventName, event.TransactionID, err)
+		return nil
+	}
+	if update == nil {
+		return nil
+	}
+	return p.store.apply(*update)
+}
+
+// projectEvent returns the change made to the projection by an event, or nil if the event does
+// not change it.
+func projectEvent(event *client.ChaincodeEvent) (*projectionUpdate, error) {
+	transaction := &ProjectedTransaction{
+		TransactionID: event.TransactionID,
+		Block:         event.BlockNumber,
+		Event:         event.EventName,
+	}
+
+	switch event.EventName {
+	case eventCreateCurrency:
+		var currency Currency
+		if err := json.Unmarshal(event.Payload, &currency); err != nil {
+			return nil, err
+		}
+		// Currency created by a transfer only emits this event with chaincode that predates the
+		// TransferCurrency event; the transfer cannot be told apart from the change, so skip it
+		switch currency.CreatedVia {
+		case "Deposit":
+			transaction.Kind = kindDeposit
+		case "System", "":
+			transaction.Kind = kindIssuance
+		default:
+			return nil, fmt.Errorf("currency created via %s without a transfer event", currency.CreatedVia)
+		}
+		transaction.To = currency.Owner
+		transaction.Amount = fromCents(toCents(currency.Amount))
+		transaction.Currency = currencyOrDefault(currency.CurrencyCode)
+		transaction.Reason = currency.CreatedVia
+		transaction.Timestamp = currency.CreatedAt
+		transaction.Parties = []string{currency.Owner}
+		return &projectionUpdate{transaction: transaction}, nil
+
+	case eventTransferCurrency:
+		var transfer transferEvent
+		if err := json.Unmarshal(event.Payload, &transfer); err != nil {
+			return nil, err
+		}
+		transaction.Kind = kindTransfer
+		transaction.From = transfer.From
+		transaction.To = transfer.To
+		transaction.Amount = fromCents(toCents(transfer.Amount))
+		transaction.Currency = currencyOrDefault(transfer.CurrencyCode)
+		transaction.Reason = transfer.Reason
+		transaction.Timestamp = transfer.Timestamp
+		transaction.Fee = fromCents(toCents(transfer.Fee))
+		if transaction.Fee != 0 {
+			transaction.FeeAccount = transfer.FeeAccount
+		}
+		transaction.Parties = uniqueParties(transfer.From, transfer.To, transaction.FeeAccount)
+		return &projectionUpdate{transaction: transaction}, nil
+
+	case eventConvertCurrency:
+		var conversion conversionEvent
+		if err := json.Unmarshal(event.Payload, &conversion); err != nil {
+			return nil, err
+		}
+		// The owner pays in the source currency and receives the converted amount
+		transaction.Kind = kindConversion
+		transaction.From = conversion.Owner
+		transaction.To = conversion.Owner
+		transaction.Amount = fromCents(toCents(conversion.ToAmount))
+		transaction.Currency = conversion.ToCurrency
+		transaction.Settlement = &ProjectedSettlement{
+			Currency: conversion.FromCurrency,
+			Amount:   fromCents(toCents(conversion.FromAmount)),
+			Rate:     conversion.EffectiveRate,
+		}
+		if spread := fromCents(toCents(conversion.SpreadAmount)); spread != 0 {
+			transaction.Settlement.Spread, transaction.Settlement.SpreadAccount = spread, conversion.FeeAccount
+		}
+		transaction.Reason = "Convert"
+		transaction.Timestamp = conversion.Timestamp
+		transaction.Parties = uniqueParties(conversion.Owner, transaction.Settlement.SpreadAccount)
+		return &projectionUpdate{transaction: transaction}, nil
+
+	case eventCreateLoan, eventStartLoan, eventLoanContractCheck:
+		return projectContract(transaction, "loan", event.Payload)
+
+	case eventCreateInsurance, eventStartInsurance, eventInsuranceContractCheck:
+		return projectContract(transaction, "insurance", event.Payload)
+	}
+	return nil, nil
+}
+
+// projectContract projects a contract event, with the currency moved by the contract state it
+// reached.
+func projectContract(transaction *ProjectedTransaction, contractType string, payload []byte) (*projectionUpdate, error) {
+	var event contractEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+
+	contract := &ProjectedContract{
+		Type:          contractType,
+		BusinessID:    event.BusinessID,
+		Applicant:     event.Applicant,
+		Issuer:        event.Issuer,
+		State:         event.State,
+		Amount:        fromCents(toCents(event.Amount)),
+		Rate:          float64(event.Rate),
+		Period:        event.Period,
+		Currency:      currencyOrDefault(event.CurrencyCode),
+		CreatedAt:     event.CreatedAt,
+		UpdatedAt:     event.UpdatedAt,
+		Block:         transaction.Block,
+		TransactionID: transaction.TransactionID,
+	}
+
+	transaction.Kind = kindContract
+	transaction.Currency = contract.Currency
+	transaction.Reason = strings.ToUpper(contractType[:1]) + contractType[1:]
+	transaction.ContractType = contractType
+	transaction.BusinessID = event.BusinessID
+	transaction.State = event.State
+	transaction.Timestamp = event.UpdatedAt
+	transaction.Parties = uniqueParties(event.Applicant, event.Issuer)
+
+	// The amounts below match the TransferCurrency calls of the chaincode, including its float32
+	// arithmetic
+	switch {
+	case transaction.Event == eventStartLoan && event.State == "Approved":
+		transaction.Kind = kindLoanDisbursement
+		transaction.From, transaction.To = event.Issuer, event.Applicant
+		transaction.Amount = fromCents(toCents(event.Amount))
+	case transaction.Event == eventLoanContractCheck && event.State == "Claimed":
+		transaction.Kind = kindLoanRepayment
+		transaction.From, transaction.To = event.Applicant, event.Issuer
+		transaction.Amount = fromCents(toCents(event.Amount * (1 + event.Rate)))
+		if event.RepaymentCurrency != "" {
+			transaction.Settlement = &ProjectedSettlement{
+				Currency: event.RepaymentCurrency,
+				Amount:   fromCents(toCents(event.RepaymentAmount)),
+				Rate:     event.RepaymentRate,
+			}
+		}
+	case transaction.Event == eventStartInsurance && event.State == "Approved":
+		transaction.Kind = kindInsurancePremium
+		transaction.From, transaction.To = event.Applicant, event.Issuer
+		transaction.Amount = fromCents(toCents(event.Amount))
+	case transaction.Event == eventInsuranceContractCheck && event.State == "Claimed":
+		transaction.Kind = kindInsurancePayout
+		transaction.From, transaction.To = event.Issuer, event.Applicant
+		transaction.Amount = fromCents(toCents(event.Amount * (1 + event.Rate)))
+	}
+	// The contract records the fee of the transfer made by its last transition
+	if transaction.From != "" && event.Fee != 0 {
+		transaction.Fee = fromCents(toCents(event.Fee))
+		transaction.FeeAccount = event.FeeAccount
+		transaction.Parties = uniqueParties(event.Applicant, event.Issuer, event.FeeAccount)
+	}
+	return &projectionUpdate{transaction: transaction, contract: contract}, nil
+}
+
+// currencyOrDefault returns the currency of an event, which is the default currency if it has no
+// currency code.
+func currencyOrDefault(code string) string {
+	if code == "" {
+		return defaultCurrencyCode
+	}
+	return code
+}
+
+func uniqueParties(parties ...string) []string {
+	var unique []string
+	for _, party := range parties {
+		found := party == ""
+		for _, existing := range unique {
+			found = found || existing == party
+		}
+		if !found {
+			unique = append(unique, party)
+		}
+	}
+	return unique
+}
+
+// ProjectionResult is the result of every projection endpoint: the data read from the local
+// projection and how fresh it is.
+type ProjectionResult struct {
+	Freshness Freshness `json:"freshness"`
+	Data      any       `json:"data"`
+}
+
+// ProjectionPage selects a page of a projected list.
+type ProjectionPage struct {
+	Limit  int `form:"limit" binding:"omitempty,min=1,max=100"`
+	Offset int `form:"offset" binding:"omitempty,min=0"`
+}
+
+// ProjectionSearch is a full-text search of projected contracts and transactions. Every term of
+// the query must match.
+type ProjectionSearch struct {
+	Query string `form:"q" binding:"required,max=256"`
+	Limit int    `form:"limit" binding:"omitempty,min=1,max=100"`
+}
+
+// SearchResult is the result of a projection search.
+type SearchResult struct {
+	Contracts    []*ProjectedContract    `json:"contracts"`
+	Transactions []*ProjectedTransaction `json:"transactions"`
+}
+
+// ProjectionReport summarizes the whole projection. Balances, contract amounts, transaction
+// volumes and fees only add up amounts in the default currency.
+type ProjectionReport struct {
+	Accounts     int                                   `json:"accounts"`
+	TotalBalance float64                               `json:"total_balance"`
+	Contracts    map[string]map[string]*ContractTotals `json:"contracts"`
+	Transactions map[string]*TransactionTotals         `json:"transactions"`
+}
+
+// ContractTotals counts the contracts of a type in a state.
+type ContractTotals struct {
+	Count  int     `json:"count"`
+	Amount float64 `json:"amount"`
+}
+
+// TransactionTotals counts the transactions of a kind, with their volume and the fees paid on them.
+type TransactionTotals struct {
+	Count  int     `json:"count"`
+	Volume float64 `json:"volume"`
+	Fees   float64 `json:"fees,omitempty"`
+}
+
+// registerProjectionRoutes registers the reads served from the local projection. They are
+// eventually consistent with the ledger; every result says how fresh it is.
+func (s *apiServer) registerProjectionRoutes(router gin.IRouter) {
+	projection := router.Group("/"+apiVersion+"/projection", s.requireAuth)
+
+	users := projection.Group("/users/:id", s.requireSelf)
+	users.GET("", s.getProjectedAccount)
+	users.GET("/contracts", s.listProjectedContracts)
+	users.GET("/transactions", s.listProjectedTransactions)
+
+	projection.GET("/search", s.searchProjection)
+	projection.GET("/reports/summary", s.requireRole(roleTreasury), s.getProjectionReport)
+}
+
+// respondProjected writes a projected result with the freshness of the projection.
+func (s *apiServer) respondProjected(c *gin.Context, message string, data any) {
+	respondOK(c, message, ProjectionResult{
+		Freshness: s.projection.store.Freshness(s.projection.metrics.knownLedgerHeight()),
+		Data:      data,
+	})
+}
+
+func (s *apiServer) getProjectedAccount(c *gin.Context) {
+	account, err := s.projection.store.Account(c.Param("id"))
+	if err != nil {
+		respondError(c, "GetProjectedAccount Failed", err)
+		return
+	}
+	s.respondProjected(c, "GetProjectedAccount Success", account)
+}
+
+func (s *apiServer) listProjectedContracts(c *gin.Context) {
+	var filter ContractFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	userID := c.Param("id")
+	contracts, err := s.projection.store.Contracts(func(contract *ProjectedContract) bool {
+		return (contract.Applicant == userID || contract.Issuer == userID) &&
+			(filter.Type == "" || contract.Type == filter.Type) &&
+			(filter.State == "" || contract.State == filter.State)
+	})
+	if err != nil {
+		respondError(c, "ListProjectedContracts Failed", err)
+		return
+	}
+	s.respondProjected(c, "ListProjectedContracts Success", contracts)
+}
+
+func (s *apiServer) listProjectedTransactions(c *gin.Context) {
+	var page ProjectionPage
+	if err := c.ShouldBindQuery(&page); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	if page.Limit == 0 {
+		page.Limit = defaultProjectionLimit
+	}
+	history, err := s.projection.store.History(c.Param("id"), page.Offset, page.Limit)
+	if err != nil {
+		respondError(c, "ListProjectedTransactions Failed", err)
+		return
+	}
+	s.respondProjected(c, "ListProjectedTransactions Success", history)
+}
+
+// searchProjection searches the contracts and transactions of the authenticated user, or of all
+// users for the treasury.
+func (s *apiServer) searchProjection(c *gin.Context) {
+	var search ProjectionSearch
+	if err := c.ShouldBindQuery(&search); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	if search.Limit == 0 {
+		search.Limit = defaultProjectionLimit
+	}
+
+	userID := authenticatedUser(c)
+	everyone := authenticatedRole(c) == roleTreasury
+	terms := strings.Fields(strings.ToLower(search.Query))
+
+	contracts, err := s.projection.store.Contracts(func(contract *ProjectedContract) bool {
+		return (everyone || contract.Applicant == userID || contract.Issuer == userID) &&
+			matchesTerms(terms, contract.Type, contract.BusinessID, contract.Applicant, contract.Issuer, contract.State, contract.Currency)
+	})
+	if err != nil {
+		respondError(c, "SearchProjection Failed", err)
+		return
+	}
+	transactions, err := s.projection.store.Transactions(func(transaction *ProjectedTransaction) bool {
+		return (everyone || slices.Contains(transaction.Parties, userID)) &&
+			matchesTerms(terms, transaction.TransactionID, transaction.Kind, transaction.From, transaction.To,
+				transaction.Reason, transaction.ContractType, transaction.BusinessID, transaction.State, transaction.Currency)
+	})
+	if err != nil {
+		respondError(c, "SearchProjection Failed", err)
+		return
+	}
+
+	s.respondProjected(c, "SearchProjection Success", SearchResult{
+		Contracts:    contracts[:min(len(contracts), search.Limit)],
+		Transactions: transactions[:min(len(transactions), search.Limit)],
+	})
+}
+
+// getProjectionReport summarizes balances, contracts and transactions for the treasury.
+func (s *apiServer) getProjectionReport(c *gin.Context) {
+	report := ProjectionReport{
+		Contracts:    map[string]map[string]*ContractTotals{},
+		Transactions: map[string]*TransactionTotals{},
+	}
+
+	accounts, err := s.projection.store.Accounts()
+	if err != nil {
+		respondError(c, "GetProjectionReport Failed", err)
+		return
+	}
+	var totalCents int64
+	for _, account := range accounts {
+		totalCents += account.BalanceCents
+	}
+	report.Accounts = len(accounts)
+	report.TotalBalance = fromCents(totalCents)
+
+	contracts, err := s.projection.store.Contracts(func(*ProjectedContract) bool { return true })
+	if err != nil {
+		respondError(c, "GetProjectionReport Failed", err)
+		return
+	}
+	for _, contract := range contracts {
+		states := report.Contracts[contract.Type]
+		if states == nil {
+			states = map[string]*ContractTotals{}
+			report.Contracts[contract.Type] = states
+		}
+		totals := states[contract.State]
+		if totals == nil {
+			totals = &ContractTotals{}
+			states[contract.State] = totals
+		}
+		totals.Count++
+		if currencyOrDefault(contract.Currency) == defaultCurrencyCode {
+			totals.Amount = fromCents(floatToCents(totals.Amount) + floatToCents(contract.Amount))
+		}
+	}
+
+	transactions, err := s.projection.store.Transactions(func(*ProjectedTransaction) bool { return true })
+	if err != nil {
+		respondError(c, "GetProjectionReport Failed", err)
+		return
+	}
+	for _, transaction := range transactions {
+		totals := report.Transactions[transaction.Kind]
+		if totals == nil {
+			totals = &TransactionTotals{}
+			report.Transactions[transaction.Kind] = totals
+		}
+		totals.Count++
+		if currencyOrDefault(transaction.Currency) == defaultCurrencyCode {
+			totals.Volume = fromCents(floatToCents(totals.Volume) + floatToCents(transaction.Amount))
+			totals.Fees = fromCents(floatToCents(totals.Fees) + floatToCents(transaction.Fee))
+		}
+	}
+
+	s.respondProjected(c, "GetProjectionReport Success", report)
+}
+
+// matchesTerms reports whether every search term is contained in one of the fields.
+func matchesTerms(terms []string, fields ...string) bool {
+	document := strings.ToLower(strings.Join(fields, " "))
+	for _, term := range terms {
+		if !strings.Contains(document, term) {
+			return false
+		}
+	}
+	return true
+}
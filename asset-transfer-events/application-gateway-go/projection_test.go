@@ -0,0 +1,327 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+func newTestProjection(t *testing.T) *projection {
+	t.Helper()
+	store, err := openProjectionStore(filepath.Join(t.TempDir(), "projection.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return newProjection(store, newMetrics())
+}
+
+// project runs the projection over events until it has processed the stream once.
+func project(t *testing.T, p *projection, events []*client.ChaincodeEvent) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	network := &fakeEventNetwork{events: events, checkpointer: p.store, cancel: cancel}
+	var genesis uint64
+	consumer := newEventConsumer("projection", func() (eventNetwork, error) { return network, nil }, "events", p.store, &genesis, p.metrics)
+	consumer.retryDelay = time.Millisecond
+	p.register(consumer)
+	consumer.Run(ctx)
+}
+
+func chaincodeEvent(t *testing.T, block uint64, transactionID string, name string, payload any) *client.ChaincodeEvent {
+	t.Helper()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client.ChaincodeEvent{BlockNumber: block, TransactionID: transactionID, EventName: name, Payload: data}
+}
+
+// loanEvents deposits currency for the bank and alice, then lends 100 to alice at 10%, which
+// she transfers partly to bob before the loan is claimed.
+func loanEvents(t *testing.T) []*client.ChaincodeEvent {
+	loan := contractEvent{BusinessID: "Loan1", Amount: 100, Issuer: "bank", Rate: 0.1, Period: 30, Applicant: "alice", State: "Applied"}
+	approved, claimed := loan, loan
+	approved.State, claimed.State = "Approved", "Claimed"
+	return []*client.ChaincodeEvent{
+		chaincodeEvent(t, 1, "tx1", eventCreateCurrency, Currency{Owner: "bank", Amount: 1000, CreatedVia: "Deposit"}),
+		chaincodeEvent(t, 1, "tx2", eventCreateCurrency, Currency{Owner: "alice", Amount: 50, CreatedVia: "Deposit"}),
+		chaincodeEvent(t, 2, "tx3", eventCreateLoan, loan),
+		chaincodeEvent(t, 3, "tx4", eventStartLoan, approved),
+		chaincodeEvent(t, 4, "tx5", eventTransferCurrency, transferEvent{From: "alice", To: "bob", Amount: 30.5, Reason: "Transfer"}),
+		// Change of a transfer made by chaincode without the TransferCurrency event
+		chaincodeEvent(t, 5, "tx6", eventCreateCurrency, Currency{Owner: "alice", Amount: 5, CreatedVia: "Change"}),
+		chaincodeEvent(t, 6, "tx7", eventLoanContractCheck, claimed),
+	}
+}
+
+func assertBalances(t *testing.T, store *projectionStore, want map[string]float64) {
+	t.Helper()
+	for userID, balance := range want {
+		account, err := store.Account(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Balance != balance {
+			t.Errorf("balance of %s = %v, want %v", userID, account.Balance, balance)
+		}
+	}
+}
+
+func TestProjectionAppliesEvents(t *testing.T) {
+	p := newTestProjection(t)
+	events := loanEvents(t)
+	project(t, p, events)
+
+	balances := map[string]float64{"bank": 1010, "alice": 9.5, "bob": 30.5}
+	assertBalances(t, p.store, balances)
+	if p.store.BlockNumber() != 6 || p.store.TransactionID() != "tx7" {
+		t.Errorf("checkpoint = block %d, transaction %q", p.store.BlockNumber(), p.store.TransactionID())
+	}
+
+	// Events delivered again, as after a crash before the checkpoint, are not counted twice
+	for _, event := range events {
+		if err := p.handle(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertBalances(t, p.store, balances)
+
+	history, err := p.store.History("alice", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, transaction := range history {
+		kinds = append(kinds, transaction.Kind)
+	}
+	want := []string{kindLoanRepayment, kindTransfer, kindLoanDisbursement, kindContract, kindDeposit}
+	if len(kinds) != len(want) {
+		t.Fatalf("history of alice = %v, want %v", kinds, want)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Errorf("history of alice = %v, want %v", kinds, want)
+			break
+		}
+	}
+	if history[0].Amount != 110 {
+		t.Errorf("loan repayment = %v, want principal and interest", history[0].Amount)
+	}
+
+	contracts, err := p.store.Contracts(func(contract *ProjectedContract) bool { return contract.Applicant == "alice" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contracts) != 1 || contracts[0].State != "Claimed" || contracts[0].TransactionID != "tx7" {
+		t.Errorf("contracts of alice = %+v", contracts)
+	}
+}
+
+func TestProjectionRebuild(t *testing.T) {
+	p := newTestProjection(t)
+	project(t, p, loanEvents(t))
+
+	if err := p.store.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if p.store.BlockNumber() != 0 || p.store.TransactionID() != "" {
+		t.Errorf("checkpoint was not reset")
+	}
+	assertBalances(t, p.store, map[string]float64{"bank": 0, "alice": 0})
+
+	project(t, p, loanEvents(t))
+	assertBalances(t, p.store, map[string]float64{"bank": 1010, "alice": 9.5, "bob": 30.5})
+}
+
+func TestProjectionEndpoints(t *testing.T) {
+	p := newTestProjection(t)
+	project(t, p, loanEvents(t))
+	p.metrics.setLedgerHeight(10)
+
+	auth := newTestAuth(t)
+	router := newRouter(newEcosysService(&fakeContract{}, p.metrics, serviceOptions{}), auth, newTestIdentities(t), routerOptions{projection: p})
+	get := func(userID string, role string, target string) (*httptest.ResponseRecorder, ProjectionResult) {
+		t.Helper()
+		token, _, err := auth.issueToken(userID, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder, response := record(t, router, request)
+
+		var result ProjectionResult
+		data, _ := json.Marshal(response.Result)
+		json.Unmarshal(data, &result)
+		return recorder, result
+	}
+
+	recorder, result := get("alice", roleApplicant, "/v1/projection/users/alice")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	if account := result.Data.(map[string]any); account["balance"] != 9.5 {
+		t.Errorf("account = %v", account)
+	}
+	if result.Freshness.Block != 6 || result.Freshness.LagBlocks == nil || *result.Freshness.LagBlocks != 3 || result.Freshness.ProjectedAt == nil {
+		t.Errorf("freshness = %+v", result.Freshness)
+	}
+
+	if recorder, _ := get("alice", roleApplicant, "/v1/projection/users/bob"); recorder.Code != http.StatusForbidden {
+		t.Errorf("projection of another user status = %d", recorder.Code)
+	}
+
+	_, result = get("bob", roleApplicant, "/v1/projection/search?q=loan1")
+	if search := result.Data.(map[string]any); len(search["contracts"].([]any)) != 0 {
+		t.Errorf("search returned the contracts of another user: %v", search)
+	}
+	_, result = get("alice", roleApplicant, "/v1/projection/search?q=loan1+claimed")
+	if search := result.Data.(map[string]any); len(search["contracts"].([]any)) != 1 || len(search["transactions"].([]any)) != 1 {
+		t.Errorf("search = %v", search)
+	}
+
+	if recorder, _ := get("alice", roleApplicant, "/v1/projection/reports/summary"); recorder.Code != http.StatusForbidden {
+		t.Errorf("report status for an applicant = %d", recorder.Code)
+	}
+	recorder, result = get("carol", roleTreasury, "/v1/projection/reports/summary")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("report status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	if report := result.Data.(map[string]any); report["accounts"] != float64(3) || report["total_balance"] != float64(1050) {
+		t.Errorf("report = %v", report)
+	}
+}
+
+func TestProjectionKeepsBalancesPerCurrency(t *testing.T) {
+	p := newTestProjection(t)
+	loan := contractEvent{BusinessID: "Loan1", Amount: 40, Issuer: "bank", Rate: 0.1, Period: 30, Applicant: "alice", State: "Approved", CurrencyCode: "USD"}
+	project(t, p, []*client.ChaincodeEvent{
+		chaincodeEvent(t, 1, "tx1", eventCreateCurrency, Currency{Owner: "bank", Amount: 1000, CreatedVia: "Deposit"}),
+		chaincodeEvent(t, 1, "tx2", eventCreateCurrency, Currency{Owner: "bank", Amount: 500, CreatedVia: "Deposit", CurrencyCode: "USD"}),
+		chaincodeEvent(t, 2, "tx3", eventStartLoan, loan),
+		chaincodeEvent(t, 3, "tx4", eventTransferCurrency, transferEvent{From: "alice", To: "bob", Amount: 15, Reason: "Transfer", CurrencyCode: "USD"}),
+	})
+
+	assertBalances(t, p.store, map[string]float64{"bank": 1000, "alice": 0, "bob": 0})
+	for userID, want := range map[string]map[string]float64{
+		"bank":  {"CNY": 1000, "USD": 460},
+		"alice": {"CNY": 0, "USD": 25},
+		"bob":   {"CNY": 0, "USD": 15},
+	} {
+		account, err := p.store.Account(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(account.Balances, want) {
+			t.Errorf("balances of %s = %v, want %v", userID, account.Balances, want)
+		}
+	}
+
+	contracts, err := p.store.Contracts(func(*ProjectedContract) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contracts) != 1 || contracts[0].Currency != "USD" {
+		t.Errorf("contracts = %+v", contracts)
+	}
+}
+
+func TestProjectionChargesFeesToTheSender(t *testing.T) {
+	p := newTestProjection(t)
+	loan := contractEvent{BusinessID: "Loan1", Amount: 100, Issuer: "bank", Rate: 0.1, Period: 30, Applicant: "alice", State: "Approved", Fee: 0.3, FeeAccount: "platform"}
+	project(t, p, []*client.ChaincodeEvent{
+		chaincodeEvent(t, 1, "tx1", eventCreateCurrency, Currency{Owner: "bank", Amount: 1000, CreatedVia: "Deposit"}),
+		chaincodeEvent(t, 2, "tx2", eventStartLoan, loan),
+		chaincodeEvent(t, 3, "tx3", eventTransferCurrency, transferEvent{From: "alice", To: "bob", Amount: 50, Reason: "Transfer", Fee: 1, FeeAccount: "platform"}),
+	})
+
+	assertBalances(t, p.store, map[string]float64{"bank": 899.7, "alice": 49, "bob": 50, "platform": 1.3})
+	history, err := p.store.History("alice", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Fee != 1 || history[0].FeeAccount != "platform" {
+		t.Errorf("history = %+v", history)
+	}
+	if history, _ := p.store.History("platform", 0, 10); len(history) != 2 {
+		t.Errorf("fee account history = %+v", history)
+	}
+}
+
+func TestProjectionAppliesConversionsAtTheirRate(t *testing.T) {
+	p := newTestProjection(t)
+	loan := contractEvent{BusinessID: "Loan1", Amount: 100, Issuer: "bank", Rate: 0.1, Period: 30, Applicant: "alice", State: "Approved"}
+	repaid := loan
+	repaid.State = "Claimed"
+	repaid.RepaymentCurrency, repaid.RepaymentAmount, repaid.RepaymentRate = "USD", 15.44, 7.128
+	project(t, p, []*client.ChaincodeEvent{
+		chaincodeEvent(t, 1, "tx1", eventCreateCurrency, Currency{Owner: "bank", Amount: 1000, CreatedVia: "Deposit"}),
+		chaincodeEvent(t, 1, "tx2", eventCreateCurrency, Currency{Owner: "alice", Amount: 50, CreatedVia: "Deposit", CurrencyCode: "USD"}),
+		chaincodeEvent(t, 2, "tx3", eventStartLoan, loan),
+		chaincodeEvent(t, 3, "tx4", eventConvertCurrency, conversionEvent{Owner: "alice", FromCurrency: "USD", FromAmount: 10, ToCurrency: "CNY", ToAmount: 71.28, EffectiveRate: 7.128}),
+		chaincodeEvent(t, 4, "tx5", eventLoanContractCheck, repaid),
+	})
+
+	// The repayment in dollars is burned; the bank receives the loan currency
+	assertBalances(t, p.store, map[string]float64{"bank": 1010})
+	for userID, want := range map[string]map[string]float64{
+		"bank":  nil,
+		"alice": {"CNY": 171.28, "USD": 24.56},
+	} {
+		account, err := p.store.Account(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(account.Balances, want) {
+			t.Errorf("balances of %s = %v, want %v", userID, account.Balances, want)
+		}
+	}
+
+	history, err := p.store.History("alice", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 4 || history[0].Settlement == nil || history[0].Settlement.Currency != "USD" || history[1].Kind != kindConversion {
+		t.Errorf("history = %+v", history)
+	}
+}
+
+func TestProjectionCreditsTheConversionSpreadToTheFeeAccount(t *testing.T) {
+	p := newTestProjection(t)
+	project(t, p, []*client.ChaincodeEvent{
+		chaincodeEvent(t, 1, "tx1", eventCreateCurrency, Currency{Owner: "alice", Amount: 10, CreatedVia: "Deposit"}),
+		chaincodeEvent(t, 2, "tx2", eventConvertCurrency, conversionEvent{Owner: "alice", FromCurrency: "CNY", FromAmount: 10, ToCurrency: "USD", ToAmount: 1.38,
+			EffectiveRate: 0.1386, SpreadAmount: 0.02, FeeAccount: "platform"}),
+	})
+
+	assertBalances(t, p.store, map[string]float64{"alice": 0})
+	for userID, want := range map[string]map[string]float64{
+		"alice":    {"CNY": 0, "USD": 1.38},
+		"platform": {"CNY": 0, "USD": 0.02},
+	} {
+		account, err := p.store.Account(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(account.Balances, want) {
+			t.Errorf("balances of %s = %v, want %v", userID, account.Balances, want)
+		}
+	}
+	if history, err := p.store.History("platform", 0, 10); err != nil || len(history) != 1 || history[0].Kind != kindConversion {
+		t.Errorf("platform history = %+v, err = %v", history, err)
+	}
+}
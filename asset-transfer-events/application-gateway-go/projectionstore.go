@@ -0,0 +1,512 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the projection store.
+var (
+	accountsBucket     = []byte("accounts")
+	contractsBucket    = []byte("contracts")
+	transactionsBucket = []byte("transactions")
+	historyBucket      = []byte("history")
+	metaBucket         = []byte("meta")
+
+	checkpointKey = []byte("checkpoint")
+
+	projectionBuckets = [][]byte{accountsBucket, contractsBucket, transactionsBucket, historyBucket, metaBucket}
+)
+
+// ProjectedAccount is the balance of a user, as projected from currency movements. Balance is in
+// the default currency; Balances has the balance in every currency, once the user held another
+// currency.
+type ProjectedAccount struct {
+	UserID   string             `json:"user_id"`
+	Balance  float64            `json:"balance"`
+	Balances map[string]float64 `json:"balances,omitempty"`
+	// BalanceCents is the exact balance; the chaincode does not track amounts below 0.01.
+	BalanceCents int64  `json:"-"`
+	Block        uint64 `json:"block"`
+	UpdatedAt    string `json:"updated_at"`
+}
+
+// ProjectedContract is the latest state of a loan or insurance contract.
+type ProjectedContract struct {
+	Type          string  `json:"type"`
+	BusinessID    string  `json:"business_id"`
+	Applicant     string  `json:"applicant"`
+	Issuer        string  `json:"issuer"`
+	State         string  `json:"state"`
+	Amount        float64 `json:"amount"`
+	Rate          float64 `json:"rate"`
+	Period        int     `json:"period,omitempty"`
+	Currency      string  `json:"currency,omitempty"`
+	CreatedAt     string  `json:"created_at"`
+	UpdatedAt     string  `json:"updated_at"`
+	Block         uint64  `json:"block"`
+	TransactionID string  `json:"transaction_id"`
+}
+
+// ProjectedTransaction is one entry of the transaction history. Transactions that only change a
+// contract have no amount.
+type ProjectedTransaction struct {
+	TransactionID string  `json:"transaction_id"`
+	Block         uint64  `json:"block"`
+	Event         string  `json:"event"`
+	Kind          string  `json:"kind"`
+	From          string  `json:"from,omitempty"`
+	To            string  `json:"to,omitempty"`
+	Amount        float64 `json:"amount,omitempty"`
+	Currency      string  `json:"currency,omitempty"`
+	Reason        string  `json:"reason,omitempty"`
+	ContractType  string  `json:"contract_type,omitempty"`
+	BusinessID    string  `json:"business_id,omitempty"`
+	State         string  `json:"state,omitempty"`
+	// Settlement is set when From paid in another currency than the Amount received by To.
+	Settlement *ProjectedSettlement `json:"settlement,omitempty"`
+	// Fee is paid by From on top of Amount, in the same currency, to FeeAccount.
+	Fee        float64 `json:"fee,omitempty"`
+	FeeAccount string  `json:"fee_account,omitempty"`
+	Timestamp  string  `json:"timestamp"`
+	// Parties are the users whose history includes the transaction.
+	Parties []string `json:"parties"`
+}
+
+// ProjectedSettlement is the amount paid in a currency exchanged at Rate units of the
+// transaction currency per unit, after the spread.
+type ProjectedSettlement struct {
+	Currency string  `json:"currency"`
+	Amount   float64 `json:"amount"`
+	Rate     float64 `json:"rate"`
+	// Spread is the part of the exchanged amount, in the transaction currency, that was paid to
+	// SpreadAccount instead of To.
+	Spread        float64 `json:"spread,omitempty"`
+	SpreadAccount string  `json:"spread_account,omitempty"`
+}
+
+// Freshness tells how up to date a projected result is: the last block and transaction applied,
+// when that was, and how many blocks the ledger is ahead if its height is known.
+type Freshness struct {
+	Block         uint64     `json:"block"`
+	TransactionID string     `json:"transaction_id,omitempty"`
+	ProjectedAt   *time.Time `json:"projected_at,omitempty"`
+	LedgerHeight  uint64     `json:"ledger_height,omitempty"`
+	LagBlocks     *uint64    `json:"lag_blocks,omitempty"`
+}
+
+type checkpointState struct {
+	BlockNumber   uint64    `json:"blockNumber"`
+	TransactionID string    `json:"transactionId"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// projectionStore is the bbolt database holding the projection. It is also the checkpointer of
+// the projection's event consumer, so that the projection and its position are stored together.
+type projectionStore struct {
+	db *bolt.DB
+
+	mu         sync.RWMutex
+	checkpoint checkpointState
+}
+
+func openProjectionStore(path string) (*projectionStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open projection store %s: %w", path, err)
+	}
+
+	store := &projectionStore{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range projectionBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if data := tx.Bucket(metaBucket).Get(checkpointKey); data != nil {
+			return json.Unmarshal(data, &store.checkpoint)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to read projection store %s: %w", path, err)
+	}
+	return store, nil
+}
+
+func (s *projectionStore) Close() error {
+	return s.db.Close()
+}
+
+// Reset deletes the whole projection, including its checkpoint, so that it is rebuilt from the
+// first block.
+func (s *projectionStore) Reset() error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range projectionBuckets {
+			if err := tx.DeleteBucket(name); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoint = checkpointState{}
+	return nil
+}
+
+// BlockNumber implements client.Checkpoint.
+func (s *projectionStore) BlockNumber() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.checkpoint.BlockNumber
+}
+
+// TransactionID implements client.Checkpoint.
+func (s *projectionStore) TransactionID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.checkpoint.TransactionID
+}
+
+// CheckpointChaincodeEvent records an event as projected.
+func (s *projectionStore) CheckpointChaincodeEvent(event *client.ChaincodeEvent) error {
+	checkpoint := checkpointState{BlockNumber: event.BlockNumber, TransactionID: event.TransactionID, UpdatedAt: time.Now().UTC()}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(metaBucket), checkpointKey, checkpoint)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoint = checkpoint
+	return nil
+}
+
+// Sync is a no-op: every bbolt transaction is synced to disk when it commits.
+func (s *projectionStore) Sync() error {
+	return nil
+}
+
+// Freshness returns the position of the projection, given the ledger height if it is known.
+func (s *projectionStore) Freshness(ledgerHeight uint64) Freshness {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	freshness := Freshness{Block: s.checkpoint.BlockNumber, TransactionID: s.checkpoint.TransactionID, LedgerHeight: ledgerHeight}
+	if !s.checkpoint.UpdatedAt.IsZero() {
+		projectedAt := s.checkpoint.UpdatedAt
+		freshness.ProjectedAt = &projectedAt
+	}
+	if ledgerHeight > 0 {
+		var lag uint64
+		if ledgerHeight > s.checkpoint.BlockNumber+1 {
+			lag = ledgerHeight - 1 - s.checkpoint.BlockNumber
+		}
+		freshness.LagBlocks = &lag
+	}
+	return freshness
+}
+
+// projectionUpdate is the change made to the projection by one transaction.
+type projectionUpdate struct {
+	transaction *ProjectedTransaction
+	contract    *ProjectedContract
+}
+
+// apply stores the changes of a transaction. A transaction that has already been projected is
+// skipped, so that events delivered again after a restart are not counted twice.
+func (s *projectionStore) apply(update projectionUpdate) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		transactions := tx.Bucket(transactionsBucket)
+		transaction := update.transaction
+		if transactions.Get([]byte(transaction.TransactionID)) != nil {
+			return nil
+		}
+		if err := putJSON(transactions, []byte(transaction.TransactionID), transaction); err != nil {
+			return err
+		}
+
+		if contract := update.contract; contract != nil {
+			if err := putJSON(tx.Bucket(contractsBucket), contractKey(contract.Type, contract.Applicant, contract.BusinessID), contract); err != nil {
+				return err
+			}
+		}
+		for _, party := range transaction.Parties {
+			if err := tx.Bucket(historyBucket).Put(historyKey(party, transaction.Block, transaction.TransactionID), nil); err != nil {
+				return err
+			}
+		}
+
+		cents := floatToCents(transaction.Amount)
+		if cents == 0 {
+			return nil
+		}
+		accounts := tx.Bucket(accountsBucket)
+		if transaction.From != "" {
+			paidCurrency, paidCents := transaction.Currency, cents
+			if settlement := transaction.Settlement; settlement != nil {
+				paidCurrency, paidCents = settlement.Currency, floatToCents(settlement.Amount)
+			}
+			if err := adjustBalance(accounts, transaction, transaction.From, paidCurrency, -paidCents); err != nil {
+				return err
+			}
+		}
+		if settlement := transaction.Settlement; settlement != nil && settlement.SpreadAccount != "" {
+			if err := adjustBalance(accounts, transaction, settlement.SpreadAccount, transaction.Currency, floatToCents(settlement.Spread)); err != nil {
+				return err
+			}
+		}
+		if feeCents := floatToCents(transaction.Fee); feeCents != 0 {
+			if err := adjustBalance(accounts, transaction, transaction.From, transaction.Currency, -feeCents); err != nil {
+				return err
+			}
+			if err := adjustBalance(accounts, transaction, transaction.FeeAccount, transaction.Currency, feeCents); err != nil {
+				return err
+			}
+		}
+		return adjustBalance(accounts, transaction, transaction.To, transaction.Currency, cents)
+	})
+}
+
+// accountRecord is the stored balance of a user. BalanceCents is in the default currency, and
+// CurrencyCents in the other currencies.
+type accountRecord struct {
+	UserID        string           `json:"userId"`
+	BalanceCents  int64            `json:"balanceCents"`
+	CurrencyCents map[string]int64 `json:"currencyCents,omitempty"`
+	Block         uint64           `json:"block"`
+	UpdatedAt     string           `json:"updatedAt"`
+}
+
+// balances returns the balance in every currency, or nil if the user only held the default currency.
+func (r *accountRecord) balances() map[string]float64 {
+	if len(r.CurrencyCents) == 0 {
+		return nil
+	}
+	balances := map[string]float64{defaultCurrencyCode: fromCents(r.BalanceCents)}
+	for code, cents := range r.CurrencyCents {
+		balances[code] = fromCents(cents)
+	}
+	return balances
+}
+
+func adjustBalance(accounts *bolt.Bucket, transaction *ProjectedTransaction, userID string, currency string, cents int64) error {
+	var account accountRecord
+	if data := accounts.Get([]byte(userID)); data != nil {
+		if err := json.Unmarshal(data, &account); err != nil {
+			return err
+		}
+	}
+	account.UserID = userID
+	if code := currencyOrDefault(currency); code != defaultCurrencyCode {
+		if account.CurrencyCents == nil {
+			account.CurrencyCents = map[string]int64{}
+		}
+		account.CurrencyCents[code] += cents
+	} else {
+		account.BalanceCents += cents
+	}
+	account.Block = transaction.Block
+	account.UpdatedAt = transaction.Timestamp
+	return putJSON(accounts, []byte(userID), account)
+}
+
+// Account returns the projected balance of a user, which is zero for a user without currency.
+func (s *projectionStore) Account(userID string) (*ProjectedAccount, error) {
+	account := &ProjectedAccount{UserID: userID}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(accountsBucket).Get([]byte(userID))
+		if data == nil {
+			return nil
+		}
+		var record accountRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		account.BalanceCents = record.BalanceCents
+		account.Balance = fromCents(record.BalanceCents)
+		account.Balances = record.balances()
+		account.Block = record.Block
+		account.UpdatedAt = record.UpdatedAt
+		return nil
+	})
+	return account, err
+}
+
+// Contracts returns the contracts matching a filter, in the order of their keys.
+func (s *projectionStore) Contracts(match func(*ProjectedContract) bool) ([]*ProjectedContract, error) {
+	contracts := []*ProjectedContract{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(contractsBucket).ForEach(func(_, data []byte) error {
+			var contract ProjectedContract
+			if err := json.Unmarshal(data, &contract); err != nil {
+				return err
+			}
+			if match(&contract) {
+				contracts = append(contracts, &contract)
+			}
+			return nil
+		})
+	})
+	return contracts, err
+}
+
+// History returns the transactions of a user, most recent first, skipping offset transactions.
+func (s *projectionStore) History(userID string, offset int, limit int) ([]*ProjectedTransaction, error) {
+	history := []*ProjectedTransaction{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		transactions := tx.Bucket(transactionsBucket)
+		prefix := []byte(userID + "\x00")
+		cursor := tx.Bucket(historyBucket).Cursor()
+
+		// Seek past the last key of the user, then walk back
+		key, _ := cursor.Seek(append([]byte(userID), 0x01))
+		if key == nil {
+			key, _ = cursor.Last()
+		} else {
+			key, _ = cursor.Prev()
+		}
+		for ; key != nil && strings.HasPrefix(string(key), string(prefix)) && len(history) < limit; key, _ = cursor.Prev() {
+			if offset > 0 {
+				offset--
+				continue
+			}
+			transaction, err := getTransaction(transactions, string(key[len(prefix)+8:]))
+			if err != nil {
+				return err
+			}
+			history = append(history, transaction)
+		}
+		return nil
+	})
+	return history, err
+}
+
+// Transaction returns a projected transaction, or nil if it has not been projected.
+func (s *projectionStore) Transaction(transactionID string) (*ProjectedTransaction, error) {
+	var transaction *ProjectedTransaction
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(transactionsBucket).Get([]byte(transactionID)) == nil {
+			return nil
+		}
+		var err error
+		transaction, err = getTransaction(tx.Bucket(transactionsBucket), transactionID)
+		return err
+	})
+	return transaction, err
+}
+
+// Transactions returns every transaction matching a filter, most recent first.
+func (s *projectionStore) Transactions(match func(*ProjectedTransaction) bool) ([]*ProjectedTransaction, error) {
+	transactions := []*ProjectedTransaction{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(transactionsBucket).ForEach(func(_, data []byte) error {
+			var transaction ProjectedTransaction
+			if err := json.Unmarshal(data, &transaction); err != nil {
+				return err
+			}
+			if match(&transaction) {
+				transactions = append(transactions, &transaction)
+			}
+			return nil
+		})
+	})
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].Block > transactions[j].Block
+	})
+	return transactions, err
+}
+
+// Accounts returns every projected account.
+func (s *projectionStore) Accounts() ([]*ProjectedAccount, error) {
+	accounts := []*ProjectedAccount{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountsBucket).ForEach(func(_, data []byte) error {
+			var record accountRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			accounts = append(accounts, &ProjectedAccount{
+				UserID:       record.UserID,
+				Balance:      fromCents(record.BalanceCents),
+				Balances:     record.balances(),
+				BalanceCents: record.BalanceCents,
+				Block:        record.Block,
+				UpdatedAt:    record.UpdatedAt,
+			})
+			return nil
+		})
+	})
+	return accounts, err
+}
+
+func getTransaction(transactions *bolt.Bucket, transactionID string) (*ProjectedTransaction, error) {
+	data := transactions.Get([]byte(transactionID))
+	if data == nil {
+		return nil, fmt.Errorf("transaction %s is indexed but not stored", transactionID)
+	}
+	var transaction ProjectedTransaction
+	if err := json.Unmarshal(data, &transaction); err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+func putJSON(bucket *bolt.Bucket, key []byte, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+func contractKey(contractType string, applicant string, businessID string) []byte {
+	return []byte(contractType + "\x00" + applicant + "\x00" + businessID)
+}
+
+// historyKey orders the history of a user by block. Transactions within a block are ordered by ID.
+func historyKey(userID string, block uint64, transactionID string) []byte {
+	key := make([]byte, 0, len(userID)+1+8+len(transactionID))
+	key = append(key, userID...)
+	key = append(key, 0)
+	key = binary.BigEndian.AppendUint64(key, block)
+	return append(key, transactionID...)
+}
+
+// toCents converts a chaincode amount to cents, the smallest unit of currency.
+func toCents(amount float32) int64 {
+	return int64(math.Round(float64(amount) * 100))
+}
+
+func fromCents(cents int64) float64 {
+	return float64(cents) / 100
+}
+
+func floatToCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
@@ -0,0 +1,165 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retryBudgetCapacity is the number of retries that can be made in a burst once the retry budget
+// has filled up.
+const retryBudgetCapacity = 10
+
+// retryPolicy retries submissions that failed for reasons that endorsing them again can fix:
+// read conflicts with a concurrent transaction at commit, and endorsements aborted or refused by
+// unavailable peers. The transaction is endorsed again, against the current world state, after a
+// jittered exponential backoff, up to maxAttempts in total.
+//
+// Retries are also limited by a budget shared by all submissions, so that retrying does not make
+// a burst of conflicting transactions worse: every submission earns a fraction of a retry, and
+// every retry spends a whole one.
+type retryPolicy struct {
+	maxAttempts int
+	delay       time.Duration
+	maxDelay    time.Duration
+	metrics     *metrics
+
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func newRetryPolicy(config RetryConfig, metrics *metrics) *retryPolicy {
+	return &retryPolicy{
+		maxAttempts: config.MaxAttempts,
+		delay:       config.Delay,
+		maxDelay:    config.MaxDelay,
+		metrics:     metrics,
+		ratio:       config.Budget,
+		tokens:      retryBudgetCapacity,
+	}
+}
+
+// retriesExhaustedError is the error of the last attempt of a submission that was retried.
+type retriesExhaustedError struct {
+	attempts int
+	err      error
+}
+
+func (e *retriesExhaustedError) Error() string {
+	return fmt.Sprintf("failed after %d attempts: %v", e.attempts, e.err)
+}
+
+func (e *retriesExhaustedError) Unwrap() error {
+	return e.err
+}
+
+// do calls attempt until it succeeds, fails with an error that is not retryable, or the attempts
+// or the retry budget run out. A nil policy makes a single attempt. The error of a submission that
+// was retried reports the number of attempts.
+func (p *retryPolicy) do(ctx context.Context, function string, attempt func() error) error {
+	if p == nil {
+		return attempt()
+	}
+	p.earn()
+	for attempts := 1; ; attempts++ {
+		err := attempt()
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if attempts >= p.maxAttempts || !p.spend() {
+			if attempts == 1 {
+				return err
+			}
+			return &retriesExhaustedError{attempts: attempts, err: err}
+		}
+
+		delay, reason := p.backoff(attempts), retryReason(err)
+		log.Printf("%s failed with %s, retrying in %s", function, reason, delay)
+		p.metrics.observeRetry(function, reason)
+		select {
+		case <-ctx.Done():
+			return &retriesExhaustedError{attempts: attempts, err: err}
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns the delay before the retry following an attempt: the retry delay, doubled on
+// every attempt up to the maximum, with half of it randomized so that conflicting submissions
+// retried together are spread out.
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.delay << (attempt - 1)
+	if delay <= 0 || delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// earn adds the share of a retry earned by a submission to the retry budget.
+func (p *retryPolicy) earn() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tokens = min(p.tokens+p.ratio, retryBudgetCapacity)
+}
+
+// spend takes a retry from the retry budget, returning false if it is used up.
+func (p *retryPolicy) spend() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tokens < 1 {
+		return false
+	}
+	p.tokens--
+	return true
+}
+
+// retryable reports whether a submission that failed with err may succeed if it is endorsed again.
+// Errors raised by the chaincode are final, as are failures after the transaction was sent for
+// ordering, since it may still be committed.
+func retryable(err error) bool {
+	var commitFailed *commitFailedError
+	if errors.As(err, &commitFailed) {
+		switch commitFailed.validationCode {
+		case peer.TxValidationCode_MVCC_READ_CONFLICT.String(), peer.TxValidationCode_PHANTOM_READ_CONFLICT.String():
+			return true
+		}
+		return false
+	}
+
+	var endorseErr *client.EndorseError
+	if !errors.As(err, &endorseErr) {
+		return false
+	}
+	if _, ok := parseChaincodeError(err); ok {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Aborted, codes.Unavailable:
+		return true
+	}
+	return false
+}
+
+// retryReason labels a retryable error with its validation code or gateway error code.
+func retryReason(err error) string {
+	var commitFailed *commitFailedError
+	if errors.As(err, &commitFailed) {
+		return commitFailed.validationCode
+	}
+	return toAPIError(err).Code
+}
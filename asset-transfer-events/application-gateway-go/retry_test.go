@@ -0,0 +1,118 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestRetryPolicy() *retryPolicy {
+	return newRetryPolicy(RetryConfig{MaxAttempts: 3, Delay: time.Millisecond, MaxDelay: 5 * time.Millisecond, Budget: 0.2}, newMetrics())
+}
+
+// newRetryRouter returns a router retrying submissions with policy, and a token for alice.
+func newRetryRouter(t *testing.T, contract *fakeContract, policy *retryPolicy) (*gin.Engine, string) {
+	t.Helper()
+	auth := newTestAuth(t)
+	token, _, err := auth.issueToken("alice", roleApplicant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRouter(newEcosysService(contract, newMetrics(), serviceOptions{retry: policy}), auth, newTestIdentities(t), routerOptions{}), token
+}
+
+func transferRequest(token string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/v1/users/alice/transfers", strings.NewReader(`{"target_user_id": "bob", "amount": 12.5}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+	return request
+}
+
+func TestConflictingSubmissionIsRetried(t *testing.T) {
+	contract := &fakeContract{conflicts: 2}
+	router, token := newRetryRouter(t, contract, newTestRetryPolicy())
+
+	recorder, _ := record(t, router, transferRequest(token))
+	if recorder.Code != http.StatusCreated || recorder.Header().Get("Transaction-Attempts") != "3" {
+		t.Fatalf("status = %d, attempts = %q, body = %s", recorder.Code, recorder.Header().Get("Transaction-Attempts"), recorder.Body.String())
+	}
+	if len(contract.calls) != 3 {
+		t.Errorf("submissions = %d, want 3", len(contract.calls))
+	}
+}
+
+func TestRetriesAreExhausted(t *testing.T) {
+	contract := &fakeContract{conflicts: 5}
+	router, token := newRetryRouter(t, contract, newTestRetryPolicy())
+
+	recorder, response := record(t, router, transferRequest(token))
+	if recorder.Code != http.StatusConflict || response.Error.Code != errCodeCommitFailed {
+		t.Fatalf("status = %d, error = %+v", recorder.Code, response.Error)
+	}
+	if details := response.Error.Details; details["attempts"] != "3" || details["validationCode"] != "MVCC_READ_CONFLICT" || details["transactionId"] != "tx3" {
+		t.Errorf("details = %v", details)
+	}
+}
+
+func TestChaincodeErrorsAreNotRetried(t *testing.T) {
+	contract := &fakeContract{err: &ChaincodeError{Code: errCodeInsufficientFunds, Message: "insufficient funds"}}
+	router, token := newRetryRouter(t, contract, newTestRetryPolicy())
+
+	recorder, response := record(t, router, transferRequest(token))
+	if recorder.Code != http.StatusUnprocessableEntity || response.Error.Details["attempts"] != "" {
+		t.Errorf("status = %d, error = %+v", recorder.Code, response.Error)
+	}
+	if len(contract.calls) != 1 {
+		t.Errorf("submissions = %d, want 1", len(contract.calls))
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	policy := newTestRetryPolicy()
+	for i := 0; i < retryBudgetCapacity; i++ {
+		if !policy.spend() {
+			t.Fatalf("retry %d was refused within the budget capacity", i)
+		}
+	}
+	if policy.spend() {
+		t.Error("retry allowed beyond the budget")
+	}
+
+	// Every submission earns a fifth of a retry
+	for i := 0; i < 4; i++ {
+		policy.earn()
+	}
+	if policy.spend() {
+		t.Error("retry allowed before it was earned")
+	}
+	policy.earn()
+	if !policy.spend() {
+		t.Error("earned retry was refused")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{&commitFailedError{transactionID: "tx1", validationCode: "MVCC_READ_CONFLICT"}, true},
+		{&commitFailedError{transactionID: "tx1", validationCode: "PHANTOM_READ_CONFLICT"}, true},
+		{&commitFailedError{transactionID: "tx1", validationCode: "ENDORSEMENT_POLICY_FAILURE"}, false},
+		{&ChaincodeError{Code: errCodeInsufficientFunds}, false},
+		{errors.New("connection refused"), false},
+	} {
+		if got := retryable(test.err); got != test.want {
+			t.Errorf("retryable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
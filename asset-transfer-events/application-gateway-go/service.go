@@ -0,0 +1,577 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// chaincodeContract is the view of the deployed chaincode used by the service layer. It is
+// implemented by fabricContract for a real network and can be replaced by a fake in tests.
+type chaincodeContract interface {
+	Evaluate(ctx context.Context, function string, args ...string) ([]byte, error)
+	SubmitAsync(ctx context.Context, function string, transient map[string][]byte, args ...string) ([]byte, submittedTransaction, error)
+}
+
+// submittedTransaction is a transaction that has been endorsed and sent for ordering, whose
+// commit status can be waited for.
+type submittedTransaction interface {
+	TransactionID() string
+	Status(ctx context.Context) (*client.Status, error)
+}
+
+// fabricContract adapts a Fabric Gateway contract to chaincodeContract.
+type fabricContract struct {
+	contract *client.Contract
+}
+
+func (f *fabricContract) Evaluate(ctx context.Context, function string, args ...string) ([]byte, error) {
+	return f.contract.EvaluateWithContext(ctx, function, client.WithArguments(args...))
+}
+
+func (f *fabricContract) SubmitAsync(ctx context.Context, function string, transient map[string][]byte, args ...string) ([]byte, submittedTransaction, error) {
+	result, commit, err := f.contract.SubmitAsyncWithContext(ctx, function, client.WithArguments(args...), client.WithTransient(transient))
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, fabricCommit{commit: commit}, nil
+}
+
+// fabricCommit adapts a Fabric Gateway commit to submittedTransaction.
+type fabricCommit struct {
+	commit *client.Commit
+}
+
+func (f fabricCommit) TransactionID() string {
+	return f.commit.TransactionID()
+}
+
+func (f fabricCommit) Status(ctx context.Context) (*client.Status, error) {
+	return f.commit.StatusWithContext(ctx)
+}
+
+// contractProvider returns the chaincode contract that signs transactions as a given user. It is
+// implemented by gatewayPool, which uses the identity of the user from the wallet.
+type contractProvider interface {
+	Contract(userID string) (chaincodeContract, error)
+}
+
+// ecosysService invokes the chaincode on behalf of the HTTP handlers. Every method returns an
+// error instead of panicking so that a failed transaction only fails the request that caused it.
+//
+// The first argument of every method is the acting user, whose identity signs the transaction.
+type ecosysService struct {
+	contracts contractProvider
+	metrics   *metrics
+	serviceOptions
+}
+
+// serviceOptions are the optional features of the service; the zero value disables them all.
+type serviceOptions struct {
+	// transactions records submitted transactions and tracks their commit status
+	transactions *transactionTracker
+	// idempotencyRetention is how long the chaincode keeps the idempotency keys of submissions
+	idempotencyRetention time.Duration
+	// retry retries submissions failing with a read conflict or an aborted endorsement
+	retry *retryPolicy
+}
+
+func newEcosysService(contracts contractProvider, metrics *metrics, options serviceOptions) *ecosysService {
+	return &ecosysService{contracts: contracts, metrics: metrics, serviceOptions: options}
+}
+
+// Transient data fields read by the chaincode. See chaincode-go/chaincode/idempotency.go.
+const (
+	transientIdempotencyKey       = "idempotency_key"
+	transientIdempotencyRetention = "idempotency_retention"
+)
+
+type submissionKey struct{}
+
+// submission holds the options of a request submitting a transaction, and receives what the
+// service learns about the transaction besides its result.
+type submission struct {
+	// async asks the service to return as soon as the transaction is submitted for ordering,
+	// without waiting for its commit
+	async bool
+	// idempotencyKey makes the chaincode return the outcome of the transaction first submitted
+	// by the user with the same key, instead of executing it again
+	idempotencyKey string
+
+	// transaction is the tracked transaction of an asynchronous submission
+	transaction *TrackedTransaction
+	// replayedTransactionID is the transaction whose outcome was returned for the idempotency key
+	replayedTransactionID string
+	// attempts is the number of times the transaction was endorsed
+	attempts int
+}
+
+// withSubmission returns a context submitting transactions with the options of submission.
+func withSubmission(ctx context.Context, submission *submission) context.Context {
+	return context.WithValue(ctx, submissionKey{}, submission)
+}
+
+// submissionFrom returns the submission of a context, or the default options if it has none.
+func submissionFrom(ctx context.Context) *submission {
+	if submission, ok := ctx.Value(submissionKey{}).(*submission); ok {
+		return submission
+	}
+	return &submission{}
+}
+
+// transient returns the transient data of a submission, which is not recorded on the ledger.
+func (s *ecosysService) transient(submission *submission) map[string][]byte {
+	if submission.idempotencyKey == "" {
+		return nil
+	}
+	transient := map[string][]byte{transientIdempotencyKey: []byte(submission.idempotencyKey)}
+	if s.idempotencyRetention > 0 {
+		transient[transientIdempotencyRetention] = []byte(strconv.FormatInt(int64(s.idempotencyRetention/time.Second), 10))
+	}
+	return transient
+}
+
+// ContractList holds the contracts of one party, as returned by the chaincode list queries.
+type ContractList struct {
+	Loans      json.RawMessage `json:"loans"`
+	Insurances json.RawMessage `json:"insurances"`
+}
+
+func (s *ecosysService) evaluate(ctx context.Context, signer string, function string, args ...string) (json.RawMessage, error) {
+	contract, err := s.contracts.Contract(signer)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	result, err := contract.Evaluate(ctx, function, args...)
+	s.metrics.observeChaincode(operationEvaluate, function, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResult(function, result)
+}
+
+func (s *ecosysService) submit(ctx context.Context, signer string, function string, args ...string) (json.RawMessage, error) {
+	contract, err := s.contracts.Contract(signer)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Submitting %s as %s", function, signer)
+	submission := submissionFrom(ctx)
+	start := time.Now()
+	var result []byte
+	err = s.retry.do(ctx, function, func() error {
+		submission.attempts++
+		var err error
+		result, err = s.submitOnce(ctx, contract, signer, function, submission, args...)
+		return err
+	})
+	s.metrics.observeChaincode(operationSubmit, function, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResult(function, result)
+}
+
+// submitOnce endorses and submits a transaction, then waits for its commit as the submission asks.
+func (s *ecosysService) submitOnce(ctx context.Context, contract chaincodeContract, signer string, function string, submission *submission, args ...string) ([]byte, error) {
+	result, submitted, err := contract.SubmitAsync(ctx, function, s.transient(submission), args...)
+	if replay, ok := idempotentReplay(err); ok {
+		submission.replayedTransactionID = replay.Details["transactionId"]
+		log.Printf("%s was already submitted as %s", function, submission.replayedTransactionID)
+		return []byte(replay.Details["result"]), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, s.commit(ctx, signer, function, result, submitted, submission)
+}
+
+// commit waits for the commit of a submitted transaction, unless the submission is asynchronous,
+// in which case the tracked transaction is returned through it.
+func (s *ecosysService) commit(ctx context.Context, signer string, function string, result []byte, submitted submittedTransaction, submission *submission) error {
+	if s.transactions == nil {
+		status, err := submitted.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return committed(function, status.TransactionID, status.Successful, status.Code.String())
+	}
+
+	waiter, err := s.transactions.track(signer, function, result, submitted)
+	if err != nil {
+		return err
+	}
+	if submission.async {
+		submission.transaction = waiter.submitted
+		log.Printf("%s submitted as %s", function, submitted.TransactionID())
+		return nil
+	}
+	transaction, err := waiter.wait(ctx)
+	if err != nil {
+		return err
+	}
+	return committed(function, transaction.TransactionID, transaction.Status == transactionCommitted, transaction.ValidationCode)
+}
+
+// committed reports a transaction that failed validation as an error.
+func committed(function string, transactionID string, successful bool, validationCode string) error {
+	if !successful {
+		return &commitFailedError{transactionID: transactionID, validationCode: validationCode}
+	}
+	log.Printf("%s committed as %s", function, transactionID)
+	return nil
+}
+
+// decodeResult checks that a chaincode result is JSON before it is passed through to the client.
+// Chaincode functions without a return value, or returning an empty list, produce an empty payload.
+func decodeResult(function string, result []byte) (json.RawMessage, error) {
+	if len(result) == 0 {
+		return json.RawMessage("null"), nil
+	}
+	if !json.Valid(result) {
+		return nil, &badPayloadError{function: function, payload: result}
+	}
+	return json.RawMessage(result), nil
+}
+
+// Balance returns the total currency owned by a user.
+func (s *ecosysService) Balance(ctx context.Context, userID string) (json.RawMessage, error) {
+	return s.evaluate(ctx, userID, "ReadTotalCurrencyByOwner", userID)
+}
+
+// Contracts returns the loan and insurance contracts applied for by a user.
+func (s *ecosysService) Contracts(ctx context.Context, userID string) (*ContractList, error) {
+	insurances, err := s.evaluate(ctx, userID, "ReadInsuranceListByOwner", userID)
+	if err != nil {
+		return nil, err
+	}
+	loans, err := s.evaluate(ctx, userID, "ReadLoanListByOwner", userID)
+	if err != nil {
+		return nil, err
+	}
+	return &ContractList{Loans: loans, Insurances: insurances}, nil
+}
+
+// Filter returns the contracts matching the business type and state of the filter. A contract
+// type that is filtered out is reported as an empty list.
+func (l *ContractList) Filter(filter ContractFilter) (*ContractList, error) {
+	loans, err := filterByState(l.Loans, filter.State)
+	if err != nil {
+		return nil, err
+	}
+	insurances, err := filterByState(l.Insurances, filter.State)
+	if err != nil {
+		return nil, err
+	}
+	switch filter.Type {
+	case "loan":
+		insurances = json.RawMessage("[]")
+	case "insurance":
+		loans = json.RawMessage("[]")
+	}
+	return &ContractList{Loans: loans, Insurances: insurances}, nil
+}
+
+func filterByState(contracts json.RawMessage, state string) (json.RawMessage, error) {
+	var list []json.RawMessage
+	if err := json.Unmarshal(contracts, &list); err != nil {
+		return nil, err
+	}
+	filtered := []json.RawMessage{}
+	for _, contract := range list {
+		var fields struct {
+			State string `json:"State"`
+		}
+		if err := json.Unmarshal(contract, &fields); err != nil {
+			return nil, err
+		}
+		if state == "" || fields.State == state {
+			filtered = append(filtered, contract)
+		}
+	}
+	return json.Marshal(filtered)
+}
+
+// Contract returns a single loan or insurance contract.
+func (s *ecosysService) Contract(ctx context.Context, userID string, businessType string, businessID string) (json.RawMessage, error) {
+	if strings.EqualFold(businessType, "loan") {
+		return s.evaluate(ctx, userID, "ReadLoan", userID, businessID)
+	}
+	return s.evaluate(ctx, userID, "ReadInsurance", userID, businessID)
+}
+
+// IssuerContracts returns the loan and insurance contracts issued by a bank or insurer.
+func (s *ecosysService) IssuerContracts(ctx context.Context, issuerID string) (*ContractList, error) {
+	loans, err := s.evaluate(ctx, issuerID, "ReadLoanListByIssuer", issuerID)
+	if err != nil {
+		return nil, err
+	}
+	insurances, err := s.evaluate(ctx, issuerID, "ReadInsuranceListByIssuer", issuerID)
+	if err != nil {
+		return nil, err
+	}
+	return &ContractList{Loans: loans, Insurances: insurances}, nil
+}
+
+// IssuerPortfolio returns the portfolio summary of a bank or insurer.
+func (s *ecosysService) IssuerPortfolio(ctx context.Context, issuerID string) (json.RawMessage, error) {
+	return s.evaluate(ctx, issuerID, "ReadIssuerPortfolio", issuerID)
+}
+
+// CreateContract creates a loan or insurance contract in the Applied state. The contract settles
+// in the given currency, or in the default currency if it is empty.
+func (s *ecosysService) CreateContract(ctx context.Context, applicant string, businessID string, amount float32, issuer string, rate float32, businessType string, period int, currency string) (json.RawMessage, error) {
+	args := []string{applicant, businessID, fmt.Sprintf("%f", amount), issuer, fmt.Sprintf("%f", rate), businessType, fmt.Sprintf("%d", period)}
+	if currency == "" {
+		return s.submit(ctx, applicant, "CreateContract", args...)
+	}
+	return s.submit(ctx, applicant, "CreateContractInCurrency", append(args, currency)...)
+}
+
+// CheckContractCurrency returns a CURRENCY_MISMATCH error if a contract of the user does not settle
+// in the given currency. Contracts created before currencies were introduced settle in the default
+// currency.
+func (s *ecosysService) CheckContractCurrency(ctx context.Context, userID string, businessType string, businessID string, currency string) error {
+	result, err := s.Contract(ctx, userID, businessType, businessID)
+	if err != nil {
+		return err
+	}
+	var contract struct {
+		CurrencyCode string `json:"CurrencyCode"`
+	}
+	if err := json.Unmarshal(result, &contract); err != nil {
+		return &badPayloadError{function: "Read" + strings.ToUpper(businessType[:1]) + businessType[1:], payload: result}
+	}
+	if contract.CurrencyCode == "" {
+		contract.CurrencyCode = defaultCurrencyCode
+	}
+	if contract.CurrencyCode != currency {
+		return &ChaincodeError{
+			Code:    errCodeCurrencyMismatch,
+			Message: fmt.Sprintf("contract %s settles in %s, not %s", businessID, contract.CurrencyCode, currency),
+			Details: map[string]string{"businessId": businessID, "currency": contract.CurrencyCode, "requested": currency},
+		}
+	}
+	return nil
+}
+
+// StartLoan pays out an applied loan if the applicant meets the lending conditions.
+func (s *ecosysService) StartLoan(ctx context.Context, applicant string, businessID string, credit float32, income float32) (json.RawMessage, error) {
+	return s.submit(ctx, applicant, "StartLoan", applicant, businessID, fmt.Sprintf("%f", credit), fmt.Sprintf("%f", income))
+}
+
+// CheckLoan enforces repayment of an approved loan if it is overdue or the applicant no longer
+// qualifies. If settlementCurrency is set, the loan is repaid in that currency at the current
+// exchange rate.
+func (s *ecosysService) CheckLoan(ctx context.Context, applicant string, businessID string, credit float32, income float32, currentTime string, settlementCurrency string) (json.RawMessage, error) {
+	args := []string{applicant, businessID, fmt.Sprintf("%f", credit), fmt.Sprintf("%f", income), currentTime}
+	if settlementCurrency == "" {
+		return s.submit(ctx, applicant, "LoanContractCheck", args...)
+	}
+	return s.submit(ctx, applicant, "LoanContractCheckInCurrency", append(args, settlementCurrency)...)
+}
+
+// StartInsurance collects the premium of an applied insurance if the applicant qualifies.
+func (s *ecosysService) StartInsurance(ctx context.Context, applicant string, businessID string, credit float32, income float32) (json.RawMessage, error) {
+	return s.submit(ctx, applicant, "StartInsurance", applicant, businessID, fmt.Sprintf("%f", credit), fmt.Sprintf("%f", income))
+}
+
+// CheckInsurance pays the claim of an approved insurance if a covered contingency occurred.
+func (s *ecosysService) CheckInsurance(ctx context.Context, applicant string, businessID string, credit float32, income float32, isSudden bool, contingencyInfo string) (json.RawMessage, error) {
+	return s.submit(ctx, applicant, "InsuranceContractCheck", applicant, businessID, fmt.Sprintf("%f", credit), fmt.Sprintf("%f", income), fmt.Sprintf("%t", isSudden), contingencyInfo)
+}
+
+// Transfer moves currency between two users. Only coins of the given currency, or of the default
+// currency if it is empty, are spent. The coins spent are chosen by the coin selection strategy if
+// one is given, in which case the coins spent and the change are returned.
+func (s *ecosysService) Transfer(ctx context.Context, from string, to string, amount float32, currency string, coinSelection string) (json.RawMessage, error) {
+	if currency == "" && coinSelection == "" {
+		return s.submit(ctx, from, "TransferCurrency", from, to, fmt.Sprintf("%f", amount), "Transfer")
+	}
+	var result json.RawMessage
+	var err error
+	if currency == "" {
+		result, err = s.submit(ctx, from, "TransferCurrencyWithCoinSelection", from, to, fmt.Sprintf("%f", amount), "Transfer", coinSelection)
+	} else {
+		result, err = s.submit(ctx, from, "TransferCurrencyInCurrency", from, to, fmt.Sprintf("%f", amount), currency, "Transfer", coinSelection)
+	}
+	if err == nil {
+		s.observeCoins(from, result)
+	}
+	return result, err
+}
+
+// Coins returns the unspent coins owned by a user.
+func (s *ecosysService) Coins(ctx context.Context, userID string) (json.RawMessage, error) {
+	result, err := s.evaluate(ctx, userID, "ReadCurrencyListByOwner", userID)
+	if err != nil {
+		return nil, err
+	}
+	var coins []json.RawMessage
+	if err := json.Unmarshal(result, &coins); err != nil {
+		return nil, &badPayloadError{function: "ReadCurrencyListByOwner", payload: result}
+	}
+	s.metrics.setCoinCount(userID, len(coins))
+	if coins == nil {
+		return json.RawMessage("[]"), nil
+	}
+	return result, nil
+}
+
+// Consolidate merges the coins of a currency of a user worth at most maxAmount, or all of them if
+// it is zero, into one coin, up to maxInputs coins.
+func (s *ecosysService) Consolidate(ctx context.Context, userID string, maxAmount float32, maxInputs int, currency string) (json.RawMessage, error) {
+	result, err := s.submit(ctx, userID, "ConsolidateCurrency", userID, fmt.Sprintf("%f", maxAmount), fmt.Sprintf("%d", maxInputs), currency)
+	if err == nil {
+		s.observeCoins(userID, result)
+	}
+	return result, err
+}
+
+// Account returns the account balance in a currency of a user who was migrated from coins to an
+// account.
+func (s *ecosysService) Account(ctx context.Context, userID string, currency string) (json.RawMessage, error) {
+	return s.evaluate(ctx, userID, "ReadAccount", userID, currency)
+}
+
+// MigrateToAccount converts the coins of a user into an account balance. Currency received
+// afterwards is added to the balance instead of creating coins.
+func (s *ecosysService) MigrateToAccount(ctx context.Context, userID string) (json.RawMessage, error) {
+	result, err := s.submit(ctx, userID, "MigrateCurrencyToAccount", userID)
+	if err == nil {
+		s.metrics.setCoinCount(userID, 0)
+	}
+	return result, err
+}
+
+// AggregateAccount folds the balance changes in a currency recorded for an account since it was
+// last aggregated into its balance.
+func (s *ecosysService) AggregateAccount(ctx context.Context, userID string, currency string) (json.RawMessage, error) {
+	return s.submit(ctx, userID, "AggregateAccount", userID, currency)
+}
+
+// Balances returns the balance of a user in every currency it holds.
+func (s *ecosysService) Balances(ctx context.Context, userID string) (json.RawMessage, error) {
+	return s.evaluate(ctx, userID, "ReadBalancesByOwner", userID)
+}
+
+// Currencies returns the registered currencies, starting with the default currency.
+func (s *ecosysService) Currencies(ctx context.Context, signer string) (json.RawMessage, error) {
+	return s.evaluate(ctx, signer, "ListCurrencies")
+}
+
+// Currency returns the definition of a currency.
+func (s *ecosysService) Currency(ctx context.Context, signer string, code string) (json.RawMessage, error) {
+	return s.evaluate(ctx, signer, "ReadCurrencyDefinition", code)
+}
+
+// RegisterCurrency registers a currency. If issuer is set, only that user may deposit it.
+func (s *ecosysService) RegisterCurrency(ctx context.Context, signer string, code string, name string, decimals int, issuer string) (json.RawMessage, error) {
+	return s.submit(ctx, signer, "RegisterCurrency", code, name, fmt.Sprintf("%d", decimals), issuer)
+}
+
+// ExchangeRates returns every posted exchange rate, including expired ones.
+func (s *ecosysService) ExchangeRates(ctx context.Context, signer string) (json.RawMessage, error) {
+	return s.evaluate(ctx, signer, "ListExchangeRates")
+}
+
+// ExchangeRate quotes the conversion of currency from into currency to at the current rate.
+func (s *ecosysService) ExchangeRate(ctx context.Context, signer string, from string, to string) (json.RawMessage, error) {
+	return s.evaluate(ctx, signer, "QuoteExchangeRate", from, to)
+}
+
+// PostExchangeRate posts the rate of base in quote, valid between two Unix times. Only a rate
+// oracle may post rates.
+func (s *ecosysService) PostExchangeRate(ctx context.Context, signer string, base string, quote string, rate float64, spread float64, validFrom string, validUntil string) (json.RawMessage, error) {
+	return s.submit(ctx, signer, "PostExchangeRate", base, quote,
+		strconv.FormatFloat(rate, 'f', -1, 64), strconv.FormatFloat(spread, 'f', -1, 64), validFrom, validUntil)
+}
+
+// Convert converts an amount of currency from of a user into currency to at the current rate.
+func (s *ecosysService) Convert(ctx context.Context, userID string, amount float32, from string, to string) (json.RawMessage, error) {
+	return s.submit(ctx, userID, "ConvertCurrency", userID, fmt.Sprintf("%f", amount), from, to)
+}
+
+// FeeSchedule returns the fee schedule, which is empty if transfers are free.
+func (s *ecosysService) FeeSchedule(ctx context.Context, signer string) (json.RawMessage, error) {
+	return s.evaluate(ctx, signer, "ReadFeeSchedule")
+}
+
+// QuoteFee returns the fee charged to the sender of a transfer.
+func (s *ecosysService) QuoteFee(ctx context.Context, signer string, reason string, amount float32, currency string) (json.RawMessage, error) {
+	return s.evaluate(ctx, signer, "QuoteFee", reason, fmt.Sprintf("%f", amount), currency)
+}
+
+// chaincodeFeeTier and chaincodeFeeRule are the fee schedule as stored by the chaincode.
+type chaincodeFeeTier struct {
+	UpTo   float32 `json:"UpTo"`
+	Amount float32 `json:"Amount"`
+	Rate   float64 `json:"Rate"`
+}
+
+type chaincodeFeeRule struct {
+	Type   string             `json:"Type"`
+	Amount float32            `json:"Amount"`
+	Rate   float64            `json:"Rate"`
+	Tiers  []chaincodeFeeTier `json:"Tiers"`
+}
+
+// SetFeeSchedule replaces the fee schedule. Only the treasury may set fees.
+func (s *ecosysService) SetFeeSchedule(ctx context.Context, signer string, schedule FeeScheduleRequest) (json.RawMessage, error) {
+	rules := make(map[string]chaincodeFeeRule, len(schedule.Rules))
+	for reason, rule := range schedule.Rules {
+		tiers := make([]chaincodeFeeTier, 0, len(rule.Tiers))
+		for _, tier := range rule.Tiers {
+			tiers = append(tiers, chaincodeFeeTier(tier))
+		}
+		rules[reason] = chaincodeFeeRule{Type: rule.Type, Amount: rule.Amount, Rate: rule.Rate, Tiers: tiers}
+	}
+	scheduleJSON, err := json.Marshal(struct {
+		FeeAccount string                      `json:"FeeAccount"`
+		Rules      map[string]chaincodeFeeRule `json:"Rules"`
+	}{schedule.FeeAccount, rules})
+	if err != nil {
+		return nil, err
+	}
+	return s.submit(ctx, signer, "SetFeeSchedule", string(scheduleJSON))
+}
+
+// observeCoins records the number of coins left to a user by a coin selection or consolidation.
+func (s *ecosysService) observeCoins(userID string, result json.RawMessage) {
+	var coins struct {
+		Coins *int `json:"Coins"`
+	}
+	if json.Unmarshal(result, &coins) == nil && coins.Coins != nil {
+		s.metrics.setCoinCount(userID, *coins.Coins)
+	}
+}
+
+// Deposit creates new currency owned by a user, in the default currency if code is empty.
+func (s *ecosysService) Deposit(ctx context.Context, userID string, amount float32, code string, currentTime string) (json.RawMessage, error) {
+	currency := Currency{
+		CurrencyID:   "Currency" + currentTime,
+		Amount:       amount,
+		Owner:        userID,
+		CreatedAt:    currentTime,
+		CreatedVia:   "Deposit",
+		UpdatedAt:    currentTime,
+		UpdatedVia:   "Deposit",
+		CurrencyCode: code,
+	}
+	currencyJSON, err := json.Marshal(currency)
+	if err != nil {
+		return nil, err
+	}
+	return s.submit(ctx, userID, "CreateCurrency", string(currencyJSON))
+}
@@ -0,0 +1,310 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// statementDateLayout is the layout of the dates of a statement period.
+	statementDateLayout = "2006-01-02"
+	// maxStatementDays is the longest period of a statement.
+	maxStatementDays = 366
+	// maxStatementRecords is the most transfer records read to generate a statement, counting
+	// those after the period that are worked back from the current balance.
+	maxStatementRecords = 10000
+	// statementPageSize is the number of transfer records read per chaincode query.
+	statementPageSize = 100
+)
+
+// StatementQuery selects the period and currency of a statement. From and To are dates in UTC;
+// both days are included.
+type StatementQuery struct {
+	From     string `form:"from" binding:"required,datetime=2006-01-02"`
+	To       string `form:"to" binding:"required,datetime=2006-01-02"`
+	Currency string `form:"currency" binding:"omitempty,alphanum,uppercase,min=3,max=10"`
+	Format   string `form:"format" binding:"omitempty,oneof=json csv"`
+}
+
+// StatementTotals sums the entries of a statement. Credits and Debits are the money in and out,
+// Fees the fees paid on top of transfers, included in Debits. ByKind is the net amount of each
+// kind of entry.
+type StatementTotals struct {
+	Credits float64            `json:"credits"`
+	Debits  float64            `json:"debits"`
+	Fees    float64            `json:"fees"`
+	ByKind  map[string]float64 `json:"by_kind"`
+}
+
+// StatementReconciliation checks a statement against the ledger. ComputedBalance is the closing
+// balance plus the movements after the period, and LedgerBalance the balance read from the
+// chaincode once the statement was generated. They differ if currency moved while the statement
+// was generated, which then needs to be generated again.
+type StatementReconciliation struct {
+	LedgerBalance        float64 `json:"ledger_balance"`
+	MovementsAfterPeriod float64 `json:"movements_after_period"`
+	ComputedBalance      float64 `json:"computed_balance"`
+	Difference           float64 `json:"difference"`
+	Reconciled           bool    `json:"reconciled"`
+}
+
+// Statement is the account statement of a user in a currency over a period, oldest entry first,
+// structured for a PDF renderer.
+type Statement struct {
+	UserID         string                  `json:"user_id"`
+	Currency       string                  `json:"currency"`
+	From           string                  `json:"from"`
+	To             string                  `json:"to"`
+	GeneratedAt    string                  `json:"generated_at"`
+	OpeningBalance float64                 `json:"opening_balance"`
+	ClosingBalance float64                 `json:"closing_balance"`
+	Entries        []*StatementEntry       `json:"entries"`
+	Totals         StatementTotals         `json:"totals"`
+	Reconciliation StatementReconciliation `json:"reconciliation"`
+}
+
+// statementPeriod is the period of a statement, from the start of its first day until the start
+// of the day after its last day.
+type statementPeriod struct {
+	from  time.Time
+	until time.Time
+}
+
+func parseStatementPeriod(query StatementQuery) (*statementPeriod, error) {
+	from, err := time.Parse(statementDateLayout, query.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := time.Parse(statementDateLayout, query.To)
+	if err != nil {
+		return nil, err
+	}
+	if to.Before(from) {
+		return nil, errors.New("to must not be before from")
+	}
+	until := to.AddDate(0, 0, 1)
+	if until.Sub(from) > maxStatementDays*24*time.Hour {
+		return nil, fmt.Errorf("a statement covers at most %d days", maxStatementDays)
+	}
+	return &statementPeriod{from: from, until: until}, nil
+}
+
+// LedgerBalance returns the balance of a user in a currency, in cents. The default currency is
+// read with ReadTotalCurrencyByOwner, the balance reported by the balance endpoint.
+func (s *ecosysService) LedgerBalance(ctx context.Context, userID string, currency string) (int64, error) {
+	if currency != defaultCurrencyCode {
+		return s.CurrencyBalance(ctx, userID, currency)
+	}
+	result, err := s.Balance(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	var balance float32
+	if err := json.Unmarshal(result, &balance); err != nil {
+		return 0, &badPayloadError{function: "ReadTotalCurrencyByOwner", payload: result}
+	}
+	return toCents(balance), nil
+}
+
+// Statement returns the statement of a user in a currency over a period. The transfer records
+// are read newest first from the current balance, which is worked back through the movements
+// after the period to the closing balance, and through the period to the opening balance.
+//
+// projected returns the kind the projection gave to a transaction from its contract event, or ""
+// if the transaction is not projected; it may be nil.
+func (s *ecosysService) Statement(ctx context.Context, userID string, currency string, period *statementPeriod, projected func(transactionID string) (string, error)) (*Statement, error) {
+	if currency == "" {
+		currency = defaultCurrencyCode
+	}
+	currentCents, err := s.LedgerBalance(ctx, userID, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	balanceCents, afterCents := currentCents, int64(0)
+	var entries []*StatementEntry
+	bookmark, read := "", 0
+	done := false
+	for !done {
+		history, err := s.TransactionHistory(ctx, userID, currency, statementPageSize, bookmark)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range history.Records {
+			seconds, err := strconv.ParseInt(record.Timestamp, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("transfer record %s has an invalid timestamp %q", record.TxID, record.Timestamp)
+			}
+			if seconds < period.from.Unix() {
+				done = true
+				break
+			}
+			if read++; read > maxStatementRecords {
+				return nil, &ChaincodeError{
+					Code:    errCodeConditionNotMet,
+					Message: fmt.Sprintf("a statement reads at most %d transfer records; choose a shorter or earlier period", maxStatementRecords),
+				}
+			}
+			deltaCents := toCents(record.Delta)
+			if seconds >= period.until.Unix() {
+				afterCents += deltaCents
+			} else {
+				entry := statementEntry(userID, record, balanceCents)
+				if entry.Kind == kindContract && projected != nil {
+					kind, err := projected(record.TxID)
+					if err != nil {
+						return nil, err
+					}
+					if kind != "" {
+						entry.Kind = kind
+					}
+				}
+				entries = append(entries, entry)
+			}
+			balanceCents -= deltaCents
+		}
+		bookmark = history.Bookmark
+		done = done || bookmark == ""
+	}
+
+	ledgerCents, err := s.LedgerBalance(ctx, userID, currency)
+	if err != nil {
+		return nil, err
+	}
+	closingCents := currentCents - afterCents
+	statement := &Statement{
+		UserID:         userID,
+		Currency:       currency,
+		From:           period.from.Format(statementDateLayout),
+		To:             period.until.AddDate(0, 0, -1).Format(statementDateLayout),
+		GeneratedAt:    time.Now().UTC().Format(time.RFC3339),
+		OpeningBalance: fromCents(balanceCents),
+		ClosingBalance: fromCents(closingCents),
+		Entries:        make([]*StatementEntry, 0, len(entries)),
+		Totals:         statementTotals(entries),
+		Reconciliation: StatementReconciliation{
+			LedgerBalance:        fromCents(ledgerCents),
+			MovementsAfterPeriod: fromCents(afterCents),
+			ComputedBalance:      fromCents(closingCents + afterCents),
+			Difference:           fromCents(ledgerCents - closingCents - afterCents),
+			Reconciled:           ledgerCents == closingCents+afterCents,
+		},
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		statement.Entries = append(statement.Entries, entries[i])
+	}
+	return statement, nil
+}
+
+// statementTotals sums the entries of a statement in cents.
+func statementTotals(entries []*StatementEntry) StatementTotals {
+	var creditCents, debitCents, feeCents int64
+	byKind := map[string]int64{}
+	for _, entry := range entries {
+		cents := floatToCents(entry.Amount)
+		if cents > 0 {
+			creditCents += cents
+		} else {
+			debitCents -= cents
+		}
+		feeCents += floatToCents(entry.Fee)
+		byKind[entry.Kind] += cents
+	}
+	totals := StatementTotals{
+		Credits: fromCents(creditCents),
+		Debits:  fromCents(debitCents),
+		Fees:    fromCents(feeCents),
+		ByKind:  make(map[string]float64, len(byKind)),
+	}
+	for kind, cents := range byKind {
+		totals.ByKind[kind] = fromCents(cents)
+	}
+	return totals
+}
+
+// statementCSV writes a statement as CSV, one row per entry between an opening and a closing
+// balance row. Dates are RFC 3339 in UTC.
+func statementCSV(statement *Statement) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	amount := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', 2, 64)
+	}
+	rows := [][]string{
+		{"date", "transaction_id", "kind", "reason", "contract_id", "counterparty", "currency", "amount", "fee", "rate", "balance"},
+		{statement.From, "", "opening_balance", "", "", "", statement.Currency, "", "", "", amount(statement.OpeningBalance)},
+	}
+	for _, entry := range statement.Entries {
+		date := entry.Timestamp
+		if seconds, err := strconv.ParseInt(entry.Timestamp, 10, 64); err == nil {
+			date = time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+		}
+		rate := ""
+		if entry.Rate != 0 {
+			rate = strconv.FormatFloat(entry.Rate, 'f', -1, 64)
+		}
+		rows = append(rows, []string{date, entry.TransactionID, entry.Kind, entry.Reason, entry.ContractID, entry.Counterparty,
+			statement.Currency, amount(entry.Amount), amount(entry.Fee), rate, amount(entry.Balance)})
+	}
+	rows = append(rows, []string{statement.To, "", "closing_balance", "", "", "", statement.Currency, "", "", "", amount(statement.ClosingBalance)})
+	if err := writer.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// getStatement returns the statement of a user over a period, as JSON or as a CSV download.
+// Contract entries are told apart by the projection, when the gateway runs one.
+func (s *apiServer) getStatement(c *gin.Context) {
+	var query StatementQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	period, err := parseStatementPeriod(query)
+	if err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	var projected func(string) (string, error)
+	if s.projection != nil {
+		projected = func(transactionID string) (string, error) {
+			transaction, err := s.projection.store.Transaction(transactionID)
+			if err != nil || transaction == nil {
+				return "", err
+			}
+			return transaction.Kind, nil
+		}
+	}
+	statement, err := s.service.Statement(c.Request.Context(), c.Param("id"), query.Currency, period, projected)
+	if err != nil {
+		respondError(c, "GetStatement Failed", err)
+		return
+	}
+	if query.Format != "csv" {
+		respondOK(c, "GetStatement Success", statement)
+		return
+	}
+	data, err := statementCSV(statement)
+	if err != nil {
+		respondError(c, "GetStatement Failed", err)
+		return
+	}
+	c.Header("API-Version", apiVersion)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		fmt.Sprintf("statement-%s-%s-%s-%s.csv", statement.UserID, statement.Currency, statement.From, statement.To)))
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", data)
+}
@@ -0,0 +1,139 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// statementContract returns a contract holding the history of alice in CNY: a deposit before
+// September 2026, a loan and a transfer in September, and a deposit after it.
+func statementContract(t *testing.T) *fakeContract {
+	t.Helper()
+	timestamp := func(day time.Time) string {
+		return fmt.Sprintf("%d", day.Unix())
+	}
+	history := transferHistory{Records: []*transferRecord{
+		{TxID: "tx4", To: "alice", Amount: 10, CurrencyCode: "CNY", Reason: "Deposit",
+			Timestamp: timestamp(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)), Owner: "alice", OwnerCurrency: "CNY", Delta: 10},
+		{TxID: "tx3", From: "alice", To: "bob", Amount: 50, CurrencyCode: "CNY", PaidCurrency: "CNY", PaidAmount: 50, Fee: 1, FeeAccount: "platform",
+			Reason: "Transfer", Timestamp: timestamp(time.Date(2026, 9, 30, 23, 59, 59, 0, time.UTC)), Owner: "alice", OwnerCurrency: "CNY", Delta: -51},
+		{TxID: "tx2", From: "bank", To: "alice", Amount: 100, CurrencyCode: "CNY", PaidCurrency: "CNY", PaidAmount: 100, Reason: "Loan", ContractID: "Loan1",
+			Timestamp: timestamp(time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)), Owner: "alice", OwnerCurrency: "CNY", Delta: 100},
+		{TxID: "tx1", To: "alice", Amount: 900, CurrencyCode: "CNY", Reason: "Deposit",
+			Timestamp: timestamp(time.Date(2026, 8, 31, 23, 59, 59, 0, time.UTC)), Owner: "alice", OwnerCurrency: "CNY", Delta: 900},
+	}}
+	data, err := json.Marshal(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeContract{results: map[string][]byte{
+		"ReadTotalCurrencyByOwner": []byte(`959`),
+		"ReadTransactionHistory":   data,
+	}}
+}
+
+func TestStatementWorksBackFromTheLedgerBalance(t *testing.T) {
+	contract := statementContract(t)
+	recorder, response := serve(t, contract, http.MethodGet, "/v1/users/alice/statements?from=2026-09-01&to=2026-09-30", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	want := []chaincodeCall{
+		{function: "ReadTotalCurrencyByOwner", args: []string{"alice"}},
+		{function: "ReadTransactionHistory", args: []string{"alice", "CNY", "100", ""}},
+		{function: "ReadTotalCurrencyByOwner", args: []string{"alice"}},
+	}
+	if !reflect.DeepEqual(contract.calls, want) {
+		t.Errorf("chaincode calls = %+v, want %+v", contract.calls, want)
+	}
+
+	data, _ := json.Marshal(response.Result)
+	var statement Statement
+	if err := json.Unmarshal(data, &statement); err != nil {
+		t.Fatal(err)
+	}
+	if statement.From != "2026-09-01" || statement.To != "2026-09-30" || statement.Currency != "CNY" ||
+		statement.OpeningBalance != 900 || statement.ClosingBalance != 949 {
+		t.Errorf("statement = %+v", statement)
+	}
+	if len(statement.Entries) != 2 || statement.Entries[0].TransactionID != "tx2" || statement.Entries[0].Balance != 1000 ||
+		statement.Entries[1].TransactionID != "tx3" || statement.Entries[1].Balance != 949 {
+		t.Errorf("entries = %+v", statement.Entries)
+	}
+	wantTotals := StatementTotals{Credits: 100, Debits: 51, Fees: 1, ByKind: map[string]float64{kindContract: 100, kindTransfer: -51}}
+	if !reflect.DeepEqual(statement.Totals, wantTotals) {
+		t.Errorf("totals = %+v, want %+v", statement.Totals, wantTotals)
+	}
+	wantReconciliation := StatementReconciliation{LedgerBalance: 959, MovementsAfterPeriod: 10, ComputedBalance: 959, Reconciled: true}
+	if statement.Reconciliation != wantReconciliation {
+		t.Errorf("reconciliation = %+v, want %+v", statement.Reconciliation, wantReconciliation)
+	}
+}
+
+func TestStatementTellsContractEntriesApartWithTheProjection(t *testing.T) {
+	p := newTestProjection(t)
+	project(t, p, []*client.ChaincodeEvent{
+		chaincodeEvent(t, 1, "tx2", eventStartLoan, contractEvent{BusinessID: "Loan1", Amount: 100, Issuer: "bank", State: "Approved", Applicant: "alice"}),
+	})
+
+	auth := newTestAuth(t)
+	router := newRouter(newEcosysService(statementContract(t), p.metrics, serviceOptions{}), auth, newTestIdentities(t), routerOptions{projection: p})
+	token, _, err := auth.issueToken("alice", roleApplicant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodGet, "/v1/users/alice/statements?from=2026-09-01&to=2026-09-30&format=csv", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("status = %d, headers = %v, body = %s", recorder.Code, recorder.Header(), recorder.Body.String())
+	}
+	if disposition := recorder.Header().Get("Content-Disposition"); disposition != `attachment; filename="statement-alice-CNY-2026-09-01-2026-09-30.csv"` {
+		t.Errorf("Content-Disposition = %s", disposition)
+	}
+	rows, err := csv.NewReader(strings.NewReader(recorder.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"date", "transaction_id", "kind", "reason", "contract_id", "counterparty", "currency", "amount", "fee", "rate", "balance"},
+		{"2026-09-01", "", "opening_balance", "", "", "", "CNY", "", "", "", "900.00"},
+		{"2026-09-01T00:00:00Z", "tx2", kindLoanDisbursement, "Loan", "Loan1", "bank", "CNY", "100.00", "0.00", "", "1000.00"},
+		{"2026-09-30T23:59:59Z", "tx3", kindTransfer, "Transfer", "", "bob", "CNY", "-51.00", "1.00", "", "949.00"},
+		{"2026-09-30", "", "closing_balance", "", "", "", "CNY", "", "", "", "949.00"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+}
+
+func TestStatementPeriodIsValidated(t *testing.T) {
+	for _, query := range []string{
+		"to=2026-09-30",
+		"from=2026-09-01&to=2026-09-31",
+		"from=2026-09-30&to=2026-09-01",
+		"from=2025-01-01&to=2026-09-30",
+		"from=2026-09-01&to=2026-09-30&format=pdf",
+	} {
+		contract := statementContract(t)
+		recorder, _ := serve(t, contract, http.MethodGet, "/v1/users/alice/statements?"+query, "")
+		if recorder.Code != http.StatusBadRequest || len(contract.calls) != 0 {
+			t.Errorf("%s: status = %d, calls = %+v", query, recorder.Code, contract.calls)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+const (
+	// streamBufferSize is the number of recent events kept to resume event streams.
+	streamBufferSize = 1024
+	// streamSubscriberBuffer is the number of events queued for a stream before the client is
+	// considered too slow and disconnected. It can reconnect and resume from its last event.
+	streamSubscriberBuffer = 64
+	// streamHeartbeat is the interval of the comments sent to keep idle streams open through
+	// proxies.
+	streamHeartbeat = 15 * time.Second
+)
+
+// StreamEvent is a chaincode event pushed to clients. Its ID is "block:transaction" and is sent
+// back in the Last-Event-ID header to resume a stream. The status event of a transaction has the
+// same block and transaction as its chaincode event, so its ID ends with ":status".
+type StreamEvent struct {
+	ID            string          `json:"id"`
+	EventName     string          `json:"event_name"`
+	Block         uint64          `json:"block"`
+	TransactionID string          `json:"transaction_id"`
+	Payload       json.RawMessage `json:"payload"`
+
+	parties []string
+}
+
+// eventSubjects are the users named by an event payload.
+type eventSubjects struct {
+	Owner     string `json:"Owner"`
+	From      string `json:"From"`
+	To        string `json:"To"`
+	Applicant string `json:"Applicant"`
+	Issuer    string `json:"Issuer"`
+}
+
+// parseEventSubjects returns the users named by an event payload, or none if it is not JSON.
+func parseEventSubjects(payload []byte) eventSubjects {
+	var subjects eventSubjects
+	json.Unmarshal(payload, &subjects)
+	return subjects
+}
+
+// parties returns the users an event concerns: the owner of currency, the parties of a transfer,
+// or the applicant and issuer of a contract.
+func (s eventSubjects) parties() []string {
+	return uniqueParties(s.Owner, s.From, s.To, s.Applicant, s.Issuer)
+}
+
+// newStreamEvent converts a chaincode event for clients. A payload that is not JSON is passed as
+// a JSON string.
+func newStreamEvent(event *client.ChaincodeEvent) *StreamEvent {
+	payload := json.RawMessage(event.Payload)
+	if !json.Valid(payload) {
+		payload, _ = json.Marshal(string(event.Payload))
+	}
+	id := fmt.Sprintf("%d:%s", event.BlockNumber, event.TransactionID)
+	if event.EventName == eventTransactionStatus {
+		id += ":status"
+	}
+	return &StreamEvent{
+		ID:            id,
+		EventName:     event.EventName,
+		Block:         event.BlockNumber,
+		TransactionID: event.TransactionID,
+		Payload:       payload,
+		parties:       parseEventSubjects(event.Payload).parties(),
+	}
+}
+
+// eventSubscription is the queue of events of one stream.
+type eventSubscription struct {
+	userID string
+	events chan *StreamEvent
+	closed bool
+}
+
+// eventHub fans chaincode events out to the event streams of the users they concern, and keeps
+// the most recent events so that a stream can resume after a reconnection.
+type eventHub struct {
+	mu          sync.Mutex
+	recent      []*StreamEvent
+	size        int
+	subscribers map[*eventSubscription]struct{}
+}
+
+func newEventHub(size int) *eventHub {
+	return &eventHub{size: size, subscribers: map[*eventSubscription]struct{}{}}
+}
+
+// publish is an event handler delivering an event to the subscribed users it concerns. Events
+// delivered again by the event consumer are ignored.
+func (h *eventHub) publish(_ context.Context, event *client.ChaincodeEvent) error {
+	streamEvent := newStreamEvent(event)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if slices.ContainsFunc(h.recent, func(recent *StreamEvent) bool { return recent.ID == streamEvent.ID }) {
+		return nil
+	}
+	h.recent = append(h.recent, streamEvent)
+	if len(h.recent) > h.size {
+		h.recent = slices.Delete(h.recent, 0, len(h.recent)-h.size)
+	}
+
+	for subscription := range h.subscribers {
+		if !slices.Contains(streamEvent.parties, subscription.userID) {
+			continue
+		}
+		select {
+		case subscription.events <- streamEvent:
+		default:
+			h.closeSubscription(subscription)
+		}
+	}
+	return nil
+}
+
+// subscribe opens a stream of the events concerning a user. If lastEventID is set, the events
+// after it are returned as a backlog; resumed is false if they are no longer all kept, in which
+// case the client has to reload its state.
+func (h *eventHub) subscribe(userID string, lastEventID string) (subscription *eventSubscription, backlog []*StreamEvent, resumed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subscription = &eventSubscription{userID: userID, events: make(chan *StreamEvent, streamSubscriberBuffer)}
+	h.subscribers[subscription] = struct{}{}
+	if lastEventID == "" {
+		return subscription, nil, true
+	}
+
+	start, resumed := h.resumeIndex(lastEventID)
+	for _, event := range h.recent[start:] {
+		if slices.Contains(event.parties, userID) {
+			backlog = append(backlog, event)
+		}
+	}
+	return subscription, backlog, resumed
+}
+
+// resumeIndex returns the index of the first recent event after lastEventID. The caller must hold
+// the lock.
+func (h *eventHub) resumeIndex(lastEventID string) (int, bool) {
+	for i, event := range h.recent {
+		if event.ID == lastEventID {
+			return i + 1, true
+		}
+	}
+
+	// The event is not kept any more, or was received before a restart: resume after its block
+	// if no later block has been dropped
+	blockText, _, _ := strings.Cut(lastEventID, ":")
+	block, err := strconv.ParseUint(blockText, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	for i, event := range h.recent {
+		if event.Block > block {
+			return i, i > 0 || len(h.recent) < h.size
+		}
+	}
+	return len(h.recent), true
+}
+
+func (h *eventHub) unsubscribe(subscription *eventSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closeSubscription(subscription)
+}
+
+// closeSubscription ends a stream. The caller must hold the lock.
+func (h *eventHub) closeSubscription(subscription *eventSubscription) {
+	if subscription.closed {
+		return
+	}
+	subscription.closed = true
+	delete(h.subscribers, subscription)
+	close(subscription.events)
+}
+
+// Close ends every stream, so that the server can shut down.
+func (h *eventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for subscription := range h.subscribers {
+		h.closeSubscription(subscription)
+	}
+}
+
+// registerStreamRoutes registers the server-sent events stream of a user. Browsers cannot set
+// headers on an EventSource, so the access token may also be passed as the access_token query
+// parameter.
+func (s *apiServer) registerStreamRoutes(router gin.IRouter) {
+	router.GET("/"+apiVersion+"/users/:id/events", tokenFromQuery, s.requireAuth, s.requireSelf, s.streamEvents)
+}
+
+// tokenFromQuery uses the access_token query parameter as bearer token if the request has no
+// Authorization header.
+func tokenFromQuery(c *gin.Context) {
+	if token := c.Query("access_token"); token != "" && c.GetHeader("Authorization") == "" {
+		c.Request.Header.Set("Authorization", "Bearer "+token)
+	}
+	c.Next()
+}
+
+// streamEvents streams the chaincode events concerning the user as server-sent events, starting
+// after the Last-Event-ID header or last_event_id query parameter if set. If events after it have
+// been dropped, a "reset" event tells the client to reload its state first.
+func (s *apiServer) streamEvents(c *gin.Context) {
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+
+	subscription, backlog, resumed := s.events.subscribe(c.Param("id"), lastEventID)
+	defer s.events.unsubscribe(subscription)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	if !resumed {
+		fmt.Fprintf(c.Writer, "event: reset\ndata: {\"last_event_id\":%q}\n\n", lastEventID)
+	}
+	for _, event := range backlog {
+		writeStreamEvent(c.Writer, event)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-subscription.events:
+			if !ok {
+				return
+			}
+			writeStreamEvent(c.Writer, event)
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": heartbeat\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeStreamEvent(w gin.ResponseWriter, event *StreamEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.EventName, data)
+}
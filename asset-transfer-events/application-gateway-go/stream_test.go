@@ -0,0 +1,122 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+func publish(t *testing.T, hub *eventHub, events ...*client.ChaincodeEvent) {
+	t.Helper()
+	for _, event := range events {
+		if err := hub.publish(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func streamIDs(events []*StreamEvent) []string {
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestEventHubFiltersAndResumes(t *testing.T) {
+	hub := newEventHub(4)
+	events := loanEvents(t)
+	publish(t, hub, events[:5]...)
+
+	// Only the events concerning bob, after the last one seen
+	_, backlog, resumed := hub.subscribe("bob", "1:tx1")
+	if ids := streamIDs(backlog); !resumed || len(ids) != 1 || ids[0] != "4:tx5" {
+		t.Errorf("backlog of bob = %v, resumed = %v", ids, resumed)
+	}
+
+	// tx1 is no longer kept, but no event after block 1 was dropped
+	_, backlog, resumed = hub.subscribe("alice", "1:tx1")
+	if ids := streamIDs(backlog); !resumed || len(ids) != 3 {
+		t.Errorf("backlog of alice = %v, resumed = %v", ids, resumed)
+	}
+
+	// Events of block 0 and 1 have been dropped
+	if _, _, resumed = hub.subscribe("alice", "0:tx0"); resumed {
+		t.Errorf("stream resumed although events were dropped")
+	}
+
+	live, _, _ := hub.subscribe("alice", "")
+	publish(t, hub, events[4], events[6])
+	select {
+	case event := <-live.events:
+		if event.ID != "6:tx7" {
+			t.Errorf("live event = %s, a duplicate was delivered", event.ID)
+		}
+	default:
+		t.Errorf("live event was not delivered")
+	}
+
+	hub.Close()
+	if _, ok := <-live.events; ok {
+		t.Errorf("stream was not closed")
+	}
+}
+
+func TestStreamEndpoint(t *testing.T) {
+	hub := newEventHub(streamBufferSize)
+	events := loanEvents(t)
+	publish(t, hub, events[:3]...)
+
+	auth := newTestAuth(t)
+	server := httptest.NewServer(newRouter(newEcosysService(&fakeContract{}, newMetrics(), serviceOptions{}), auth, newTestIdentities(t), routerOptions{events: hub}))
+	defer server.Close()
+	token, _, err := auth.issueToken("alice", roleApplicant)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v1/users/alice/events?access_token="+token, nil)
+	request.Header.Set("Last-Event-ID", "1:tx2")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status = %d, content type = %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	go hub.publish(context.Background(), events[3])
+	var ids []string
+	scanner := bufio.NewScanner(response.Body)
+	for len(ids) < 2 && scanner.Scan() {
+		if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) != 2 || ids[0] != "2:tx3" || ids[1] != "3:tx4" {
+		t.Errorf("streamed events = %v, want the backlog then the live event", ids)
+	}
+
+	forbidden, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/users/bob/events?access_token="+token, nil)
+	response, err = http.DefaultClient.Do(forbidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("stream of another user status = %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,253 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// eventTransactionStatus is the event published to event streams and webhooks when a tracked
+// transaction is committed, found invalid or given up on. Its payload is the TrackedTransaction.
+const eventTransactionStatus = "TransactionStatus"
+
+// commitStatusLookup finds the commit status of a transaction on the ledger. It is implemented by
+// gatewayPool.
+type commitStatusLookup interface {
+	TransactionStatus(ctx context.Context, transactionID string) (*client.Status, error)
+}
+
+// transactionTracker records every submitted transaction and waits for its commit status in the
+// background, so that requests need not hold the connection open until the block is committed.
+// Transactions still submitted after a restart are resolved by looking up their status on the
+// ledger, until they expire.
+type transactionTracker struct {
+	store        *transactionStore
+	lookup       commitStatusLookup
+	expiry       time.Duration
+	pollInterval time.Duration
+	now          func() time.Time
+	handlers     []eventHandler
+
+	// ctx bounds the commit status waits, which outlive the requests that submitted them
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	waiting map[string]*commitWaiter
+}
+
+// commitWaiter is the commit status wait of a transaction submitted by this process.
+type commitWaiter struct {
+	submitted   *TrackedTransaction
+	done        chan struct{}
+	transaction *TrackedTransaction
+	err         error
+}
+
+func newTransactionTracker(store *transactionStore, lookup commitStatusLookup, config TransactionsConfig) *transactionTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &transactionTracker{
+		store:        store,
+		lookup:       lookup,
+		expiry:       config.Expiry,
+		pollInterval: 5 * time.Second,
+		now:          time.Now,
+		ctx:          ctx,
+		cancel:       cancel,
+		waiting:      map[string]*commitWaiter{},
+	}
+}
+
+// Notify registers a handler called with a TransactionStatus event when a transaction completes.
+func (t *transactionTracker) Notify(handler eventHandler) {
+	t.handlers = append(t.handlers, handler)
+}
+
+// track stores a submitted transaction and starts waiting for its commit status.
+func (t *transactionTracker) track(owner string, function string, result []byte, submitted submittedTransaction) (*commitWaiter, error) {
+	transaction := &TrackedTransaction{
+		TransactionID: submitted.TransactionID(),
+		Owner:         owner,
+		Function:      function,
+		Status:        transactionSubmitted,
+		SubmittedAt:   t.now().UTC(),
+	}
+	if json.Valid(result) {
+		transaction.Result = result
+	}
+	if err := t.store.Put(transaction); err != nil {
+		return nil, fmt.Errorf("failed to store transaction %s: %w", transaction.TransactionID, err)
+	}
+
+	waiter := &commitWaiter{submitted: transaction, done: make(chan struct{})}
+	t.mu.Lock()
+	t.waiting[transaction.TransactionID] = waiter
+	t.mu.Unlock()
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		status, err := submitted.Status(t.ctx)
+		if err == nil {
+			waiter.transaction, waiter.err = t.complete(transaction, status)
+		} else {
+			// Left submitted, to be resolved from the ledger
+			waiter.err = err
+		}
+		t.mu.Lock()
+		delete(t.waiting, transaction.TransactionID)
+		t.mu.Unlock()
+		close(waiter.done)
+	}()
+	return waiter, nil
+}
+
+// wait returns the completed transaction once its commit status is known.
+func (w *commitWaiter) wait(ctx context.Context) (*TrackedTransaction, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-w.done:
+		return w.transaction, w.err
+	}
+}
+
+// complete records the commit status of a transaction.
+func (t *transactionTracker) complete(submitted *TrackedTransaction, status *client.Status) (*TrackedTransaction, error) {
+	transaction := *submitted
+	transaction.Status = transactionCommitted
+	if !status.Successful {
+		transaction.Status = transactionInvalid
+	}
+	transaction.ValidationCode = status.Code.String()
+	transaction.Block = status.BlockNumber
+	return &transaction, t.finish(&transaction)
+}
+
+// finish stores a completed transaction and notifies its owner, unless it was already completed.
+func (t *transactionTracker) finish(transaction *TrackedTransaction) error {
+	now := t.now().UTC()
+	transaction.CompletedAt = &now
+	completed, err := t.store.Complete(transaction)
+	if err != nil {
+		return fmt.Errorf("failed to store transaction %s: %w", transaction.TransactionID, err)
+	}
+	if !completed {
+		return nil
+	}
+
+	log.Printf("Transaction %s of %s is %s", transaction.TransactionID, transaction.Function, transaction.Status)
+	payload, err := json.Marshal(transaction)
+	if err != nil {
+		return err
+	}
+	event := &client.ChaincodeEvent{
+		BlockNumber:   transaction.Block,
+		TransactionID: transaction.TransactionID,
+		EventName:     eventTransactionStatus,
+		Payload:       payload,
+	}
+	for _, handler := range t.handlers {
+		if err := handler(t.ctx, event); err != nil {
+			log.Printf("Failed to notify status of transaction %s: %v", transaction.TransactionID, err)
+		}
+	}
+	return nil
+}
+
+// Run resolves the submitted transactions not waited for by this process, until the context is
+// cancelled.
+func (t *transactionTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.pollInterval)
+	defer ticker.Stop()
+	for {
+		t.resolveSubmitted(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resolveSubmitted looks up the commit status of the submitted transactions on the ledger. Those
+// not found before they expire, for example because the orderer never received them, are marked
+// unknown.
+func (t *transactionTracker) resolveSubmitted(ctx context.Context) {
+	submitted, err := t.store.Submitted()
+	if err != nil {
+		log.Printf("Failed to read submitted transactions: %v", err)
+		return
+	}
+	for _, transaction := range submitted {
+		t.mu.Lock()
+		_, waiting := t.waiting[transaction.TransactionID]
+		t.mu.Unlock()
+		if waiting {
+			continue
+		}
+
+		status, err := t.lookup.TransactionStatus(ctx, transaction.TransactionID)
+		switch {
+		case err == nil:
+			_, err = t.complete(transaction, status)
+		case ctx.Err() != nil:
+			return
+		case t.now().Sub(transaction.SubmittedAt) >= t.expiry:
+			transaction.Status = transactionUnknown
+			transaction.Error = fmt.Sprintf("commit status not found within %v: %v", t.expiry, err)
+			err = t.finish(transaction)
+		default:
+			err = nil
+		}
+		if err != nil {
+			log.Printf("Failed to resolve transaction %s: %v", transaction.TransactionID, err)
+		}
+	}
+}
+
+// Close stops waiting for commit statuses. Transactions still submitted are resolved after a
+// restart.
+func (t *transactionTracker) Close() {
+	t.cancel()
+	t.wg.Wait()
+}
+
+// asyncRequested reports whether a client asked not to wait for the commit of the transaction it
+// submits, with the "Prefer: respond-async" header.
+func asyncRequested(c *gin.Context) bool {
+	for _, header := range c.Request.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// registerTransactionRoutes registers the status of the transactions submitted by a user.
+func (s *apiServer) registerTransactionRoutes(router gin.IRouter) {
+	router.GET("/"+apiVersion+"/transactions/:txid", s.requireAuth, s.getTransaction)
+}
+
+func (s *apiServer) getTransaction(c *gin.Context) {
+	transaction, err := s.service.transactions.store.Transaction(authenticatedUser(c), c.Param("txid"))
+	if err != nil {
+		respondError(c, "GetTransaction Failed", err)
+		return
+	}
+	respondOK(c, "GetTransaction Success", transaction)
+}
@@ -0,0 +1,172 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+)
+
+// fakeLookup finds the commit status of the transactions it holds on the ledger.
+type fakeLookup map[string]*client.Status
+
+func (f fakeLookup) TransactionStatus(_ context.Context, transactionID string) (*client.Status, error) {
+	if status, ok := f[transactionID]; ok {
+		return status, nil
+	}
+	return nil, errors.New("no such transaction ID")
+}
+
+func newTestTracker(t *testing.T, lookup commitStatusLookup) *transactionTracker {
+	t.Helper()
+	store, err := openTransactionStore(filepath.Join(t.TempDir(), "transactions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	tracker := newTransactionTracker(store, lookup, defaultConfig().Transactions)
+	t.Cleanup(tracker.Close)
+	return tracker
+}
+
+// newTransactionRequester returns a function sending authenticated requests to a router tracking
+// transactions, asynchronously if async is set.
+func newTransactionRequester(t *testing.T, contract *fakeContract, tracker *transactionTracker) func(userID string, async bool, method string, target string, body string) (*httptest.ResponseRecorder, Response) {
+	auth := newTestAuth(t)
+	router := newRouter(newEcosysService(contract, newMetrics(), serviceOptions{transactions: tracker}), auth, newTestIdentities(t), routerOptions{})
+	return func(userID string, async bool, method string, target string, body string) (*httptest.ResponseRecorder, Response) {
+		t.Helper()
+		token, _, err := auth.issueToken(userID, roleApplicant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer "+token)
+		if async {
+			request.Header.Set("Prefer", "respond-async")
+		}
+		return record(t, router, request)
+	}
+}
+
+func TestAsyncSubmitIsTracked(t *testing.T) {
+	tracker := newTestTracker(t, fakeLookup{})
+	hub := newEventHub(streamBufferSize)
+	tracker.Notify(hub.publish)
+	stream, _, _ := hub.subscribe("alice", "")
+
+	contract := &fakeContract{result: []byte(`{"ok":true}`), release: make(chan struct{})}
+	request := newTransactionRequester(t, contract, tracker)
+
+	recorder, response := request("alice", true, http.MethodPost, "/v1/users/alice/transfers", `{"target_user_id": "bob", "amount": 12.5}`)
+	if recorder.Code != http.StatusAccepted || recorder.Header().Get("Location") != "/v1/transactions/tx1" {
+		t.Fatalf("status = %d, location = %q, body = %s", recorder.Code, recorder.Header().Get("Location"), recorder.Body.String())
+	}
+	if accepted := response.Result.(map[string]any); accepted["status"] != transactionSubmitted || accepted["function"] != "TransferCurrency" {
+		t.Errorf("accepted transaction = %v", accepted)
+	}
+
+	if _, response := request("alice", false, http.MethodGet, "/v1/transactions/tx1", ""); response.Result.(map[string]any)["status"] != transactionSubmitted {
+		t.Errorf("transaction before commit = %v", response.Result)
+	}
+	if recorder, _ := request("bob", false, http.MethodGet, "/v1/transactions/tx1", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("transaction of another user status = %d", recorder.Code)
+	}
+
+	close(contract.release)
+	select {
+	case event := <-stream.events:
+		if event.ID != "1:tx1:status" || event.EventName != eventTransactionStatus {
+			t.Errorf("streamed event = %s %s", event.ID, event.EventName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transaction status was not streamed")
+	}
+
+	_, response = request("alice", false, http.MethodGet, "/v1/transactions/tx1", "")
+	committed := response.Result.(map[string]any)
+	if committed["status"] != transactionCommitted || committed["validation_code"] != "VALID" || committed["block"] != float64(1) {
+		t.Errorf("transaction after commit = %v", committed)
+	}
+}
+
+func TestSubmitWaitsForCommit(t *testing.T) {
+	tracker := newTestTracker(t, fakeLookup{})
+	contract := &fakeContract{status: &client.Status{Code: peer.TxValidationCode_MVCC_READ_CONFLICT, BlockNumber: 4}}
+	request := newTransactionRequester(t, contract, tracker)
+
+	recorder, response := request("alice", false, http.MethodPost, "/v1/users/alice/transfers", `{"target_user_id": "bob", "amount": 12.5}`)
+	if recorder.Code != http.StatusConflict || response.Error.Code != errCodeCommitFailed || response.Error.Details["validationCode"] != "MVCC_READ_CONFLICT" {
+		t.Fatalf("status = %d, error = %+v", recorder.Code, response.Error)
+	}
+	if _, response := request("alice", false, http.MethodGet, "/v1/transactions/tx1", ""); response.Result.(map[string]any)["status"] != transactionInvalid {
+		t.Errorf("invalid transaction = %v", response.Result)
+	}
+}
+
+func TestSubmittedTransactionsAreResolved(t *testing.T) {
+	lookup := fakeLookup{"tx1": {Code: peer.TxValidationCode_VALID, Successful: true, TransactionID: "tx1", BlockNumber: 7}}
+	tracker := newTestTracker(t, lookup)
+	var notified []string
+	tracker.Notify(func(_ context.Context, event *client.ChaincodeEvent) error {
+		notified = append(notified, event.TransactionID)
+		return nil
+	})
+
+	// Transactions submitted before a restart
+	now := time.Now().UTC()
+	for id, submittedAt := range map[string]time.Time{"tx1": now.Add(-time.Minute), "tx2": now.Add(-time.Hour), "tx3": now} {
+		if err := tracker.store.Put(&TrackedTransaction{TransactionID: id, Owner: "alice", Status: transactionSubmitted, SubmittedAt: submittedAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker.resolveSubmitted(context.Background())
+	for id, want := range map[string]string{"tx1": transactionCommitted, "tx2": transactionUnknown, "tx3": transactionSubmitted} {
+		transaction, err := tracker.store.Transaction("alice", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if transaction.Status != want {
+			t.Errorf("%s status = %s, want %s", id, transaction.Status, want)
+		}
+	}
+	if submitted, _ := tracker.store.Submitted(); len(submitted) != 1 {
+		t.Errorf("submitted transactions = %d, want the recent one still awaited", len(submitted))
+	}
+
+	// Completed transactions are not resolved again
+	tracker.resolveSubmitted(context.Background())
+	if len(notified) != 2 {
+		t.Errorf("notified = %v, want tx1 and tx2 once", notified)
+	}
+}
+
+func TestAsyncRequested(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                              false,
+		"respond-async":                 true,
+		"return=minimal, Respond-Async": true,
+		"wait=10":                       false,
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+		c.Request.Header.Set("Prefer", header)
+		if got := asyncRequested(c); got != want {
+			t.Errorf("Prefer %q: async = %v, want %v", header, got, want)
+		}
+	}
+}
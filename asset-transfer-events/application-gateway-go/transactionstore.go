@@ -0,0 +1,149 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the transaction store. Submitted transactions whose commit status is not known yet
+// are also indexed in the submitted bucket, so that they can be resolved after a restart.
+var (
+	trackedBucket   = []byte("transactions")
+	submittedBucket = []byte("submitted")
+
+	transactionBuckets = [][]byte{trackedBucket, submittedBucket}
+)
+
+// Transaction states. A transaction is submitted once it has been endorsed and sent for
+// ordering; it is committed or invalid once its block is committed. Its state is unknown if the
+// commit status could not be found before the tracking expired.
+const (
+	transactionSubmitted = "submitted"
+	transactionCommitted = "committed"
+	transactionInvalid   = "invalid"
+	transactionUnknown   = "unknown"
+)
+
+// TrackedTransaction is a transaction submitted through the gateway. Result is the result of the
+// endorsed chaincode function, which only takes effect if the transaction is committed.
+type TrackedTransaction struct {
+	TransactionID  string          `json:"transaction_id"`
+	Owner          string          `json:"owner"`
+	Function       string          `json:"function"`
+	Status         string          `json:"status"`
+	ValidationCode string          `json:"validation_code,omitempty"`
+	Block          uint64          `json:"block,omitempty"`
+	Result         json.RawMessage `json:"result,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	SubmittedAt    time.Time       `json:"submitted_at"`
+	CompletedAt    *time.Time      `json:"completed_at,omitempty"`
+}
+
+// transactionStore is the bbolt database of tracked transactions.
+type transactionStore struct {
+	db *bolt.DB
+}
+
+func openTransactionStore(path string) (*transactionStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open transaction store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range transactionBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to read transaction store %s: %w", path, err)
+	}
+	return &transactionStore{db: db}, nil
+}
+
+func (s *transactionStore) Close() error {
+	return s.db.Close()
+}
+
+// Put stores a submitted transaction, indexed as submitted until it is completed.
+func (s *transactionStore) Put(transaction *TrackedTransaction) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(transaction.TransactionID)
+		if err := putJSON(tx.Bucket(trackedBucket), key, transaction); err != nil {
+			return err
+		}
+		return tx.Bucket(submittedBucket).Put(key, []byte{})
+	})
+}
+
+// Complete stores a completed transaction. It returns false without storing it if the
+// transaction is no longer submitted, so that a transaction is only completed once.
+func (s *transactionStore) Complete(transaction *TrackedTransaction) (bool, error) {
+	var completed bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(transaction.TransactionID)
+		submitted := tx.Bucket(submittedBucket)
+		if submitted.Get(key) == nil {
+			return nil
+		}
+		completed = true
+		if err := putJSON(tx.Bucket(trackedBucket), key, transaction); err != nil {
+			return err
+		}
+		return submitted.Delete(key)
+	})
+	return completed, err
+}
+
+// Transaction returns a transaction submitted by owner. Transactions of other users are reported
+// as not found.
+func (s *transactionStore) Transaction(owner string, transactionID string) (*TrackedTransaction, error) {
+	var transaction TrackedTransaction
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(trackedBucket).Get([]byte(transactionID))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &transaction)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found || transaction.Owner != owner {
+		return nil, &ChaincodeError{
+			Code:    errCodeNotFound,
+			Message: fmt.Sprintf("transaction %s does not exist", transactionID),
+			Details: map[string]string{"transaction_id": transactionID},
+		}
+	}
+	return &transaction, nil
+}
+
+// Submitted returns the transactions whose commit status is not known yet.
+func (s *transactionStore) Submitted() ([]*TrackedTransaction, error) {
+	var transactions []*TrackedTransaction
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tracked := tx.Bucket(trackedBucket)
+		return tx.Bucket(submittedBucket).ForEach(func(key, _ []byte) error {
+			var transaction TrackedTransaction
+			if err := json.Unmarshal(tracked.Get(key), &transaction); err != nil {
+				return err
+			}
+			transactions = append(transactions, &transaction)
+			return nil
+		})
+	})
+	return transactions, err
+}
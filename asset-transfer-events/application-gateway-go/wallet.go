@@ -0,0 +1,298 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"golang.org/x/crypto/scrypt"
+)
+
+// errIdentityNotFound is returned by a wallet that holds no identity for a label.
+var errIdentityNotFound = errors.New("no Fabric identity is enrolled for this user")
+
+// walletIdentity is an X.509 identity stored in a wallet. It uses the identity file format of the
+// Fabric SDKs, so wallets can be shared with other Fabric client applications.
+type walletIdentity struct {
+	Version     int    `json:"version"`
+	MSPID       string `json:"mspId"`
+	Type        string `json:"type"`
+	Credentials struct {
+		Certificate string `json:"certificate"`
+		PrivateKey  string `json:"privateKey"`
+	} `json:"credentials"`
+}
+
+// newWalletIdentity checks that the private key belongs to the certificate and returns the identity.
+func newWalletIdentity(mspID string, certificatePEM []byte, privateKeyPEM []byte) (*walletIdentity, error) {
+	certificate, err := identity.CertificateFromPEM(certificatePEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	privateKey, err := identity.PrivateKeyFromPEM(privateKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	publicKey, ok := certificate.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(signer.Public()) {
+		return nil, errors.New("private key does not match the certificate")
+	}
+
+	id := &walletIdentity{Version: 1, MSPID: mspID, Type: "X.509"}
+	id.Credentials.Certificate = string(certificatePEM)
+	id.Credentials.PrivateKey = string(privateKeyPEM)
+	return id, nil
+}
+
+// x509Identity returns the client identity used to connect a Gateway.
+func (w *walletIdentity) x509Identity() (*identity.X509Identity, error) {
+	certificate, err := identity.CertificateFromPEM([]byte(w.Credentials.Certificate))
+	if err != nil {
+		return nil, err
+	}
+	return identity.NewX509Identity(w.MSPID, certificate)
+}
+
+// sign returns the signing function for the private key of the identity.
+func (w *walletIdentity) sign() (identity.Sign, error) {
+	privateKey, err := identity.PrivateKeyFromPEM([]byte(w.Credentials.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return identity.NewPrivateKeySign(privateKey)
+}
+
+// wallet stores the Fabric identities of gateway users, labelled by user ID.
+type wallet interface {
+	Put(label string, id *walletIdentity) error
+	Get(label string) (*walletIdentity, error)
+	Remove(label string) error
+	List() ([]string, error)
+}
+
+const identityFileExtension = ".id"
+
+// fileSystemWallet stores each identity as a plain JSON file named <label>.id. The private keys
+// are only protected by the file permissions.
+type fileSystemWallet struct {
+	dir string
+}
+
+func newFileSystemWallet(dir string) (*fileSystemWallet, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create wallet directory: %w", err)
+	}
+	return &fileSystemWallet{dir: dir}, nil
+}
+
+func (w *fileSystemWallet) Put(label string, id *walletIdentity) error {
+	data, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	return writeWalletFile(w.dir, label, data)
+}
+
+func (w *fileSystemWallet) Get(label string) (*walletIdentity, error) {
+	data, err := readWalletFile(w.dir, label)
+	if err != nil {
+		return nil, err
+	}
+	var id walletIdentity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return nil, fmt.Errorf("failed to parse identity %s: %w", label, err)
+	}
+	return &id, nil
+}
+
+func (w *fileSystemWallet) Remove(label string) error {
+	return removeWalletFile(w.dir, label)
+}
+
+func (w *fileSystemWallet) List() ([]string, error) {
+	return listWalletFiles(w.dir)
+}
+
+// encryptedFileWallet stores each identity as a <label>.id file encrypted with AES-256-GCM. The
+// key is derived with scrypt from a passphrase and a random salt kept in the wallet directory.
+// The label is authenticated as additional data, so files cannot be swapped between users.
+type encryptedFileWallet struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+const (
+	walletSaltFile = "wallet.salt"
+	walletSaltSize = 16
+)
+
+func newEncryptedFileWallet(dir string, passphrase string) (*encryptedFileWallet, error) {
+	if passphrase == "" {
+		return nil, errors.New("wallet passphrase must not be empty")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create wallet directory: %w", err)
+	}
+
+	salt, err := walletSalt(filepath.Join(dir, walletSaltFile))
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFileWallet{dir: dir, aead: aead}, nil
+}
+
+// walletSalt reads the salt of an encrypted wallet, creating it for a new wallet.
+func walletSalt(path string) ([]byte, error) {
+	salt, err := os.ReadFile(path)
+	if err == nil && len(salt) == walletSaltSize {
+		return salt, nil
+	}
+	if err == nil {
+		return nil, fmt.Errorf("invalid wallet salt file %s", path)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read wallet salt: %w", err)
+	}
+
+	salt = make([]byte, walletSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, salt, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write wallet salt: %w", err)
+	}
+	return salt, nil
+}
+
+func (w *encryptedFileWallet) Put(label string, id *walletIdentity) error {
+	plaintext, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return writeWalletFile(w.dir, label, w.aead.Seal(nonce, nonce, plaintext, []byte(label)))
+}
+
+func (w *encryptedFileWallet) Get(label string) (*walletIdentity, error) {
+	data, err := readWalletFile(w.dir, label)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := w.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("identity file %s is truncated", label)
+	}
+	plaintext, err := w.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(label))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt identity %s, check the wallet passphrase: %w", label, err)
+	}
+
+	var id walletIdentity
+	if err := json.Unmarshal(plaintext, &id); err != nil {
+		return nil, fmt.Errorf("failed to parse identity %s: %w", label, err)
+	}
+	return &id, nil
+}
+
+func (w *encryptedFileWallet) Remove(label string) error {
+	return removeWalletFile(w.dir, label)
+}
+
+func (w *encryptedFileWallet) List() ([]string, error) {
+	return listWalletFiles(w.dir)
+}
+
+// walletFile returns the path of the identity file for a label. Labels are user IDs, which must
+// not escape the wallet directory.
+func walletFile(dir string, label string) (string, error) {
+	if label == "" || label == "." || label == ".." || strings.ContainsAny(label, `/\`) {
+		return "", fmt.Errorf("invalid wallet label %q", label)
+	}
+	return filepath.Join(dir, label+identityFileExtension), nil
+}
+
+func writeWalletFile(dir string, label string, data []byte) error {
+	path, err := walletFile(dir, label)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write identity %s: %w", label, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func readWalletFile(dir string, label string) ([]byte, error) {
+	path, err := walletFile(dir, label)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errIdentityNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity %s: %w", label, err)
+	}
+	return data, nil
+}
+
+func removeWalletFile(dir string, label string) error {
+	path, err := walletFile(dir, label)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func listWalletFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var labels []string
+	for _, entry := range entries {
+		if label, ok := strings.CutSuffix(entry.Name(), identityFileExtension); ok && !entry.IsDir() {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
@@ -0,0 +1,174 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCredentials returns a self-signed certificate and its private key, PEM encoded.
+func newTestCredentials(t *testing.T, commonName string) ([]byte, []byte) {
+	t.Helper()
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKeyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyDER})
+}
+
+func TestWalletBackends(t *testing.T) {
+	certificatePEM, privateKeyPEM := newTestCredentials(t, "alice")
+	id, err := newWalletIdentity(testMSPID, certificatePEM, privateKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	fileSystem, err := newFileSystemWallet(filepath.Join(dir, "plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := newEncryptedFileWallet(filepath.Join(dir, "encrypted"), "wallet passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, userWallet := range map[string]wallet{"file system": fileSystem, "encrypted": encrypted} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := userWallet.Get("alice"); !errors.Is(err, errIdentityNotFound) {
+				t.Fatalf("Get of a missing identity: err = %v", err)
+			}
+			if err := userWallet.Put("alice", id); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := userWallet.Get("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(stored, id) {
+				t.Errorf("stored identity = %+v, want %+v", stored, id)
+			}
+			if labels, _ := userWallet.List(); !reflect.DeepEqual(labels, []string{"alice"}) {
+				t.Errorf("labels = %v", labels)
+			}
+			if err := userWallet.Put("../alice", id); err == nil {
+				t.Errorf("label outside the wallet directory was accepted")
+			}
+			if err := userWallet.Remove("alice"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := userWallet.Get("alice"); !errors.Is(err, errIdentityNotFound) {
+				t.Errorf("Get after Remove: err = %v", err)
+			}
+		})
+	}
+}
+
+func TestEncryptedWalletProtectsKeys(t *testing.T) {
+	certificatePEM, privateKeyPEM := newTestCredentials(t, "alice")
+	id, err := newWalletIdentity(testMSPID, certificatePEM, privateKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	encrypted, err := newEncryptedFileWallet(dir, "wallet passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := encrypted.Put("alice", id); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "alice.id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "PRIVATE KEY") {
+		t.Errorf("identity file contains the plain private key")
+	}
+
+	reopened, err := newEncryptedFileWallet(dir, "wrong passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Get("alice"); err == nil {
+		t.Errorf("identity was decrypted with the wrong passphrase")
+	}
+
+	// A file copied to the label of another user does not decrypt
+	if err := os.WriteFile(filepath.Join(dir, "bob.id"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encrypted.Get("bob"); err == nil {
+		t.Errorf("identity file of alice was accepted for bob")
+	}
+}
+
+func TestImportIdentity(t *testing.T) {
+	certificatePEM, privateKeyPEM := newTestCredentials(t, "alice")
+	_, otherKeyPEM := newTestCredentials(t, "mallory")
+	body := func(privateKey []byte) string {
+		request, _ := json.Marshal(ImportIdentityRequest{Certificate: string(certificatePEM), PrivateKey: string(privateKey)})
+		return string(request)
+	}
+
+	contract := &fakeContract{}
+	recorder, _ := serve(t, contract, http.MethodPut, "/v1/users/alice/identity", body(otherKeyPEM))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("mismatched key status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder, response := serve(t, contract, http.MethodPut, "/v1/users/alice/identity", body(privateKeyPEM))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	result, _ := response.Result.(map[string]any)
+	if result["subject"] != "CN=alice" || result["msp_id"] != testMSPID {
+		t.Errorf("result = %v", result)
+	}
+	if strings.Contains(recorder.Body.String(), "PRIVATE KEY") {
+		t.Errorf("response contains the private key")
+	}
+}
+
+func TestMissingIdentityIsForbidden(t *testing.T) {
+	pool := newGatewayPool(nil, newTestWallet(t), defaultConfig(), nil)
+	_, err := newEcosysService(pool, newMetrics(), serviceOptions{}).Balance(context.Background(), "alice")
+	if apiError := toAPIError(err); apiError.Code != errCodeNotEnrolled || apiError.httpStatus() != http.StatusForbidden {
+		t.Errorf("error = %+v", apiError)
+	}
+}
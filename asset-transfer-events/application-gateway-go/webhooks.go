@@ -0,0 +1,380 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// Headers of webhook deliveries. The signature is "t=<unix time>,v1=<hex HMAC-SHA256>" of the
+// time, a dot and the request body, keyed with the webhook secret; receivers should reject
+// deliveries with an old time to prevent replays.
+const (
+	webhookSignatureHeader = "X-Ecosys-Signature"
+	webhookEventHeader     = "X-Ecosys-Event"
+	webhookDeliveryHeader  = "X-Ecosys-Delivery"
+)
+
+const (
+	// webhookBatchSize is the number of due deliveries attempted per poll.
+	webhookBatchSize = 100
+	// webhookConcurrency is the number of deliveries attempted at the same time, so that a slow
+	// partner does not hold up the others.
+	webhookConcurrency = 4
+	// defaultDeliveryLimit is the number of deliveries listed without a limit.
+	defaultDeliveryLimit = 20
+)
+
+// WebhookPayload is the body of a webhook delivery.
+type WebhookPayload struct {
+	DeliveryID string       `json:"delivery_id"`
+	WebhookID  string       `json:"webhook_id"`
+	Event      *StreamEvent `json:"event"`
+}
+
+// signWebhook returns the signature header of a delivery body.
+func signWebhook(secret string, timestamp time.Time, body []byte) string {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unix + "."))
+	mac.Write(body)
+	return "t=" + unix + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// matches reports whether an event is delivered to a webhook. Only the treasury is notified of
+// events that do not concern the webhook owner. Transaction status events are only delivered to
+// webhooks subscribing to them by name.
+func (w *Webhook) matches(event *StreamEvent, subjects eventSubjects) bool {
+	if w.Role != roleTreasury && !slices.Contains(event.parties, w.Owner) {
+		return false
+	}
+	subscribed := slices.Contains(w.Events, event.EventName) ||
+		len(w.Events) == 0 && event.EventName != eventTransactionStatus
+	return subscribed &&
+		(w.Issuer == "" || w.Issuer == subjects.Issuer) &&
+		(w.Applicant == "" || w.Applicant == subjects.Applicant)
+}
+
+// webhookDispatcher enqueues a delivery for every webhook matching a chaincode event, and
+// delivers them in the background. Failed deliveries are retried with exponential backoff, and
+// moved to the dead letters after maxAttempts.
+type webhookDispatcher struct {
+	store         *webhookStore
+	client        *http.Client
+	maxAttempts   int
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+	pollInterval  time.Duration
+	now           func() time.Time
+}
+
+func newWebhookDispatcher(store *webhookStore, config WebhooksConfig) *webhookDispatcher {
+	return &webhookDispatcher{
+		store:         store,
+		client:        &http.Client{Timeout: config.Timeout},
+		maxAttempts:   config.MaxAttempts,
+		retryDelay:    config.RetryDelay,
+		maxRetryDelay: config.MaxRetryDelay,
+		pollInterval:  time.Second,
+		now:           time.Now,
+	}
+}
+
+// enqueue is an event handler enqueuing the deliveries of an event. Deliveries are stored before
+// the event is checkpointed, so none is lost if the gateway stops.
+func (d *webhookDispatcher) enqueue(_ context.Context, event *client.ChaincodeEvent) error {
+	webhooks, err := d.store.Webhooks("")
+	if err != nil {
+		return err
+	}
+
+	streamEvent := newStreamEvent(event)
+	subjects := parseEventSubjects(event.Payload)
+	for _, webhook := range webhooks {
+		if !webhook.matches(streamEvent, subjects) {
+			continue
+		}
+		payload := func(deliveryID string) ([]byte, error) {
+			return json.Marshal(WebhookPayload{DeliveryID: deliveryID, WebhookID: webhook.ID, Event: streamEvent})
+		}
+		if err := d.store.Enqueue(webhook, streamEvent.ID, event.EventName, payload, d.now().UTC()); err != nil {
+			return fmt.Errorf("failed to enqueue delivery to webhook %s: %w", webhook.ID, err)
+		}
+	}
+	return nil
+}
+
+// Run delivers due deliveries until the context is cancelled.
+func (d *webhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+	for {
+		d.deliverDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverDue attempts every due delivery once.
+func (d *webhookDispatcher) deliverDue(ctx context.Context) {
+	due, err := d.store.Due(d.now(), webhookBatchSize)
+	if err != nil {
+		log.Printf("Failed to read due webhook deliveries: %v", err)
+		return
+	}
+
+	webhooks := map[string]*Webhook{}
+	all, err := d.store.Webhooks("")
+	if err != nil {
+		log.Printf("Failed to read webhooks: %v", err)
+		return
+	}
+	for _, webhook := range all {
+		webhooks[webhook.ID] = webhook
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, webhookConcurrency)
+	for _, delivery := range due {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(delivery *Delivery) {
+			defer func() { <-slots; wg.Done() }()
+			d.attempt(ctx, webhooks[delivery.WebhookID], delivery)
+		}(delivery)
+	}
+	wg.Wait()
+}
+
+// attempt sends a delivery and records the outcome.
+func (d *webhookDispatcher) attempt(ctx context.Context, webhook *Webhook, delivery *Delivery) {
+	previousAttempt := *delivery.NextAttemptAt
+	now := d.now().UTC()
+	delivery.Attempts++
+	delivery.LastStatusCode = 0
+	delivery.LastError = ""
+
+	var err error
+	if webhook == nil {
+		err = fmt.Errorf("webhook deleted")
+		delivery.Attempts = d.maxAttempts
+	} else {
+		delivery.LastStatusCode, err = d.send(ctx, webhook, delivery, now)
+	}
+	if ctx.Err() != nil {
+		// Shutting down; the attempt is made again after a restart
+		return
+	}
+
+	switch {
+	case err == nil:
+		delivery.Status = deliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.NextAttemptAt = nil
+	case delivery.Attempts >= d.maxAttempts:
+		log.Printf("Webhook delivery %s of %s failed %d times, moved to dead letters: %v", delivery.ID, delivery.WebhookID, delivery.Attempts, err)
+		delivery.Status = deliveryDead
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = nil
+	default:
+		delay := d.retryDelay << (delivery.Attempts - 1)
+		if delay <= 0 || delay > d.maxRetryDelay {
+			delay = d.maxRetryDelay
+		}
+		next := now.Add(delay)
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = &next
+	}
+
+	if err := d.store.Record(delivery, previousAttempt); err != nil {
+		log.Printf("Failed to record webhook delivery %s of %s: %v", delivery.ID, delivery.WebhookID, err)
+	}
+}
+
+// send posts a delivery to its webhook. Any 2xx response is a success.
+func (d *webhookDispatcher) send(ctx context.Context, webhook *Webhook, delivery *Delivery, now time.Time) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookSignatureHeader, signWebhook(webhook.Secret, now, delivery.Payload))
+	request.Header.Set(webhookEventHeader, delivery.EventName)
+	request.Header.Set(webhookDeliveryHeader, delivery.WebhookID+"/"+delivery.ID)
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// CreateWebhookRequest registers a webhook of the authenticated partner.
+type CreateWebhookRequest struct {
+	URL       string   `json:"url" binding:"required,url,max=2048"`
+	Events    []string `json:"events" binding:"omitempty,dive,oneof=CreateCurrency TransferCurrency ConsolidateCurrency ConvertCurrency PostExchangeRate SetFeeSchedule CreateLoan StartLoan LoanContractCheck CreateInsurance StartInsurance InsuranceContractCheck TransactionStatus"`
+	Issuer    string   `json:"issuer" binding:"max=64"`
+	Applicant string   `json:"applicant" binding:"max=64"`
+}
+
+// DeliveryQuery selects a page of the delivery log.
+type DeliveryQuery struct {
+	Status string `form:"status" binding:"omitempty,oneof=pending delivered dead"`
+	Limit  int    `form:"limit" binding:"omitempty,min=1,max=100"`
+	Offset int    `form:"offset" binding:"omitempty,min=0"`
+}
+
+// registerWebhookRoutes registers the webhook API. Webhooks are registered by partner banks,
+// which are issuers, and by the treasury; each partner only sees its own webhooks.
+func (s *apiServer) registerWebhookRoutes(router gin.IRouter) {
+	webhooks := router.Group("/"+apiVersion+"/webhooks", s.requireAuth, s.requireRole(roleIssuer, roleTreasury))
+	webhooks.POST("", s.createWebhook)
+	webhooks.GET("", s.listWebhooks)
+	webhooks.GET("/:id", s.getWebhook)
+	webhooks.DELETE("/:id", s.deleteWebhook)
+	webhooks.GET("/:id/deliveries", s.listDeliveries)
+	webhooks.GET("/:id/dead-letters", s.listDeadLetters)
+	webhooks.POST("/:id/deliveries/:delivery/redeliver", s.redeliver)
+}
+
+func (s *apiServer) createWebhook(c *gin.Context) {
+	var request CreateWebhookRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		respondError(c, "CreateWebhook Failed", err)
+		return
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		respondError(c, "CreateWebhook Failed", err)
+		return
+	}
+	webhook := &Webhook{
+		ID:        "wh_" + id,
+		Owner:     authenticatedUser(c),
+		Role:      authenticatedRole(c),
+		URL:       request.URL,
+		Secret:    secret,
+		Events:    request.Events,
+		Issuer:    request.Issuer,
+		Applicant: request.Applicant,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.webhooks.store.CreateWebhook(webhook); err != nil {
+		respondError(c, "CreateWebhook Failed", err)
+		return
+	}
+	respondCreated(c, "CreateWebhook Success", webhook)
+}
+
+func (s *apiServer) listWebhooks(c *gin.Context) {
+	webhooks, err := s.webhooks.store.Webhooks(authenticatedUser(c))
+	if err != nil {
+		respondError(c, "ListWebhooks Failed", err)
+		return
+	}
+	for _, webhook := range webhooks {
+		webhook.Secret = ""
+	}
+	respondOK(c, "ListWebhooks Success", webhooks)
+}
+
+func (s *apiServer) getWebhook(c *gin.Context) {
+	webhook, err := s.webhooks.store.Webhook(authenticatedUser(c), c.Param("id"))
+	if err != nil {
+		respondError(c, "GetWebhook Failed", err)
+		return
+	}
+	webhook.Secret = ""
+	respondOK(c, "GetWebhook Success", webhook)
+}
+
+func (s *apiServer) deleteWebhook(c *gin.Context) {
+	if err := s.webhooks.store.DeleteWebhook(authenticatedUser(c), c.Param("id")); err != nil {
+		respondError(c, "DeleteWebhook Failed", err)
+		return
+	}
+	respondOK(c, "DeleteWebhook Success", nil)
+}
+
+func (s *apiServer) listDeliveries(c *gin.Context) {
+	var query DeliveryQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	s.respondDeliveries(c, "ListDeliveries", query)
+}
+
+func (s *apiServer) listDeadLetters(c *gin.Context) {
+	var query DeliveryQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondBadRequest(c, err)
+		return
+	}
+	query.Status = deliveryDead
+	s.respondDeliveries(c, "ListDeadLetters", query)
+}
+
+func (s *apiServer) respondDeliveries(c *gin.Context, operation string, query DeliveryQuery) {
+	if query.Limit == 0 {
+		query.Limit = defaultDeliveryLimit
+	}
+	deliveries, err := s.webhooks.store.Deliveries(authenticatedUser(c), c.Param("id"), query.Status, query.Offset, query.Limit)
+	if err != nil {
+		respondError(c, operation+" Failed", err)
+		return
+	}
+	respondOK(c, operation+" Success", deliveries)
+}
+
+// redeliver schedules a dead letter for delivery again.
+func (s *apiServer) redeliver(c *gin.Context) {
+	delivery, err := s.webhooks.store.Redeliver(authenticatedUser(c), c.Param("id"), c.Param("delivery"), time.Now().UTC())
+	if err != nil {
+		respondError(c, "Redeliver Failed", err)
+		return
+	}
+	respondOK(c, "Redeliver Success", delivery)
+}
+
+func randomHex(size int) (string, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
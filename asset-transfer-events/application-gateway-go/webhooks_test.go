@@ -0,0 +1,208 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a partner endpoint failing the given number of deliveries of each event, and
+// checking the signature of every delivery.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	secret   string
+	failures map[string]int
+	received []WebhookPayload
+	invalid  int
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	body, _ := io.ReadAll(request.Body)
+	signature := request.Header.Get(webhookSignatureHeader)
+	unix, _, _ := strings.Cut(strings.TrimPrefix(signature, "t="), ",")
+	seconds, _ := strconv.ParseInt(unix, 10, 64)
+	if signature != signWebhook(r.secret, time.Unix(seconds, 0), body) {
+		r.invalid++
+	}
+
+	var payload WebhookPayload
+	json.Unmarshal(body, &payload)
+	if r.failures[payload.Event.ID] > 0 {
+		r.failures[payload.Event.ID]--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	r.received = append(r.received, payload)
+}
+
+func newTestDispatcher(t *testing.T, maxAttempts int) (*webhookDispatcher, *time.Time) {
+	t.Helper()
+	store, err := openWebhookStore(filepath.Join(t.TempDir(), "webhooks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	config := defaultConfig().Webhooks
+	config.MaxAttempts = maxAttempts
+	dispatcher := newWebhookDispatcher(store, config)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	dispatcher.now = func() time.Time { return now }
+	return dispatcher, &now
+}
+
+func registerTestWebhook(t *testing.T, dispatcher *webhookDispatcher, receiver *webhookReceiver, url string) *Webhook {
+	t.Helper()
+	webhook := &Webhook{ID: "wh_1", Owner: "bank", Role: roleIssuer, URL: url, Secret: receiver.secret, Events: []string{eventStartLoan, eventLoanContractCheck}}
+	if err := dispatcher.store.CreateWebhook(webhook); err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range loanEvents(t) {
+		if err := dispatcher.enqueue(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return webhook
+}
+
+func TestWebhookDeliveryIsRetried(t *testing.T) {
+	receiver := &webhookReceiver{secret: "secret", failures: map[string]int{"3:tx4": 1}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	dispatcher, now := newTestDispatcher(t, 3)
+	registerTestWebhook(t, dispatcher, receiver, server.URL)
+	// Events delivered again by the event consumer are not delivered twice
+	dispatcher.enqueue(context.Background(), loanEvents(t)[3])
+
+	dispatcher.deliverDue(context.Background())
+	deliveries, err := dispatcher.store.Deliveries("bank", "wh_1", "", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("deliveries = %d, want the StartLoan and LoanContractCheck events", len(deliveries))
+	}
+	retried := deliveries[1]
+	if retried.EventID != "3:tx4" || retried.Status != deliveryPending || retried.Attempts != 1 || retried.LastStatusCode != http.StatusServiceUnavailable {
+		t.Errorf("failed delivery = %+v", retried)
+	}
+	if retried.NextAttemptAt == nil || !retried.NextAttemptAt.Equal(now.Add(dispatcher.retryDelay)) {
+		t.Errorf("next attempt = %v, want after the retry delay", retried.NextAttemptAt)
+	}
+
+	// Not retried before the delay
+	dispatcher.deliverDue(context.Background())
+	if len(receiver.received) != 1 {
+		t.Errorf("received = %d, the delivery was retried early", len(receiver.received))
+	}
+
+	*now = now.Add(dispatcher.retryDelay)
+	dispatcher.deliverDue(context.Background())
+	deliveries, _ = dispatcher.store.Deliveries("bank", "wh_1", deliveryDelivered, 0, 10)
+	if len(deliveries) != 2 || len(receiver.received) != 2 || receiver.invalid != 0 {
+		t.Errorf("delivered = %d, received = %d, invalid signatures = %d", len(deliveries), len(receiver.received), receiver.invalid)
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	receiver := &webhookReceiver{secret: "secret", failures: map[string]int{"3:tx4": 2, "6:tx7": 2}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	dispatcher, now := newTestDispatcher(t, 2)
+	registerTestWebhook(t, dispatcher, receiver, server.URL)
+
+	for i := 0; i < 2; i++ {
+		dispatcher.deliverDue(context.Background())
+		*now = now.Add(time.Hour)
+	}
+	dead, err := dispatcher.store.Deliveries("bank", "wh_1", deliveryDead, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 2 || dead[0].Attempts != 2 || dead[0].LastError == "" {
+		t.Fatalf("dead letters = %+v", dead)
+	}
+	if due, _ := dispatcher.store.Due(*now, 10); len(due) != 0 {
+		t.Errorf("dead letters are still pending")
+	}
+
+	if _, err := dispatcher.store.Redeliver("bank", "wh_1", dead[0].ID, *now); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.deliverDue(context.Background())
+	if dead, _ = dispatcher.store.Deliveries("bank", "wh_1", deliveryDead, 0, 10); len(dead) != 1 {
+		t.Errorf("dead letters = %d after redelivery", len(dead))
+	}
+	if len(receiver.received) != 1 {
+		t.Errorf("redelivered dead letter was not received")
+	}
+}
+
+func TestWebhookEndpoints(t *testing.T) {
+	dispatcher, _ := newTestDispatcher(t, 3)
+	auth := newTestAuth(t)
+	router := newRouter(newEcosysService(&fakeContract{}, newMetrics(), serviceOptions{}), auth, newTestIdentities(t), routerOptions{webhooks: dispatcher})
+	request := func(userID string, role string, method string, target string, body string) (*httptest.ResponseRecorder, Response) {
+		t.Helper()
+		token, _, err := auth.issueToken(userID, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer "+token)
+		return record(t, router, request)
+	}
+
+	recorder, response := request("bank", roleIssuer, http.MethodPost, "/v1/webhooks", `{"url": "https://partner.example.com/hooks", "events": ["StartLoan"], "issuer": "bank"}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+	created := response.Result.(map[string]any)
+	if created["secret"] == "" || created["secret"] == nil {
+		t.Errorf("created webhook has no secret: %v", created)
+	}
+	id := created["id"].(string)
+
+	if recorder, _ := request("bank", roleIssuer, http.MethodPost, "/v1/webhooks", `{"url": "https://partner.example.com", "events": ["Unknown"]}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("unknown event filter status = %d", recorder.Code)
+	}
+	if recorder, _ := request("alice", roleApplicant, http.MethodGet, "/v1/webhooks", ""); recorder.Code != http.StatusForbidden {
+		t.Errorf("applicant status = %d", recorder.Code)
+	}
+	if recorder, _ := request("other", roleIssuer, http.MethodGet, "/v1/webhooks/"+id, ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("webhook of another partner status = %d", recorder.Code)
+	}
+
+	_, response = request("bank", roleIssuer, http.MethodGet, "/v1/webhooks", "")
+	if webhooks := response.Result.([]any); len(webhooks) != 1 || webhooks[0].(map[string]any)["secret"] != nil {
+		t.Errorf("webhooks = %v, the secret must not be listed", webhooks)
+	}
+
+	if recorder, _ := request("bank", roleIssuer, http.MethodGet, "/v1/webhooks/"+id+"/deliveries?status=pending", ""); recorder.Code != http.StatusOK {
+		t.Errorf("deliveries status = %d", recorder.Code)
+	}
+	if recorder, _ := request("bank", roleIssuer, http.MethodPost, "/v1/webhooks/"+id+"/deliveries/1/redeliver", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("redelivery of an unknown dead letter status = %d", recorder.Code)
+	}
+	if recorder, _ := request("bank", roleIssuer, http.MethodDelete, "/v1/webhooks/"+id, ""); recorder.Code != http.StatusOK {
+		t.Errorf("delete status = %d", recorder.Code)
+	}
+}
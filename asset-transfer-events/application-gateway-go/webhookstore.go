@@ -0,0 +1,368 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the webhook store. Deliveries are keyed by webhook ID and sequence number, so that the
+// log of a webhook is a range of keys in delivery order.
+var (
+	webhooksBucket      = []byte("webhooks")
+	deliveriesBucket    = []byte("deliveries")
+	deliveryIndexBucket = []byte("delivery_index")
+	pendingBucket       = []byte("pending")
+	deadLettersBucket   = []byte("dead_letters")
+
+	webhookBuckets = [][]byte{webhooksBucket, deliveriesBucket, deliveryIndexBucket, pendingBucket, deadLettersBucket}
+)
+
+// Delivery states.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+)
+
+// Webhook is a URL registered by a partner to be notified of chaincode events. Events, Issuer and
+// Applicant filter the events delivered; an empty filter matches every event, except transaction
+// status events which have to be subscribed to by name. The secret signs deliveries and is only
+// returned when the webhook is created.
+type Webhook struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	Role      string    `json:"role"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events,omitempty"`
+	Issuer    string    `json:"issuer,omitempty"`
+	Applicant string    `json:"applicant,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Delivery is one event to be delivered to a webhook, with the outcome of its last attempt.
+// Payload is the exact request body, so that every attempt sends the same bytes.
+type Delivery struct {
+	ID             string          `json:"id"`
+	WebhookID      string          `json:"webhook_id"`
+	EventID        string          `json:"event_id"`
+	EventName      string          `json:"event_name"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+// webhookStore is the bbolt database of webhooks and their deliveries. Pending deliveries are
+// indexed by the time of their next attempt, and dead deliveries are kept apart as dead letters
+// until they are redelivered.
+type webhookStore struct {
+	db *bolt.DB
+}
+
+func openWebhookStore(path string) (*webhookStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open webhook store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range webhookBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to read webhook store %s: %w", path, err)
+	}
+	return &webhookStore{db: db}, nil
+}
+
+func (s *webhookStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *webhookStore) CreateWebhook(webhook *Webhook) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(webhooksBucket), []byte(webhook.ID), webhook)
+	})
+}
+
+// Webhook returns a webhook of an owner. Webhooks of other owners are reported as not found.
+func (s *webhookStore) Webhook(owner string, id string) (*Webhook, error) {
+	var webhook *Webhook
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		webhook, err = getWebhook(tx, owner, id)
+		return err
+	})
+	return webhook, err
+}
+
+// Webhooks returns the webhooks of an owner, or of every owner if owner is empty.
+func (s *webhookStore) Webhooks(owner string) ([]*Webhook, error) {
+	webhooks := []*Webhook{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).ForEach(func(_, data []byte) error {
+			var webhook Webhook
+			if err := json.Unmarshal(data, &webhook); err != nil {
+				return err
+			}
+			if owner == "" || webhook.Owner == owner {
+				webhooks = append(webhooks, &webhook)
+			}
+			return nil
+		})
+	})
+	return webhooks, err
+}
+
+// DeleteWebhook deletes a webhook and cancels its pending deliveries. Its delivery log is kept.
+func (s *webhookStore) DeleteWebhook(owner string, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getWebhook(tx, owner, id); err != nil {
+			return err
+		}
+		prefix := deliveryPrefix(id)
+		cursor := tx.Bucket(deliveriesBucket).Cursor()
+		for key, data := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, data = cursor.Next() {
+			var delivery Delivery
+			if err := json.Unmarshal(data, &delivery); err != nil {
+				return err
+			}
+			if delivery.Status != deliveryPending {
+				continue
+			}
+			if err := tx.Bucket(pendingBucket).Delete(pendingKey(*delivery.NextAttemptAt, key)); err != nil {
+				return err
+			}
+			delivery.Status = deliveryDead
+			delivery.LastError = "webhook deleted"
+			delivery.NextAttemptAt = nil
+			if err := putJSON(tx.Bucket(deliveriesBucket), key, &delivery); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(webhooksBucket).Delete([]byte(id))
+	})
+}
+
+// Enqueue schedules the delivery of an event to a webhook now. An event already enqueued for the
+// webhook is not enqueued again.
+func (s *webhookStore) Enqueue(webhook *Webhook, eventID string, eventName string, payload func(deliveryID string) ([]byte, error), now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		index := tx.Bucket(deliveryIndexBucket)
+		indexKey := append(deliveryPrefix(webhook.ID), eventID...)
+		if index.Get(indexKey) != nil {
+			return nil
+		}
+
+		deliveries := tx.Bucket(deliveriesBucket)
+		sequence, err := deliveries.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := deliveryKey(webhook.ID, sequence)
+		delivery := &Delivery{
+			ID:            strconv.FormatUint(sequence, 10),
+			WebhookID:     webhook.ID,
+			EventID:       eventID,
+			EventName:     eventName,
+			Status:        deliveryPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		}
+		if delivery.Payload, err = payload(delivery.ID); err != nil {
+			return err
+		}
+
+		if err := putJSON(deliveries, key, delivery); err != nil {
+			return err
+		}
+		if err := index.Put(indexKey, key); err != nil {
+			return err
+		}
+		return tx.Bucket(pendingBucket).Put(pendingKey(now, key), nil)
+	})
+}
+
+// Due returns up to limit pending deliveries whose next attempt is not after now, earliest first.
+func (s *webhookStore) Due(now time.Time, limit int) ([]*Delivery, error) {
+	var due []*Delivery
+	err := s.db.View(func(tx *bolt.Tx) error {
+		deliveries := tx.Bucket(deliveriesBucket)
+		cursor := tx.Bucket(pendingBucket).Cursor()
+		for key, _ := cursor.First(); key != nil && len(due) < limit; key, _ = cursor.Next() {
+			if int64(binary.BigEndian.Uint64(key)) > now.UnixNano() {
+				break
+			}
+			var delivery Delivery
+			if err := json.Unmarshal(deliveries.Get(key[8:]), &delivery); err != nil {
+				return err
+			}
+			due = append(due, &delivery)
+		}
+		return nil
+	})
+	return due, err
+}
+
+// Record stores the outcome of a delivery attempt: pending deliveries are rescheduled at their
+// next attempt time, and dead deliveries are moved to the dead letters.
+func (s *webhookStore) Record(delivery *Delivery, previousAttempt time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key, err := deliveryKeyOf(delivery)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(pendingBucket).Delete(pendingKey(previousAttempt, key)); err != nil {
+			return err
+		}
+		switch delivery.Status {
+		case deliveryPending:
+			if err := tx.Bucket(pendingBucket).Put(pendingKey(*delivery.NextAttemptAt, key), nil); err != nil {
+				return err
+			}
+		case deliveryDead:
+			if err := tx.Bucket(deadLettersBucket).Put(key, nil); err != nil {
+				return err
+			}
+		}
+		return putJSON(tx.Bucket(deliveriesBucket), key, delivery)
+	})
+}
+
+// Deliveries returns the delivery log of a webhook of an owner, most recent first, optionally only
+// the deliveries in a state. Dead deliveries are read from the dead letters.
+func (s *webhookStore) Deliveries(owner string, webhookID string, status string, offset int, limit int) ([]*Delivery, error) {
+	deliveries := []*Delivery{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if _, err := getWebhook(tx, owner, webhookID); err != nil {
+			return err
+		}
+
+		log := tx.Bucket(deliveriesBucket)
+		index := log
+		if status == deliveryDead {
+			index = tx.Bucket(deadLettersBucket)
+		}
+		prefix := deliveryPrefix(webhookID)
+		cursor := index.Cursor()
+		// Seek past the last key of the webhook, then walk back
+		key, _ := cursor.Seek(deliveryKey(webhookID, 1<<64-1))
+		if key == nil {
+			key, _ = cursor.Last()
+		} else {
+			key, _ = cursor.Prev()
+		}
+		for ; key != nil && bytes.HasPrefix(key, prefix) && len(deliveries) < limit; key, _ = cursor.Prev() {
+			var delivery Delivery
+			if err := json.Unmarshal(log.Get(key), &delivery); err != nil {
+				return err
+			}
+			if status != "" && delivery.Status != status {
+				continue
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+			deliveries = append(deliveries, &delivery)
+		}
+		return nil
+	})
+	return deliveries, err
+}
+
+// Redeliver takes a dead delivery out of the dead letters and schedules it again now, with a new
+// allowance of attempts.
+func (s *webhookStore) Redeliver(owner string, webhookID string, deliveryID string, now time.Time) (*Delivery, error) {
+	var delivery Delivery
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getWebhook(tx, owner, webhookID); err != nil {
+			return err
+		}
+		sequence, err := strconv.ParseUint(deliveryID, 10, 64)
+		if err != nil {
+			return &ChaincodeError{Code: errCodeNotFound, Message: fmt.Sprintf("delivery %s does not exist", deliveryID)}
+		}
+		key := deliveryKey(webhookID, sequence)
+		if tx.Bucket(deadLettersBucket).Get(key) == nil {
+			return &ChaincodeError{
+				Code:    errCodeNotFound,
+				Message: fmt.Sprintf("delivery %s is not a dead letter", deliveryID),
+				Details: map[string]string{"webhook_id": webhookID, "delivery_id": deliveryID},
+			}
+		}
+		if err := json.Unmarshal(tx.Bucket(deliveriesBucket).Get(key), &delivery); err != nil {
+			return err
+		}
+
+		delivery.Status = deliveryPending
+		delivery.Attempts = 0
+		delivery.NextAttemptAt = &now
+		if err := tx.Bucket(deadLettersBucket).Delete(key); err != nil {
+			return err
+		}
+		if err := tx.Bucket(pendingBucket).Put(pendingKey(now, key), nil); err != nil {
+			return err
+		}
+		return putJSON(tx.Bucket(deliveriesBucket), key, &delivery)
+	})
+	return &delivery, err
+}
+
+func getWebhook(tx *bolt.Tx, owner string, id string) (*Webhook, error) {
+	data := tx.Bucket(webhooksBucket).Get([]byte(id))
+	var webhook Webhook
+	if data != nil {
+		if err := json.Unmarshal(data, &webhook); err != nil {
+			return nil, err
+		}
+	}
+	if data == nil || webhook.Owner != owner {
+		return nil, &ChaincodeError{
+			Code:    errCodeNotFound,
+			Message: fmt.Sprintf("webhook %s does not exist", id),
+			Details: map[string]string{"webhook_id": id},
+		}
+	}
+	return &webhook, nil
+}
+
+func deliveryPrefix(webhookID string) []byte {
+	return append([]byte(webhookID), 0)
+}
+
+func deliveryKey(webhookID string, sequence uint64) []byte {
+	return binary.BigEndian.AppendUint64(deliveryPrefix(webhookID), sequence)
+}
+
+func deliveryKeyOf(delivery *Delivery) ([]byte, error) {
+	sequence, err := strconv.ParseUint(delivery.ID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delivery ID %q: %w", delivery.ID, err)
+	}
+	return deliveryKey(delivery.WebhookID, sequence), nil
+}
+
+// pendingKey orders pending deliveries by the time of their next attempt.
+func pendingKey(at time.Time, key []byte) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(at.UnixNano())), key...)
+}
@@ -12,7 +12,7 @@ import (
 )
 
 func main() {
-	assetChaincode, err := contractapi.NewChaincode(&chaincode.SmartContract{})
+	assetChaincode, err := contractapi.NewChaincode(chaincode.NewSmartContract())
 	if err != nil {
 		log.Panicf("Error creating asset-transfer-events chaincode: %v", err)
 	}
@@ -0,0 +1,47 @@
+package chaincode
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+/* 访问控制
+ * 用户ID即证书Subject的CN，角色保存在证书属性role中，由网关注册用户时写入。
+ * requireRole 只允许指定角色调用，如汇率预言机、财务和管理员
+ * requireOwner 只允许资产所有者本人或管理员调用，所有转出、合并、迁移资产的公开函数都要先检查
+ */
+
+const (
+	//证书中保存用户角色的属性，由网关注册用户时写入
+	roleAttribute = "role"
+	//管理员的角色
+	adminRole = "admin"
+)
+
+// requireRole 检查调用者证书中的角色属性
+func requireRole(ctx contractapi.TransactionContextInterface, role string) error {
+	value, found, err := ctx.GetClientIdentity().GetAttributeValue(roleAttribute)
+	if err != nil {
+		return internalError(err)
+	}
+	if !found || value != role {
+		return newError(ErrCodeForbidden, fmt.Sprintf("only the %s role may call this function", role), "role", value, "required", role)
+	}
+	return nil
+}
+
+// requireOwner 检查调用者是owner本人（证书的CN即用户ID）或管理员
+func requireOwner(ctx contractapi.TransactionContextInterface, owner string) error {
+	certificate, err := ctx.GetClientIdentity().GetX509Certificate()
+	if err != nil {
+		return internalError(err)
+	}
+	if certificate != nil && certificate.Subject.CommonName == owner {
+		return nil
+	}
+	if err := requireRole(ctx, adminRole); err != nil {
+		return newError(ErrCodeForbidden, fmt.Sprintf("only %s or the %s role may call this function", owner, adminRole), "owner", owner)
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+/* 账户余额模式全流程
+ * UTXO方式下，用户的每笔货币都是一个("Currency", owner, id)键，ReadTotalCurrencyByOwner需要遍历全部货币，
+ * 高频用户的货币越多越慢。账户余额模式是可选的：迁移后用户只有一个余额键，余额变化以增量（delta）的方式写入。
+ * 账本中的键：
+ *   ("AccountMode", owner) 账户模式标记，迁移时写入，之后不再修改，收款时只读取该键判断模式
+ *   ("AccountBalance", owner, 币种) 某一币种已汇总的余额（单位为分）
+ *   ("AccountDelta", owner, 币种, 交易ID:引用) 每笔交易的余额增量（单位为分），收款只写入增量，不读取余额，
+ *   因此同一账户的并发收款不会产生MVCC冲突
+ * 付款需要读取余额和全部增量以检查余额是否足够，增量超过accountAggregateThreshold笔时顺便汇总到余额键（惰性汇总）。
+ * 对外接口不变：CreateCurrency、TransferCurrency、ReadTotalCurrencyByOwner 自动识别账户模式。
+ * MigrateCurrencyToAccount 把用户现有的UTXO货币按币种合并为账户余额，并切换为账户模式（迁移工具）
+ * AggregateAccount 把账户某一币种的增量汇总到余额键
+ * ReadAccount 查询账户某一币种的余额和未汇总的增量数量
+ * 注意：一笔交易中同一账户最多付款一次（增量键以交易ID区分）。
+ */
+
+const (
+	accountModeObjectType    = "AccountMode"
+	accountBalanceObjectType = "AccountBalance"
+	accountDeltaObjectType   = "AccountDelta"
+	//付款时未汇总的增量达到该数量则汇总到余额键
+	accountAggregateThreshold = 50
+	//账户模式下转账的选币策略
+	coinSelectionAccount = "account"
+)
+
+// AccountMode 账户模式标记
+type AccountMode struct {
+	Owner      string `json:"Owner"`
+	MigratedAt string `json:"MigratedAt"`
+}
+
+// AccountBalance 某一币种已汇总的账户余额，单位为分，避免浮点误差累积
+type AccountBalance struct {
+	Owner        string `json:"Owner"`
+	CurrencyCode string `json:"CurrencyCode"`
+	BalanceCents int64  `json:"BalanceCents"`
+	AggregatedAt string `json:"AggregatedAt"`
+}
+
+// AccountDelta 一笔交易的余额增量，付款为负数
+type AccountDelta struct {
+	AmountCents   int64  `json:"AmountCents"`
+	Reason        string `json:"Reason"`
+	TransactionID string `json:"TransactionID"`
+	Timestamp     string `json:"Timestamp"`
+}
+
+// Account 账户某一币种的查询结果，Balance包括未汇总的增量
+type Account struct {
+	Owner         string  `json:"Owner"`
+	CurrencyCode  string  `json:"CurrencyCode"`
+	Balance       float32 `json:"Balance"`
+	PendingDeltas int     `json:"PendingDeltas"`
+	MigratedAt    string  `json:"MigratedAt"`
+	AggregatedAt  string  `json:"AggregatedAt"`
+}
+
+// fromCents 将分换算为金额
+func fromCents(cents int64) float32 {
+	return float32(cents) / 100
+}
+
+// isAccount 判断用户是否已切换为账户模式
+func isAccount(ctx contractapi.TransactionContextInterface, owner string) (bool, error) {
+	compositeKey, err := ctx.GetStub().CreateCompositeKey(accountModeObjectType, []string{owner})
+	if err != nil {
+		return false, internalError(err)
+	}
+	modeJSON, err := ctx.GetStub().GetState(compositeKey)
+	if err != nil {
+		return false, internalError(err)
+	}
+	return modeJSON != nil, nil
+}
+
+// readAccount 读取账户模式标记、某一币种已汇总的余额和全部增量，返回汇总后的余额以及增量的键
+func readAccount(ctx contractapi.TransactionContextInterface, owner string, code string) (*Account, int64, []string, error) {
+	modeKey, err := ctx.GetStub().CreateCompositeKey(accountModeObjectType, []string{owner})
+	if err != nil {
+		return nil, 0, nil, internalError(err)
+	}
+	modeJSON, err := ctx.GetStub().GetState(modeKey)
+	if err != nil {
+		return nil, 0, nil, internalError(err)
+	}
+	if modeJSON == nil {
+		return nil, 0, nil, newError(ErrCodeNotFound, fmt.Sprintf("owner %s does not use an account balance", owner), "owner", owner)
+	}
+	var mode AccountMode
+	if err := json.Unmarshal(modeJSON, &mode); err != nil {
+		return nil, 0, nil, internalError(err)
+	}
+
+	balanceKey, err := ctx.GetStub().CreateCompositeKey(accountBalanceObjectType, []string{owner, code})
+	if err != nil {
+		return nil, 0, nil, internalError(err)
+	}
+	balanceJSON, err := ctx.GetStub().GetState(balanceKey)
+	if err != nil {
+		return nil, 0, nil, internalError(err)
+	}
+	var balance AccountBalance
+	if balanceJSON != nil {
+		if err := json.Unmarshal(balanceJSON, &balance); err != nil {
+			return nil, 0, nil, internalError(err)
+		}
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(accountDeltaObjectType, []string{owner, code})
+	if err != nil {
+		return nil, 0, nil, internalError(err)
+	}
+	defer resultsIterator.Close()
+	cents := balance.BalanceCents
+	var deltaKeys []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, 0, nil, internalError(err)
+		}
+		var delta AccountDelta
+		if err := json.Unmarshal(queryResponse.Value, &delta); err != nil {
+			return nil, 0, nil, internalError(err)
+		}
+		cents += delta.AmountCents
+		deltaKeys = append(deltaKeys, queryResponse.Key)
+	}
+
+	account := &Account{
+		Owner:         owner,
+		CurrencyCode:  code,
+		Balance:       fromCents(cents),
+		PendingDeltas: len(deltaKeys),
+		MigratedAt:    mode.MigratedAt,
+		AggregatedAt:  balance.AggregatedAt,
+	}
+	return account, cents, deltaKeys, nil
+}
+
+// readAccountBalances 读取账户各币种的余额，包括未汇总的增量
+func readAccountBalances(ctx contractapi.TransactionContextInterface, owner string) (map[string]float32, error) {
+	cents := map[string]int64{}
+	for _, objectType := range []string{accountBalanceObjectType, accountDeltaObjectType} {
+		resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(objectType, []string{owner})
+		if err != nil {
+			return nil, internalError(err)
+		}
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, internalError(err)
+			}
+			_, attributes, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+			if err != nil || len(attributes) < 2 {
+				resultsIterator.Close()
+				return nil, internalError(fmt.Errorf("invalid %s key of owner %s", objectType, owner))
+			}
+			//余额和增量都只需要金额字段
+			var amount struct {
+				BalanceCents int64 `json:"BalanceCents"`
+				AmountCents  int64 `json:"AmountCents"`
+			}
+			if err := json.Unmarshal(queryResponse.Value, &amount); err != nil {
+				resultsIterator.Close()
+				return nil, internalError(err)
+			}
+			cents[attributes[1]] += amount.BalanceCents + amount.AmountCents
+		}
+		resultsIterator.Close()
+	}
+	balances := make(map[string]float32, len(cents))
+	for code, amount := range cents {
+		balances[code] = fromCents(amount)
+	}
+	return balances, nil
+}
+
+// putAccountDelta 写入某一币种的一笔余额增量，ref区分同一交易中的多笔增量
+func putAccountDelta(ctx contractapi.TransactionContextInterface, owner string, code string, cents int64, reason string, ref string) error {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return internalError(err)
+	}
+	txID := ctx.GetStub().GetTxID()
+	compositeKey, err := ctx.GetStub().CreateCompositeKey(accountDeltaObjectType, []string{owner, code, txID + ":" + ref})
+	if err != nil {
+		return internalError(err)
+	}
+	deltaJSON, err := json.Marshal(AccountDelta{
+		AmountCents:   cents,
+		Reason:        reason,
+		TransactionID: txID,
+		Timestamp:     fmt.Sprintf("%d", timestamp.GetSeconds()),
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	return internalError(ctx.GetStub().PutState(compositeKey, deltaJSON))
+}
+
+// writeAccountBalance 把某一币种汇总后的余额写入余额键，并删除已汇总的增量
+func writeAccountBalance(ctx contractapi.TransactionContextInterface, owner string, code string, cents int64, deltaKeys []string) (string, error) {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return "", internalError(err)
+	}
+	aggregatedAt := fmt.Sprintf("%d", timestamp.GetSeconds())
+	balanceKey, err := ctx.GetStub().CreateCompositeKey(accountBalanceObjectType, []string{owner, code})
+	if err != nil {
+		return "", internalError(err)
+	}
+	balanceJSON, err := json.Marshal(AccountBalance{Owner: owner, CurrencyCode: code, BalanceCents: cents, AggregatedAt: aggregatedAt})
+	if err != nil {
+		return "", internalError(err)
+	}
+	if err := ctx.GetStub().PutState(balanceKey, balanceJSON); err != nil {
+		return "", internalError(err)
+	}
+	for _, key := range deltaKeys {
+		if err := ctx.GetStub().DelState(key); err != nil {
+			return "", internalError(err)
+		}
+	}
+	return aggregatedAt, nil
+}
+
+// debitAccount 从账户付款某一币种，余额不足时返回INSUFFICIENT_FUNDS；增量过多时顺便汇总
+func debitAccount(ctx contractapi.TransactionContextInterface, owner string, code string, amount float32, reason string) (*CoinSelection, error) {
+	account, cents, deltaKeys, err := readAccount(ctx, owner, code)
+	if err != nil {
+		return nil, err
+	}
+	if cents < toCents(amount) {
+		return nil, newError(ErrCodeInsufficientFunds, "insufficient balance for transfer",
+			"owner", owner, "currency", code, "balance", fmt.Sprintf("%f", account.Balance), "amount", fmt.Sprintf("%f", amount))
+	}
+	if len(deltaKeys) >= accountAggregateThreshold {
+		if _, err := writeAccountBalance(ctx, owner, code, cents-toCents(amount), deltaKeys); err != nil {
+			return nil, err
+		}
+	} else if err := putAccountDelta(ctx, owner, code, -toCents(amount), reason, "debit"); err != nil {
+		return nil, err
+	}
+	return &CoinSelection{Strategy: coinSelectionAccount, Amount: amount}, nil
+}
+
+// MigrateCurrencyToAccount 迁移工具：把owner现有的UTXO货币按币种合并为账户余额，并切换为账户模式，返回迁移后各币种的账户
+// 之后转入的货币计入账户余额，不再产生UTXO货币。只有owner本人或管理员可以迁移
+func (s *SmartContract) MigrateCurrencyToAccount(ctx contractapi.TransactionContextInterface, owner string) ([]*Account, error) {
+	if err := requireOwner(ctx, owner); err != nil {
+		return nil, err
+	}
+	account, err := isAccount(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	if account {
+		return nil, newError(ErrCodeAlreadyExists, fmt.Sprintf("owner %s already uses an account balance", owner), "owner", owner)
+	}
+	coins, err := s.ReadCurrencyListByOwner(ctx, owner)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	//没有货币的用户也迁移为默认币种的空账户
+	cents := map[string]int64{defaultCurrencyCode: 0}
+	coinKeys := map[string][]string{}
+	for _, coin := range coins {
+		compositeKey, err := ctx.GetStub().CreateCompositeKey("Currency", []string{owner, coin.CurrencyID})
+		if err != nil {
+			return nil, internalError(err)
+		}
+		code := currencyCodeOf(coin.CurrencyCode)
+		cents[code] += toCents(coin.Amount)
+		coinKeys[code] = append(coinKeys[code], compositeKey)
+	}
+	// 删除UTXO货币，写入各币种的余额键
+	codes := make([]string, 0, len(cents))
+	for code := range cents {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	var accounts []*Account
+	var migratedAt string
+	for _, code := range codes {
+		migratedAt, err = writeAccountBalance(ctx, owner, code, cents[code], coinKeys[code])
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, &Account{Owner: owner, CurrencyCode: code, Balance: fromCents(cents[code]), MigratedAt: migratedAt, AggregatedAt: migratedAt})
+	}
+	modeKey, err := ctx.GetStub().CreateCompositeKey(accountModeObjectType, []string{owner})
+	if err != nil {
+		return nil, internalError(err)
+	}
+	modeJSON, err := json.Marshal(AccountMode{Owner: owner, MigratedAt: migratedAt})
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if err := ctx.GetStub().PutState(modeKey, modeJSON); err != nil {
+		return nil, internalError(err)
+	}
+	return accounts, nil
+}
+
+// AggregateAccount 把owner账户某一币种（code为空时为默认币种）的全部增量汇总到余额键，返回汇总后的账户。只有owner本人或管理员可以汇总
+func (s *SmartContract) AggregateAccount(ctx contractapi.TransactionContextInterface, owner string, code string) (*Account, error) {
+	if err := requireOwner(ctx, owner); err != nil {
+		return nil, err
+	}
+	code = currencyCodeOf(code)
+	account, cents, deltaKeys, err := readAccount(ctx, owner, code)
+	if err != nil {
+		return nil, err
+	}
+	aggregatedAt, err := writeAccountBalance(ctx, owner, code, cents, deltaKeys)
+	if err != nil {
+		return nil, err
+	}
+	account.PendingDeltas = 0
+	account.AggregatedAt = aggregatedAt
+	return account, nil
+}
+
+// ReadAccount 查询owner账户某一币种（code为空时为默认币种）的余额，owner未切换为账户模式时返回NOT_FOUND
+func (s *SmartContract) ReadAccount(ctx contractapi.TransactionContextInterface, owner string, code string) (*Account, error) {
+	account, _, _, err := readAccount(ctx, owner, currencyCodeOf(code))
+	return account, err
+}
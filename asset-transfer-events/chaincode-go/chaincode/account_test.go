@@ -0,0 +1,124 @@
+package chaincode
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrateCurrencyToAccount(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller string
+		role   string
+		want   string
+	}{
+		{"owner", "alice", "", ""},
+		{"admin", "operator", adminRole, ""},
+		{"another user", "bob", "", ErrCodeForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := newTestLedger(t)
+			ledger.registerCurrency("USD", 2, "")
+			ledger.deposit("alice", 10, defaultCurrencyCode)
+			ledger.deposit("alice", 2.5, defaultCurrencyCode)
+			ledger.deposit("alice", 7, "USD")
+
+			accounts, err := new(SmartContract).MigrateCurrencyToAccount(ledger.as(test.caller, test.role), "alice")
+			if errorCode(err) != test.want {
+				t.Fatalf("err = %v, want %s", err, test.want)
+			}
+			if err != nil {
+				if account, _ := isAccount(ledger.as("alice", ""), "alice"); account {
+					t.Error("alice was migrated")
+				}
+				return
+			}
+			if len(accounts) != 2 || accounts[0].CurrencyCode != defaultCurrencyCode || accounts[0].Balance != 12.5 ||
+				accounts[1].CurrencyCode != "USD" || accounts[1].Balance != 7 {
+				t.Errorf("accounts = %+v", accounts)
+			}
+			for key := range ledger.state {
+				if strings.HasPrefix(key, "\x00Currency\x00alice\x00") {
+					t.Errorf("coin %q was not removed", key)
+				}
+			}
+			if balance := ledger.balance("alice", defaultCurrencyCode); balance != 12.5 {
+				t.Errorf("balance = %v, want 12.5", balance)
+			}
+		})
+	}
+}
+
+func TestAccountDeltas(t *testing.T) {
+	ledger := newTestLedger(t)
+	contract := new(SmartContract)
+	ledger.deposit("alice", 10, defaultCurrencyCode)
+	ledger.deposit("bob", 20, defaultCurrencyCode)
+	if _, err := contract.MigrateCurrencyToAccount(ledger.as("alice", ""), "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 收款和付款都只写入增量
+	ledger.deposit("alice", 5, defaultCurrencyCode)
+	if err := contract.TransferCurrency(ledger.as("bob", ""), "bob", "alice", 4, "Transfer"); err != nil {
+		t.Fatal(err)
+	}
+	selection, err := contract.TransferCurrencyWithCoinSelection(ledger.as("alice", ""), "alice", "bob", 3, "Transfer", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selection.Strategy != coinSelectionAccount || len(selection.Inputs) != 0 {
+		t.Errorf("selection = %+v", selection)
+	}
+	account, err := contract.ReadAccount(ledger.as("alice", ""), "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 16 || account.PendingDeltas != 3 {
+		t.Errorf("account = %+v", account)
+	}
+	if err := contract.TransferCurrency(ledger.as("alice", ""), "alice", "bob", 17, "Transfer"); errorCode(err) != ErrCodeInsufficientFunds {
+		t.Errorf("overdraft err = %v", err)
+	}
+
+	if _, err := contract.AggregateAccount(ledger.as("bob", ""), "alice", ""); errorCode(err) != ErrCodeForbidden {
+		t.Errorf("aggregate as bob err = %v", err)
+	}
+	account, err = contract.AggregateAccount(ledger.as("alice", ""), "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 16 || account.PendingDeltas != 0 || account.AggregatedAt == "" {
+		t.Errorf("aggregated account = %+v", account)
+	}
+	for key := range ledger.state {
+		if strings.HasPrefix(key, "\x00"+accountDeltaObjectType+"\x00") {
+			t.Errorf("delta %q was not aggregated", key)
+		}
+	}
+	if balance := ledger.balance("bob", defaultCurrencyCode); balance != 19 {
+		t.Errorf("bob balance = %v, want 19", balance)
+	}
+}
+
+func TestDebitsAggregateManyDeltas(t *testing.T) {
+	ledger := newTestLedger(t)
+	contract := new(SmartContract)
+	if _, err := contract.MigrateCurrencyToAccount(ledger.as("alice", ""), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < accountAggregateThreshold; i++ {
+		ledger.deposit("alice", 1, defaultCurrencyCode)
+	}
+	if err := contract.TransferCurrency(ledger.as("alice", ""), "alice", "bob", 1, "Transfer"); err != nil {
+		t.Fatal(err)
+	}
+	account, err := contract.ReadAccount(ledger.as("alice", ""), "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != accountAggregateThreshold-1 || account.PendingDeltas != 0 {
+		t.Errorf("account = %+v", account)
+	}
+}
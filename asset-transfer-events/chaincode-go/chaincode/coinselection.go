@@ -0,0 +1,254 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+/* 选币策略与零钱合并全流程
+ * 转账需要从转出方的UTXO中选出足够的货币。原先按迭代顺序选取，总是使用最早的货币，
+ * 并发转账容易选中同一批货币而冲突，每次转账产生的找零也会让账户积累大量小额货币。
+ * TransferCurrencyWithCoinSelection 按指定的选币策略转账，返回选中的货币、找零和转出方剩余的货币数量
+ * ConsolidateCurrency 把某个用户同一币种的小额货币合并为一笔货币，返回合并结果
+ * 选币策略：
+ *   oldest 按迭代顺序选取，即原先的方式
+ *   largest-first 从大到小选取，使用的货币数量最少
+ *   smallest-sufficient 选取足够支付的最小一笔货币，没有单笔足够的货币时从大到小选取
+ *   random 随机选取，不同交易选中不同的货币；随机数由交易ID生成，保证各背书节点结果一致
+ *   branch-and-bound 分支定界搜索金额恰好相等的组合，不产生找零；找不到时按smallest-sufficient选取
+ * TransferCurrency 和合同中的转账使用默认策略oldest，与原先的方式一致。
+ * 注意：转出方的货币列表通过范围查询读取，同一用户的并发转账仍可能因幻读冲突失效，网关会重试（见网关retry.go）。
+ */
+
+// 选币策略
+const (
+	CoinSelectionOldest             = "oldest"
+	CoinSelectionLargestFirst       = "largest-first"
+	CoinSelectionSmallestSufficient = "smallest-sufficient"
+	CoinSelectionRandom             = "random"
+	CoinSelectionBranchAndBound     = "branch-and-bound"
+
+	defaultCoinSelection = CoinSelectionOldest
+	//分支定界搜索的最大尝试次数，超过后按smallest-sufficient选取
+	maxBranchAndBoundTries = 100000
+	//一次合并的最大货币数量，避免交易读写集过大
+	maxConsolidationInputs = 100
+)
+
+// CoinSelection 一次转账的选币结果，Coins为转出方转账后剩余的货币数量（包括找零）
+type CoinSelection struct {
+	Strategy string   `json:"Strategy"`
+	Inputs   []string `json:"Inputs"`
+	Amount   float32  `json:"Amount"`
+	Change   float32  `json:"Change"`
+	Coins    int      `json:"Coins"`
+	//转出方另外支付的手续费和收取手续费的账户，Amount包含手续费（见fees.go）
+	Fee        float32 `json:"Fee"`
+	FeeAccount string  `json:"FeeAccount"`
+}
+
+// Consolidation 零钱合并结果，作为ConsolidateCurrency事件的内容
+type Consolidation struct {
+	Owner        string   `json:"Owner"`
+	Inputs       []string `json:"Inputs"`
+	Amount       float32  `json:"Amount"`
+	CurrencyID   string   `json:"CurrencyID"`
+	CurrencyCode string   `json:"CurrencyCode"`
+	Coins        int      `json:"Coins"`
+	Timestamp    string   `json:"Timestamp"`
+}
+
+// toCents 将金额换算为分，货币的最小单位为0.01
+func toCents(amount float32) int64 {
+	return int64(math.Round(float64(amount) * 100))
+}
+
+// selectCoins 按选币策略从coins中选出总额不少于amount的货币，余额不足时返回选中的全部货币，由调用方检查
+func selectCoins(coins []Currency, amount float32, strategy string, txID string) ([]Currency, error) {
+	target := toCents(amount)
+	switch strategy {
+	case CoinSelectionOldest:
+		return accumulateCoins(coins, target), nil
+	case CoinSelectionLargestFirst:
+		return accumulateCoins(sortedCoins(coins, true), target), nil
+	case CoinSelectionSmallestSufficient:
+		return smallestSufficient(coins, target), nil
+	case CoinSelectionRandom:
+		shuffled := append([]Currency(nil), coins...)
+		hash := fnv.New64a()
+		hash.Write([]byte(txID))
+		random := rand.New(rand.NewSource(int64(hash.Sum64())))
+		random.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		return accumulateCoins(shuffled, target), nil
+	case CoinSelectionBranchAndBound:
+		if selected, ok := branchAndBound(coins, target); ok {
+			return selected, nil
+		}
+		return smallestSufficient(coins, target), nil
+	default:
+		return nil, newError(ErrCodeInvalidArgument, fmt.Sprintf("unknown coin selection strategy %s", strategy), "strategy", strategy)
+	}
+}
+
+// accumulateCoins 按顺序选取货币，直到总额不少于target
+func accumulateCoins(coins []Currency, target int64) []Currency {
+	var selected []Currency
+	var total int64
+	for _, coin := range coins {
+		if total >= target {
+			break
+		}
+		selected = append(selected, coin)
+		total += toCents(coin.Amount)
+	}
+	return selected
+}
+
+// sortedCoins 按金额排序货币，金额相同时按ID排序，保证各背书节点结果一致
+func sortedCoins(coins []Currency, descending bool) []Currency {
+	sorted := append([]Currency(nil), coins...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Amount != sorted[j].Amount {
+			return (sorted[i].Amount > sorted[j].Amount) == descending
+		}
+		return sorted[i].CurrencyID < sorted[j].CurrencyID
+	})
+	return sorted
+}
+
+// smallestSufficient 选取足够支付的最小一笔货币，没有单笔足够的货币时从大到小选取
+func smallestSufficient(coins []Currency, target int64) []Currency {
+	for _, coin := range sortedCoins(coins, false) {
+		if toCents(coin.Amount) >= target {
+			return []Currency{coin}
+		}
+	}
+	return accumulateCoins(sortedCoins(coins, true), target)
+}
+
+// branchAndBound 深度优先搜索总额恰好等于target的货币组合，从大额货币开始尝试，
+// 剩余货币不足以凑齐或已超过target的分支被剪去
+func branchAndBound(coins []Currency, target int64) ([]Currency, bool) {
+	sorted := sortedCoins(coins, true)
+	remaining := make([]int64, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + toCents(sorted[i].Amount)
+	}
+
+	var selected []Currency
+	tries := 0
+	var search func(index int, total int64) bool
+	search = func(index int, total int64) bool {
+		if total == target {
+			return true
+		}
+		tries++
+		if index == len(sorted) || total > target || total+remaining[index] < target || tries > maxBranchAndBoundTries {
+			return false
+		}
+		selected = append(selected, sorted[index])
+		if search(index+1, total+toCents(sorted[index].Amount)) {
+			return true
+		}
+		selected = selected[:len(selected)-1]
+		return search(index+1, total)
+	}
+	if !search(0, 0) {
+		return nil, false
+	}
+	return selected, true
+}
+
+// TransferCurrencyWithCoinSelection 按指定的选币策略转账默认币种，strategy为空时使用默认策略；其他币种见TransferCurrencyInCurrency。
+// 只有oldOwner本人或管理员可以转出
+func (s *SmartContract) TransferCurrencyWithCoinSelection(ctx contractapi.TransactionContextInterface, oldOwner string, newOwner string, amount float32, transferReason string, strategy string) (*CoinSelection, error) {
+	if err := requireOwner(ctx, oldOwner); err != nil {
+		return nil, err
+	}
+	if strategy == "" {
+		strategy = defaultCoinSelection
+	}
+	return s.transferCurrency(ctx, oldOwner, newOwner, amount, defaultCurrencyCode, transferReason, strategy, "")
+}
+
+// ConsolidateCurrency 把owner币种为currencyCode（为空时为默认币种）、金额不超过maxAmount的货币（maxAmount不大于0时为全部货币）
+// 从小到大合并为一笔货币，一次最多合并maxInputs笔（不大于0或超过上限时为上限maxConsolidationInputs）。只有owner本人或管理员可以合并
+func (s *SmartContract) ConsolidateCurrency(ctx contractapi.TransactionContextInterface, owner string, maxAmount float32, maxInputs int, currencyCode string) (*Consolidation, error) {
+	if err := requireOwner(ctx, owner); err != nil {
+		return nil, err
+	}
+	code := currencyCodeOf(currencyCode)
+	coins, err := s.ReadCurrencyListByOwner(ctx, owner)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if maxInputs <= 0 || maxInputs > maxConsolidationInputs {
+		maxInputs = maxConsolidationInputs
+	}
+	var inputs []Currency
+	for _, coin := range sortedCoins(coins, false) {
+		if currencyCodeOf(coin.CurrencyCode) != code {
+			continue
+		}
+		if len(inputs) == maxInputs || (maxAmount > 0 && coin.Amount > maxAmount) {
+			break
+		}
+		inputs = append(inputs, coin)
+	}
+	if len(inputs) < 2 {
+		return nil, newError(ErrCodeConditionNotMet, fmt.Sprintf("owner %s has fewer than 2 %s coins to consolidate", owner, code),
+			"owner", owner, "currency", code, "coins", fmt.Sprintf("%d", len(inputs)))
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, internalError(err)
+	}
+	seconds := fmt.Sprintf("%d", timestamp.GetSeconds())
+	consolidation := &Consolidation{
+		Owner:        owner,
+		CurrencyID:   "Currency" + owner + "Consolidated" + ctx.GetStub().GetTxID(),
+		CurrencyCode: code,
+		Coins:        len(coins) - len(inputs) + 1,
+		Timestamp:    seconds,
+	}
+	for _, coin := range inputs {
+		compositeKey, err := ctx.GetStub().CreateCompositeKey("Currency", []string{owner, coin.CurrencyID})
+		if err != nil {
+			return nil, internalError(err)
+		}
+		if err := ctx.GetStub().DelState(compositeKey); err != nil {
+			return nil, internalError(err)
+		}
+		consolidation.Inputs = append(consolidation.Inputs, coin.CurrencyID)
+		consolidation.Amount += coin.Amount
+	}
+	err = s.createCurrency(ctx, Currency{
+		CurrencyID:   consolidation.CurrencyID,
+		Amount:       consolidation.Amount,
+		Owner:        owner,
+		CreatedAt:    seconds,
+		CreatedVia:   "Consolidate",
+		UpdatedAt:    seconds,
+		UpdatedVia:   "Consolidate",
+		CurrencyCode: code,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 发出合并事件，覆盖createCurrency发出的事件，合并不改变余额
+	consolidationJSON, err := json.Marshal(consolidation)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if err := ctx.GetStub().SetEvent("ConsolidateCurrency", consolidationJSON); err != nil {
+		return nil, internalError(err)
+	}
+	return consolidation, nil
+}
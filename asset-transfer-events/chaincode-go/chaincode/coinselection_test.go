@@ -0,0 +1,170 @@
+package chaincode
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testCoins 返回ID依次为A、B、C……，金额为amounts的货币
+func testCoins(amounts ...float32) []Currency {
+	coins := make([]Currency, len(amounts))
+	for i, amount := range amounts {
+		coins[i] = Currency{CurrencyID: string(rune('A' + i)), Amount: amount}
+	}
+	return coins
+}
+
+func coinIDs(coins []Currency) []string {
+	var ids []string
+	for _, coin := range coins {
+		ids = append(ids, coin.CurrencyID)
+	}
+	return ids
+}
+
+func TestSelectCoins(t *testing.T) {
+	coins := testCoins(5, 50, 10, 20)
+	tests := []struct {
+		name     string
+		strategy string
+		amount   float32
+		want     []string
+	}{
+		{"oldest takes coins in order", CoinSelectionOldest, 12, []string{"A", "B"}},
+		{"largest first", CoinSelectionLargestFirst, 60, []string{"B", "D"}},
+		{"smallest sufficient coin", CoinSelectionSmallestSufficient, 12, []string{"D"}},
+		{"smallest sufficient without a sufficient coin", CoinSelectionSmallestSufficient, 60, []string{"B", "D"}},
+		{"branch and bound finds an exact match", CoinSelectionBranchAndBound, 35, []string{"D", "C", "A"}},
+		{"branch and bound prefers large coins", CoinSelectionBranchAndBound, 50, []string{"B"}},
+		{"branch and bound without an exact match", CoinSelectionBranchAndBound, 12, []string{"D"}},
+		{"insufficient coins are all selected", CoinSelectionOldest, 100, []string{"A", "B", "C", "D"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selected, err := selectCoins(coins, test.amount, test.strategy, "tx1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := coinIDs(selected); !reflect.DeepEqual(ids, test.want) {
+				t.Errorf("selected = %v, want %v", ids, test.want)
+			}
+		})
+	}
+}
+
+func TestRandomCoinSelectionIsDeterministic(t *testing.T) {
+	coins := testCoins(1, 2, 3, 4, 5, 6, 7, 8)
+	first, err := selectCoins(coins, 10, CoinSelectionRandom, "tx1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := selectCoins(coins, 10, CoinSelectionRandom, "tx1")
+	if !reflect.DeepEqual(first, again) {
+		t.Errorf("endorsements of tx1 selected %v and %v", coinIDs(first), coinIDs(again))
+	}
+	var total float32
+	for _, coin := range first {
+		total += coin.Amount
+	}
+	if total < 10 {
+		t.Errorf("selected %v worth %v, want at least 10", coinIDs(first), total)
+	}
+}
+
+func TestUnknownCoinSelectionStrategy(t *testing.T) {
+	if _, err := selectCoins(testCoins(5), 1, "cheapest", "tx1"); errorCode(err) != ErrCodeInvalidArgument {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestTransfersSpendTheOldestCoinsByDefault(t *testing.T) {
+	ledger := newTestLedger(t)
+	ledger.deposit("alice", 5, defaultCurrencyCode)
+	ledger.deposit("alice", 10, defaultCurrencyCode)
+	ledger.deposit("alice", 20, defaultCurrencyCode)
+
+	selection, err := new(SmartContract).TransferCurrencyWithCoinSelection(ledger.as("alice", ""), "alice", "bob", 12, "Transfer", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selection.Strategy != CoinSelectionOldest || !reflect.DeepEqual(selection.Inputs, []string{"Currencytx001", "Currencytx002"}) ||
+		selection.Change != 3 || selection.Coins != 2 {
+		t.Errorf("selection = %+v", selection)
+	}
+	if balance := ledger.balance("alice", defaultCurrencyCode); balance != 23 {
+		t.Errorf("alice balance = %v, want 23", balance)
+	}
+	if balance := ledger.balance("bob", defaultCurrencyCode); balance != 12 {
+		t.Errorf("bob balance = %v, want 12", balance)
+	}
+}
+
+func TestTransferCurrencyWithCoinSelectionIsRestrictedToTheOwner(t *testing.T) {
+	ledger := newTestLedger(t)
+	ledger.deposit("alice", 20, defaultCurrencyCode)
+
+	if _, err := new(SmartContract).TransferCurrencyWithCoinSelection(ledger.as("mallory", ""), "alice", "mallory", 10, "Transfer", ""); errorCode(err) != ErrCodeForbidden {
+		t.Errorf("err = %v, want %s", err, ErrCodeForbidden)
+	}
+	if balance := ledger.balance("alice", defaultCurrencyCode); balance != 20 {
+		t.Errorf("alice balance = %v, want 20", balance)
+	}
+}
+
+func TestConsolidateCurrency(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller string
+		role   string
+		want   string
+	}{
+		{"owner", "alice", "", ""},
+		{"admin", "operator", adminRole, ""},
+		{"another user", "bob", "", ErrCodeForbidden},
+		{"another user claiming the owner role", "bob", treasuryRole, ErrCodeForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := newTestLedger(t)
+			ledger.deposit("alice", 1, defaultCurrencyCode)
+			ledger.deposit("alice", 2, defaultCurrencyCode)
+
+			consolidation, err := new(SmartContract).ConsolidateCurrency(ledger.as(test.caller, test.role), "alice", 0, 0, "")
+			if errorCode(err) != test.want {
+				t.Fatalf("err = %v, want %s", err, test.want)
+			}
+			if err != nil {
+				return
+			}
+			if consolidation.Amount != 3 || consolidation.Coins != 1 || len(consolidation.Inputs) != 2 {
+				t.Errorf("consolidation = %+v", consolidation)
+			}
+			if balance := ledger.balance("alice", defaultCurrencyCode); balance != 3 {
+				t.Errorf("balance = %v, want 3", balance)
+			}
+		})
+	}
+}
+
+func TestConsolidationsInTheSameSecondDoNotCollide(t *testing.T) {
+	ledger := newTestLedger(t)
+	contract := new(SmartContract)
+	ledger.deposit("alice", 1, defaultCurrencyCode)
+	ledger.deposit("alice", 2, defaultCurrencyCode)
+	first, err := contract.ConsolidateCurrency(ledger.as("alice", ""), "alice", 0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger.deposit("alice", 1, defaultCurrencyCode)
+	ledger.deposit("alice", 1, defaultCurrencyCode)
+	second, err := contract.ConsolidateCurrency(ledger.as("alice", ""), "alice", 0, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.CurrencyID == second.CurrencyID || second.Coins != 2 {
+		t.Errorf("first = %+v, second = %+v", first, second)
+	}
+	if balance := ledger.balance("alice", defaultCurrencyCode); balance != 5 {
+		t.Errorf("balance = %v, want 5", balance)
+	}
+}
@@ -0,0 +1,193 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+/* 多币种全流程
+ * 每笔货币（UTXO）、账户余额和合同都带有币种代码CurrencyCode，币种代码为空的旧数据视为默认币种CNY。
+ * 支持的币种登记在币种注册表中，记录币种的小数位数和发行机构：
+ * RegisterCurrency 财务（证书属性role为treasury的用户）登记一个币种，如美元、积分、稳定币
+ * ReadCurrencyDefinition 查询币种定义，默认币种无需登记
+ * ListCurrencies 查询全部币种
+ * ReadBalancesByOwner 查询某个用户各币种的余额
+ * ReadTotalCurrencyByOwnerInCurrency 查询某个用户某一币种的余额
+ * 转账和合同结算只使用同一币种的货币，不同币种的货币不会混用；合同以创建时的币种结算。跨币种需要显式兑换（见fx.go）。
+ * 有发行机构的币种只能由发行机构存入（发行），再由发行机构转给其他用户。
+ * 注意：金额仍为float32，最小单位为0.01，因此小数位数最多为2位。
+ */
+
+const (
+	currencyDefinitionObjectType = "CurrencyDefinition"
+	//默认币种，即多币种之前唯一的货币单位
+	defaultCurrencyCode = "CNY"
+	//货币的最小单位为0.01，小数位数不能超过2位
+	maxCurrencyDecimals = 2
+)
+
+// currencyCodePattern 币种代码为3到10位大写字母或数字，以字母开头，如"USD"、"POINTS"
+var currencyCodePattern = regexp.MustCompile(`^[A-Z][A-Z0-9]{2,9}$`)
+
+// CurrencyDefinition 币种定义，Issuer为发行机构的用户ID，为空时任何用户都可以存入该币种
+type CurrencyDefinition struct {
+	Code      string `json:"Code"`
+	Name      string `json:"Name"`
+	Decimals  int    `json:"Decimals"`
+	Issuer    string `json:"Issuer"`
+	CreatedAt string `json:"CreatedAt"`
+}
+
+// defaultCurrency 默认币种的定义，未登记时使用
+var defaultCurrency = CurrencyDefinition{Code: defaultCurrencyCode, Name: "Renminbi", Decimals: 2}
+
+// currencyCodeOf 返回币种代码，空代码为默认币种
+func currencyCodeOf(code string) string {
+	if code == "" {
+		return defaultCurrencyCode
+	}
+	return code
+}
+
+// RegisterCurrency 财务登记一个币种，decimals为小数位数（0到2），issuer为发行机构，为空时任何用户都可以存入。
+// 已登记的币种不能被覆盖
+func (s *SmartContract) RegisterCurrency(ctx contractapi.TransactionContextInterface, code string, name string, decimals int, issuer string) (*CurrencyDefinition, error) {
+	if err := requireRole(ctx, treasuryRole); err != nil {
+		return nil, err
+	}
+	if !currencyCodePattern.MatchString(code) {
+		return nil, newError(ErrCodeInvalidArgument, "currency code must be 3 to 10 upper case letters or digits, starting with a letter", "code", code)
+	}
+	if decimals < 0 || decimals > maxCurrencyDecimals {
+		return nil, newError(ErrCodeInvalidArgument, fmt.Sprintf("currency decimals must be between 0 and %d", maxCurrencyDecimals),
+			"decimals", fmt.Sprintf("%d", decimals))
+	}
+	compositeKey, err := ctx.GetStub().CreateCompositeKey(currencyDefinitionObjectType, []string{code})
+	if err != nil {
+		return nil, internalError(err)
+	}
+	existing, err := ctx.GetStub().GetState(compositeKey)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if existing != nil {
+		return nil, newError(ErrCodeAlreadyExists, fmt.Sprintf("currency %s is already registered", code), "code", code)
+	}
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, internalError(err)
+	}
+	definition := &CurrencyDefinition{
+		Code:      code,
+		Name:      name,
+		Decimals:  decimals,
+		Issuer:    issuer,
+		CreatedAt: fmt.Sprintf("%d", timestamp.GetSeconds()),
+	}
+	definitionJSON, err := json.Marshal(definition)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	return definition, internalError(ctx.GetStub().PutState(compositeKey, definitionJSON))
+}
+
+// ReadCurrencyDefinition 查询币种定义，code为空时为默认币种；未登记的币种返回NOT_FOUND
+func (s *SmartContract) ReadCurrencyDefinition(ctx contractapi.TransactionContextInterface, code string) (*CurrencyDefinition, error) {
+	code = currencyCodeOf(code)
+	compositeKey, err := ctx.GetStub().CreateCompositeKey(currencyDefinitionObjectType, []string{code})
+	if err != nil {
+		return nil, internalError(err)
+	}
+	definitionJSON, err := ctx.GetStub().GetState(compositeKey)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if definitionJSON == nil {
+		if code == defaultCurrencyCode {
+			definition := defaultCurrency
+			return &definition, nil
+		}
+		return nil, newError(ErrCodeNotFound, fmt.Sprintf("currency %s is not supported", code), "currency", code)
+	}
+	var definition CurrencyDefinition
+	if err := json.Unmarshal(definitionJSON, &definition); err != nil {
+		return nil, internalError(err)
+	}
+	return &definition, nil
+}
+
+// ListCurrencies 查询全部币种，默认币种未登记时排在最前
+func (s *SmartContract) ListCurrencies(ctx contractapi.TransactionContextInterface) ([]*CurrencyDefinition, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(currencyDefinitionObjectType, []string{})
+	if err != nil {
+		return nil, internalError(err)
+	}
+	defer resultsIterator.Close()
+
+	var definitions []*CurrencyDefinition
+	registeredDefault := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, internalError(err)
+		}
+		var definition CurrencyDefinition
+		if err := json.Unmarshal(queryResponse.Value, &definition); err != nil {
+			return nil, internalError(err)
+		}
+		registeredDefault = registeredDefault || definition.Code == defaultCurrencyCode
+		definitions = append(definitions, &definition)
+	}
+	if !registeredDefault {
+		definition := defaultCurrency
+		definitions = append([]*CurrencyDefinition{&definition}, definitions...)
+	}
+	return definitions, nil
+}
+
+// checkCurrencyAmount 检查金额是否符合币种的小数位数，如积分只能是整数
+func checkCurrencyAmount(definition *CurrencyDefinition, amount float32) error {
+	unit := int64(math.Pow10(maxCurrencyDecimals - definition.Decimals))
+	if toCents(amount)%unit != 0 {
+		return newError(ErrCodeInvalidArgument, fmt.Sprintf("%s amounts have at most %d decimals", definition.Code, definition.Decimals),
+			"currency", definition.Code, "amount", fmt.Sprintf("%f", amount))
+	}
+	return nil
+}
+
+// ReadBalancesByOwner 查询某个用户各币种的余额，包括账户模式的余额
+func (s *SmartContract) ReadBalancesByOwner(ctx contractapi.TransactionContextInterface, owner string) (map[string]float32, error) {
+	account, err := isAccount(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	if account {
+		return readAccountBalances(ctx, owner)
+	}
+	coins, err := s.ReadCurrencyListByOwner(ctx, owner)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	cents := map[string]int64{}
+	for _, coin := range coins {
+		cents[currencyCodeOf(coin.CurrencyCode)] += toCents(coin.Amount)
+	}
+	balances := make(map[string]float32, len(cents))
+	for code, amount := range cents {
+		balances[code] = fromCents(amount)
+	}
+	return balances, nil
+}
+
+// ReadTotalCurrencyByOwnerInCurrency 查询某个用户（owner）某一币种的当前余额，code为空时为默认币种
+func (s *SmartContract) ReadTotalCurrencyByOwnerInCurrency(ctx contractapi.TransactionContextInterface, owner string, code string) (float32, error) {
+	balances, err := s.ReadBalancesByOwner(ctx, owner)
+	if err != nil {
+		return 0, err
+	}
+	return balances[currencyCodeOf(code)], nil
+}
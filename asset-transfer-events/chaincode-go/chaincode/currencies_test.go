@@ -0,0 +1,144 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRegisterCurrency(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		code     string
+		decimals int
+		want     string
+	}{
+		{"treasury", treasuryRole, "USD", 2, ""},
+		{"without a role", "", "USD", 2, ErrCodeForbidden},
+		{"oracle", rateOracleRole, "USD", 2, ErrCodeForbidden},
+		{"admin", adminRole, "USD", 2, ErrCodeForbidden},
+		{"already registered", treasuryRole, "POINTS", 2, ErrCodeAlreadyExists},
+		{"invalid code", treasuryRole, "usd", 2, ErrCodeInvalidArgument},
+		{"too many decimals", treasuryRole, "USD", 3, ErrCodeInvalidArgument},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := newTestLedger(t)
+			ledger.registerCurrency("POINTS", 0, "")
+			contract := new(SmartContract)
+
+			_, err := contract.RegisterCurrency(ledger.as("carol", test.role), test.code, "Test", test.decimals, "mallory")
+			if errorCode(err) != test.want {
+				t.Fatalf("err = %v, want %s", err, test.want)
+			}
+			// 已登记的币种不被覆盖
+			definition, err := contract.ReadCurrencyDefinition(ledger.as("carol", ""), "POINTS")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if definition.Decimals != 0 || definition.Issuer != "" {
+				t.Errorf("POINTS = %+v", definition)
+			}
+		})
+	}
+}
+
+func TestCreateCurrency(t *testing.T) {
+	tests := []struct {
+		name     string
+		caller   string
+		role     string
+		currency Currency
+		want     string
+	}{
+		{"deposit", "alice", "", Currency{Owner: "alice", Amount: 10, CreatedVia: "Deposit"}, ""},
+		{"system issuance", "alice", "", Currency{Owner: "alice", Amount: 10}, ""},
+		{"issuer deposit", "bank", "", Currency{Owner: "bank", Amount: 10, CreatedVia: "Deposit", CurrencyCode: "USDC"}, ""},
+		{"admin deposit for a user", "operator", adminRole, Currency{Owner: "alice", Amount: 10, CreatedVia: "Deposit"}, ""},
+		{"deposit for another user", "bob", "", Currency{Owner: "alice", Amount: 10, CreatedVia: "Deposit"}, ErrCodeForbidden},
+		{"deposit of an issued currency", "alice", "", Currency{Owner: "alice", Amount: 10, CreatedVia: "Deposit", CurrencyCode: "USDC"}, ErrCodeForbidden},
+		{"issued currency created via the system", "alice", "", Currency{Owner: "alice", Amount: 10, CurrencyCode: "USDC"}, ErrCodeForbidden},
+		{"currency created via a transfer", "alice", "", Currency{Owner: "alice", Amount: 10, CreatedVia: "Transfer", CurrencyCode: "USDC"}, ErrCodeInvalidArgument},
+		{"currency created as change", "alice", "", Currency{Owner: "alice", Amount: 1.5, CreatedVia: "Change", CurrencyCode: "POINTS"}, ErrCodeInvalidArgument},
+		{"too many decimals", "alice", "", Currency{Owner: "alice", Amount: 1.5, CreatedVia: "Deposit", CurrencyCode: "POINTS"}, ErrCodeInvalidArgument},
+		{"negative amount", "alice", "", Currency{Owner: "alice", Amount: -10, CreatedVia: "Deposit"}, ErrCodeInvalidArgument},
+		{"unregistered currency", "alice", "", Currency{Owner: "alice", Amount: 10, CreatedVia: "Deposit", CurrencyCode: "EUR"}, ErrCodeNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := newTestLedger(t)
+			ledger.registerCurrency("POINTS", 0, "")
+			ledger.registerCurrency("USDC", 2, "bank")
+
+			test.currency.CurrencyID = "Currency1"
+			currencyBytes, _ := json.Marshal(test.currency)
+			err := new(SmartContract).CreateCurrency(ledger.as(test.caller, test.role), currencyBytes)
+			if errorCode(err) != test.want {
+				t.Fatalf("err = %v, want %s", err, test.want)
+			}
+			code := currencyCodeOf(test.currency.CurrencyCode)
+			want := test.currency.Amount
+			if err != nil {
+				want = 0
+			}
+			if balance := ledger.balance(test.currency.Owner, code); balance != want {
+				t.Errorf("%s balance = %v, want %v", code, balance, want)
+			}
+		})
+	}
+}
+
+func TestTransfersOfIssuedCurrencies(t *testing.T) {
+	ledger := newTestLedger(t)
+	ledger.registerCurrency("USDC", 2, "bank")
+	ledger.deposit("bank", 100, "USDC")
+
+	// 发行机构之外的用户收到的货币和找零由链码内部创建，不受发行机构检查的限制
+	contract := new(SmartContract)
+	if _, err := contract.TransferCurrencyInCurrency(ledger.as("bank", ""), "bank", "alice", 30, "USDC", "Transfer", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := contract.TransferCurrencyInCurrency(ledger.as("alice", ""), "alice", "bob", 10, "USDC", "Transfer", ""); err != nil {
+		t.Fatal(err)
+	}
+	for owner, want := range map[string]float32{"bank": 70, "alice": 20, "bob": 10} {
+		if balance := ledger.balance(owner, "USDC"); balance != want {
+			t.Errorf("%s balance = %v, want %v", owner, balance, want)
+		}
+	}
+}
+
+func TestTransfersAreRestrictedToTheOwner(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller string
+		role   string
+		want   string
+	}{
+		{"owner", "bob", "", ""},
+		{"admin", "operator", adminRole, ""},
+		{"another user", "mallory", "", ErrCodeForbidden},
+		{"another user with the treasury role", "mallory", treasuryRole, ErrCodeForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := newTestLedger(t)
+			ledger.deposit("bob", 20, defaultCurrencyCode)
+			contract := new(SmartContract)
+
+			if err := contract.TransferCurrency(ledger.as(test.caller, test.role), "bob", "mallory", 5, "Transfer"); errorCode(err) != test.want {
+				t.Fatalf("TransferCurrency err = %v, want %s", err, test.want)
+			}
+			if _, err := contract.TransferCurrencyInCurrency(ledger.as(test.caller, test.role), "bob", "mallory", 5, "", "Transfer", ""); errorCode(err) != test.want {
+				t.Fatalf("TransferCurrencyInCurrency err = %v, want %s", err, test.want)
+			}
+			want := float32(10)
+			if test.want != "" {
+				want = 20
+			}
+			if balance := ledger.balance("bob", defaultCurrencyCode); balance != want {
+				t.Errorf("bob balance = %v, want %v", balance, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+/* 链码错误码
+ * 链码函数返回的错误统一使用ChaincodeError，错误信息被序列化为JSON：{"code":"...","message":"...","details":{...}}
+ * peer会把错误信息原样放入背书响应中，网关从gRPC status details中解析出该JSON，再映射为对应的HTTP状态码。
+ * 复合键含有U+0000分隔符，错误信息中不直接使用复合键，而是使用keyDetails拆分出的对象类型、所有者和ID。
+ */
+
+// 错误码，网关依据错误码决定HTTP状态码
+const (
+	ErrCodeNotFound          = "NOT_FOUND"          //资产/合同不存在 - 404
+	ErrCodeAlreadyExists     = "ALREADY_EXISTS"     //资产/合同已存在 - 409
+	ErrCodeInvalidArgument   = "INVALID_ARGUMENT"   //参数不合法 - 400
+	ErrCodeInvalidState      = "INVALID_STATE"      //合同状态不允许该操作 - 409
+	ErrCodeInsufficientFunds = "INSUFFICIENT_FUNDS" //余额不足 - 422
+	ErrCodeConditionNotMet   = "CONDITION_NOT_MET"  //业务条件不满足，如未达到赔偿/强制还款条件 - 422
+	ErrCodeForbidden         = "FORBIDDEN"          //调用者无权执行该操作 - 403
+	ErrCodeInternal          = "INTERNAL"           //账本读写等内部错误 - 500
+	ErrCodeIdempotentReplay  = "IDEMPOTENT_REPLAY"  //幂等键已被使用，网关返回首次执行的结果（见idempotency.go）
+)
+
+// ChaincodeError 带错误码的链码错误
+type ChaincodeError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Error 返回JSON格式的错误信息，便于网关解析
+func (e *ChaincodeError) Error() string {
+	errorJSON, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Sprintf(`{"code":%q,"message":%q}`, e.Code, e.Message)
+	}
+	return string(errorJSON)
+}
+
+// newError 创建一个带错误码的链码错误，details为成对出现的键值，如 newError(ErrCodeNotFound, "...", "id", id)
+func newError(code string, message string, details ...string) *ChaincodeError {
+	chaincodeError := &ChaincodeError{
+		Code:    code,
+		Message: message,
+	}
+	if len(details) > 0 {
+		chaincodeError.Details = make(map[string]string, len(details)/2)
+		for i := 0; i+1 < len(details); i += 2 {
+			chaincodeError.Details[details[i]] = details[i+1]
+		}
+	}
+	return chaincodeError
+}
+
+// internalError 将账本读写、序列化等底层错误包装为INTERNAL错误；已经是ChaincodeError的错误原样返回
+func internalError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*ChaincodeError); ok {
+		return err
+	}
+	return newError(ErrCodeInternal, err.Error())
+}
+
+// keyDetails 返回状态键在错误信息中的描述和错误详情。复合键拆分为对象类型和各个部分，第一部分为所有者，最后一部分为ID
+func keyDetails(ctx contractapi.TransactionContextInterface, key string) (string, []string) {
+	if !strings.HasPrefix(key, "\x00") {
+		return key, []string{"id", key}
+	}
+	objectType, attributes, err := ctx.GetStub().SplitCompositeKey(key)
+	if err != nil || len(attributes) == 0 {
+		return "composite key", nil
+	}
+	id := attributes[len(attributes)-1]
+	details := []string{"objectType", objectType, "id", id}
+	if len(attributes) > 1 {
+		details = append(details, "owner", attributes[0])
+	}
+	return fmt.Sprintf("%s %s", objectType, strings.Join(attributes, "/")), details
+}
@@ -0,0 +1,33 @@
+package chaincode
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNotFoundErrorsReportLogicalKeys(t *testing.T) {
+	ledger := newTestLedger(t)
+	contract := new(SmartContract)
+
+	_, err := contract.ReadLoan(ledger.as("alice", ""), "alice", "Loan1")
+	chaincodeError, ok := err.(*ChaincodeError)
+	if !ok || chaincodeError.Code != ErrCodeNotFound {
+		t.Fatalf("err = %v", err)
+	}
+	if strings.ContainsRune(err.Error(), 0) {
+		t.Errorf("error contains a composite key separator: %q", err.Error())
+	}
+	if chaincodeError.Message != "the asset Loan alice/Loan1 does not exist" {
+		t.Errorf("message = %q", chaincodeError.Message)
+	}
+	want := map[string]string{"objectType": "Loan", "owner": "alice", "id": "Loan1"}
+	if !reflect.DeepEqual(chaincodeError.Details, want) {
+		t.Errorf("details = %v, want %v", chaincodeError.Details, want)
+	}
+
+	_, err = contract.ReadCurrency(ledger.as("alice", ""), "Currency1")
+	if chaincodeError, ok := err.(*ChaincodeError); !ok || chaincodeError.Details["id"] != "Currency1" {
+		t.Errorf("err = %v", err)
+	}
+}
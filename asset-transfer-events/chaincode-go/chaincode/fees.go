@@ -0,0 +1,251 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+/* 手续费全流程
+ * 转账按转账原因（Transfer、Loan、Insurance）收取手续费，费率表保存在账本上，由财务（证书属性role为treasury的用户）设置。
+ * 其他转账原因的转账被拒绝，不能借此免除手续费：
+ * SetFeeSchedule 设置（覆盖）费率表和收取手续费的账户
+ * ReadFeeSchedule 查询费率表，未设置时为空，所有转账免费
+ * QuoteFee 查询某一转账原因、金额和币种的手续费
+ * 每种转账原因的收费方式：
+ *   flat 固定金额Amount
+ *   percentage 转账金额的Rate比例
+ *   tiered 分档收费，使用第一个UpTo不小于转账金额的档位（最后一档的UpTo必须为0，不限金额），收取该档的Amount加转账金额的Rate比例
+ * 手续费以转账币种收取，Amount为转账币种的金额，按币种的最小单位向上取整。手续费由转出方在转账金额之外支付，
+ * 在同一交易中转入手续费账户；手续费账户自己转出时免费。转账事件、CoinSelection和合同中记录本次支付的手续费。
+ * 注意：兑换（ConvertCurrency）和外币还款不收取手续费，其收益来自点差（见fx.go）。
+ */
+
+const (
+	feeScheduleObjectType = "FeeSchedule"
+	//财务的角色
+	treasuryRole = "treasury"
+	//手续费入账时的货币来源
+	feeReason = "Fee"
+)
+
+// 收费方式
+const (
+	feeTypeFlat       = "flat"
+	feeTypePercentage = "percentage"
+	feeTypeTiered     = "tiered"
+)
+
+// feeReasons 可以设置手续费的转账原因
+var feeReasons = []string{"Transfer", "Loan", "Insurance"}
+
+// FeeTier 分档收费的一档，UpTo为该档的最大转账金额，为0时不限金额
+type FeeTier struct {
+	UpTo   float32 `json:"UpTo"`
+	Amount float32 `json:"Amount"`
+	Rate   float64 `json:"Rate"`
+}
+
+// FeeRule 一种转账原因的收费方式
+type FeeRule struct {
+	Type   string    `json:"Type"` //"flat","percentage","tiered"
+	Amount float32   `json:"Amount"`
+	Rate   float64   `json:"Rate"`
+	Tiers  []FeeTier `json:"Tiers"`
+}
+
+// FeeSchedule 费率表，Rules以转账原因为键，没有规则的转账原因免费
+type FeeSchedule struct {
+	FeeAccount string             `json:"FeeAccount"`
+	Rules      map[string]FeeRule `json:"Rules"`
+	UpdatedAt  string             `json:"UpdatedAt"`
+	UpdatedBy  string             `json:"UpdatedBy"`
+}
+
+// FeeQuote 某一笔转账的手续费
+type FeeQuote struct {
+	Reason       string  `json:"Reason"`
+	Amount       float32 `json:"Amount"`
+	CurrencyCode string  `json:"CurrencyCode"`
+	Fee          float32 `json:"Fee"`
+	FeeAccount   string  `json:"FeeAccount"`
+}
+
+// checkFeeReason 检查转账原因是否是可以收取手续费的转账原因
+func checkFeeReason(reason string) error {
+	for _, feeReason := range feeReasons {
+		if reason == feeReason {
+			return nil
+		}
+	}
+	return newError(ErrCodeInvalidArgument, fmt.Sprintf("unknown transfer reason %s", reason), "reason", reason)
+}
+
+// checkFeeRule 检查收费方式是否有效
+func checkFeeRule(reason string, rule FeeRule) error {
+	invalid := func(message string) error {
+		return newError(ErrCodeInvalidArgument, fmt.Sprintf("fee rule for %s: %s", reason, message), "reason", reason, "type", rule.Type)
+	}
+	switch rule.Type {
+	case feeTypeFlat:
+		if rule.Amount <= 0 {
+			return invalid("a flat fee must be positive")
+		}
+	case feeTypePercentage:
+		if rule.Rate <= 0 || rule.Rate >= 1 {
+			return invalid("a percentage fee rate must be greater than 0 and less than 1")
+		}
+	case feeTypeTiered:
+		if len(rule.Tiers) == 0 {
+			return invalid("a tiered fee needs at least one tier")
+		}
+		for i, tier := range rule.Tiers {
+			if tier.Amount < 0 || tier.Rate < 0 || tier.Rate >= 1 {
+				return invalid(fmt.Sprintf("tier %d must have a non-negative amount and a rate less than 1", i))
+			}
+			last := i == len(rule.Tiers)-1
+			if tier.UpTo < 0 || (tier.UpTo == 0 && !last) {
+				return invalid(fmt.Sprintf("tier %d must have a positive upper bound; only the last tier may be unbounded", i))
+			}
+			// 最后一档必须不限金额，每笔转账才都有对应的档位
+			if last && tier.UpTo != 0 {
+				return invalid("the last tier must be unbounded")
+			}
+			if i > 0 && tier.UpTo != 0 && tier.UpTo <= rule.Tiers[i-1].UpTo {
+				return invalid("tier upper bounds must be increasing")
+			}
+		}
+	default:
+		return invalid("type must be flat, percentage or tiered")
+	}
+	return nil
+}
+
+// SetFeeSchedule 设置费率表，scheduleJSON为FeeSchedule的JSON，只需要FeeAccount和Rules。只有财务可以设置
+func (s *SmartContract) SetFeeSchedule(ctx contractapi.TransactionContextInterface, scheduleJSON string) (*FeeSchedule, error) {
+	if err := requireRole(ctx, treasuryRole); err != nil {
+		return nil, err
+	}
+	var schedule FeeSchedule
+	if err := json.Unmarshal([]byte(scheduleJSON), &schedule); err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "fee schedule is not valid JSON", "reason", err.Error())
+	}
+	if len(schedule.Rules) > 0 && schedule.FeeAccount == "" {
+		return nil, newError(ErrCodeInvalidArgument, "a fee schedule with rules needs a fee account")
+	}
+	reasons := make([]string, 0, len(schedule.Rules))
+	for reason := range schedule.Rules {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		if err := checkFeeReason(reason); err != nil {
+			return nil, err
+		}
+		if err := checkFeeRule(reason, schedule.Rules[reason]); err != nil {
+			return nil, err
+		}
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, internalError(err)
+	}
+	updatedBy, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, internalError(err)
+	}
+	schedule.UpdatedAt = fmt.Sprintf("%d", timestamp.GetSeconds())
+	schedule.UpdatedBy = updatedBy
+	compositeKey, err := ctx.GetStub().CreateCompositeKey(feeScheduleObjectType, []string{})
+	if err != nil {
+		return nil, internalError(err)
+	}
+	storedJSON, err := json.Marshal(schedule)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if err := ctx.GetStub().PutState(compositeKey, storedJSON); err != nil {
+		return nil, internalError(err)
+	}
+	return &schedule, internalError(ctx.GetStub().SetEvent("SetFeeSchedule", storedJSON))
+}
+
+// ReadFeeSchedule 查询费率表，未设置时返回空费率表
+func (s *SmartContract) ReadFeeSchedule(ctx contractapi.TransactionContextInterface) (*FeeSchedule, error) {
+	compositeKey, err := ctx.GetStub().CreateCompositeKey(feeScheduleObjectType, []string{})
+	if err != nil {
+		return nil, internalError(err)
+	}
+	scheduleJSON, err := ctx.GetStub().GetState(compositeKey)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	schedule := &FeeSchedule{Rules: map[string]FeeRule{}}
+	if scheduleJSON == nil {
+		return schedule, nil
+	}
+	if err := json.Unmarshal(scheduleJSON, schedule); err != nil {
+		return nil, internalError(err)
+	}
+	return schedule, nil
+}
+
+// computeFee 按收费方式计算amount的手续费，按币种的最小单位向上取整
+func computeFee(rule FeeRule, amount float32, definition *CurrencyDefinition) float32 {
+	flat, rate := rule.Amount, rule.Rate
+	if rule.Type == feeTypeTiered {
+		// 超出所有档位上限时使用最后一档，只可能出现在最后一档有上限的旧费率表中
+		for _, tier := range rule.Tiers {
+			flat, rate = tier.Amount, tier.Rate
+			if tier.UpTo == 0 || toCents(amount) <= toCents(tier.UpTo) {
+				break
+			}
+		}
+	} else if rule.Type == feeTypeFlat {
+		rate = 0
+	} else {
+		flat = 0
+	}
+	cents := float64(toCents(flat)) + float64(toCents(amount))*rate
+	if cents <= 0 {
+		return 0
+	}
+	return fromCents(roundUpCents(cents, definition))
+}
+
+// transferFee 返回from以code货币转出amount时应支付的手续费和手续费账户，没有收费规则或手续费账户转出时为0。
+// 未知的转账原因返回INVALID_ARGUMENT
+func (s *SmartContract) transferFee(ctx contractapi.TransactionContextInterface, from string, amount float32, code string, transferReason string) (float32, string, error) {
+	if err := checkFeeReason(transferReason); err != nil {
+		return 0, "", err
+	}
+	schedule, err := s.ReadFeeSchedule(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	rule, found := schedule.Rules[transferReason]
+	if !found || from == schedule.FeeAccount {
+		return 0, "", nil
+	}
+	definition, err := s.ReadCurrencyDefinition(ctx, code)
+	if err != nil {
+		return 0, "", err
+	}
+	return computeFee(rule, amount, definition), schedule.FeeAccount, nil
+}
+
+// QuoteFee 查询以currencyCode货币（为空时为默认币种）转账amount时，转账原因为transferReason的手续费
+func (s *SmartContract) QuoteFee(ctx contractapi.TransactionContextInterface, transferReason string, amount float32, currencyCode string) (*FeeQuote, error) {
+	if amount <= 0 {
+		return nil, newError(ErrCodeInvalidArgument, "transfer amount must be positive", "amount", fmt.Sprintf("%f", amount))
+	}
+	code := currencyCodeOf(currencyCode)
+	fee, feeAccount, err := s.transferFee(ctx, "", amount, code, transferReason)
+	if err != nil {
+		return nil, err
+	}
+	return &FeeQuote{Reason: transferReason, Amount: amount, CurrencyCode: code, Fee: fee, FeeAccount: feeAccount}, nil
+}
@@ -0,0 +1,146 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// setFees 以财务的身份设置费率表，手续费账户为platform
+func (l *testLedger) setFees(rules map[string]FeeRule) {
+	l.t.Helper()
+	scheduleJSON, _ := json.Marshal(FeeSchedule{FeeAccount: "platform", Rules: rules})
+	if _, err := new(SmartContract).SetFeeSchedule(l.as("treasurer", treasuryRole), string(scheduleJSON)); err != nil {
+		l.t.Fatal(err)
+	}
+}
+
+func TestComputeFee(t *testing.T) {
+	cents := &CurrencyDefinition{Code: defaultCurrencyCode, Decimals: 2}
+	units := &CurrencyDefinition{Code: "POINTS", Decimals: 0}
+	tiered := FeeRule{Type: feeTypeTiered, Tiers: []FeeTier{{UpTo: 100, Amount: 1}, {Amount: 0.5, Rate: 0.01}}}
+	tests := []struct {
+		name       string
+		rule       FeeRule
+		amount     float32
+		definition *CurrencyDefinition
+		want       float32
+	}{
+		{"flat", FeeRule{Type: feeTypeFlat, Amount: 1, Rate: 0.5}, 50, cents, 1},
+		{"percentage rounds up", FeeRule{Type: feeTypePercentage, Amount: 1, Rate: 0.003}, 10.01, cents, 0.04},
+		{"percentage in whole units", FeeRule{Type: feeTypePercentage, Rate: 0.005}, 150, units, 1},
+		{"first tier", tiered, 100, cents, 1},
+		{"unbounded tier", tiered, 100.01, cents, 1.51},
+		{"above the last bounded tier", FeeRule{Type: feeTypeTiered, Tiers: []FeeTier{{UpTo: 100, Amount: 1}}}, 200, cents, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if fee := computeFee(test.rule, test.amount, test.definition); fee != test.want {
+				t.Errorf("fee = %v, want %v", fee, test.want)
+			}
+		})
+	}
+}
+
+func TestTransferFee(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   string
+		reason string
+		fee    float32
+		want   string
+	}{
+		{"transfer", "alice", "Transfer", 1, ""},
+		{"reason without a rule", "alice", "Loan", 0, ""},
+		{"fee account", "platform", "Transfer", 0, ""},
+		{"unknown reason", "alice", "Gift", 0, ErrCodeInvalidArgument},
+		{"empty reason", "alice", "", 0, ErrCodeInvalidArgument},
+		{"reason in another case", "alice", "transfer", 0, ErrCodeInvalidArgument},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := newTestLedger(t)
+			ledger.setFees(map[string]FeeRule{"Transfer": {Type: feeTypeFlat, Amount: 1}})
+			ledger.deposit(test.from, 20, defaultCurrencyCode)
+
+			selection, err := new(SmartContract).TransferCurrencyWithCoinSelection(ledger.as(test.from, ""), test.from, "bob", 10, test.reason, "")
+			if errorCode(err) != test.want {
+				t.Fatalf("err = %v, want %s", err, test.want)
+			}
+			spent, fees := float32(0), float32(0)
+			if err == nil {
+				spent, fees = 10+test.fee, test.fee
+				if selection.Fee != test.fee {
+					t.Errorf("selection = %+v", selection)
+				}
+			}
+			if balance := ledger.balance(test.from, defaultCurrencyCode); balance != 20-spent {
+				t.Errorf("%s balance = %v, want %v", test.from, balance, 20-spent)
+			}
+			if test.from != "platform" {
+				if balance := ledger.balance("platform", defaultCurrencyCode); balance != fees {
+					t.Errorf("platform balance = %v, want %v", balance, fees)
+				}
+			}
+		})
+	}
+}
+
+func TestFeeTransfersInTheSameSecondDoNotCollide(t *testing.T) {
+	ledger := newTestLedger(t)
+	ledger.setFees(map[string]FeeRule{"Transfer": {Type: feeTypeFlat, Amount: 1}})
+	ledger.deposit("alice", 20, defaultCurrencyCode)
+	ledger.deposit("carol", 20, defaultCurrencyCode)
+
+	for _, from := range []string{"alice", "carol", "alice"} {
+		if err := new(SmartContract).TransferCurrency(ledger.as(from, ""), from, "bob", 5, "Transfer"); err != nil {
+			t.Fatalf("%s: %v", from, err)
+		}
+	}
+	for owner, want := range map[string]float32{"alice": 8, "carol": 14, "bob": 15, "platform": 3} {
+		if balance := ledger.balance(owner, defaultCurrencyCode); balance != want {
+			t.Errorf("%s balance = %v, want %v", owner, balance, want)
+		}
+	}
+}
+
+func TestQuoteFee(t *testing.T) {
+	ledger := newTestLedger(t)
+	ledger.setFees(map[string]FeeRule{"Loan": {Type: feeTypePercentage, Rate: 0.003}})
+	contract := new(SmartContract)
+
+	quote, err := contract.QuoteFee(ledger.as("alice", ""), "Loan", 1000, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote.Fee != 3 || quote.FeeAccount != "platform" || quote.CurrencyCode != defaultCurrencyCode {
+		t.Errorf("quote = %+v", quote)
+	}
+	if _, err := contract.QuoteFee(ledger.as("alice", ""), "Gift", 1000, ""); errorCode(err) != ErrCodeInvalidArgument {
+		t.Errorf("unknown reason err = %v", err)
+	}
+}
+
+func TestSetFeeSchedule(t *testing.T) {
+	tests := []struct {
+		name  string
+		role  string
+		rules map[string]FeeRule
+		want  string
+	}{
+		{"treasury", treasuryRole, map[string]FeeRule{"Transfer": {Type: feeTypeFlat, Amount: 1}}, ""},
+		{"without the treasury role", adminRole, map[string]FeeRule{"Transfer": {Type: feeTypeFlat, Amount: 1}}, ErrCodeForbidden},
+		{"unknown reason", treasuryRole, map[string]FeeRule{"Deposit": {Type: feeTypeFlat, Amount: 1}}, ErrCodeInvalidArgument},
+		{"invalid rule", treasuryRole, map[string]FeeRule{"Transfer": {Type: feeTypePercentage, Rate: 1}}, ErrCodeInvalidArgument},
+		{"tiered", treasuryRole, map[string]FeeRule{"Transfer": {Type: feeTypeTiered, Tiers: []FeeTier{{UpTo: 100, Amount: 1}, {Rate: 0.01}}}}, ""},
+		{"last tier bounded", treasuryRole, map[string]FeeRule{"Transfer": {Type: feeTypeTiered, Tiers: []FeeTier{{UpTo: 100, Amount: 1}, {UpTo: 1000, Rate: 0.01}}}}, ErrCodeInvalidArgument},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := newTestLedger(t)
+			scheduleJSON, _ := json.Marshal(FeeSchedule{FeeAccount: "platform", Rules: test.rules})
+			if _, err := new(SmartContract).SetFeeSchedule(ledger.as("carol", test.role), string(scheduleJSON)); errorCode(err) != test.want {
+				t.Errorf("err = %v, want %s", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+/* 货币兑换全流程
+ * 不同币种的货币不会混用，跨币种只能显式兑换。汇率由汇率预言机（证书属性role为oracle的用户）发布在账本上：
+ *   ("ExchangeRate", base, quote) 1单位base兑换Rate单位quote的中间价，带有点差Spread和有效期[ValidFrom, ValidUntil]
+ * PostExchangeRate 汇率预言机发布（覆盖）一个币种对的汇率
+ * QuoteExchangeRate 查询从一个币种兑换为另一个币种的报价，只有反向汇率时使用其倒数
+ * ListExchangeRates 查询全部汇率
+ * ConvertCurrency 按报价兑换：销毁用户的源币种货币，为用户创建目标币种的货币
+ * LoanContractCheckInCurrency 贷款以外币还款，使用的汇率记录在贷款合同上（见smartcontract.go）
+ * 报价 = 中间价 × (1 - 点差)，点差归平台所有：按中间价兑换的金额与实际兑换金额之差转入费率表的手续费账户（见fees.go），
+ * 未设置手续费账户时点差随源币种货币一起销毁。兑换得到的金额向下取整，外币还款需要支付的金额向上取整，
+ * 取整单位为目标币种的最小单位。交易时间不在有效期内的汇率不能使用。
+ */
+
+const (
+	exchangeRateObjectType = "ExchangeRate"
+	//汇率预言机的角色
+	rateOracleRole = "oracle"
+	//浮点误差容忍度，避免取整时把0.9999999当作0
+	roundingTolerance = 1e-6
+)
+
+// ExchangeRate 汇率预言机发布的汇率，1单位Base兑换Rate单位Quote，时间为Unix秒
+type ExchangeRate struct {
+	Base       string  `json:"Base"`
+	Quote      string  `json:"Quote"`
+	Rate       float64 `json:"Rate"`
+	Spread     float64 `json:"Spread"`
+	ValidFrom  string  `json:"ValidFrom"`
+	ValidUntil string  `json:"ValidUntil"`
+	Oracle     string  `json:"Oracle"`
+	PostedAt   string  `json:"PostedAt"`
+}
+
+// FXQuote 从From兑换为To的报价，EffectiveRate为扣除点差后1单位From兑换的To
+type FXQuote struct {
+	From          string  `json:"From"`
+	To            string  `json:"To"`
+	Rate          float64 `json:"Rate"`
+	Spread        float64 `json:"Spread"`
+	EffectiveRate float64 `json:"EffectiveRate"`
+	ValidUntil    string  `json:"ValidUntil"`
+}
+
+// Conversion 兑换结果，作为ConvertCurrency事件的内容
+type Conversion struct {
+	Owner         string  `json:"Owner"`
+	FromCurrency  string  `json:"FromCurrency"`
+	FromAmount    float32 `json:"FromAmount"`
+	ToCurrency    string  `json:"ToCurrency"`
+	ToAmount      float32 `json:"ToAmount"`
+	Rate          float64 `json:"Rate"`
+	Spread        float64 `json:"Spread"`
+	EffectiveRate float64 `json:"EffectiveRate"`
+	CurrencyID    string  `json:"CurrencyID"`
+	Timestamp     string  `json:"Timestamp"`
+	//转入手续费账户的点差（目标币种），未设置手续费账户时为0和空
+	SpreadAmount float32 `json:"SpreadAmount"`
+	FeeAccount   string  `json:"FeeAccount"`
+}
+
+// FXSettlement 以外币结算的结果：支付的外币币种、金额和使用的报价
+type FXSettlement struct {
+	Currency string  `json:"Currency"`
+	Amount   float32 `json:"Amount"`
+	Rate     float64 `json:"Rate"`
+}
+
+// PostExchangeRate 汇率预言机发布1单位base兑换rate单位quote的汇率，spread为点差（0到1之间），
+// validFrom和validUntil为有效期的Unix秒，validFrom为空时从当前交易时间开始生效
+func (s *SmartContract) PostExchangeRate(ctx contractapi.TransactionContextInterface, base string, quote string, rate float64, spread float64, validFrom string, validUntil string) (*ExchangeRate, error) {
+	if err := requireRole(ctx, rateOracleRole); err != nil {
+		return nil, err
+	}
+	if base == quote {
+		return nil, newError(ErrCodeInvalidArgument, "an exchange rate needs two different currencies", "base", base, "quote", quote)
+	}
+	for _, code := range []string{base, quote} {
+		if _, err := s.ReadCurrencyDefinition(ctx, code); err != nil {
+			return nil, err
+		}
+	}
+	if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return nil, newError(ErrCodeInvalidArgument, "exchange rate must be positive", "rate", fmt.Sprintf("%f", rate))
+	}
+	if spread < 0 || spread >= 1 {
+		return nil, newError(ErrCodeInvalidArgument, "spread must be at least 0 and less than 1", "spread", fmt.Sprintf("%f", spread))
+	}
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if validFrom == "" {
+		validFrom = fmt.Sprintf("%d", timestamp.GetSeconds())
+	}
+	from, fromErr := strconv.ParseInt(validFrom, 10, 64)
+	until, untilErr := strconv.ParseInt(validUntil, 10, 64)
+	if fromErr != nil || untilErr != nil || until <= from {
+		return nil, newError(ErrCodeInvalidArgument, "validity must be Unix seconds with validUntil after validFrom",
+			"validFrom", validFrom, "validUntil", validUntil)
+	}
+	oracle, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	exchangeRate := &ExchangeRate{
+		Base:       base,
+		Quote:      quote,
+		Rate:       rate,
+		Spread:     spread,
+		ValidFrom:  validFrom,
+		ValidUntil: validUntil,
+		Oracle:     oracle,
+		PostedAt:   fmt.Sprintf("%d", timestamp.GetSeconds()),
+	}
+	compositeKey, err := ctx.GetStub().CreateCompositeKey(exchangeRateObjectType, []string{base, quote})
+	if err != nil {
+		return nil, internalError(err)
+	}
+	rateJSON, err := json.Marshal(exchangeRate)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if err := ctx.GetStub().PutState(compositeKey, rateJSON); err != nil {
+		return nil, internalError(err)
+	}
+	return exchangeRate, internalError(ctx.GetStub().SetEvent("PostExchangeRate", rateJSON))
+}
+
+// readExchangeRate 读取base/quote的汇率，不存在时返回nil
+func readExchangeRate(ctx contractapi.TransactionContextInterface, base string, quote string) (*ExchangeRate, error) {
+	compositeKey, err := ctx.GetStub().CreateCompositeKey(exchangeRateObjectType, []string{base, quote})
+	if err != nil {
+		return nil, internalError(err)
+	}
+	rateJSON, err := ctx.GetStub().GetState(compositeKey)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if rateJSON == nil {
+		return nil, nil
+	}
+	var exchangeRate ExchangeRate
+	if err := json.Unmarshal(rateJSON, &exchangeRate); err != nil {
+		return nil, internalError(err)
+	}
+	return &exchangeRate, nil
+}
+
+// QuoteExchangeRate 查询从from兑换为to的报价（币种代码为空时为默认币种）。没有from/to的汇率时使用to/from汇率的倒数；
+// 汇率不存在时返回NOT_FOUND，当前交易时间不在有效期内时返回CONDITION_NOT_MET
+func (s *SmartContract) QuoteExchangeRate(ctx contractapi.TransactionContextInterface, from string, to string) (*FXQuote, error) {
+	from, to = currencyCodeOf(from), currencyCodeOf(to)
+	exchangeRate, err := readExchangeRate(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	rate := 0.0
+	if exchangeRate != nil {
+		rate = exchangeRate.Rate
+	} else {
+		exchangeRate, err = readExchangeRate(ctx, to, from)
+		if err != nil {
+			return nil, err
+		}
+		if exchangeRate == nil {
+			return nil, newError(ErrCodeNotFound, fmt.Sprintf("no exchange rate from %s to %s", from, to), "from", from, "to", to)
+		}
+		rate = 1 / exchangeRate.Rate
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, internalError(err)
+	}
+	validFrom, _ := strconv.ParseInt(exchangeRate.ValidFrom, 10, 64)
+	validUntil, _ := strconv.ParseInt(exchangeRate.ValidUntil, 10, 64)
+	if now := timestamp.GetSeconds(); now < validFrom || now > validUntil {
+		return nil, newError(ErrCodeConditionNotMet, fmt.Sprintf("the exchange rate from %s to %s is not valid at %d", from, to, now),
+			"from", from, "to", to, "validFrom", exchangeRate.ValidFrom, "validUntil", exchangeRate.ValidUntil)
+	}
+	return &FXQuote{
+		From:          from,
+		To:            to,
+		Rate:          rate,
+		Spread:        exchangeRate.Spread,
+		EffectiveRate: rate * (1 - exchangeRate.Spread),
+		ValidUntil:    exchangeRate.ValidUntil,
+	}, nil
+}
+
+// ListExchangeRates 查询全部汇率，包括已过期的汇率
+func (s *SmartContract) ListExchangeRates(ctx contractapi.TransactionContextInterface) ([]*ExchangeRate, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(exchangeRateObjectType, []string{})
+	if err != nil {
+		return nil, internalError(err)
+	}
+	defer resultsIterator.Close()
+
+	exchangeRates := []*ExchangeRate{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, internalError(err)
+		}
+		var exchangeRate ExchangeRate
+		if err := json.Unmarshal(queryResponse.Value, &exchangeRate); err != nil {
+			return nil, internalError(err)
+		}
+		exchangeRates = append(exchangeRates, &exchangeRate)
+	}
+	return exchangeRates, nil
+}
+
+// currencyUnit 返回币种最小单位对应的分数，如2位小数为1分，0位小数为100分
+func currencyUnit(definition *CurrencyDefinition) float64 {
+	return math.Pow10(maxCurrencyDecimals - definition.Decimals)
+}
+
+// roundDownCents 把分向下取整为币种的最小单位
+func roundDownCents(cents float64, definition *CurrencyDefinition) int64 {
+	unit := currencyUnit(definition)
+	return int64(math.Floor(cents/unit+roundingTolerance) * unit)
+}
+
+// roundUpCents 把分向上取整为币种的最小单位
+func roundUpCents(cents float64, definition *CurrencyDefinition) int64 {
+	unit := currencyUnit(definition)
+	return int64(math.Ceil(cents/unit-roundingTolerance) * unit)
+}
+
+// ConvertCurrency 把owner的amount单位fromCode货币按报价兑换为toCode货币：销毁源币种的货币，为owner创建目标币种的货币，
+// 点差转入手续费账户。只有owner本人或管理员可以兑换
+func (s *SmartContract) ConvertCurrency(ctx contractapi.TransactionContextInterface, owner string, amount float32, fromCode string, toCode string) (*Conversion, error) {
+	if err := requireOwner(ctx, owner); err != nil {
+		return nil, err
+	}
+	fromDefinition, err := s.ReadCurrencyDefinition(ctx, fromCode)
+	if err != nil {
+		return nil, err
+	}
+	toDefinition, err := s.ReadCurrencyDefinition(ctx, toCode)
+	if err != nil {
+		return nil, err
+	}
+	if fromDefinition.Code == toDefinition.Code {
+		return nil, newError(ErrCodeInvalidArgument, "cannot convert a currency to itself", "currency", fromDefinition.Code)
+	}
+	if err := checkCurrencyAmount(fromDefinition, amount); err != nil {
+		return nil, err
+	}
+	quote, err := s.QuoteExchangeRate(ctx, fromDefinition.Code, toDefinition.Code)
+	if err != nil {
+		return nil, err
+	}
+	toAmount := roundDownCents(float64(toCents(amount))*quote.EffectiveRate, toDefinition)
+	if toAmount <= 0 {
+		return nil, newError(ErrCodeInvalidArgument, fmt.Sprintf("%f %s is too small to convert to %s", amount, fromDefinition.Code, toDefinition.Code),
+			"amount", fmt.Sprintf("%f", amount), "from", fromDefinition.Code, "to", toDefinition.Code)
+	}
+
+	if _, err := s.burnCurrency(ctx, owner, amount, fromDefinition.Code, "Convert", defaultCoinSelection); err != nil {
+		return nil, err
+	}
+	timestamp, _ := ctx.GetStub().GetTxTimestamp()
+	seconds := fmt.Sprintf("%d", timestamp.GetSeconds())
+	txID := ctx.GetStub().GetTxID()
+	conversion := &Conversion{
+		Owner:         owner,
+		FromCurrency:  fromDefinition.Code,
+		FromAmount:    amount,
+		ToCurrency:    toDefinition.Code,
+		ToAmount:      fromCents(toAmount),
+		Rate:          quote.Rate,
+		Spread:        quote.Spread,
+		EffectiveRate: quote.EffectiveRate,
+		CurrencyID:    "Currency" + owner + "Converted" + txID,
+		Timestamp:     seconds,
+	}
+	if err := s.mintCurrency(ctx, owner, conversion.CurrencyID, conversion.ToAmount, toDefinition.Code, "Convert"); err != nil {
+		return nil, err
+	}
+	err = recordTransfer(ctx, TransferRecord{
+		From:         owner,
+		To:           owner,
+		Amount:       conversion.ToAmount,
+		CurrencyCode: conversion.ToCurrency,
+		PaidCurrency: conversion.FromCurrency,
+		PaidAmount:   conversion.FromAmount,
+		Rate:         conversion.EffectiveRate,
+		Reason:       "Convert",
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 点差转入手续费账户
+	schedule, err := s.ReadFeeSchedule(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if spread := roundDownCents(float64(toCents(amount))*quote.Rate, toDefinition) - toAmount; spread > 0 && schedule.FeeAccount != "" {
+		conversion.SpreadAmount, conversion.FeeAccount = fromCents(spread), schedule.FeeAccount
+		if err := s.mintCurrency(ctx, schedule.FeeAccount, "Currency"+schedule.FeeAccount+"Spread"+txID, conversion.SpreadAmount, toDefinition.Code, feeReason); err != nil {
+			return nil, err
+		}
+		err = recordTransfer(ctx, TransferRecord{
+			To:           schedule.FeeAccount,
+			Amount:       conversion.SpreadAmount,
+			CurrencyCode: conversion.ToCurrency,
+			Rate:         conversion.Rate,
+			Reason:       feeReason,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 发出兑换事件，覆盖CreateCurrency发出的事件
+	conversionJSON, err := json.Marshal(conversion)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	return conversion, internalError(ctx.GetStub().SetEvent("ConvertCurrency", conversionJSON))
+}
+
+// settleInForeignCurrency from以settlementCode支付to应收的amount单位code货币：按settlementCode兑换code的报价换算，
+// 从from扣除换算后的外币（向上取整），为to创建code货币。contractID为结算所属的合同，记录在交易流水中
+func (s *SmartContract) settleInForeignCurrency(ctx contractapi.TransactionContextInterface, from string, to string, amount float32, code string, settlementCode string, reason string, contractID string) (*FXSettlement, error) {
+	settlementDefinition, err := s.ReadCurrencyDefinition(ctx, settlementCode)
+	if err != nil {
+		return nil, err
+	}
+	quote, err := s.QuoteExchangeRate(ctx, settlementCode, code)
+	if err != nil {
+		return nil, err
+	}
+	settlement := &FXSettlement{
+		Currency: settlementDefinition.Code,
+		Amount:   fromCents(roundUpCents(float64(toCents(amount))/quote.EffectiveRate, settlementDefinition)),
+		Rate:     quote.EffectiveRate,
+	}
+	if _, err := s.burnCurrency(ctx, from, settlement.Amount, settlement.Currency, reason, defaultCoinSelection); err != nil {
+		return nil, err
+	}
+	if err := s.mintCurrency(ctx, to, "Currency"+to+ctx.GetStub().GetTxID(), amount, code, reason); err != nil {
+		return nil, err
+	}
+	err = recordTransfer(ctx, TransferRecord{
+		From:         from,
+		To:           to,
+		Amount:       amount,
+		CurrencyCode: code,
+		PaidCurrency: settlement.Currency,
+		PaidAmount:   settlement.Amount,
+		Rate:         settlement.Rate,
+		Reason:       reason,
+		ContractID:   contractID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return settlement, nil
+}
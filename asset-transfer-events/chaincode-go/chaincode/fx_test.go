@@ -0,0 +1,207 @@
+package chaincode
+
+import (
+	"testing"
+)
+
+// postRate 以汇率预言机的身份发布base/quote的汇率，有效期到2000秒
+func (l *testLedger) postRate(base string, quote string, rate float64, spread float64) {
+	l.t.Helper()
+	if _, err := new(SmartContract).PostExchangeRate(l.as("oracle1", rateOracleRole), base, quote, rate, spread, "", "2000"); err != nil {
+		l.t.Fatal(err)
+	}
+}
+
+func TestRoundCents(t *testing.T) {
+	cents := &CurrencyDefinition{Code: "USD", Decimals: 2}
+	units := &CurrencyDefinition{Code: "POINTS", Decimals: 0}
+	tests := []struct {
+		name       string
+		cents      float64
+		definition *CurrencyDefinition
+		down, up   int64
+	}{
+		{"fraction of a cent", 123.4, cents, 123, 124},
+		{"whole cents", 123, cents, 123, 123},
+		{"float error below a cent", 99.9999999, cents, 100, 100},
+		{"float error above a cent", 100.0000001, cents, 100, 100},
+		{"fraction of a unit", 250, units, 200, 300},
+		{"whole units", 300, units, 300, 300},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if down := roundDownCents(test.cents, test.definition); down != test.down {
+				t.Errorf("roundDownCents(%v) = %d, want %d", test.cents, down, test.down)
+			}
+			if up := roundUpCents(test.cents, test.definition); up != test.up {
+				t.Errorf("roundUpCents(%v) = %d, want %d", test.cents, up, test.up)
+			}
+		})
+	}
+}
+
+func TestPostExchangeRateRequiresTheOracleRole(t *testing.T) {
+	for _, role := range []string{"", treasuryRole, adminRole, "Oracle"} {
+		ledger := newTestLedger(t)
+		ledger.registerCurrency("USD", 2, "")
+		if _, err := new(SmartContract).PostExchangeRate(ledger.as("mallory", role), defaultCurrencyCode, "USD", 1, 0, "", "2000"); errorCode(err) != ErrCodeForbidden {
+			t.Errorf("role %q: err = %v", role, err)
+		}
+	}
+}
+
+func TestConvertCurrencyRoundsDown(t *testing.T) {
+	tests := []struct {
+		name     string
+		to       string
+		decimals int
+		//rate为0时只发布反向汇率to/CNY = 7.8
+		rate   float64
+		spread float64
+		want   float32
+	}{
+		{"to cents", "USD", 2, 0.14, 0.01, 1.38},
+		{"to whole units", "POINTS", 0, 3.33, 0, 33},
+		{"with the inverse rate", "EUR", 2, 0, 0, 1.28},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := newTestLedger(t)
+			ledger.registerCurrency(test.to, test.decimals, "")
+			if test.rate > 0 {
+				ledger.postRate(defaultCurrencyCode, test.to, test.rate, test.spread)
+			} else {
+				ledger.postRate(test.to, defaultCurrencyCode, 7.8, 0)
+			}
+			ledger.deposit("alice", 10, defaultCurrencyCode)
+
+			conversion, err := new(SmartContract).ConvertCurrency(ledger.as("alice", ""), "alice", 10, "", test.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conversion.ToAmount != test.want {
+				t.Errorf("converted to %v %s, want %v", conversion.ToAmount, test.to, test.want)
+			}
+			if balance := ledger.balance("alice", test.to); balance != test.want {
+				t.Errorf("%s balance = %v, want %v", test.to, balance, test.want)
+			}
+			if balance := ledger.balance("alice", defaultCurrencyCode); balance != 0 {
+				t.Errorf("%s balance = %v, want 0", defaultCurrencyCode, balance)
+			}
+		})
+	}
+}
+
+func TestForeignSettlementRoundsUp(t *testing.T) {
+	ledger := newTestLedger(t)
+	ledger.registerCurrency("USD", 2, "")
+	ledger.postRate(defaultCurrencyCode, "USD", 0.14, 0)
+	ledger.deposit("alice", 10, "USD")
+
+	// 1.01 CNY按USD/CNY = 1/0.14换算为0.1414 USD，向上取整为0.15 USD
+	settlement, err := new(SmartContract).settleInForeignCurrency(ledger.as("alice", ""), "alice", "bob", 1.01, defaultCurrencyCode, "USD", "Loan", "Loan1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settlement.Currency != "USD" || settlement.Amount != 0.15 {
+		t.Errorf("settlement = %+v", settlement)
+	}
+	if balance := ledger.balance("alice", "USD"); balance != 9.85 {
+		t.Errorf("alice USD balance = %v, want 9.85", balance)
+	}
+	if balance := ledger.balance("bob", defaultCurrencyCode); balance != 1.01 {
+		t.Errorf("bob CNY balance = %v, want 1.01", balance)
+	}
+}
+
+func TestConvertCurrencyIsRestrictedToTheOwner(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller string
+		role   string
+		want   string
+	}{
+		{"owner", "alice", "", ""},
+		{"admin", "operator", adminRole, ""},
+		{"another user", "mallory", "", ErrCodeForbidden},
+		{"another user with the oracle role", "mallory", rateOracleRole, ErrCodeForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := newTestLedger(t)
+			ledger.registerCurrency("USD", 2, "")
+			ledger.postRate(defaultCurrencyCode, "USD", 0.14, 0)
+			ledger.deposit("alice", 10, defaultCurrencyCode)
+
+			if _, err := new(SmartContract).ConvertCurrency(ledger.as(test.caller, test.role), "alice", 10, "", "USD"); errorCode(err) != test.want {
+				t.Fatalf("err = %v, want %s", err, test.want)
+			}
+			want := float32(0)
+			if test.want != "" {
+				want = 10
+			}
+			if balance := ledger.balance("alice", defaultCurrencyCode); balance != want {
+				t.Errorf("alice balance = %v, want %v", balance, want)
+			}
+		})
+	}
+}
+
+func TestConversionSpreadGoesToTheFeeAccount(t *testing.T) {
+	ledger := newTestLedger(t)
+	ledger.registerCurrency("USD", 2, "")
+	ledger.postRate(defaultCurrencyCode, "USD", 0.14, 0.01)
+	ledger.setFees(map[string]FeeRule{"Transfer": {Type: feeTypeFlat, Amount: 1}})
+	ledger.deposit("alice", 20, defaultCurrencyCode)
+
+	// 同一秒内兑换两次：10 CNY按中间价为1.40 USD，alice得到1.38 USD，点差0.02 USD转入platform
+	for i := 0; i < 2; i++ {
+		conversion, err := new(SmartContract).ConvertCurrency(ledger.as("alice", ""), "alice", 10, "", "USD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conversion.ToAmount != 1.38 || conversion.SpreadAmount != 0.02 || conversion.FeeAccount != "platform" {
+			t.Errorf("conversion = %+v", conversion)
+		}
+	}
+	if balance := ledger.balance("alice", "USD"); balance != 2.76 {
+		t.Errorf("alice USD balance = %v, want 2.76", balance)
+	}
+	if balance := ledger.balance("platform", "USD"); balance != 0.04 {
+		t.Errorf("platform USD balance = %v, want 0.04", balance)
+	}
+	if records := ledger.history("platform", "USD"); len(records) != 2 || records[0].Delta != 0.02 || records[0].Reason != feeReason {
+		t.Errorf("platform records = %+v", records)
+	}
+}
+
+func TestConversionSpreadWithoutAFeeAccount(t *testing.T) {
+	ledger := newTestLedger(t)
+	ledger.registerCurrency("USD", 2, "")
+	ledger.postRate(defaultCurrencyCode, "USD", 0.14, 0.01)
+	ledger.deposit("alice", 10, defaultCurrencyCode)
+
+	conversion, err := new(SmartContract).ConvertCurrency(ledger.as("alice", ""), "alice", 10, "", "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conversion.ToAmount != 1.38 || conversion.SpreadAmount != 0 || conversion.FeeAccount != "" {
+		t.Errorf("conversion = %+v", conversion)
+	}
+}
+
+func TestForeignSettlementsInTheSameSecondDoNotCollide(t *testing.T) {
+	ledger := newTestLedger(t)
+	ledger.registerCurrency("USD", 2, "")
+	ledger.postRate(defaultCurrencyCode, "USD", 0.14, 0)
+	ledger.deposit("alice", 10, "USD")
+
+	for i := 0; i < 2; i++ {
+		if _, err := new(SmartContract).settleInForeignCurrency(ledger.as("alice", ""), "alice", "bob", 1, defaultCurrencyCode, "USD", "Loan", "Loan1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if balance := ledger.balance("bob", defaultCurrencyCode); balance != 2 {
+		t.Errorf("bob CNY balance = %v, want 2", balance)
+	}
+}
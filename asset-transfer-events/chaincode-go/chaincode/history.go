@@ -0,0 +1,172 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+/* 交易流水全流程
+ * 货币被花费时UTXO会被删除，因此每笔资金变动另外写入一条不可变的交易流水（TransferRecord），按参与方和币种分别保存：
+ *   ("TransferRecord", owner, currencyCode, 倒序时间戳, txID, 序号) 该交易中owner在该币种上的一笔资金变动
+ * 序号是该笔流水在交易中的写入顺序，由交易上下文TransactionContext计数，同一交易中同一参与方和币种的多笔资金变动各有一条流水。
+ * 转出方、转入方和手续费账户各有一条流水，内容相同，Owner和Delta（该参与方在该币种上的余额变动）不同。
+ * 兑换和外币还款中支付方支付的币种与收款方收到的币种不同，支付方在两个币种上各有一条流水。
+ * 写入流水的资金变动：存入（CreateCurrency，Deposit、System）、转账（TransferCurrency及合同的放款、还款、保费、赔付）、兑换和外币还款。
+ * 找零、零钱合并和迁移为账户余额不改变余额，不写流水。
+ * ReadTransactionHistory 分页查询某个用户某一币种的流水，按时间从新到旧排列
+ * 注意：分页查询只能在查询（evaluate）中调用；流水只从该功能上线后开始记录，之前的余额没有对应的流水。
+ */
+
+const (
+	transferRecordObjectType = "TransferRecord"
+	//流水分页查询的最大页大小
+	maxHistoryPageSize = 100
+	//倒序时间戳的位数，使复合键按时间从新到旧排序
+	historyTimestampDigits = 19
+	//流水序号的位数，使同一交易的流水按写入顺序排序
+	historySequenceDigits = 4
+)
+
+// TransactionContext 链码的交易上下文，每笔交易一个，记录本交易已写入的流水数量。
+// peer在交易内读不到本交易的写入，因此序号只能在内存中计数
+type TransactionContext struct {
+	contractapi.TransactionContext
+	historySequence int
+}
+
+// nextHistorySequence 返回本交易下一条流水的序号
+func (c *TransactionContext) nextHistorySequence() string {
+	c.historySequence++
+	return fmt.Sprintf("%0*d", historySequenceDigits, c.historySequence)
+}
+
+// historySequencer 为本交易的流水编号的交易上下文
+type historySequencer interface {
+	nextHistorySequence() string
+}
+
+// TransferRecord 一笔资金变动的流水。From为空表示存入；PaidCurrency和PaidAmount为支付方实际支付的币种和金额，
+// 与CurrencyCode不同时按Rate（扣除点差后1单位支付币种兑换的收款币种）换算
+type TransferRecord struct {
+	TxID         string  `json:"TxID"`
+	From         string  `json:"From"`
+	To           string  `json:"To"`
+	Amount       float32 `json:"Amount"`
+	CurrencyCode string  `json:"CurrencyCode"`
+	PaidCurrency string  `json:"PaidCurrency"`
+	PaidAmount   float32 `json:"PaidAmount"`
+	Rate         float64 `json:"Rate"`
+	Fee          float32 `json:"Fee"`
+	FeeAccount   string  `json:"FeeAccount"`
+	Reason       string  `json:"Reason"`
+	ContractID   string  `json:"ContractID"`
+	Timestamp    string  `json:"Timestamp"`
+	//该流水所属的参与方、币种和该参与方在该币种上的余额变动
+	Owner         string  `json:"Owner"`
+	OwnerCurrency string  `json:"OwnerCurrency"`
+	Delta         float32 `json:"Delta"`
+}
+
+// TransferHistory 一页流水，Bookmark为下一页的书签，为空时没有更多流水
+type TransferHistory struct {
+	Records  []*TransferRecord `json:"Records"`
+	Bookmark string            `json:"Bookmark"`
+}
+
+// historyTimestamp 返回倒序的时间戳，较新的流水排在前面
+func historyTimestamp(seconds int64) string {
+	return fmt.Sprintf("%0*d", historyTimestampDigits, math.MaxInt64-seconds)
+}
+
+// recordTransfer 为资金变动的每个参与方和币种写入一条流水。record中未设置PaidCurrency时，支付方以CurrencyCode支付Amount；
+// 存入没有支付方，PaidCurrency为空
+func recordTransfer(ctx contractapi.TransactionContextInterface, record TransferRecord) error {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return internalError(err)
+	}
+	sequencer, ok := ctx.(historySequencer)
+	if !ok {
+		return internalError(fmt.Errorf("transfer records need the chaincode transaction context, got %T", ctx))
+	}
+	record.TxID = ctx.GetStub().GetTxID()
+	record.Timestamp = fmt.Sprintf("%d", timestamp.GetSeconds())
+	record.CurrencyCode = currencyCodeOf(record.CurrencyCode)
+	if record.PaidCurrency == "" && record.From != "" {
+		record.PaidCurrency, record.PaidAmount = record.CurrencyCode, record.Amount
+	}
+
+	// 按参与方和币种汇总余额变动，同一参与方在同一币种上只写一条流水
+	type entryKey struct{ owner, code string }
+	var order []entryKey
+	deltas := map[entryKey]int64{}
+	add := func(owner string, code string, cents int64) {
+		key := entryKey{owner, code}
+		if _, found := deltas[key]; !found {
+			order = append(order, key)
+		}
+		deltas[key] += cents
+	}
+	if record.From != "" {
+		add(record.From, record.PaidCurrency, -toCents(record.PaidAmount))
+	}
+	add(record.To, record.CurrencyCode, toCents(record.Amount))
+	if record.Fee > 0 {
+		add(record.From, record.CurrencyCode, -toCents(record.Fee))
+		add(record.FeeAccount, record.CurrencyCode, toCents(record.Fee))
+	}
+
+	for _, key := range order {
+		entry := record
+		entry.Owner, entry.OwnerCurrency, entry.Delta = key.owner, key.code, fromCents(deltas[key])
+		compositeKey, err := ctx.GetStub().CreateCompositeKey(transferRecordObjectType,
+			[]string{key.owner, key.code, historyTimestamp(timestamp.GetSeconds()), record.TxID, sequencer.nextHistorySequence()})
+		if err != nil {
+			return internalError(err)
+		}
+		entryJSON, err := json.Marshal(entry)
+		if err != nil {
+			return internalError(err)
+		}
+		if err := ctx.GetStub().PutState(compositeKey, entryJSON); err != nil {
+			return internalError(err)
+		}
+	}
+	return nil
+}
+
+// ReadTransactionHistory 分页查询owner在currencyCode币种（为空时为默认币种）上的流水，按时间从新到旧排列。
+// pageSize为每页数量（1到100），bookmark为上一页返回的书签，第一页为空
+func (s *SmartContract) ReadTransactionHistory(ctx contractapi.TransactionContextInterface, owner string, currencyCode string, pageSize int32, bookmark string) (*TransferHistory, error) {
+	if pageSize <= 0 || pageSize > maxHistoryPageSize {
+		return nil, newError(ErrCodeInvalidArgument, fmt.Sprintf("page size must be between 1 and %d", maxHistoryPageSize),
+			"pageSize", fmt.Sprintf("%d", pageSize))
+	}
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(transferRecordObjectType,
+		[]string{owner, currencyCodeOf(currencyCode)}, pageSize, bookmark)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	defer resultsIterator.Close()
+
+	history := &TransferHistory{Records: []*TransferRecord{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, internalError(err)
+		}
+		var record TransferRecord
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			return nil, internalError(err)
+		}
+		history.Records = append(history.Records, &record)
+	}
+	// 不足一页时没有更多流水
+	if len(history.Records) == int(pageSize) {
+		history.Bookmark = metadata.GetBookmark()
+	}
+	return history, nil
+}
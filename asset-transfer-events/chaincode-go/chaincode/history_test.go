@@ -0,0 +1,129 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+// history 返回owner在code币种上的全部流水，按时间从新到旧排列
+func (l *testLedger) history(owner string, code string) []*TransferRecord {
+	l.t.Helper()
+	history, err := new(SmartContract).ReadTransactionHistory(l.as(owner, ""), owner, code, maxHistoryPageSize, "")
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return history.Records
+}
+
+func TestChaincodeUsesTheTransactionContext(t *testing.T) {
+	if _, err := contractapi.NewChaincode(NewSmartContract()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadTransactionHistoryPages(t *testing.T) {
+	ledger := newTestLedger(t)
+	for amount := float32(1); amount <= 5; amount++ {
+		ledger.deposit("alice", amount, defaultCurrencyCode)
+		ledger.seconds++
+	}
+
+	tests := []struct {
+		name     string
+		pageSize int32
+		want     [][]float32
+	}{
+		{"pages", 2, [][]float32{{5, 4}, {3, 2}, {1}}},
+		{"pages filled exactly", 5, [][]float32{{5, 4, 3, 2, 1}}},
+		{"one page", 100, [][]float32{{5, 4, 3, 2, 1}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var pages [][]float32
+			bookmark := ""
+			for {
+				history, err := new(SmartContract).ReadTransactionHistory(ledger.as("alice", ""), "alice", "", test.pageSize, bookmark)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var page []float32
+				for _, record := range history.Records {
+					page = append(page, record.Delta)
+				}
+				pages = append(pages, page)
+				if bookmark = history.Bookmark; bookmark == "" || len(pages) > 5 {
+					break
+				}
+			}
+			if !reflect.DeepEqual(pages, test.want) {
+				t.Errorf("pages = %v, want %v", pages, test.want)
+			}
+		})
+	}
+
+	for _, pageSize := range []int32{0, -1, maxHistoryPageSize + 1} {
+		if _, err := new(SmartContract).ReadTransactionHistory(ledger.as("alice", ""), "alice", "", pageSize, ""); errorCode(err) != ErrCodeInvalidArgument {
+			t.Errorf("page size %d: err = %v", pageSize, err)
+		}
+	}
+}
+
+func TestTransferRecordsOfOneTransactionDoNotCollide(t *testing.T) {
+	ledger := newTestLedger(t)
+	ctx := ledger.as("alice", "")
+	for _, amount := range []float32{10, 20} {
+		if err := recordTransfer(ctx, TransferRecord{From: "alice", To: "bob", Amount: amount, Reason: "Loan", ContractID: "Loan1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for owner, want := range map[string][]float32{"alice": {-10, -20}, "bob": {10, 20}} {
+		records := ledger.history(owner, defaultCurrencyCode)
+		var deltas []float32
+		for _, record := range records {
+			deltas = append(deltas, record.Delta)
+			if record.TxID != ctx.GetStub().GetTxID() {
+				t.Errorf("%s record of transaction %s", owner, record.TxID)
+			}
+		}
+		if !reflect.DeepEqual(deltas, want) {
+			t.Errorf("%s deltas = %v, want %v", owner, deltas, want)
+		}
+	}
+}
+
+func TestDepositsAreRecordedByCreateCurrency(t *testing.T) {
+	ledger := newTestLedger(t)
+	contract := new(SmartContract)
+	for _, createdVia := range []string{"Deposit", ""} {
+		ctx := ledger.as("alice", "")
+		currencyBytes, _ := json.Marshal(Currency{CurrencyID: "Currency" + ctx.GetStub().GetTxID(), Amount: 10, Owner: "alice", CreatedVia: createdVia})
+		if err := contract.CreateCurrency(ctx, currencyBytes); err != nil {
+			t.Fatal(err)
+		}
+		ledger.seconds++
+	}
+	// 链码内部创建的货币即使来源为Deposit也不写存入流水
+	if err := contract.mintCurrency(ledger.as("alice", ""), "alice", "CurrencyMinted", 5, defaultCurrencyCode, "Deposit"); err != nil {
+		t.Fatal(err)
+	}
+	ledger.seconds++
+	// 转账只写一条流水，找零不写流水
+	if err := contract.TransferCurrency(ledger.as("alice", ""), "alice", "bob", 12, "Transfer"); err != nil {
+		t.Fatal(err)
+	}
+
+	var reasons []string
+	for _, record := range ledger.history("alice", defaultCurrencyCode) {
+		reasons = append(reasons, record.Reason)
+	}
+	if want := []string{"Transfer", "System", "Deposit"}; !reflect.DeepEqual(reasons, want) {
+		t.Errorf("reasons = %v, want %v", reasons, want)
+	}
+	if records := ledger.history("bob", defaultCurrencyCode); len(records) != 1 || records[0].Delta != 12 || records[0].From != "alice" {
+		t.Errorf("bob records = %+v", records)
+	}
+}
@@ -0,0 +1,200 @@
+package chaincode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+/* 幂等键全流程
+ * 客户端超时后重试转账等交易，可能导致同一笔业务被执行两次（例如重复扣款）。
+ * 因此网关把客户端请求头中的Idempotency-Key放入交易的transient数据中，由链码保证同一个调用者的同一个幂等键只执行一次：
+ * checkIdempotency 交易执行前（BeforeTransaction），如果该幂等键已有未过期的记录，则拒绝执行，
+ *                  返回IDEMPOTENT_REPLAY错误，其中带有首次执行的交易ID和结果，网关据此返回首次执行的结果；
+ *                  幂等键已用于其他函数或其他参数时返回ALREADY_EXISTS，不返回与本次请求无关的结果
+ * recordIdempotency 交易执行成功后（AfterTransaction），保存幂等键、交易ID和执行结果，保留期由网关配置
+ * PurgeIdempotencyKeys 删除已过期的幂等键记录，返回删除的数量
+ * 注意：首次交易尚未提交时的重试仍会被执行，但两笔交易写入同一个幂等键，后提交的一笔会因MVCC读冲突而失效。
+ */
+
+const (
+	idempotencyObjectType = "Idempotency"
+	//transient数据中的幂等键及其保留秒数
+	idempotencyKeyField       = "idempotency_key"
+	idempotencyRetentionField = "idempotency_retention"
+	//网关未指定保留期时，幂等键保留一天
+	defaultIdempotencyRetention = secondsPerDay
+	maxIdempotencyKeyLength     = 255
+)
+
+// IdempotencyRecord 幂等键记录，Result为首次执行结果的JSON，ArgumentsHash为首次执行参数的SHA-256
+type IdempotencyRecord struct {
+	Key           string          `json:"Key"`
+	Function      string          `json:"Function"`
+	ArgumentsHash string          `json:"ArgumentsHash"`
+	TransactionID string          `json:"TransactionID"`
+	Result        json.RawMessage `json:"Result"`
+	CreatedAt     string          `json:"CreatedAt"`
+	ExpiresAt     string          `json:"ExpiresAt"`
+}
+
+// NewSmartContract 创建链码合约，并注册幂等键检查
+func NewSmartContract() *SmartContract {
+	contract := &SmartContract{}
+	contract.TransactionContextHandler = new(TransactionContext)
+	contract.BeforeTransaction = contract.checkIdempotency
+	contract.AfterTransaction = contract.recordIdempotency
+	return contract
+}
+
+// idempotencyKey 读取交易transient数据中的幂等键，没有幂等键时返回空字符串
+func idempotencyKey(ctx contractapi.TransactionContextInterface) (string, error) {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return "", internalError(err)
+	}
+	key := string(transient[idempotencyKeyField])
+	if key == "" {
+		return "", nil
+	}
+	if len(key) > maxIdempotencyKeyLength || strings.IndexFunc(key, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+		return "", newError(ErrCodeInvalidArgument, fmt.Sprintf("idempotency key must be at most %d printable characters", maxIdempotencyKeyLength))
+	}
+	return key, nil
+}
+
+// idempotencyCompositeKey 幂等键按调用者区分，不同用户使用相同的幂等键互不影响
+func idempotencyCompositeKey(ctx contractapi.TransactionContextInterface, key string) (string, error) {
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", internalError(err)
+	}
+	return ctx.GetStub().CreateCompositeKey(idempotencyObjectType, []string{clientID, key})
+}
+
+// argumentsHash 返回交易参数的SHA-256
+func argumentsHash(args []string) string {
+	argsJSON, _ := json.Marshal(args)
+	hash := sha256.Sum256(argsJSON)
+	return hex.EncodeToString(hash[:])
+}
+
+// checkIdempotency 交易执行前检查幂等键，已使用且未过期的幂等键返回IDEMPOTENT_REPLAY错误
+func (s *SmartContract) checkIdempotency(ctx contractapi.TransactionContextInterface) error {
+	key, err := idempotencyKey(ctx)
+	if err != nil || key == "" {
+		return err
+	}
+	compositeKey, err := idempotencyCompositeKey(ctx, key)
+	if err != nil {
+		return internalError(err)
+	}
+	recordJSON, err := ctx.GetStub().GetState(compositeKey)
+	if err != nil {
+		return internalError(err)
+	}
+	if recordJSON == nil {
+		return nil
+	}
+	var record IdempotencyRecord
+	if err := json.Unmarshal(recordJSON, &record); err != nil {
+		return internalError(err)
+	}
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return internalError(err)
+	}
+	//已过期的幂等键可以重新使用
+	expiresAt, _ := strconv.ParseInt(record.ExpiresAt, 10, 64)
+	if timestamp.GetSeconds() >= expiresAt {
+		return nil
+	}
+	//旧记录没有参数的哈希，只比较函数
+	function, args := ctx.GetStub().GetFunctionAndParameters()
+	if function != record.Function || (record.ArgumentsHash != "" && argumentsHash(args) != record.ArgumentsHash) {
+		return newError(ErrCodeAlreadyExists, fmt.Sprintf("idempotency key %s was already used for another %s request", key, record.Function),
+			"idempotencyKey", key, "function", record.Function, "transactionId", record.TransactionID)
+	}
+	return newError(ErrCodeIdempotentReplay, fmt.Sprintf("idempotency key %s was already used by transaction %s", key, record.TransactionID),
+		"idempotencyKey", key, "function", record.Function, "transactionId", record.TransactionID,
+		"result", string(record.Result), "createdAt", record.CreatedAt)
+}
+
+// recordIdempotency 交易执行成功后保存幂等键记录，result为链码函数的返回值
+func (s *SmartContract) recordIdempotency(ctx contractapi.TransactionContextInterface, result interface{}) error {
+	key, err := idempotencyKey(ctx)
+	if err != nil || key == "" {
+		return err
+	}
+	compositeKey, err := idempotencyCompositeKey(ctx, key)
+	if err != nil {
+		return internalError(err)
+	}
+	transient, _ := ctx.GetStub().GetTransient()
+	retention, err := strconv.ParseInt(string(transient[idempotencyRetentionField]), 10, 64)
+	if err != nil || retention <= 0 {
+		retention = defaultIdempotencyRetention
+	}
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return internalError(err)
+	}
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return internalError(err)
+	}
+	function, args := ctx.GetStub().GetFunctionAndParameters()
+	recordJSON, err := json.Marshal(IdempotencyRecord{
+		Key:           key,
+		Function:      function,
+		ArgumentsHash: argumentsHash(args),
+		TransactionID: ctx.GetStub().GetTxID(),
+		Result:        resultJSON,
+		CreatedAt:     fmt.Sprintf("%d", timestamp.GetSeconds()),
+		ExpiresAt:     fmt.Sprintf("%d", timestamp.GetSeconds()+retention),
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	return internalError(ctx.GetStub().PutState(compositeKey, recordJSON))
+}
+
+// PurgeIdempotencyKeys 删除所有已过期的幂等键记录，返回删除的数量
+func (s *SmartContract) PurgeIdempotencyKeys(ctx contractapi.TransactionContextInterface) (int, error) {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return 0, internalError(err)
+	}
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(idempotencyObjectType, []string{})
+	if err != nil {
+		return 0, internalError(err)
+	}
+	defer resultsIterator.Close()
+
+	var count int
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, internalError(err)
+		}
+		var record IdempotencyRecord
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			return 0, internalError(err)
+		}
+		expiresAt, _ := strconv.ParseInt(record.ExpiresAt, 10, 64)
+		if timestamp.GetSeconds() < expiresAt {
+			continue
+		}
+		if err := ctx.GetStub().DelState(queryResponse.Key); err != nil {
+			return 0, internalError(err)
+		}
+		count++
+	}
+	return count, nil
+}
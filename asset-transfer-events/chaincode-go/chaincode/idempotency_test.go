@@ -0,0 +1,114 @@
+package chaincode
+
+import (
+	"strconv"
+	"testing"
+)
+
+// idempotentCall 一次带幂等键的链码调用
+type idempotentCall struct {
+	user     string
+	key      string
+	function string
+	args     []string
+}
+
+// run 以call的调用者、幂等键和参数执行一笔交易：执行前检查幂等键，检查通过时把result作为执行结果保存，
+// 幂等键保留retention秒
+func (l *testLedger) run(call idempotentCall, retention int, result any) error {
+	l.t.Helper()
+	ctx := l.as(call.user, "")
+	stub := ctx.GetStub().(*memStub)
+	stub.function, stub.args = call.function, call.args
+	stub.transient = map[string][]byte{
+		idempotencyKeyField:       []byte(call.key),
+		idempotencyRetentionField: []byte(strconv.Itoa(retention)),
+	}
+	contract := NewSmartContract()
+	if err := contract.checkIdempotency(ctx); err != nil {
+		return err
+	}
+	if err := contract.recordIdempotency(ctx, result); err != nil {
+		l.t.Fatal(err)
+	}
+	return nil
+}
+
+func TestIdempotency(t *testing.T) {
+	first := idempotentCall{user: "alice", key: "payment-1", function: "TransferCurrency", args: []string{"alice", "bob", "10", "Transfer"}}
+	tests := []struct {
+		name    string
+		elapsed int64
+		retry   idempotentCall
+		want    string
+	}{
+		{"retry", 59, first, ErrCodeIdempotentReplay},
+		{"retry after the key expired", 60, first, ""},
+		{"key reused with other arguments", 0,
+			idempotentCall{user: "alice", key: "payment-1", function: "TransferCurrency", args: []string{"alice", "bob", "20", "Transfer"}}, ErrCodeAlreadyExists},
+		{"key reused for another function", 0,
+			idempotentCall{user: "alice", key: "payment-1", function: "ConvertCurrency", args: first.args}, ErrCodeAlreadyExists},
+		{"key of another user", 0,
+			idempotentCall{user: "bob", key: "payment-1", function: "TransferCurrency", args: first.args}, ""},
+		{"another key", 0,
+			idempotentCall{user: "alice", key: "payment-2", function: "TransferCurrency", args: first.args}, ""},
+		{"no key", 0,
+			idempotentCall{user: "alice", function: "TransferCurrency", args: first.args}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := newTestLedger(t)
+			if err := ledger.run(first, 60, map[string]string{"status": "done"}); err != nil {
+				t.Fatal(err)
+			}
+			ledger.seconds += test.elapsed
+
+			err := ledger.run(test.retry, 60, nil)
+			if errorCode(err) != test.want {
+				t.Fatalf("err = %v, want %s", err, test.want)
+			}
+			if test.want == ErrCodeIdempotentReplay {
+				details := err.(*ChaincodeError).Details
+				if details["transactionId"] != "tx001" || details["result"] != `{"status":"done"}` || details["createdAt"] != "1000" {
+					t.Errorf("details = %v", details)
+				}
+			}
+		})
+	}
+}
+
+func TestExpiredKeysAreRecordedAgain(t *testing.T) {
+	ledger := newTestLedger(t)
+	call := idempotentCall{user: "alice", key: "payment-1", function: "TransferCurrency", args: []string{"alice", "bob", "10", "Transfer"}}
+	if err := ledger.run(call, 60, "first"); err != nil {
+		t.Fatal(err)
+	}
+	ledger.seconds += 60
+	if err := ledger.run(call, 60, "second"); err != nil {
+		t.Fatal(err)
+	}
+	err := ledger.run(call, 60, nil)
+	if chaincodeError, ok := err.(*ChaincodeError); !ok || chaincodeError.Details["transactionId"] != "tx002" || chaincodeError.Details["result"] != `"second"` {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestPurgeIdempotencyKeys(t *testing.T) {
+	ledger := newTestLedger(t)
+	for _, call := range []struct {
+		key       string
+		retention int
+	}{{"short", 60}, {"long", 3600}} {
+		if err := ledger.run(idempotentCall{user: "alice", key: call.key, function: "TransferCurrency"}, call.retention, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ledger.seconds += 60
+	count, err := new(SmartContract).PurgeIdempotencyKeys(ledger.as("operator", ""))
+	if err != nil || count != 1 {
+		t.Fatalf("count = %d, err = %v", count, err)
+	}
+	if err := ledger.run(idempotentCall{user: "alice", key: "long", function: "TransferCurrency"}, 60, nil); errorCode(err) != ErrCodeIdempotentReplay {
+		t.Errorf("long key err = %v", err)
+	}
+}
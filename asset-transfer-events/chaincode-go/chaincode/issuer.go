@@ -0,0 +1,259 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
+)
+
+/* Issuer 视角全流程
+ * 原有的查询函数都是以申请人（applicant）为中心的，银行/保险公司无法查看自己发行的合同。
+ * 因此为每份合同额外写入一个以发行方（issuer）为首的索引键，用于按发行方查询。
+ * writeIssuerIndex 在创建合同时写入发行方索引
+ * IndexIssuerContracts 为索引上线之前已经存在的合同补建发行方索引，会扫描并写入所有合同，只有管理员（证书属性role为admin的用户）可以调用
+ * ReadLoanListByIssuer 通过issuer查询贷款合同列表
+ * ReadInsuranceListByIssuer 通过issuer查询保险合同列表
+ * ReadIssuerPortfolio 汇总某个发行方的资产组合：在贷本金、有效保单、已赔付金额、赔付率、违约率、预期现金流
+ */
+
+const (
+	loanIssuerIndex      = "LoanByIssuer"
+	insuranceIssuerIndex = "InsuranceByIssuer"
+	secondsPerDay        = 24 * 60 * 60
+)
+
+// CashFlow 发行方的一笔预期现金流
+// Direction 为"In"表示发行方预期收入（贷款到期还款），"Out"表示发行方可能的支出（有效保单的最大赔付）
+type CashFlow struct {
+	BusinessID   string  `json:"BusinessID"`
+	BusinessType string  `json:"BusinessType"` //"Loan","Insurance"
+	Counterparty string  `json:"Counterparty"`
+	Direction    string  `json:"Direction"` //"In","Out"
+	Amount       float32 `json:"Amount"`
+	DueAt        string  `json:"DueAt"` //到期时间戳，保险赔付时间不确定时为空
+	CurrencyCode string  `json:"CurrencyCode"`
+}
+
+// IssuerPortfolio 发行方资产组合汇总
+type IssuerPortfolio struct {
+	Issuer string `json:"Issuer"`
+	//贷款部分
+	LoanCount            int     `json:"LoanCount"`
+	ActiveLoans          int     `json:"ActiveLoans"`
+	OutstandingPrincipal float32 `json:"OutstandingPrincipal"`
+	DefaultedLoans       int     `json:"DefaultedLoans"`
+	DefaultRate          float32 `json:"DefaultRate"` //强制还款的贷款数 / 已放款的贷款数
+	//保险部分
+	InsuranceCount    int     `json:"InsuranceCount"`
+	ActivePolicies    int     `json:"ActivePolicies"`
+	PremiumsCollected float32 `json:"PremiumsCollected"`
+	ClaimsPaid        float32 `json:"ClaimsPaid"`
+	LossRatio         float32 `json:"LossRatio"` //已赔付金额 / 已收保费
+	//预期现金流
+	ExpectedCashFlows []CashFlow `json:"ExpectedCashFlows"`
+}
+
+// writeIssuerIndex 在创建合同时写入发行方索引，索引值只是一个占位符，真正的数据仍然保存在申请人复合键下
+func (s *SmartContract) writeIssuerIndex(ctx contractapi.TransactionContextInterface, indexName string, issuer string, applicant string, businessId string) error {
+	indexKey, err := ctx.GetStub().CreateCompositeKey(indexName, []string{issuer, applicant, businessId})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(indexKey, []byte{0x00})
+}
+
+// IndexIssuerContracts 为索引上线之前已经存在的合同补建发行方索引，返回补建的索引数量。只有管理员可以调用
+func (s *SmartContract) IndexIssuerContracts(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := requireRole(ctx, adminRole); err != nil {
+		return 0, err
+	}
+	var count int
+	for _, index := range []struct{ objectType, indexName string }{{"Loan", loanIssuerIndex}, {"Insurance", insuranceIssuerIndex}} {
+		resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(index.objectType, []string{})
+		if err != nil {
+			return 0, err
+		}
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return 0, err
+			}
+			//贷款和保险合同共用这几个字段
+			var contract struct {
+				BusinessID string `json:"BusinessID"`
+				Issuer     string `json:"Issuer"`
+				Applicant  string `json:"Applicant"`
+			}
+			err = json.Unmarshal(queryResponse.Value, &contract)
+			if err != nil {
+				resultsIterator.Close()
+				return 0, err
+			}
+			err = s.writeIssuerIndex(ctx, index.indexName, contract.Issuer, contract.Applicant, contract.BusinessID)
+			if err != nil {
+				resultsIterator.Close()
+				return 0, err
+			}
+			count++
+		}
+		resultsIterator.Close()
+	}
+	return count, nil
+}
+
+// readIssuerIndex 通过发行方索引读取合同原始数据
+func (s *SmartContract) readIssuerIndex(ctx contractapi.TransactionContextInterface, indexName string, objectType string, issuer string) ([][]byte, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(indexName, []string{issuer})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var contracts [][]byte
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(keyParts) != 3 {
+			return nil, newError(ErrCodeInternal, fmt.Sprintf("malformed %s key of issuer %s", indexName, issuer), "issuer", issuer)
+		}
+		compositeKey, err := ctx.GetStub().CreateCompositeKey(objectType, []string{keyParts[1], keyParts[2]})
+		if err != nil {
+			return nil, err
+		}
+		contractJSON, err := s.readState(ctx, compositeKey)
+		if err != nil {
+			return nil, err
+		}
+		contracts = append(contracts, contractJSON)
+	}
+	return contracts, nil
+}
+
+// ReadLoanListByIssuer 通过issuer查询贷款合同列表
+func (s *SmartContract) ReadLoanListByIssuer(ctx contractapi.TransactionContextInterface, issuer string) ([]*Loan, error) {
+	contracts, err := s.readIssuerIndex(ctx, loanIssuerIndex, "Loan", issuer)
+	if err != nil {
+		return nil, err
+	}
+	var loans []*Loan
+	for _, contractJSON := range contracts {
+		var loan Loan
+		err = json.Unmarshal(contractJSON, &loan)
+		if err != nil {
+			return nil, err
+		}
+		if loan.Issuer == issuer {
+			loans = append(loans, &loan)
+		}
+	}
+	return loans, nil
+}
+
+// ReadInsuranceListByIssuer 通过issuer查询保险合同列表
+func (s *SmartContract) ReadInsuranceListByIssuer(ctx contractapi.TransactionContextInterface, issuer string) ([]*Insurance, error) {
+	contracts, err := s.readIssuerIndex(ctx, insuranceIssuerIndex, "Insurance", issuer)
+	if err != nil {
+		return nil, err
+	}
+	var insuranceList []*Insurance
+	for _, contractJSON := range contracts {
+		var insurance Insurance
+		err = json.Unmarshal(contractJSON, &insurance)
+		if err != nil {
+			return nil, err
+		}
+		if insurance.Issuer == issuer {
+			insuranceList = append(insuranceList, &insurance)
+		}
+	}
+	return insuranceList, nil
+}
+
+// ReadIssuerPortfolio 汇总某个发行方的资产组合
+// 贷款：状态为"Approved"的贷款计入在贷本金；状态为"Claimed"的贷款是被强制还款的，计为违约
+// 保险：状态为"Approved"的保单为有效保单；"Approved"和"Claimed"的保单都已经收取了保费；"Claimed"的保单已经赔付
+// 金额合计（在贷本金、保费、赔付）只计入默认币种的合同，其他币种的合同只计入数量和预期现金流（现金流带有币种）
+func (s *SmartContract) ReadIssuerPortfolio(ctx contractapi.TransactionContextInterface, issuer string) (*IssuerPortfolio, error) {
+	loans, err := s.ReadLoanListByIssuer(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	insuranceList, err := s.ReadInsuranceListByIssuer(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	portfolio := IssuerPortfolio{
+		Issuer:            issuer,
+		LoanCount:         len(loans),
+		InsuranceCount:    len(insuranceList),
+		ExpectedCashFlows: []CashFlow{},
+	}
+
+	var disbursedLoans int
+	for _, loan := range loans {
+		switch loan.State {
+		case "Approved":
+			disbursedLoans++
+			portfolio.ActiveLoans++
+			if currencyCodeOf(loan.CurrencyCode) == defaultCurrencyCode {
+				portfolio.OutstandingPrincipal += loan.Amount
+			}
+			//到期时间 = 创建时间 + 贷款期限（天），与LoanContractCheck中判断逾期的方式一致
+			createdAt, _ := strconv.Atoi(loan.CreatedAt)
+			portfolio.ExpectedCashFlows = append(portfolio.ExpectedCashFlows, CashFlow{
+				BusinessID:   loan.BusinessID,
+				BusinessType: "Loan",
+				Counterparty: loan.Applicant,
+				Direction:    "In",
+				Amount:       loan.Amount * (1 + loan.Rate),
+				DueAt:        fmt.Sprintf("%d", createdAt+loan.Period*secondsPerDay),
+				CurrencyCode: currencyCodeOf(loan.CurrencyCode),
+			})
+		case "Claimed":
+			disbursedLoans++
+			portfolio.DefaultedLoans++
+		}
+	}
+	if disbursedLoans > 0 {
+		portfolio.DefaultRate = float32(portfolio.DefaultedLoans) / float32(disbursedLoans)
+	}
+
+	for _, insurance := range insuranceList {
+		inDefaultCurrency := currencyCodeOf(insurance.CurrencyCode) == defaultCurrencyCode
+		switch insurance.State {
+		case "Approved":
+			portfolio.ActivePolicies++
+			if inDefaultCurrency {
+				portfolio.PremiumsCollected += insurance.Amount
+			}
+			portfolio.ExpectedCashFlows = append(portfolio.ExpectedCashFlows, CashFlow{
+				BusinessID:   insurance.BusinessID,
+				BusinessType: "Insurance",
+				Counterparty: insurance.Applicant,
+				Direction:    "Out",
+				Amount:       insurance.Amount * (1 + insurance.Rate),
+				CurrencyCode: currencyCodeOf(insurance.CurrencyCode),
+			})
+		case "Claimed":
+			if inDefaultCurrency {
+				portfolio.PremiumsCollected += insurance.Amount
+				portfolio.ClaimsPaid += insurance.Amount * (1 + insurance.Rate)
+			}
+		}
+	}
+	if portfolio.PremiumsCollected > 0 {
+		portfolio.LossRatio = portfolio.ClaimsPaid / portfolio.PremiumsCollected
+	}
+
+	return &portfolio, nil
+}
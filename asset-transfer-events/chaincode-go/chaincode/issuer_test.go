@@ -0,0 +1,143 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// putContract 直接写入一份没有发行方索引的合同，即索引上线之前的合同
+func (l *testLedger) putContract(objectType string, applicant string, businessID string, contract any) {
+	l.t.Helper()
+	compositeKey, _ := (&memStub{}).CreateCompositeKey(objectType, []string{applicant, businessID})
+	contractJSON, err := json.Marshal(contract)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	l.state[compositeKey] = contractJSON
+}
+
+// putIssuerContracts 写入bank发行的贷款和保险合同，以及另一个发行方的一份贷款
+func putIssuerContracts(ledger *testLedger) {
+	for _, loan := range []Loan{
+		{BusinessID: "Loan1", Amount: 1000, Issuer: "bank", State: "Approved", Period: 30, Rate: 0.25, Applicant: "alice", CreatedAt: "1000"},
+		{BusinessID: "Loan2", Amount: 500, Issuer: "bank", State: "Claimed", Rate: 0.25, Applicant: "bob", CreatedAt: "1000"},
+		{BusinessID: "Loan3", Amount: 200, Issuer: "bank", State: "Applied", Applicant: "alice", CreatedAt: "1000"},
+		{BusinessID: "Loan4", Amount: 300, Issuer: "bank", State: "Approved", Period: 1, Rate: 0.5, Applicant: "carol", CreatedAt: "2000", CurrencyCode: "USD"},
+		{BusinessID: "Loan5", Amount: 700, Issuer: "lender", State: "Approved", Applicant: "alice", CreatedAt: "1000"},
+	} {
+		ledger.putContract("Loan", loan.Applicant, loan.BusinessID, loan)
+	}
+	for _, insurance := range []Insurance{
+		{BusinessID: "Insurance1", Amount: 100, Issuer: "bank", State: "Approved", Rate: 2, Applicant: "alice"},
+		{BusinessID: "Insurance2", Amount: 50, Issuer: "bank", State: "Claimed", Rate: 3, Applicant: "bob"},
+	} {
+		ledger.putContract("Insurance", insurance.Applicant, insurance.BusinessID, insurance)
+	}
+}
+
+func TestIndexIssuerContracts(t *testing.T) {
+	tests := []struct {
+		name      string
+		role      string
+		wantCount int
+		want      string
+	}{
+		{"admin", adminRole, 7, ""},
+		{"without a role", "", 0, ErrCodeForbidden},
+		{"treasury", treasuryRole, 0, ErrCodeForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := newTestLedger(t)
+			putIssuerContracts(ledger)
+
+			count, err := new(SmartContract).IndexIssuerContracts(ledger.as("operator", test.role))
+			if errorCode(err) != test.want || count != test.wantCount {
+				t.Fatalf("count = %d, err = %v, want %d and %s", count, err, test.wantCount, test.want)
+			}
+			indexed := 0
+			for key := range ledger.state {
+				if strings.HasPrefix(key, "\x00"+loanIssuerIndex+"\x00") || strings.HasPrefix(key, "\x00"+insuranceIssuerIndex+"\x00") {
+					indexed++
+				}
+			}
+			if indexed != test.wantCount {
+				t.Errorf("%d index keys, want %d", indexed, test.wantCount)
+			}
+		})
+	}
+}
+
+func TestNewContractsAreIndexedByIssuer(t *testing.T) {
+	ledger := newTestLedger(t)
+	contract := new(SmartContract)
+	if err := contract.CreateLoan(ledger.as("alice", ""), "alice", "Loan1", 100, "bank", 0.1, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := contract.CreateInsurance(ledger.as("alice", ""), "alice", "Insurance1", 10, "insurer", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	loans, err := contract.ReadLoanListByIssuer(ledger.as("bank", ""), "bank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loans) != 1 || loans[0].BusinessID != "Loan1" || loans[0].Applicant != "alice" {
+		t.Errorf("loans = %+v", loans)
+	}
+	insuranceList, err := contract.ReadInsuranceListByIssuer(ledger.as("insurer", ""), "insurer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insuranceList) != 1 || insuranceList[0].BusinessID != "Insurance1" {
+		t.Errorf("insurance = %+v", insuranceList)
+	}
+	if loans, _ := contract.ReadLoanListByIssuer(ledger.as("insurer", ""), "insurer"); len(loans) != 0 {
+		t.Errorf("loans of insurer = %+v", loans)
+	}
+}
+
+func TestReadIssuerPortfolio(t *testing.T) {
+	ledger := newTestLedger(t)
+	putIssuerContracts(ledger)
+	contract := new(SmartContract)
+	if _, err := contract.IndexIssuerContracts(ledger.as("operator", adminRole)); err != nil {
+		t.Fatal(err)
+	}
+
+	portfolio, err := contract.ReadIssuerPortfolio(ledger.as("bank", ""), "bank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &IssuerPortfolio{
+		Issuer:               "bank",
+		LoanCount:            4,
+		ActiveLoans:          2,
+		OutstandingPrincipal: 1000,
+		DefaultedLoans:       1,
+		DefaultRate:          float32(1) / 3,
+		InsuranceCount:       2,
+		ActivePolicies:       1,
+		PremiumsCollected:    150,
+		ClaimsPaid:           200,
+		LossRatio:            float32(200) / 150,
+		ExpectedCashFlows: []CashFlow{
+			{BusinessID: "Loan1", BusinessType: "Loan", Counterparty: "alice", Direction: "In", Amount: 1250, DueAt: "2593000", CurrencyCode: defaultCurrencyCode},
+			{BusinessID: "Loan4", BusinessType: "Loan", Counterparty: "carol", Direction: "In", Amount: 450, DueAt: "88400", CurrencyCode: "USD"},
+			{BusinessID: "Insurance1", BusinessType: "Insurance", Counterparty: "alice", Direction: "Out", Amount: 300, CurrencyCode: defaultCurrencyCode},
+		},
+	}
+	if !reflect.DeepEqual(portfolio, want) {
+		t.Errorf("portfolio = %+v, want %+v", portfolio, want)
+	}
+
+	empty, err := contract.ReadIssuerPortfolio(ledger.as("nobody", ""), "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.LoanCount != 0 || empty.DefaultRate != 0 || empty.LossRatio != 0 || len(empty.ExpectedCashFlows) != 0 {
+		t.Errorf("empty portfolio = %+v", empty)
+	}
+}
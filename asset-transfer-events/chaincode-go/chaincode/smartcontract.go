@@ -3,7 +3,6 @@ package chaincode
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"strconv"
 
 	"github.com/hyperledger/fabric-contract-api-go/v2/contractapi"
@@ -31,16 +30,33 @@ type SmartContract struct {
 //    ReadTotalCurrencyByOwner 查询某个用户的当前总余额
 //    ReadLoanListByOwner 通过owner查询贷款合同列表
 //    ReadInsuranceListByOwner 通过owner查询保险合同列表
+//    ReadLoanListByIssuer/ReadInsuranceListByIssuer 通过issuer查询合同列表，ReadIssuerPortfolio 查询发行方的资产组合汇总（见issuer.go）
 // 7.支付行为调用链码全流程：
 //    TransferCurrency 货币结构体的转移函数，使用UTXO方式。该函数体现了货币的使用方式，即转账。（注意，不再使用合同方式操作了）
+//    TransferCurrencyWithCoinSelection 按指定的选币策略转账，ConsolidateCurrency 合并小额货币（见coinselection.go）
+// 8.错误返回：
+//    链码函数返回的错误统一为带错误码的ChaincodeError（见errors.go），网关据此返回对应的HTTP状态码。
+// 9.幂等执行：
+//    交易的transient数据中带有幂等键时，同一调用者的同一幂等键只执行一次，重试返回首次执行的结果（见idempotency.go）。
+// 10.账户余额模式：
+//    高频用户可以用MigrateCurrencyToAccount把UTXO货币迁移为账户余额，之后余额以增量方式更新，对外接口不变（见account.go）。
+// 11.多币种：
+//    货币和合同带有币种代码，币种登记在币种注册表中；转账和合同结算只使用同一币种的货币，不混用不同币种（见currencies.go）。
+// 12.货币兑换：
+//    汇率由汇率预言机发布在账本上，ConvertCurrency按汇率和点差兑换货币，贷款可以用外币还款（见fx.go）。
+// 13.手续费：
+//    转账按转账原因和账本上的费率表收取手续费，由转出方另外支付，在同一交易中转入手续费账户（见fees.go）。
+// 14.交易流水：
+//    每笔资金变动为每个参与方写入一条不可变的流水，ReadTransactionHistory分页查询（见history.go）。
 
 /* Currency 全流程
  * 货币结构体，作为交易其他资产的基础，可以被转让，用来作为系统中用户的账户余额
  * CreateCurrency 货币结构体的创建函数，用于创建系统货币/用户存入货币。
  * ReadCurrency 根据id读取货币
  * ReadCurrencyListByOwner 通过owner查询货币列表，是一个辅助函数
- * ReadTotalCurrencyByOwner 查询某个用户（owner）的当前总余额
+ * ReadTotalCurrencyByOwner 查询某个用户（owner）的当前总余额（默认币种）
  * TransferCurrency 货币结构体的转移函数，使用UTXO方式。该函数体现了货币的使用方式，即转账。
+ * TransferCurrencyInCurrency 按币种转账，只使用该币种的货币
  */
 
 // Currency 系统货币结构体，作为交易其他资产的基础，可以被转让，用来作为系统中用户的账户余额
@@ -49,30 +65,97 @@ type Currency struct {
 	Amount     float32 `json:"Amount"`     //限制货币的最小单位为0.01
 	Owner      string  `json:"Owner"`      //user_id
 	CreatedAt  string  `json:"CreatedAt"`
-	CreatedVia string  `json:"CreatedVia"` //"Loan","Insurance","Transfer","Deposit","System"
+	CreatedVia string  `json:"CreatedVia"` //"Loan","Insurance","Transfer","Deposit","System","Fee"
 	UpdatedAt  string  `json:"UpdatedAt"`
 	UpdatedVia string  `json:"UpdatedVia"` //"Loan","Insurance","Transfer"
+	//币种代码，为空的旧数据视为默认币种（见currencies.go）
+	CurrencyCode string `json:"CurrencyCode"`
 }
 
-// CreateCurrency 货币结构体的创建函数，用于创建系统货币/用户存入货币。
-// currencyBytes 参数是一个json格式的货币结构体(需要先转换为[]byte)
+// CreateCurrency 货币结构体的创建函数，用于用户存入货币。
+// currencyBytes 参数是一个json格式的货币结构体(需要先转换为[]byte)，CreatedVia只能为"Deposit"或"System"（为空时视为"System"）。
+// 只有货币的所有者本人或管理员可以存入；金额须符合币种的小数位数，有发行机构的币种只能由发行机构存入。
+// 转账、找零、合并等链码内部创建的货币使用createCurrency，不经过这些检查
 func (s *SmartContract) CreateCurrency(ctx contractapi.TransactionContextInterface, currencyBytes []byte) error {
 	var currency Currency
 	err := json.Unmarshal(currencyBytes, &currency)
-	// 检查货币是否已经存在
-	compositeKey, err := ctx.GetStub().CreateCompositeKey("Currency", []string{currency.Owner, currency.CurrencyID})
-	existing, err := s.readState(ctx, compositeKey)
-	if err == nil && existing != nil {
-		return fmt.Errorf("the asset %s already exists", currency.CurrencyID)
+	if err != nil {
+		return newError(ErrCodeInvalidArgument, "currency is not valid JSON", "reason", err.Error())
+	}
+	if currency.CreatedVia != "Deposit" && currency.CreatedVia != "System" && currency.CreatedVia != "" {
+		return newError(ErrCodeInvalidArgument, fmt.Sprintf("currency cannot be created via %s", currency.CreatedVia), "createdVia", currency.CreatedVia)
+	}
+	if err := requireOwner(ctx, currency.Owner); err != nil {
+		return err
+	}
+	// 检查币种是否已登记，有发行机构的币种只能由发行机构存入
+	currency.CurrencyCode = currencyCodeOf(currency.CurrencyCode)
+	definition, err := s.ReadCurrencyDefinition(ctx, currency.CurrencyCode)
+	if err != nil {
+		return err
+	}
+	if currency.Amount <= 0 {
+		return newError(ErrCodeInvalidArgument, "deposit amount must be positive", "amount", fmt.Sprintf("%f", currency.Amount))
+	}
+	if err := checkCurrencyAmount(definition, currency.Amount); err != nil {
+		return err
 	}
+	if definition.Issuer != "" && definition.Issuer != currency.Owner {
+		return newError(ErrCodeForbidden, fmt.Sprintf("only %s may deposit %s", definition.Issuer, definition.Code),
+			"currency", definition.Code, "issuer", definition.Issuer)
+	}
+	if err := s.createCurrency(ctx, currency); err != nil {
+		return err
+	}
+	return recordDeposit(ctx, currency)
+}
+
+// createCurrency 创建一笔货币，账户模式的用户计入账户余额。币种和金额由调用方检查，流水由调用方记录
+func (s *SmartContract) createCurrency(ctx contractapi.TransactionContextInterface, currency Currency) error {
+	currency.CurrencyCode = currencyCodeOf(currency.CurrencyCode)
 	assetJSON, err := json.Marshal(currency)
 	if err != nil {
 		return err
 	}
+	// 账户模式的用户不产生UTXO货币，计入账户余额（见account.go）
+	account, err := isAccount(ctx, currency.Owner)
+	if err != nil {
+		return err
+	}
+	if account {
+		if err := putAccountDelta(ctx, currency.Owner, currency.CurrencyCode, toCents(currency.Amount), currency.CreatedVia, currency.CurrencyID); err != nil {
+			return err
+		}
+		return ctx.GetStub().SetEvent("CreateCurrency", assetJSON)
+	}
+	// 检查货币是否已经存在
+	compositeKey, err := ctx.GetStub().CreateCompositeKey("Currency", []string{currency.Owner, currency.CurrencyID})
+	if err != nil {
+		return newError(ErrCodeInvalidArgument, err.Error())
+	}
+	existing, err := s.readState(ctx, compositeKey)
+	if err == nil && existing != nil {
+		return newError(ErrCodeAlreadyExists, fmt.Sprintf("the asset %s already exists", currency.CurrencyID), "id", currency.CurrencyID)
+	}
 	ctx.GetStub().SetEvent("CreateCurrency", assetJSON)
 	return ctx.GetStub().PutState(compositeKey, assetJSON)
 }
 
+// recordDeposit 为CreateCurrency存入和系统发行的货币写入流水，CreatedVia为空时记为"System"；
+// 转账、找零等链码内部创建的货币不经过CreateCurrency，由调用方记录（见history.go）
+func recordDeposit(ctx contractapi.TransactionContextInterface, currency Currency) error {
+	reason := currency.CreatedVia
+	if reason == "" {
+		reason = "System"
+	}
+	return recordTransfer(ctx, TransferRecord{
+		To:           currency.Owner,
+		Amount:       currency.Amount,
+		CurrencyCode: currency.CurrencyCode,
+		Reason:       reason,
+	})
+}
+
 // ReadCurrency 根据id读取货币
 // 因为是直接调用id，所以是一个链码内部函数，不需要暴露给外部
 func (s *SmartContract) ReadCurrency(ctx contractapi.TransactionContextInterface, id string) (*Currency, error) {
@@ -118,99 +201,264 @@ func (s *SmartContract) ReadCurrencyListByOwner(ctx contractapi.TransactionConte
 	return currencyList, nil
 }
 
-// ReadTotalCurrencyByOwner 查询某个用户（owner）的当前总余额
+// ReadTotalCurrencyByOwner 查询某个用户（owner）默认币种的当前总余额，账户模式的用户返回账户余额；
+// 其他币种的余额见ReadTotalCurrencyByOwnerInCurrency（currencies.go）
 func (s *SmartContract) ReadTotalCurrencyByOwner(ctx contractapi.TransactionContextInterface, owner string) (float32, error) {
+	account, err := isAccount(ctx, owner)
+	if err != nil {
+		return 0, err
+	}
+	if account {
+		account, err := s.ReadAccount(ctx, owner, defaultCurrencyCode)
+		if err != nil {
+			return 0, err
+		}
+		return account.Balance, nil
+	}
 	currencyList, err := s.ReadCurrencyListByOwner(ctx, owner)
 	if err != nil {
 		return 0, err
 	}
 	var totalAmount float32
 	for _, currency := range currencyList {
-		totalAmount += currency.Amount
+		if currencyCodeOf(currency.CurrencyCode) == defaultCurrencyCode {
+			totalAmount += currency.Amount
+		}
 	}
 	return totalAmount, nil
 }
 
+// TransferEvent 转账事件，由TransferCurrency发出，记录一次货币转移。
+// 一个交易只保留最后一次SetEvent，因此贷款、保险合同中的转账事件会被合同事件覆盖，
+// 只有直接调用TransferCurrency的交易才会发出该事件（网关据合同状态推算合同中的转账）。
+type TransferEvent struct {
+	From      string  `json:"From"`
+	To        string  `json:"To"`
+	Amount    float32 `json:"Amount"`
+	Reason    string  `json:"Reason"`
+	Timestamp string  `json:"Timestamp"`
+	//币种代码
+	CurrencyCode string `json:"CurrencyCode"`
+	//转出方另外支付的手续费和收取手续费的账户，免费时为0和空
+	Fee        float32 `json:"Fee"`
+	FeeAccount string  `json:"FeeAccount"`
+}
+
 // TransferCurrency 货币结构体的转移函数，使用UTXO方式。该函数体现了货币的使用方式，即转账。
-// transferReason是转账原因，可以是"Loan","Insurance","Transfer"等,用于记录货币的使用情况。也供函数调用时指明转账原因。
+// transferReason是转账原因，只能是"Loan","Insurance","Transfer"（见fees.go）,用于记录货币的使用情况。也供函数调用时指明转账原因。
+// 转账默认币种，使用默认的选币策略，指定策略见TransferCurrencyWithCoinSelection（coinselection.go）。只有oldOwner本人或管理员可以转出
 func (s *SmartContract) TransferCurrency(ctx contractapi.TransactionContextInterface, oldOwner string, newOwner string, amount float32, transferReason string) error {
-	oldCurrencyList, err := s.ReadCurrencyListByOwner(ctx, oldOwner)
-	if err != nil {
-		log.Fatalln("Failed to read currency list by owner")
+	if err := requireOwner(ctx, oldOwner); err != nil {
 		return err
 	}
+	_, err := s.transferCurrency(ctx, oldOwner, newOwner, amount, defaultCurrencyCode, transferReason, defaultCoinSelection, "")
+	return err
+}
+
+// TransferCurrencyInCurrency 按币种转账，只使用转出方该币种的货币，currencyCode为空时为默认币种，strategy为空时使用默认选币策略。
+// 只有oldOwner本人或管理员可以转出
+func (s *SmartContract) TransferCurrencyInCurrency(ctx contractapi.TransactionContextInterface, oldOwner string, newOwner string, amount float32, currencyCode string, transferReason string, strategy string) (*CoinSelection, error) {
+	if err := requireOwner(ctx, oldOwner); err != nil {
+		return nil, err
+	}
+	definition, err := s.ReadCurrencyDefinition(ctx, currencyCode)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCurrencyAmount(definition, amount); err != nil {
+		return nil, err
+	}
+	if strategy == "" {
+		strategy = defaultCoinSelection
+	}
+	return s.transferCurrency(ctx, oldOwner, newOwner, amount, definition.Code, transferReason, strategy, "")
+}
+
+// transferCurrency 按选币策略strategy选出转出方币种为code的货币完成转账，返回选币结果。转出方为账户模式时直接从账户余额付款。
+// contractID为转账所属的合同，记录在交易流水中，普通转账为空
+func (s *SmartContract) transferCurrency(ctx contractapi.TransactionContextInterface, oldOwner string, newOwner string, amount float32, code string, transferReason string, strategy string, contractID string) (*CoinSelection, error) {
+	if amount <= 0 {
+		return nil, newError(ErrCodeInvalidArgument, "transfer amount must be positive", "amount", fmt.Sprintf("%f", amount))
+	}
+	// 手续费由转出方在转账金额之外支付（见fees.go）
+	fee, feeAccount, err := s.transferFee(ctx, oldOwner, amount, code, transferReason)
+	if err != nil {
+		return nil, err
+	}
+	selection, err := s.burnCurrency(ctx, oldOwner, fromCents(toCents(amount)+toCents(fee)), code, transferReason, strategy)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, _ := ctx.GetStub().GetTxTimestamp()
+	seconds := timestamp.GetSeconds()
+	// 货币ID取自交易ID，同一秒内的多笔转账不会冲突
+	txID := ctx.GetStub().GetTxID()
+	// 转账
+	err = s.mintCurrency(ctx, newOwner, "Currency"+newOwner+txID, amount, code, transferReason)
+	if err != nil {
+		return nil, err
+	}
+	// 手续费转入手续费账户
+	if fee > 0 {
+		err = s.mintCurrency(ctx, feeAccount, "Currency"+feeAccount+"Fee"+txID, fee, code, feeReason)
+		if err != nil {
+			return nil, err
+		}
+		selection.Fee, selection.FeeAccount = fee, feeAccount
+	}
+	// 写入交易流水（见history.go）
+	err = recordTransfer(ctx, TransferRecord{
+		From:         oldOwner,
+		To:           newOwner,
+		Amount:       amount,
+		CurrencyCode: code,
+		Fee:          fee,
+		FeeAccount:   feeAccount,
+		Reason:       transferReason,
+		ContractID:   contractID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 发出转账事件，覆盖CreateCurrency发出的事件
+	transferJSON, err := json.Marshal(TransferEvent{
+		From:         oldOwner,
+		To:           newOwner,
+		Amount:       amount,
+		Reason:       transferReason,
+		Timestamp:    fmt.Sprintf("%d", seconds),
+		CurrencyCode: code,
+		Fee:          fee,
+		FeeAccount:   feeAccount,
+	})
+	if err != nil {
+		return nil, internalError(err)
+	}
+	return selection, internalError(ctx.GetStub().SetEvent("TransferCurrency", transferJSON))
+}
+
+// burnCurrency 从owner扣除币种为code的amount货币：账户模式从账户余额扣除，否则按选币策略删除货币并找零
+func (s *SmartContract) burnCurrency(ctx contractapi.TransactionContextInterface, owner string, amount float32, code string, reason string, strategy string) (*CoinSelection, error) {
+	if amount <= 0 {
+		return nil, newError(ErrCodeInvalidArgument, "transfer amount must be positive", "amount", fmt.Sprintf("%f", amount))
+	}
+	account, err := isAccount(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	if account {
+		return debitAccount(ctx, owner, code, amount, reason)
+	}
+	return s.spendCoins(ctx, owner, amount, code, strategy)
+}
+
+// mintCurrency 为owner创建一笔币种为code的货币，账户模式的用户计入账户余额
+func (s *SmartContract) mintCurrency(ctx contractapi.TransactionContextInterface, owner string, currencyID string, amount float32, code string, reason string) error {
+	timestamp, _ := ctx.GetStub().GetTxTimestamp()
+	seconds := fmt.Sprintf("%d", timestamp.GetSeconds())
+	return s.createCurrency(ctx, Currency{
+		CurrencyID:   currencyID,
+		Amount:       amount,
+		Owner:        owner,
+		CreatedAt:    seconds,
+		CreatedVia:   reason,
+		UpdatedAt:    seconds,
+		UpdatedVia:   reason,
+		CurrencyCode: code,
+	})
+}
+
+// spendCoins 按选币策略选出转出方币种为code的货币并删除，超出转账金额的部分作为找零转回转出方
+func (s *SmartContract) spendCoins(ctx contractapi.TransactionContextInterface, oldOwner string, amount float32, code string, strategy string) (*CoinSelection, error) {
+	coins, err := s.ReadCurrencyListByOwner(ctx, oldOwner)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	// 只使用同一币种的货币
+	var oldCurrencyList []Currency
+	for _, coin := range coins {
+		if currencyCodeOf(coin.CurrencyCode) == code {
+			oldCurrencyList = append(oldCurrencyList, coin)
+		}
+	}
 	if len(oldCurrencyList) == 0 {
-		return fmt.Errorf("no currency found for owner %s", oldOwner)
+		return nil, newError(ErrCodeInsufficientFunds, fmt.Sprintf("no %s currency found for owner %s", code, oldOwner), "owner", oldOwner, "currency", code)
+	}
+	// 按选币策略找到足够的货币转账
+	DeleteCurrencyList, err := selectCoins(oldCurrencyList, amount, strategy, ctx.GetStub().GetTxID())
+	if err != nil {
+		return nil, err
 	}
 	var totalAmount float32
-	var DeleteCurrencyList []Currency
-	// 遍历货币列表，找到足够的货币转账
-	for _, currency := range oldCurrencyList {
+	for _, currency := range DeleteCurrencyList {
 		totalAmount += currency.Amount
-		DeleteCurrencyList = append(DeleteCurrencyList, currency)
-		if totalAmount >= amount {
-			break
-		}
 	}
 	// 检查余额是否足够
-	if totalAmount < amount {
-		return fmt.Errorf("insufficient balance for transfer")
+	if toCents(totalAmount) < toCents(amount) {
+		return nil, newError(ErrCodeInsufficientFunds, "insufficient balance for transfer",
+			"owner", oldOwner, "currency", code, "balance", fmt.Sprintf("%f", totalAmount), "amount", fmt.Sprintf("%f", amount))
 	}
+	selection := &CoinSelection{Strategy: strategy, Amount: amount, Coins: len(coins) - len(DeleteCurrencyList)}
 	// 删除原有货币
 	for _, currency := range DeleteCurrencyList {
 		compositeKey, err := ctx.GetStub().CreateCompositeKey("Currency", []string{oldOwner, currency.CurrencyID})
+		if err != nil {
+			return nil, internalError(err)
+		}
 		err = ctx.GetStub().DelState(compositeKey)
 		if err != nil {
-			log.Fatalln("Failed to delete currency")
-			return err
+			return nil, internalError(err)
 		}
+		selection.Inputs = append(selection.Inputs, currency.CurrencyID)
 	}
 	timestamp, _ := ctx.GetStub().GetTxTimestamp()
 	seconds := timestamp.GetSeconds()
-	// 转账
-	currencyBytes, err := json.Marshal(Currency{
-		CurrencyID: "Currency" + newOwner + fmt.Sprintf("%d", seconds),
-		Amount:     amount,
-		Owner:      newOwner,
-		CreatedAt:  fmt.Sprintf("%d", seconds),
-		CreatedVia: transferReason,
-		UpdatedAt:  fmt.Sprintf("%d", seconds),
-		UpdatedVia: transferReason,
-	})
-	err = s.CreateCurrency(ctx, currencyBytes)
-	if err != nil {
-		return err
-	}
 	// 找零
-	if totalAmount > amount {
-		timestamp, _ := ctx.GetStub().GetTxTimestamp()
-		seconds := timestamp.GetSeconds()
-		currencyBytes, err := json.Marshal(Currency{
-			CurrencyID: "Currency" + oldOwner + fmt.Sprintf("%d", seconds),
-			Amount:     totalAmount - amount,
-			Owner:      oldOwner,
-			CreatedAt:  fmt.Sprintf("%d", seconds),
-			CreatedVia: "Change",
-			UpdatedAt:  fmt.Sprintf("%d", seconds),
-			UpdatedVia: "Change",
+	if toCents(totalAmount) > toCents(amount) {
+		selection.Change = totalAmount - amount
+		selection.Coins++
+		err = s.createCurrency(ctx, Currency{
+			CurrencyID:   "Currency" + oldOwner + "Change" + ctx.GetStub().GetTxID(),
+			Amount:       selection.Change,
+			Owner:        oldOwner,
+			CreatedAt:    fmt.Sprintf("%d", seconds),
+			CreatedVia:   "Change",
+			UpdatedAt:    fmt.Sprintf("%d", seconds),
+			UpdatedVia:   "Change",
+			CurrencyCode: code,
 		})
-		err = s.CreateCurrency(ctx, currencyBytes)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return selection, nil
 }
 
-// CreateContract 创建合同函数，根据业务类型，调用不同的创建合同函数
+// CreateContract 创建合同函数，根据业务类型，调用不同的创建合同函数，合同以默认币种结算
 func (s *SmartContract) CreateContract(ctx contractapi.TransactionContextInterface, applicant string, businessId string, amount float32, issuer string, rate float32, businessType string, period int) error {
+	return s.createContract(ctx, applicant, businessId, amount, issuer, rate, businessType, period, defaultCurrencyCode)
+}
+
+// CreateContractInCurrency 创建以currencyCode结算的合同，合同的支付和还款/赔偿只使用该币种的货币
+func (s *SmartContract) CreateContractInCurrency(ctx contractapi.TransactionContextInterface, applicant string, businessId string, amount float32, issuer string, rate float32, businessType string, period int, currencyCode string) error {
+	definition, err := s.ReadCurrencyDefinition(ctx, currencyCode)
+	if err != nil {
+		return err
+	}
+	if err := checkCurrencyAmount(definition, amount); err != nil {
+		return err
+	}
+	return s.createContract(ctx, applicant, businessId, amount, issuer, rate, businessType, period, definition.Code)
+}
+
+func (s *SmartContract) createContract(ctx contractapi.TransactionContextInterface, applicant string, businessId string, amount float32, issuer string, rate float32, businessType string, period int, currencyCode string) error {
 	switch businessType {
 	case "Loan":
-		return s.CreateLoan(ctx, applicant, businessId, amount, issuer, rate, period)
+		return s.createLoan(ctx, applicant, businessId, amount, issuer, rate, period, currencyCode)
 	case "Insurance":
-		return s.CreateInsurance(ctx, applicant, businessId, amount, issuer, rate)
+		return s.createInsurance(ctx, applicant, businessId, amount, issuer, rate, currencyCode)
 	default:
-		return fmt.Errorf("unknown business type")
+		return newError(ErrCodeInvalidArgument, "unknown business type", "businessType", businessType)
 	}
 }
 
@@ -232,32 +480,46 @@ type Insurance struct {
 	Applicant  string  `json:"Applicant"`
 	CreatedAt  string  `json:"CreatedAt"`
 	UpdatedAt  string  `json:"UpdatedAt"`
+	//结算币种，为空的旧合同视为默认币种
+	CurrencyCode string `json:"CurrencyCode"`
+	//最近一次转账（保费或赔付）时转出方支付的手续费和手续费账户（见fees.go）
+	Fee        float32 `json:"Fee"`
+	FeeAccount string  `json:"FeeAccount"`
 }
 
 // CreateInsurance 创建保险合同。还未支付保险金，只是创建了保险合同。因此该函数只是创建一个“Applied”状态的保险合同。
 // id 参数是保险合同的ID，应该是一个唯一的字符串，格式为"Insurance"+时间戳
 func (s *SmartContract) CreateInsurance(ctx contractapi.TransactionContextInterface, applicant string, businessId string, amount float32, issuer string, rate float32) error {
+	return s.createInsurance(ctx, applicant, businessId, amount, issuer, rate, defaultCurrencyCode)
+}
+
+func (s *SmartContract) createInsurance(ctx contractapi.TransactionContextInterface, applicant string, businessId string, amount float32, issuer string, rate float32, currencyCode string) error {
 	compositeKey, _ := ctx.GetStub().CreateCompositeKey("Insurance", []string{applicant, businessId})
 	existing, err := s.readState(ctx, compositeKey)
 	if err == nil && existing != nil {
-		return fmt.Errorf("the asset %s already exists", businessId)
+		return newError(ErrCodeAlreadyExists, fmt.Sprintf("the asset %s already exists", businessId), "businessId", businessId)
 	}
 	newTimes, _ := ctx.GetStub().GetTxTimestamp()
 	seconds := newTimes.GetSeconds()
 	assetJSON, err := json.Marshal(Insurance{
-		BusinessID: businessId,
-		Amount:     amount,
-		Issuer:     issuer,
-		State:      "Applied",
-		Rate:       rate,
-		Applicant:  applicant,
-		CreatedAt:  fmt.Sprintf("%d", seconds),
-		UpdatedAt:  fmt.Sprintf("%d", seconds),
+		BusinessID:   businessId,
+		Amount:       amount,
+		Issuer:       issuer,
+		State:        "Applied",
+		Rate:         rate,
+		Applicant:    applicant,
+		CreatedAt:    fmt.Sprintf("%d", seconds),
+		UpdatedAt:    fmt.Sprintf("%d", seconds),
+		CurrencyCode: currencyCode,
 	})
 	if err != nil {
 		return err
 	}
 
+	err = s.writeIssuerIndex(ctx, insuranceIssuerIndex, issuer, applicant, businessId)
+	if err != nil {
+		return err
+	}
 	ctx.GetStub().SetEvent("CreateInsurance", assetJSON)
 	return ctx.GetStub().PutState(compositeKey, assetJSON)
 }
@@ -292,7 +554,8 @@ func (s *SmartContract) StartInsurance(ctx contractapi.TransactionContextInterfa
 	}
 	//检查保险是否处于申请状态
 	if insurance.State != "Applied" {
-		return false, fmt.Errorf("the insurance contract %s is not in Applied state", businessId)
+		return false, newError(ErrCodeInvalidState, fmt.Sprintf("the insurance contract %s is not in Applied state", businessId),
+			"businessId", businessId, "state", insurance.State)
 	}
 	newTimes, _ := ctx.GetStub().GetTxTimestamp()
 	seconds := newTimes.GetSeconds()
@@ -310,16 +573,17 @@ func (s *SmartContract) StartInsurance(ctx contractapi.TransactionContextInterfa
 	}
 	//符合启动保险的条件
 	//支付保险金
-	err = s.TransferCurrency(ctx, insurance.Applicant, insurance.Issuer, insurance.Amount, "Insurance")
+	selection, err := s.transferCurrency(ctx, insurance.Applicant, insurance.Issuer, insurance.Amount, currencyCodeOf(insurance.CurrencyCode), "Insurance", defaultCoinSelection, businessId)
 	if err != nil {
 		return false, err
 	}
+	insurance.Fee, insurance.FeeAccount = selection.Fee, selection.FeeAccount
 	//修改保险合同状态
 	insurance.State = "Approved"
 	insurance.UpdatedAt = fmt.Sprintf("%d", seconds)
 	insuranceJSON, err := json.Marshal(insurance)
 	if err != nil {
-		return false, fmt.Errorf("failed to marshal insurance")
+		return false, newError(ErrCodeInternal, "failed to marshal insurance")
 	}
 	ctx.GetStub().SetEvent("StartInsurance", insuranceJSON)
 	return true, ctx.GetStub().PutState(compositeKey, insuranceJSON)
@@ -337,15 +601,17 @@ func (s *SmartContract) InsuranceContractCheck(ctx contractapi.TransactionContex
 	}
 	//检查保险是否处于申请状态
 	if insurance.State != "Approved" {
-		return false, fmt.Errorf("the insurance contract %s is not in Approved state", businessId)
+		return false, newError(ErrCodeInvalidState, fmt.Sprintf("the insurance contract %s is not in Approved state", businessId),
+			"businessId", businessId, "state", insurance.State)
 	}
 	//检查是否需要赔偿
 	if credit > 60 && income < 10000 && isSudden {
 		//支付赔偿
-		err := s.TransferCurrency(ctx, insurance.Issuer, insurance.Applicant, insurance.Amount*(1+insurance.Rate), "Insurance")
+		selection, err := s.transferCurrency(ctx, insurance.Issuer, insurance.Applicant, insurance.Amount*(1+insurance.Rate), currencyCodeOf(insurance.CurrencyCode), "Insurance", defaultCoinSelection, businessId)
 		if err != nil {
 			return false, err
 		}
+		insurance.Fee, insurance.FeeAccount = selection.Fee, selection.FeeAccount
 		newTimes, _ := ctx.GetStub().GetTxTimestamp()
 		seconds := newTimes.GetSeconds()
 		//未来这里可以补充对突发事件具体信息的处理逻辑
@@ -361,7 +627,8 @@ func (s *SmartContract) InsuranceContractCheck(ctx contractapi.TransactionContex
 		return true, ctx.GetStub().PutState(compositeKey, insuranceJSON)
 	}
 	//当前不属于赔偿情况
-	return false, fmt.Errorf("the insurance contract %s is not in Claimed state", businessId)
+	return false, newError(ErrCodeConditionNotMet, fmt.Sprintf("the insurance contract %s is not in Claimed state", businessId),
+		"businessId", businessId)
 }
 
 // ReadInsuranceListByOwner 通过owner查询保险合同列表，是一个辅助函数
@@ -399,6 +666,7 @@ func (s *SmartContract) ReadInsuranceListByOwner(ctx contractapi.TransactionCont
  * StartLoan 贷款启动函数，用于启动贷款合同，贷款机构向申请人支付贷款金额
  * CountLoansByOwner 通过owner查询处于”Approved“状态的贷款合同数量
  * LoanContractCheck 贷款合同检查函数，检查贷款是否进入强制还款状态
+ * LoanContractCheckInCurrency 同上，申请人以外币还款，汇率记录在贷款合同上
  * ReadLoanListByOwner 通过owner查询贷款合同列表，是一个辅助函数
  */
 
@@ -414,33 +682,51 @@ type Loan struct {
 	Applicant string  `json:"Applicant"`
 	CreatedAt string  `json:"CreatedAt"`
 	UpdatedAt string  `json:"UpdatedAt"`
+	//结算币种，为空的旧合同视为默认币种
+	CurrencyCode string `json:"CurrencyCode"`
+	//以外币还款时的还款币种、申请人支付的外币金额和使用的汇率（1单位还款币种兑换的贷款币种），以贷款币种还款时为空
+	RepaymentCurrency string  `json:"RepaymentCurrency"`
+	RepaymentAmount   float32 `json:"RepaymentAmount"`
+	RepaymentRate     float64 `json:"RepaymentRate"`
+	//最近一次转账（放款或还款）时转出方支付的手续费和手续费账户（见fees.go）
+	Fee        float32 `json:"Fee"`
+	FeeAccount string  `json:"FeeAccount"`
 }
 
 // CreateLoan 创建贷款合同
 // id 参数是贷款合同的ID，应该是一个唯一的字符串，格式为"Loan"+时间戳
 func (s *SmartContract) CreateLoan(ctx contractapi.TransactionContextInterface, applicant string, businessId string, amount float32, issuer string, rate float32, period int) error {
+	return s.createLoan(ctx, applicant, businessId, amount, issuer, rate, period, defaultCurrencyCode)
+}
+
+func (s *SmartContract) createLoan(ctx contractapi.TransactionContextInterface, applicant string, businessId string, amount float32, issuer string, rate float32, period int, currencyCode string) error {
 	compositeKey, _ := ctx.GetStub().CreateCompositeKey("Loan", []string{applicant, businessId})
 	existing, err := s.readState(ctx, compositeKey)
 	if err == nil && existing != nil {
-		return fmt.Errorf("the asset %s already exists", businessId)
+		return newError(ErrCodeAlreadyExists, fmt.Sprintf("the asset %s already exists", businessId), "businessId", businessId)
 	}
 	newTimes, _ := ctx.GetStub().GetTxTimestamp()
 	seconds := newTimes.GetSeconds()
 	assetJSON, err := json.Marshal(Loan{
-		BusinessID: businessId,
-		Amount:     amount,
-		Issuer:     issuer,
-		State:      "Applied",
-		Rate:       rate,
-		Period:     period,
-		Applicant:  applicant,
-		CreatedAt:  fmt.Sprintf("%d", seconds),
-		UpdatedAt:  fmt.Sprintf("%d", seconds),
+		BusinessID:   businessId,
+		Amount:       amount,
+		Issuer:       issuer,
+		State:        "Applied",
+		Rate:         rate,
+		Period:       period,
+		Applicant:    applicant,
+		CreatedAt:    fmt.Sprintf("%d", seconds),
+		UpdatedAt:    fmt.Sprintf("%d", seconds),
+		CurrencyCode: currencyCode,
 	})
 	if err != nil {
 		return err
 	}
 
+	err = s.writeIssuerIndex(ctx, loanIssuerIndex, issuer, applicant, businessId)
+	if err != nil {
+		return err
+	}
 	ctx.GetStub().SetEvent("CreateLoan", assetJSON)
 	return ctx.GetStub().PutState(compositeKey, assetJSON)
 }
@@ -498,7 +784,8 @@ func (s *SmartContract) StartLoan(ctx contractapi.TransactionContextInterface, a
 	}
 	//检查贷款是否处于申请状态
 	if loan.State != "Applied" {
-		return false, fmt.Errorf("the loan contract %s is not in Applied state", businessId)
+		return false, newError(ErrCodeInvalidState, fmt.Sprintf("the loan contract %s is not in Applied state", businessId),
+			"businessId", businessId, "state", loan.State)
 	}
 	newTimes, _ := ctx.GetStub().GetTxTimestamp()
 	seconds := newTimes.GetSeconds()
@@ -517,16 +804,17 @@ func (s *SmartContract) StartLoan(ctx contractapi.TransactionContextInterface, a
 	}
 	//符合启动贷款的条件
 	//支付贷款金额
-	err = s.TransferCurrency(ctx, loan.Issuer, loan.Applicant, loan.Amount, "Loan")
+	selection, err := s.transferCurrency(ctx, loan.Issuer, loan.Applicant, loan.Amount, currencyCodeOf(loan.CurrencyCode), "Loan", defaultCoinSelection, businessId)
 	if err != nil {
 		return false, err
 	}
+	loan.Fee, loan.FeeAccount = selection.Fee, selection.FeeAccount
 	//修改贷款合同状态
 	loan.State = "Approved"
 	loan.UpdatedAt = fmt.Sprintf("%d", seconds)
 	loanJSON, err := json.Marshal(loan)
 	if err != nil {
-		return false, fmt.Errorf("failed to marshal loan")
+		return false, newError(ErrCodeInternal, "failed to marshal loan")
 	}
 	ctx.GetStub().SetEvent("StartLoan", loanJSON)
 	return true, ctx.GetStub().PutState(compositeKey, loanJSON)
@@ -536,6 +824,21 @@ func (s *SmartContract) StartLoan(ctx contractapi.TransactionContextInterface, a
 // credit 信用分，income 收入，isOverdue 是否逾期
 // 如果经过逻辑判断，贷款需要强制还款，则立即支付剩余贷款金额，然后修改贷款合同状态为"Claimed"，并返回true
 func (s *SmartContract) LoanContractCheck(ctx contractapi.TransactionContextInterface, applicant string, businessId string, credit float32, income float32, currentTime string) (bool, error) {
+	return s.loanContractCheck(ctx, applicant, businessId, credit, income, currentTime, "")
+}
+
+// LoanContractCheckInCurrency 与LoanContractCheck相同，但申请人以currencyCode还款：按汇率把还款金额换算为该币种，
+// 从申请人扣除换算后的金额，贷款机构收到贷款币种的还款，使用的汇率记录在贷款合同上（见fx.go）
+func (s *SmartContract) LoanContractCheckInCurrency(ctx contractapi.TransactionContextInterface, applicant string, businessId string, credit float32, income float32, currentTime string, currencyCode string) (bool, error) {
+	definition, err := s.ReadCurrencyDefinition(ctx, currencyCode)
+	if err != nil {
+		return false, err
+	}
+	return s.loanContractCheck(ctx, applicant, businessId, credit, income, currentTime, definition.Code)
+}
+
+// loanContractCheck 检查贷款是否进入强制还款状态，settlementCode为还款币种，为空时以贷款币种还款
+func (s *SmartContract) loanContractCheck(ctx contractapi.TransactionContextInterface, applicant string, businessId string, credit float32, income float32, currentTime string, settlementCode string) (bool, error) {
 	var isOverdue = false
 	//读取贷款合同
 	compositeKey, _ := ctx.GetStub().CreateCompositeKey("Loan", []string{applicant, businessId})
@@ -545,7 +848,8 @@ func (s *SmartContract) LoanContractCheck(ctx contractapi.TransactionContextInte
 	}
 	//检查贷款是否处于申请状态
 	if loan.State != "Approved" {
-		return false, fmt.Errorf("the loan contract %s is not in Approved state", businessId)
+		return false, newError(ErrCodeInvalidState, fmt.Sprintf("the loan contract %s is not in Approved state", businessId),
+			"businessId", businessId, "state", loan.State)
 	}
 	//判断是否逾期
 	currentTimestamp, _ := strconv.Atoi(currentTime)
@@ -555,8 +859,24 @@ func (s *SmartContract) LoanContractCheck(ctx contractapi.TransactionContextInte
 	}
 	//检查是否需要强制还款
 	if credit > 60 || income < 5000 || isOverdue {
-		//支付剩余贷款
-		err := s.TransferCurrency(ctx, loan.Applicant, loan.Issuer, loan.Amount*(1+loan.Rate), "Loan")
+		//支付剩余贷款，还款币种与贷款币种不同时按汇率换算
+		loanCode := currencyCodeOf(loan.CurrencyCode)
+		loan.Fee, loan.FeeAccount = 0, ""
+		if settlementCode == "" || settlementCode == loanCode {
+			var selection *CoinSelection
+			selection, err = s.transferCurrency(ctx, loan.Applicant, loan.Issuer, loan.Amount*(1+loan.Rate), loanCode, "Loan", defaultCoinSelection, businessId)
+			if err == nil {
+				loan.Fee, loan.FeeAccount = selection.Fee, selection.FeeAccount
+			}
+		} else {
+			var settlement *FXSettlement
+			settlement, err = s.settleInForeignCurrency(ctx, loan.Applicant, loan.Issuer, loan.Amount*(1+loan.Rate), loanCode, settlementCode, "Loan", businessId)
+			if err == nil {
+				loan.RepaymentCurrency = settlement.Currency
+				loan.RepaymentAmount = settlement.Amount
+				loan.RepaymentRate = settlement.Rate
+			}
+		}
 		if err != nil {
 			return false, err
 		}
@@ -573,7 +893,8 @@ func (s *SmartContract) LoanContractCheck(ctx contractapi.TransactionContextInte
 		return true, ctx.GetStub().PutState(compositeKey, loanJSON)
 	}
 	//当前不属于强制还款情况
-	return false, fmt.Errorf("the loan contract %s is not in Claimed state", businessId)
+	return false, newError(ErrCodeConditionNotMet, fmt.Sprintf("the loan contract %s is not in Claimed state", businessId),
+		"businessId", businessId)
 }
 
 // ReadLoanListByOwner 根据owner读取所有的贷款合同
@@ -611,10 +932,11 @@ func (s *SmartContract) ReadLoanListByOwner(ctx contractapi.TransactionContextIn
 func (s *SmartContract) readState(ctx contractapi.TransactionContextInterface, id string) ([]byte, error) {
 	assetJSON, err := ctx.GetStub().GetState(id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read from world state: %w", err)
+		return nil, newError(ErrCodeInternal, fmt.Sprintf("failed to read from world state: %v", err))
 	}
 	if assetJSON == nil {
-		return nil, fmt.Errorf("the asset %s does not exist", id)
+		description, details := keyDetails(ctx, id)
+		return nil, newError(ErrCodeNotFound, fmt.Sprintf("the asset %s does not exist", description), details...)
 	}
 
 	return assetJSON, nil
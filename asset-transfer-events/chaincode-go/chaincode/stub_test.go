@@ -0,0 +1,209 @@
+package chaincode
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/v2/shim"
+	"github.com/hyperledger/fabric-protos-go-apiv2/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// memStub 内存中的世界状态，实现链码用到的stub函数。范围查询和复合键查询与peer一样按键排序返回
+type memStub struct {
+	shim.ChaincodeStubInterface
+	state     map[string][]byte
+	txID      string
+	seconds   int64
+	transient map[string][]byte
+	events    []string
+	//被调用的链码函数及其参数
+	function string
+	args     []string
+}
+
+func (m *memStub) GetState(key string) ([]byte, error) { return m.state[key], nil }
+func (m *memStub) PutState(key string, value []byte) error {
+	m.state[key] = value
+	return nil
+}
+func (m *memStub) DelState(key string) error {
+	delete(m.state, key)
+	return nil
+}
+func (m *memStub) GetTxID() string { return m.txID }
+func (m *memStub) GetTxTimestamp() (*timestamppb.Timestamp, error) {
+	return &timestamppb.Timestamp{Seconds: m.seconds}, nil
+}
+func (m *memStub) GetTransient() (map[string][]byte, error) { return m.transient, nil }
+func (m *memStub) GetFunctionAndParameters() (string, []string) {
+	return m.function, m.args
+}
+func (m *memStub) SetEvent(name string, payload []byte) error {
+	m.events = append(m.events, name)
+	return nil
+}
+func (m *memStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return shim.CreateCompositeKey(objectType, attributes)
+}
+func (m *memStub) SplitCompositeKey(key string) (string, []string, error) {
+	parts := strings.Split(strings.Trim(key, "\x00"), "\x00")
+	return parts[0], parts[1:], nil
+}
+
+// keys 按顺序返回从startKey（包含）到endKey（不包含）的键
+func (m *memStub) keys(startKey string, endKey string) []string {
+	var keys []string
+	for key := range m.state {
+		if key >= startKey && (endKey == "" || key < endKey) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *memStub) iterator(keys []string) *memIterator {
+	iterator := &memIterator{}
+	for _, key := range keys {
+		iterator.results = append(iterator.results, &queryresult.KV{Key: key, Value: m.state[key]})
+	}
+	return iterator
+}
+
+func (m *memStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return m.iterator(m.keys(startKey, endKey)), nil
+}
+
+func (m *memStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := shim.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return m.iterator(m.keys(prefix, prefix+string(rune(0x10FFFF)))), nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination 从bookmark开始返回一页，书签为下一页的第一个键，最后一页的书签为空
+func (m *memStub) GetStateByPartialCompositeKeyWithPagination(objectType string, attributes []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	prefix, err := shim.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, nil, err
+	}
+	start := prefix
+	if bookmark != "" {
+		start = bookmark
+	}
+	keys := m.keys(start, prefix+string(rune(0x10FFFF)))
+	metadata := &peer.QueryResponseMetadata{}
+	if len(keys) > int(pageSize) {
+		metadata.Bookmark = keys[pageSize]
+		keys = keys[:pageSize]
+	}
+	metadata.FetchedRecordsCount = int32(len(keys))
+	return m.iterator(keys), metadata, nil
+}
+
+type memIterator struct {
+	results []*queryresult.KV
+	next    int
+}
+
+func (it *memIterator) HasNext() bool { return it.next < len(it.results) }
+func (it *memIterator) Next() (*queryresult.KV, error) {
+	it.next++
+	return it.results[it.next-1], nil
+}
+func (it *memIterator) Close() error { return nil }
+
+// testIdentity 测试交易的调用者：证书的CN为用户ID，role属性为角色
+type testIdentity struct {
+	userID string
+	role   string
+}
+
+func (i *testIdentity) GetID() (string, error)    { return "x509::CN=" + i.userID, nil }
+func (i *testIdentity) GetMSPID() (string, error) { return "Org1MSP", nil }
+func (i *testIdentity) GetAttributeValue(name string) (string, bool, error) {
+	if name != roleAttribute || i.role == "" {
+		return "", false, nil
+	}
+	return i.role, true, nil
+}
+func (i *testIdentity) AssertAttributeValue(name string, value string) error { return nil }
+func (i *testIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return &x509.Certificate{Subject: pkix.Name{CommonName: i.userID}}, nil
+}
+
+// testLedger 一个测试中各笔交易共用的世界状态
+type testLedger struct {
+	t     *testing.T
+	state map[string][]byte
+	//下一笔交易的时间戳
+	seconds int64
+	count   int
+}
+
+func newTestLedger(t *testing.T) *testLedger {
+	return &testLedger{t: t, state: map[string][]byte{}, seconds: 1000}
+}
+
+// as 返回由userID以role角色提交的一笔新交易的上下文
+func (l *testLedger) as(userID string, role string) *TransactionContext {
+	l.count++
+	stub := &memStub{state: l.state, txID: fmt.Sprintf("tx%03d", l.count), seconds: l.seconds}
+	ctx := &TransactionContext{}
+	ctx.SetStub(stub)
+	ctx.SetClientIdentity(&testIdentity{userID: userID, role: role})
+	return ctx
+}
+
+// registerCurrency 以财务的身份登记一个币种
+func (l *testLedger) registerCurrency(code string, decimals int, issuer string) {
+	l.t.Helper()
+	if _, err := new(SmartContract).RegisterCurrency(l.as("treasurer", treasuryRole), code, code, decimals, issuer); err != nil {
+		l.t.Fatal(err)
+	}
+}
+
+// deposit owner存入amount的code货币
+func (l *testLedger) deposit(owner string, amount float32, code string) {
+	l.t.Helper()
+	ctx := l.as(owner, "")
+	currencyBytes, _ := json.Marshal(Currency{
+		CurrencyID:   "Currency" + ctx.GetStub().GetTxID(),
+		Amount:       amount,
+		Owner:        owner,
+		CreatedVia:   "Deposit",
+		CurrencyCode: code,
+	})
+	if err := new(SmartContract).CreateCurrency(ctx, currencyBytes); err != nil {
+		l.t.Fatal(err)
+	}
+}
+
+// balance 返回owner在code币种上的余额
+func (l *testLedger) balance(owner string, code string) float32 {
+	l.t.Helper()
+	balance, err := new(SmartContract).ReadTotalCurrencyByOwnerInCurrency(l.as(owner, ""), owner, code)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return balance
+}
+
+// errorCode 返回链码错误的错误码，err为nil时返回空
+func errorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if chaincodeError, ok := err.(*ChaincodeError); ok {
+		return chaincodeError.Code
+	}
+	return "not a chaincode error: " + err.Error()
+}